@@ -1,6 +1,11 @@
 package api
 
+import "net"
+
 type Config struct {
 	HTTPAddress string
 	Secret      []byte
+	PublicURL   string
+	// TrustedProxies are the load balancers that may send the address of the client with the PROXY protocol.
+	TrustedProxies []*net.IPNet
 }
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// forwardConfirmationPath is the public path that confirms a forward.
+const forwardConfirmationPath = "/forwards/confirm"
+
+func (api *API) getForwardsHandler(c echo.Context) error {
+	// Parse the user ID from the URL parameter.
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID format",
+		})
+	}
+
+	forwards, err := api.backend.ForwardRepo.FindForwardsByUserID(uint(userID))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, forwards)
+}
+
+func (api *API) createForwardHandler(c echo.Context) error {
+	// Parse the user ID from the URL parameter.
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID format",
+		})
+	}
+
+	// Parse the request to get the forward address.
+	req := struct {
+		Address  string `json:"address"`
+		KeepCopy bool   `json:"keepCopy"`
+	}{}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	confirmationURL := strings.TrimSuffix(api.config.PublicURL, "/") + forwardConfirmationPath
+
+	// The forward stays inactive until the link in the confirmation mail is visited.
+	forward, err := api.backend.CreateForward(uint(userID), req.Address, req.KeepCopy, confirmationURL)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusCreated, forward)
+}
+
+func (api *API) deleteForwardHandler(c echo.Context) error {
+	// Parse the user ID and forward ID from the URL parameters.
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID format",
+		})
+	}
+	forwardID, err := strconv.ParseUint(c.Param("forwardID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid forward ID format",
+		})
+	}
+
+	err = api.backend.ForwardRepo.DeleteForwardByUserIDAndForwardID(uint(userID), uint(forwardID))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Forward deleted successfully",
+	})
+}
+
+func (api *API) confirmForwardHandler(c echo.Context) error {
+	// This endpoint is public, the token itself proves ownership of the external address.
+	forward, err := api.backend.ConfirmForward(c.QueryParam("token"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Invalid or expired confirmation token",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Forwarding to " + forward.Address + " confirmed",
+	})
+}
@@ -15,6 +15,7 @@ type Metrics struct {
 	SMTPReceived  float64
 	Users         int64
 	Messages      int64
+	Blobs         int64
 }
 
 func (api *API) metricsJSONHandler(c echo.Context) error {
@@ -56,6 +57,13 @@ func (api *API) metricsJSONHandler(c echo.Context) error {
 	}
 	metrics.Messages = messageCount
 
+	blobCount, err := api.backend.MessageRepo.GetTotalBlobsCount()
+	if err != nil {
+		log.Errorf("Unable to gather metrics: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Unable to gather blob count metric"})
+	}
+	metrics.Blobs = blobCount
+
 	return c.JSON(http.StatusOK, metrics)
 }
 
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mistralmail/mistralmail/backend/models"
+)
+
+func (api *API) getAllRoutesHandler(c echo.Context) error {
+	routes, err := api.backend.RouteRepo.GetAllRoutes()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, routes)
+}
+
+func (api *API) createRouteHandler(c echo.Context) error {
+	// Parse the request to get the route.
+	req := struct {
+		Pattern  string `json:"pattern"`
+		Priority int    `json:"priority"`
+		URL      string `json:"url"`
+		Format   string `json:"format"`
+		Secret   string `json:"secret"`
+		Store    bool   `json:"store"`
+	}{}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if _, err := path.Match(req.Pattern, ""); err != nil || req.Pattern == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid route pattern",
+		})
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid route URL",
+		})
+	}
+
+	format := models.RouteFormat(req.Format)
+	if format == "" {
+		format = models.RouteFormatJSON
+	}
+	if format != models.RouteFormatJSON && format != models.RouteFormatMultipart {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Format should be either json or multipart",
+		})
+	}
+
+	route := &models.Route{
+		Pattern:  req.Pattern,
+		Priority: req.Priority,
+		URL:      req.URL,
+		Format:   format,
+		Secret:   req.Secret,
+		Store:    req.Store,
+		Enabled:  true,
+	}
+
+	err = api.backend.RouteRepo.CreateRoute(route)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	// The secret is only returned once, it isn't included when the routes are listed
+	return c.JSON(http.StatusCreated, struct {
+		*models.Route
+		Secret string
+	}{route, route.Secret})
+}
+
+func (api *API) deleteRouteHandler(c echo.Context) error {
+	// Parse the route ID from the URL parameter.
+	routeID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid route ID format",
+		})
+	}
+
+	err = api.backend.RouteRepo.DeleteRoute(uint(routeID))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Route deleted successfully",
+	})
+}
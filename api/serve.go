@@ -1,11 +1,15 @@
 package api
 
 import (
+	"fmt"
+	"net"
+
 	jwt "github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/mistralmail/mistralmail/backend"
+	"github.com/mistralmail/mistralmail/proxyprotocol"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,6 +44,7 @@ func (api *API) Serve() error {
 	e.Use(middleware.CORS())
 
 	e.POST("/auth/login", api.loginHandler)
+	e.GET(forwardConfirmationPath, api.confirmForwardHandler)
 
 	g := e.Group("/api")
 
@@ -57,6 +62,22 @@ func (api *API) Serve() error {
 	g.POST("/users", api.createNewUserHandler)
 	g.POST("/reset-password", api.resetPasswordHandler)
 
+	// Forwards
+	g.GET("/users/:id/forwards", api.getForwardsHandler)
+	g.POST("/users/:id/forwards", api.createForwardHandler)
+	g.DELETE("/users/:id/forwards/:forwardID", api.deleteForwardHandler)
+
+	// Webhooks
+	g.GET("/webhooks", api.getAllWebhooksHandler)
+	g.POST("/webhooks", api.createWebhookHandler)
+	g.DELETE("/webhooks/:id", api.deleteWebhookHandler)
+	g.GET("/webhooks/:id/deliveries", api.getWebhookDeliveriesHandler)
+
+	// Routes
+	g.GET("/routes", api.getAllRoutesHandler)
+	g.POST("/routes", api.createRouteHandler)
+	g.DELETE("/routes/:id", api.deleteRouteHandler)
+
 	// Metrics
 	g.GET("/metrics", api.metricsJSONHandler)
 
@@ -68,6 +89,17 @@ func (api *API) Serve() error {
 		//Filesystem: http.FS(staticFS),
 	}))
 
+	// Behind a load balancer with the PROXY protocol the remote address is the client,
+	// and X-Forwarded-For headers of clients can't be trusted.
+	if len(api.config.TrustedProxies) > 0 {
+		ln, err := net.Listen("tcp", api.config.HTTPAddress)
+		if err != nil {
+			return fmt.Errorf("couldn't listen: %w", err)
+		}
+		e.Listener = proxyprotocol.NewListener(ln, api.config.TrustedProxies)
+		e.IPExtractor = echo.ExtractIPDirect()
+	}
+
 	// Start the Echo server.
 	log.Printf("Starting API at %s", api.config.HTTPAddress)
 
@@ -1,10 +1,13 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/labstack/echo/v4"
+	"github.com/mistralmail/mistralmail/backend"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
 )
 
 func (api *API) getAllUsersHandler(c echo.Context) error {
@@ -32,8 +35,8 @@ func (api *API) deleteUserHandler(c echo.Context) error {
 		})
 	}
 
-	// Call the DeleteUser method from your UserRepository.
-	err = api.backend.UserRepo.DeleteUser(uint(userID))
+	// Delete the user together with its mailboxes and messages.
+	err = api.backend.DeleteUser(uint(userID))
 	if err != nil {
 		// Handle the error, e.g., return a JSON response with an error message.
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -75,13 +78,20 @@ func (api *API) resetPasswordHandler(c echo.Context) error {
 	req := struct {
 		Email       string `json:"email"`
 		NewPassword string `json:"newPassword"`
+		// CurrentPassword is only needed for users with encryption enabled.
+		CurrentPassword string `json:"currentPassword"`
 	}{}
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
 	// Call the ResetUserPassword method from your Backend.
-	err := api.backend.ResetUserPassword(req.Email, req.NewPassword)
+	err := api.backend.ResetUserPassword(req.Email, req.NewPassword, req.CurrentPassword)
+	if errors.Is(err, backend.ErrCurrentPasswordRequired) || errors.Is(err, encryption.ErrWrongPassword) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		// Handle the error, e.g., return a JSON response with an error message.
 		return c.JSON(http.StatusInternalServerError, map[string]string{
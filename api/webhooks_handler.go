@@ -0,0 +1,114 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mistralmail/mistralmail/backend/models"
+)
+
+// maxDeliveriesInLog is the number of deliveries returned in the delivery log.
+const maxDeliveriesInLog = 100
+
+func (api *API) getAllWebhooksHandler(c echo.Context) error {
+	webhooks, err := api.backend.WebhookRepo.GetAllWebhooks()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+func (api *API) createWebhookHandler(c echo.Context) error {
+	// Parse the request to get the endpoint and subscribed events.
+	req := struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}{}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid webhook URL",
+		})
+	}
+
+	// Generate a secret when none was provided.
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return echo.ErrInternalServerError
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook := &models.Webhook{
+		URL:     req.URL,
+		Secret:  req.Secret,
+		Events:  req.Events,
+		Enabled: true,
+	}
+
+	err = api.backend.WebhookRepo.CreateWebhook(webhook)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	// The secret is only returned once, it isn't included when the webhooks are listed
+	return c.JSON(http.StatusCreated, struct {
+		*models.Webhook
+		Secret string
+	}{webhook, webhook.Secret})
+}
+
+func (api *API) deleteWebhookHandler(c echo.Context) error {
+	// Parse the webhook ID from the URL parameter.
+	webhookID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid webhook ID format",
+		})
+	}
+
+	err = api.backend.WebhookRepo.DeleteWebhook(uint(webhookID))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Webhook deleted successfully",
+	})
+}
+
+func (api *API) getWebhookDeliveriesHandler(c echo.Context) error {
+	// Parse the webhook ID from the URL parameter.
+	webhookID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid webhook ID format",
+		})
+	}
+
+	deliveries, err := api.backend.WebhookRepo.FindDeliveriesByWebhookID(uint(webhookID), maxDeliveriesInLog)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, deliveries)
+}
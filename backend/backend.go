@@ -3,9 +3,11 @@ package backend
 import (
 	"fmt"
 
+	"github.com/mistralmail/mistralmail/backend/blobstore"
 	imapbackend "github.com/mistralmail/mistralmail/backend/imap"
 	"github.com/mistralmail/mistralmail/backend/models"
 	loginattempts "github.com/mistralmail/mistralmail/backend/services/login-attempts"
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
 	smtpbackend "github.com/mistralmail/mistralmail/backend/smtp"
 	"gorm.io/gorm"
 )
@@ -16,11 +18,20 @@ type Backend struct {
 	UserRepo    *models.UserRepository
 	MailboxRepo *models.MailboxRepository
 	MessageRepo *models.MessageRepository
+	ForwardRepo *models.ForwardRepository
+	WebhookRepo *models.WebhookRepository
+	RouteRepo   *models.RouteRepository
+
+	DeliveryRepo *models.DeliveryRepository
 
 	SMTPBackend *smtpbackend.SMTPBackend
 	IMAPBackend *imapbackend.IMAPBackend
 
 	LoginAttempts *loginattempts.LoginAttempts
+	Webhooks      *webhooks.Webhooks
+
+	// MailSender is used to send mail generated by the backend itself (e.g. confirmation mails).
+	MailSender MailSender
 }
 
 // New creates a new backend with the provided database url.
@@ -45,18 +56,44 @@ func New(dbURL string, logFullQueries bool) (*Backend, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create message repo: %w", err)
 	}
+	messageRepo.SetBodyStructureParser(imapbackend.ParseBodyStructure)
+
+	forwardRepo, err := models.NewForwardRepository(db)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create forward repo: %w", err)
+	}
+
+	webhookRepo, err := models.NewWebhookRepository(db)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create webhook repo: %w", err)
+	}
+
+	routeRepo, err := models.NewRouteRepository(db)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create route repo: %w", err)
+	}
+
+	deliveryRepo, err := models.NewDeliveryRepository(db, messageRepo)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create delivery repo: %w", err)
+	}
 
 	loginAttempts, err := loginattempts.New(loginattempts.DefaultMaxAttempts, loginattempts.DefaultBlockDuration)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create login attempts service: %w", err)
 	}
 
-	imapBackend, err := imapbackend.NewIMAPBackend(userRepo, mailboxRepo, messageRepo, loginAttempts)
+	webhooksService, err := webhooks.New(webhookRepo, webhooks.DefaultMaxAttempts, webhooks.DefaultTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create webhooks service: %w", err)
+	}
+
+	imapBackend, err := imapbackend.NewIMAPBackend(userRepo, mailboxRepo, messageRepo, deliveryRepo, loginAttempts, webhooksService)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create IMAP backend: %w", err)
 	}
 
-	smtpBackend, err := smtpbackend.NewSMTPBackend(userRepo, loginAttempts)
+	smtpBackend, err := smtpbackend.NewSMTPBackend(userRepo, loginAttempts, webhooksService)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create SMTP backend: %w", err)
 	}
@@ -66,13 +103,50 @@ func New(dbURL string, logFullQueries bool) (*Backend, error) {
 		UserRepo:      userRepo,
 		MailboxRepo:   mailboxRepo,
 		MessageRepo:   messageRepo,
+		ForwardRepo:   forwardRepo,
+		WebhookRepo:   webhookRepo,
+		RouteRepo:     routeRepo,
+		DeliveryRepo:  deliveryRepo,
 		IMAPBackend:   imapBackend,
 		SMTPBackend:   smtpBackend,
 		LoginAttempts: loginAttempts,
+		Webhooks:      webhooksService,
 	}, nil
 }
 
+// SetBlobStores opens the blob store new message content is written to,
+// and the old stores that still contain content until it is moved with MoveBlobs.
+func (b *Backend) SetBlobStores(storeURL string, oldStoreURLs []string) error {
+	store, err := blobstore.Open(storeURL, b.db)
+	if err != nil {
+		return fmt.Errorf("couldn't open blob store: %w", err)
+	}
+
+	oldStores := []models.BlobStore{}
+	for _, oldStoreURL := range oldStoreURLs {
+		oldStore, err := blobstore.Open(oldStoreURL, b.db)
+		if err != nil {
+			return fmt.Errorf("couldn't open old blob store: %w", err)
+		}
+		oldStores = append(oldStores, oldStore)
+	}
+
+	b.MessageRepo.SetBlobStores(store, oldStores...)
+	return nil
+}
+
+// MoveBlobs moves all message content to the given blob store, which must be one of the stores that are set.
+// It returns the number of moved blobs.
+func (b *Backend) MoveBlobs(storeURL string) (int, error) {
+	store, err := blobstore.Open(storeURL, b.db)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open blob store: %w", err)
+	}
+	return b.MessageRepo.MoveBlobs(store)
+}
+
 // Close the backend and its database
 func (b *Backend) Close() error {
+	b.Webhooks.Stop()
 	return closeDB(b.db)
 }
@@ -0,0 +1,51 @@
+// Package blobstore contains the stores for the content of messages outside of the database.
+package blobstore
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"gorm.io/gorm"
+)
+
+// Open opens the blob store with the given url:
+//
+//	database                                          the database of the backend
+//	file:///var/lib/mistralmail/blobs                 a local directory
+//	s3://key:secret@host:port/bucket/prefix?region=   an S3-compatible object store, add insecure=true for plain HTTP
+func Open(rawURL string, db *gorm.DB) (models.BlobStore, error) {
+
+	if rawURL == "" || rawURL == models.DatabaseBlobStoreName {
+		return models.NewDatabaseBlobStore(db), nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse blob store url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Host != "" {
+			path = u.Host + path
+		}
+		return NewFilesystem(path)
+
+	case "s3":
+		return NewS3(u)
+
+	default:
+		return nil, fmt.Errorf("unsupported blob store: %s", u.Scheme)
+	}
+}
+
+// validHash checks whether the hash can be used as a file or object name.
+func validHash(hash string) error {
+	if len(hash) < 4 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// testStore checks the behaviour every BlobStore must have.
+func testStore(t *testing.T, store models.BlobStore) {
+	data := []byte("Subject: Hello\r\n\r\nHello world!\r\n")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	_, err := store.Get(hash)
+	assert.ErrorIs(t, err, models.ErrBlobNotFound)
+
+	require.NoError(t, store.Put(hash, data))
+	require.NoError(t, store.Put(hash, data))
+
+	stored, err := store.Get(hash)
+	require.NoError(t, err)
+	assert.Equal(t, data, stored)
+
+	// A blob can be replaced, e.g. by its compressed version
+	require.NoError(t, store.Put(hash, []byte("compressed")))
+	stored, err = store.Get(hash)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("compressed"), stored)
+
+	require.NoError(t, store.Delete(hash))
+	require.NoError(t, store.Delete(hash))
+	_, err = store.Get(hash)
+	assert.ErrorIs(t, err, models.ErrBlobNotFound)
+}
+
+func TestOpen(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+
+	store, err := Open("database", db)
+	require.NoError(t, err)
+	assert.Equal(t, "database", store.Name())
+
+	dir := t.TempDir()
+	store, err = Open("file://"+dir, db)
+	require.NoError(t, err)
+	assert.Equal(t, "file://"+filepath.ToSlash(dir), store.Name())
+
+	store, err = Open("s3://key:secret@localhost:9000/mail/blobs?insecure=true", db)
+	require.NoError(t, err)
+	assert.Equal(t, "s3://localhost:9000/mail/blobs", store.Name())
+
+	_, err = Open("s3://localhost:9000", db)
+	assert.Error(t, err)
+	_, err = Open("ftp://localhost/blobs", db)
+	assert.Error(t, err)
+}
+
+func TestDatabase(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.BlobData{}))
+
+	testStore(t, models.NewDatabaseBlobStore(db))
+}
+
+func TestFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFilesystem(dir)
+	require.NoError(t, err)
+
+	testStore(t, store)
+
+	assert.Error(t, store.Put("../../etc/passwd", []byte("data")))
+	require.NoError(t, store.Put("abcdef", []byte("data")))
+	_, err = os.Stat(filepath.Join(dir, "ab", "cd", "abcdef"))
+	assert.NoError(t, err)
+}
+
+// fakeS3 is a minimal in-memory S3 server with path-style bucket access.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data = decodeChunks(data)
+		}
+		s.objects[r.URL.Path] = data
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			return
+		}
+		w.Header().Set("Last-Modified", "Wed, 11 May 2016 14:31:59 GMT")
+		w.Header().Set("ETag", `"etag"`)
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeChunks decodes an aws-chunked body, which is used for uploads over plain HTTP.
+func decodeChunks(body []byte) []byte {
+	data := []byte{}
+	for {
+		line, rest, _ := bytes.Cut(body, []byte("\r\n"))
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(size), 16, 64)
+		if err != nil || n == 0 || int(n) > len(rest) {
+			return data
+		}
+		data = append(data, rest[:n]...)
+		body = bytes.TrimPrefix(rest[n:], []byte("\r\n"))
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	u, err := url.Parse(strings.Replace(server.URL, "http://", "s3://key:secret@", 1) + "/mail/blobs?insecure=true")
+	require.NoError(t, err)
+	store, err := NewS3(u)
+	require.NoError(t, err)
+
+	testStore(t, store)
+
+	require.NoError(t, store.Put("abcdef", []byte("data")))
+	assert.Contains(t, fake.objects, "/mail/blobs/ab/cd/abcdef")
+}
+
+// TestMinIO runs against a real MinIO or other S3-compatible store when MINIO_TEST_URL is set,
+// e.g. s3://minioadmin:minioadmin@localhost:9000/mistralmail?insecure=true with the docker compose minio service.
+func TestMinIO(t *testing.T) {
+	rawURL := os.Getenv("MINIO_TEST_URL")
+	if rawURL == "" {
+		t.Skip("MINIO_TEST_URL isn't set")
+	}
+
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	store, err := NewS3(u)
+	require.NoError(t, err)
+
+	testStore(t, store)
+}
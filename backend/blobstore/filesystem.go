@@ -0,0 +1,116 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+)
+
+// Filesystem is a BlobStore that keeps every blob in a file.
+// The files are sharded over two levels of directories by the start of their hash, e.g. ab/cd/abcd...,
+// so no directory contains too many files.
+type Filesystem struct {
+	root string
+}
+
+// NewFilesystem creates a new Filesystem store in the given directory, which is created when it doesn't exist.
+func NewFilesystem(root string) (*Filesystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get absolute path of blob directory: %w", err)
+	}
+
+	err = os.MkdirAll(root, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create blob directory: %w", err)
+	}
+
+	return &Filesystem{root: root}, nil
+}
+
+// Name implements the BlobStore interface.
+func (s *Filesystem) Name() string {
+	return "file://" + filepath.ToSlash(s.root)
+}
+
+// path returns the path of the file of the blob.
+func (s *Filesystem) path(hash string) (string, error) {
+	err := validHash(hash)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, hash[0:2], hash[2:4], hash), nil
+}
+
+// Put implements the BlobStore interface.
+func (s *Filesystem) Put(hash string, data []byte) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return fmt.Errorf("couldn't create blob directory: %w", err)
+	}
+
+	// Write to a temporary file first, so a blob is never read half written
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+hash)
+	if err != nil {
+		return fmt.Errorf("couldn't create blob file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write blob file: %w", err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return fmt.Errorf("couldn't write blob file: %w", err)
+	}
+
+	return nil
+}
+
+// Get implements the BlobStore interface.
+func (s *Filesystem) Get(hash string) ([]byte, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, models.ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read blob file: %w", err)
+	}
+	return data, nil
+}
+
+// Delete implements the BlobStore interface.
+func (s *Filesystem) Delete(hash string) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("couldn't delete blob file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/mistralmail/mistralmail/backend/models"
+)
+
+const (
+	// s3DefaultRegion is used when the url has no region, MinIO accepts any region.
+	s3DefaultRegion = "us-east-1"
+	// s3Timeout is how long a single request to the object store may take.
+	s3Timeout = 30 * time.Second
+)
+
+// S3 is a BlobStore that keeps every blob as an object in an S3-compatible object store.
+type S3 struct {
+	client *minio.Client
+	name   string
+	bucket string
+	prefix string
+}
+
+// NewS3 creates a new S3 store from an url like s3://key:secret@host:port/bucket/prefix?region=eu-west-1&insecure=true.
+// The bucket must exist.
+func NewS3(u *url.URL) (*S3, error) {
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Host == "" || bucket == "" {
+		return nil, fmt.Errorf("s3 blob store url needs a host and a bucket")
+	}
+
+	region := u.Query().Get("region")
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	accessKey := u.User.Username()
+	secretKey, _ := u.User.Password()
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: u.Query().Get("insecure") != "true",
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create s3 client: %w", err)
+	}
+
+	// The name doesn't contain the credentials, so they can be changed
+	name := (&url.URL{Scheme: "s3", Host: u.Host, Path: u.Path}).String()
+
+	return &S3{
+		client: client,
+		name:   name,
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+// Name implements the BlobStore interface.
+func (s *S3) Name() string {
+	return s.name
+}
+
+// key returns the object key of the blob.
+func (s *S3) key(hash string) (string, error) {
+	err := validHash(hash)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.prefix, hash[0:2], hash[2:4], hash), nil
+}
+
+// Put implements the BlobStore interface.
+func (s *S3) Put(hash string, data []byte) error {
+	key, err := s.key(hash)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+
+	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "message/rfc822",
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't put object: %w", err)
+	}
+	return nil
+}
+
+// Get implements the BlobStore interface.
+func (s *S3) Get(hash string) ([]byte, error) {
+	key, err := s.key(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get object: %w", err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, models.ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read object: %w", err)
+	}
+	return data, nil
+}
+
+// Delete implements the BlobStore interface.
+func (s *S3) Delete(hash string) error {
+	key, err := s.key(hash)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+
+	err = s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return fmt.Errorf("couldn't delete object: %w", err)
+	}
+	return nil
+}
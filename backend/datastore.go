@@ -76,17 +76,41 @@ func initDB(dbURL string, logFullQueries bool) (*gorm.DB, error) {
 // migrate the database models.
 func migrate(db *gorm.DB) error {
 
+	// The existing messages need their uids before the unique index is created
+	err := models.MigrateMailboxUIDs(db)
+	if err != nil {
+		return err
+	}
+
 	// Migrate
 	// TODO: how to do this properly?
-	err := db.AutoMigrate(
+	err = db.AutoMigrate(
 		&models.User{},
 		&models.Mailbox{},
 		&models.Message{},
+		&models.Blob{},
+		&models.BlobData{},
+		&models.Forward{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.Route{},
+		&models.Delivery{},
+		&models.ExpungedMessage{},
 	)
 	if err != nil {
 		return err
 	}
 
+	err = models.MigrateMessageBodies(db)
+	if err != nil {
+		return err
+	}
+
+	err = models.MigrateTextIndex(db)
+	if err != nil {
+		return err
+	}
+
 	err = db.Migrator().DropView(models.MessageWithSequenceNumberViewName)
 	if err != nil {
 		return err
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/smtp/smtp"
+	"gorm.io/gorm"
+)
+
+// MailSender sends mail to external addresses (e.g. via the outgoing relay).
+type MailSender interface {
+	// SendMail sends the message with the given envelope sender and recipients.
+	SendMail(from string, recipients []string, message []byte) error
+}
+
+// CreateForward creates a new unconfirmed forward for the given user
+// and mails a confirmation link to the external address.
+// The forward only becomes active once the link is visited.
+func (b *Backend) CreateForward(userID uint, address string, keepCopy bool, confirmationURL string) (*models.Forward, error) {
+
+	if _, err := smtp.ParseAddress(address); err != nil {
+		return nil, fmt.Errorf("invalid email address: %w", err)
+	}
+
+	if b.MailSender == nil {
+		return nil, fmt.Errorf("no mail sender configured to send the confirmation mail")
+	}
+
+	user, err := b.UserRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find user: %w", err)
+	}
+
+	if strings.EqualFold(user.Email, address) {
+		return nil, fmt.Errorf("can't forward mail to the same address")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate confirmation token: %w", err)
+	}
+
+	forward := &models.Forward{
+		Address:           address,
+		KeepCopy:          keepCopy,
+		Confirmed:         false,
+		ConfirmationToken: token,
+		UserID:            user.ID,
+	}
+
+	err = b.ForwardRepo.CreateForward(forward)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create forward: %w", err)
+	}
+
+	err = b.sendForwardConfirmation(user, forward, confirmationURL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't send confirmation mail: %w", err)
+	}
+
+	return forward, nil
+}
+
+// ConfirmForward activates the forward that belongs to the given confirmation token.
+func (b *Backend) ConfirmForward(token string) (*models.Forward, error) {
+
+	if token == "" {
+		return nil, fmt.Errorf("expected confirmation token")
+	}
+
+	forward, err := b.ForwardRepo.GetForwardByConfirmationToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find forward: %w", err)
+	}
+
+	forward.Confirmed = true
+	forward.ConfirmationToken = ""
+
+	err = b.ForwardRepo.UpdateForward(forward)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't confirm forward: %w", err)
+	}
+
+	return forward, nil
+}
+
+// FindConfirmedForwardsByEmail finds the active forwards of the user with the given address.
+// No forwards are returned when the address isn't a local user.
+func (b *Backend) FindConfirmedForwardsByEmail(email string) ([]*models.Forward, error) {
+
+	user, err := b.UserRepo.FindUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find user: %w", err)
+	}
+
+	return b.ForwardRepo.FindConfirmedForwardsByUserID(user.ID)
+}
+
+// sendForwardConfirmation mails the confirmation link to the forward address.
+func (b *Backend) sendForwardConfirmation(user *models.User, forward *models.Forward, confirmationURL string) error {
+
+	from := "postmaster@" + user.Email[strings.LastIndex(user.Email, "@")+1:]
+
+	body := "From: " + from + "\r\n" +
+		"To: " + forward.Address + "\r\n" +
+		"Subject: Confirm forwarding of mail from " + user.Email + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + uuid.New().String() + "@" + from[strings.LastIndex(from, "@")+1:] + ">\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Mail for " + user.Email + " will be forwarded to " + forward.Address + ".\r\n" +
+		"\r\n" +
+		"Visit the following link to confirm this forward:\r\n" +
+		"\r\n" +
+		confirmationURL + "?token=" + forward.ConfirmationToken + "\r\n" +
+		"\r\n" +
+		"If you didn't expect this message you can safely ignore it.\r\n"
+
+	return b.MailSender.SendMail(from, []string{forward.Address}, []byte(body))
+}
+
+// generateToken generates a random hex encoded token.
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
@@ -1,64 +1,209 @@
 package imapbackend
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
+	"github.com/mistralmail/mistralmail/backend/services/quarantine"
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
 	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
 )
 
+// pruneInterval denotes how often the deliveries older than the delivery window are deleted.
+const pruneInterval = time.Hour
+
+// DeliveryResult is the outcome of delivering a message to a single recipient.
+type DeliveryResult struct {
+	Recipient string
+	// Mailbox is the mailbox the message was stored in, it is empty when the delivery script discarded the message.
+	Mailbox string
+	// Duplicate denotes that the message was already delivered to the recipient by an earlier attempt.
+	Duplicate bool
+	// Err is set when the message couldn't be delivered to the recipient.
+	Err error
+}
+
 // AddMail saves a new smtp message in the IMAP backend.
-func (b *IMAPBackend) AddMail(smtpState *smtp.State) (*IMAPMessage, error) {
+// Every recipient is handled independently and gets its own copy with Delivered-To and X-Original-To headers,
+// the result of every recipient is returned. Retries of a message that was already delivered to a recipient
+// are recognized and not stored again, so a partial failure can safely be retried.
+// When a delivery script is set, it decides per recipient in which mailbox the message is stored.
+func (b *IMAPBackend) AddMail(smtpState *smtp.State) ([]*DeliveryResult, error) {
+
+	// Get either inbox or junk mailbox
+	isSpam, err := isSpam(smtpState)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't check if mail is spam: %w", err)
+	}
+	defaultMailbox := "INBOX"
+	if isSpam {
+		defaultMailbox = "Junk"
+	}
 
+	results := []*DeliveryResult{}
 	for _, recipient := range smtpState.To {
+		results = append(results, b.deliver(smtpState, recipient.Address, defaultMailbox))
+	}
 
-		// Find user
-		user, err := b.userRepo.FindUserByEmail(recipient.Address)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't find recipient: %w", err)
+	b.pruneDeliveries()
+
+	return results, nil
+}
+
+// deliver stores the message for a single recipient.
+func (b *IMAPBackend) deliver(smtpState *smtp.State, recipient string, defaultMailbox string) *DeliveryResult {
+
+	result := &DeliveryResult{Recipient: recipient}
+
+	// Find user
+	user, err := b.userRepo.FindUserByEmail(recipient)
+	if err != nil {
+		result.Err = fmt.Errorf("couldn't find recipient: %w", err)
+		return result
+	}
+
+	// Check whether an earlier attempt already delivered the message
+	key := models.DeliveryKey(recipient, smtpState.Data)
+	delivery, err := b.deliveryRepo.FindDeliverySince(key, time.Now().Add(-models.DeliveryWindow))
+	if err != nil {
+		result.Err = fmt.Errorf("couldn't check earlier deliveries: %w", err)
+		return result
+	}
+	if delivery != nil {
+		result.Duplicate = true
+		if mailbox, err := b.mailboxRepo.GetMailboxByID(delivery.MailboxID); err == nil {
+			result.Mailbox = mailbox.Name
 		}
+		return result
+	}
+
+	mailboxName := defaultMailbox
+	data := smtpState.Data
 
-		// Get either inbox or junk mailbox
-		isSpam, err := isSpam(smtpState)
+	if b.deliveryScript != nil {
+		scriptResult, err := b.runDeliveryScript(smtpState, recipient, mailboxName)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't check if mail is spam: %w", err)
+			result.Err = err
+			return result
 		}
-
-		var destinationMailbox = &models.Mailbox{}
-
-		if !isSpam {
-			destinationMailbox, err = b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(user.ID, "INBOX")
-			if err != nil {
-				return nil, fmt.Errorf("couldn't find inbox for recipient: %w", err)
-			}
-		} else {
-			destinationMailbox, err = b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(user.ID, "Junk")
-			if err != nil {
-				return nil, fmt.Errorf("couldn't find inbox for recipient: %w", err)
-			}
+		if scriptResult.Action == scripting.ActionDiscard {
+			log.WithField("recipient", recipient).Infof("Delivery script discarded message: %s", scriptResult.Reason)
+			return result
+		}
+		if scriptResult.Action == scripting.ActionQuarantine {
+			mailboxName = "Junk"
+		}
+		if scriptResult.Mailbox != "" {
+			mailboxName = scriptResult.Mailbox
 		}
+		data = prependHeaders(scriptResult.Headers, data)
+	}
 
-		message := &models.Message{
-			// UID:   inbox.uidNext(),
-			// use gorm autoincrement in db
-			Date:  time.Now(),
-			Size:  uint32(len(smtpState.Data)),
-			Flags: models.StringSlice{},
-			Body:  smtpState.Data,
+	// Delivered-To is the final address, X-Original-To the envelope recipient as given by the client
+	data = prependHeaders([]scripting.Header{
+		{Name: "X-Original-To", Value: recipient},
+		{Name: "Delivered-To", Value: user.Email},
+	}, data)
 
-			MailboxID: destinationMailbox.ID,
-		}
+	destinationMailbox, err := b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(user.ID, mailboxName)
+	if err != nil && mailboxName != defaultMailbox {
+		log.WithField("recipient", recipient).Warnf("Couldn't find mailbox %q set by the delivery script, using %s: %v", mailboxName, defaultMailbox, err)
+		destinationMailbox, err = b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(user.ID, defaultMailbox)
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("couldn't find inbox for recipient: %w", err)
+		return result
+	}
+
+	message := &models.Message{
+		Date:  time.Now(),
+		Size:  uint32(len(data)),
+		Flags: models.StringSlice{},
+		Body:  data,
+		// The added header fields differ per recipient, the rest of the message is stored once for all of them
+		Prefix: data[:len(data)-len(smtpState.Data)],
 
-		err = b.messageRepo.CreateMessage(message)
+		MailboxID: destinationMailbox.ID,
+	}
+
+	// Encrypted messages can't be shared with other recipients, so the whole message is compressed and encrypted
+	if user.EncryptionEnabled() {
+		message.Body, err = b.messageRepo.Compress(data)
+		if err == nil {
+			message.Body, err = encryption.Encrypt(user.EncryptionPublicKey, message.Body)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("couldn't save new message: %w", err)
+			result.Err = fmt.Errorf("couldn't encrypt message: %w", err)
+			return result
 		}
+		message.Prefix = nil
+		message.Encrypted = true
+	}
+
+	err = b.deliveryRepo.CreateMessageWithDelivery(message, &models.Delivery{DeliveryKey: key, Recipient: recipient})
+	if err != nil {
+		result.Err = fmt.Errorf("couldn't save new message: %w", err)
+		return result
+	}
+
+	notifyExists(b.updater, b.messageRepo, user.Username, destinationMailbox)
+
+	result.Mailbox = destinationMailbox.Name
+	return result
+}
+
+// pruneDeliveries deletes the deliveries that are older than the delivery window, at most once per prune interval.
+func (b *IMAPBackend) pruneDeliveries() {
+	b.pruneMutex.Lock()
+	defer b.pruneMutex.Unlock()
+
+	if time.Since(b.lastPrune) < pruneInterval {
+		return
+	}
+	b.lastPrune = time.Now()
+
+	err := b.deliveryRepo.DeleteDeliveriesBefore(time.Now().Add(-models.DeliveryWindow))
+	if err != nil {
+		log.Errorf("Couldn't delete old deliveries: %v", err)
+	}
+}
+
+// runDeliveryScript runs the deliver(mail) function of the delivery script for a single recipient.
+// Rejects and tempfails are returned as a *scripting.RejectedError.
+func (b *IMAPBackend) runDeliveryScript(smtpState *smtp.State, recipient string, mailbox string) (*scripting.Result, error) {
+
+	msg := scripting.NewMessage(smtpState)
+	msg.Recipient = recipient
+	msg.Mailbox = mailbox
+
+	result, err := b.deliveryScript.Run(scripting.FunctionDeliver, msg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run delivery script: %w", err)
+	}
 
+	if result.Action == scripting.ActionReject || result.Action == scripting.ActionTempFail {
+		return nil, &scripting.RejectedError{Result: result}
 	}
 
-	return nil, nil
+	return result, nil
+}
+
+// prependHeaders prepends the header fields to the message, in order.
+func prependHeaders(headers []scripting.Header, data []byte) []byte {
+	if len(headers) == 0 {
+		return data
+	}
+	var buf bytes.Buffer
+	for _, header := range headers {
+		buf.WriteString(header.Name + ": " + header.Value + "\r\n")
+	}
+	buf.Write(data)
+	return buf.Bytes()
 }
 
 // MailaddressExists checks whether a mailbox exist for the given address.
@@ -76,9 +221,13 @@ func (b *IMAPBackend) MailaddressExists(address string) (bool, error) {
 
 const spamThreshhold = 5.0
 
-// isSpam checks whether a message is classified as spam, based on the X-Spam-Score header.
+// isSpam checks whether a message is quarantined or classified as spam, based on the X-Spam-Score header.
 func isSpam(smtpState *smtp.State) (bool, error) {
 
+	if _, ok := smtpState.GetHeader(quarantine.Header); ok {
+		return true, nil
+	}
+
 	spamScore, ok := smtpState.GetHeader("X-Spam-Score")
 	if !ok {
 		return false, nil
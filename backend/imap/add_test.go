@@ -0,0 +1,236 @@
+package imapbackend
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestBackend creates an IMAP backend with a user for every given address, with an INBOX, Junk and Lists mailbox.
+func newTestBackend(t *testing.T, addresses ...string) *IMAPBackend {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Mailbox{}, &models.Message{}, &models.Blob{}, &models.BlobData{}, &models.Delivery{}, &models.ExpungedMessage{}))
+	require.NoError(t, db.Migrator().CreateView(models.MessageWithSequenceNumberViewName, gorm.ViewOption{Query: db.Raw(models.MessageWithSequenceNumberViewQuery)}))
+	require.NoError(t, models.MigrateTextIndex(db))
+
+	userRepo, err := models.NewUserRepository(db)
+	require.NoError(t, err)
+	mailboxRepo, err := models.NewMailboxRepository(db)
+	require.NoError(t, err)
+	messageRepo, err := models.NewMessageRepository(db)
+	require.NoError(t, err)
+	messageRepo.SetBodyStructureParser(ParseBodyStructure)
+	deliveryRepo, err := models.NewDeliveryRepository(db, messageRepo)
+	require.NoError(t, err)
+
+	for _, address := range addresses {
+		user, err := models.NewUser(address, "password", address)
+		require.NoError(t, err)
+		require.NoError(t, userRepo.CreateUser(user))
+		for _, name := range []string{"INBOX", "Junk", "Lists"} {
+			require.NoError(t, mailboxRepo.CreateMailbox(&models.Mailbox{Name: name, UserID: user.ID}))
+		}
+	}
+
+	b, err := NewIMAPBackend(userRepo, mailboxRepo, messageRepo, deliveryRepo, nil, nil)
+	require.NoError(t, err)
+	return b
+}
+
+// messagesIn returns the bodies of the messages in the mailbox of the user.
+func messagesIn(t *testing.T, b *IMAPBackend, address string, mailbox string) []string {
+	user, err := b.userRepo.FindUserByEmail(address)
+	require.NoError(t, err)
+	m, err := b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(user.ID, mailbox)
+	require.NoError(t, err)
+	messages, err := b.messageRepo.FindMessagesByMailboxID(m.ID, models.FindMessagesParameters{})
+	require.NoError(t, err)
+
+	bodies := []string{}
+	for _, message := range messages {
+		bodies = append(bodies, string(message.Body))
+	}
+	return bodies
+}
+
+func TestAddMailWithDeliveryScript(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "policy.star")
+	require.NoError(t, os.WriteFile(path, []byte(`
+def deliver(mail):
+    if mail.header("X-Reject") and mail.recipient == "alice@example.com":
+        return reject(550, "Not wanted", enhanced_code="5.7.1")
+    if mail.recipient == "discard@example.com":
+        return discard()
+    if mail.header("List-Id"):
+        mail.set_mailbox("Lists")
+        mail.add_header("X-Delivered-By", "script")
+`), 0o600))
+
+	script, err := scripting.New(path, scripting.DefaultMaxSteps, scripting.DefaultTimeout)
+	require.NoError(t, err)
+
+	state := func(data string) *smtp.State {
+		return &smtp.State{
+			From: &smtp.MailAddress{Address: "sender@example.net"},
+			To:   []*smtp.MailAddress{{Address: "alice@example.com"}, {Address: "discard@example.com"}},
+			Data: []byte(data),
+		}
+	}
+
+	t.Run("TestSetMailbox", func(t *testing.T) {
+		b := newTestBackend(t, "alice@example.com", "discard@example.com")
+		b.SetDeliveryScript(script)
+
+		results, err := b.AddMail(state("List-Id: <news.example.net>\r\n\r\nHello\r\n"))
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, "Lists", results[0].Mailbox)
+		assert.NoError(t, results[1].Err)
+		assert.Equal(t, "", results[1].Mailbox)
+
+		assert.Equal(t, []string{"X-Original-To: alice@example.com\r\nDelivered-To: alice@example.com\r\nX-Delivered-By: script\r\nList-Id: <news.example.net>\r\n\r\nHello\r\n"}, messagesIn(t, b, "alice@example.com", "Lists"))
+		assert.Empty(t, messagesIn(t, b, "alice@example.com", "INBOX"))
+		assert.Empty(t, messagesIn(t, b, "discard@example.com", "Lists"))
+	})
+
+	t.Run("TestRejectIsPerRecipient", func(t *testing.T) {
+		b := newTestBackend(t, "alice@example.com", "discard@example.com")
+		b.SetDeliveryScript(script)
+
+		results, err := b.AddMail(state("X-Reject: yes\r\n\r\nHello\r\n"))
+		require.NoError(t, err)
+		var rejected *scripting.RejectedError
+		require.True(t, errors.As(results[0].Err, &rejected))
+		assert.Equal(t, 550, rejected.Result.Code)
+		assert.NoError(t, results[1].Err)
+		assert.Empty(t, messagesIn(t, b, "alice@example.com", "INBOX"))
+	})
+
+	t.Run("TestWithoutScript", func(t *testing.T) {
+		b := newTestBackend(t, "alice@example.com", "discard@example.com")
+
+		_, err := b.AddMail(state("List-Id: <news.example.net>\r\n\r\nHello\r\n"))
+		require.NoError(t, err)
+
+		inbox := messagesIn(t, b, "discard@example.com", "INBOX")
+		require.Len(t, inbox, 1)
+		assert.True(t, strings.HasSuffix(inbox[0], "\r\nList-Id: <news.example.net>\r\n\r\nHello\r\n"))
+	})
+
+}
+
+func TestAddMailPerRecipient(t *testing.T) {
+
+	state := func(received string) *smtp.State {
+		return &smtp.State{
+			From: &smtp.MailAddress{Address: "sender@example.net"},
+			To:   []*smtp.MailAddress{{Address: "alice@example.com"}, {Address: "bob@example.com"}},
+			Data: []byte("Received: " + received + "\r\nMessage-ID: <1@example.net>\r\nSubject: Hello\r\n\r\nHello\r\n"),
+		}
+	}
+
+	t.Run("TestDeliveryHeaders", func(t *testing.T) {
+		b := newTestBackend(t, "alice@example.com", "bob@example.com")
+
+		results, err := b.AddMail(state("first attempt"))
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		assert.Equal(t, "alice@example.com", results[0].Recipient)
+		assert.Equal(t, "INBOX", results[0].Mailbox)
+
+		inbox := messagesIn(t, b, "alice@example.com", "INBOX")
+		require.Len(t, inbox, 1)
+		assert.True(t, strings.HasPrefix(inbox[0], "X-Original-To: alice@example.com\r\nDelivered-To: alice@example.com\r\nReceived: first attempt\r\n"))
+
+		// Both recipients have their own delivery headers, but the message is stored once
+		inbox = messagesIn(t, b, "bob@example.com", "INBOX")
+		require.Len(t, inbox, 1)
+		assert.True(t, strings.HasPrefix(inbox[0], "X-Original-To: bob@example.com\r\nDelivered-To: bob@example.com\r\nReceived: first attempt\r\n"))
+		blobs, err := b.messageRepo.GetTotalBlobsCount()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), blobs)
+	})
+
+	t.Run("TestRetriesAreIdempotent", func(t *testing.T) {
+		b := newTestBackend(t, "alice@example.com", "bob@example.com")
+
+		// Bob has no inbox yet, so only Alice gets the message
+		bob, err := b.userRepo.FindUserByEmail("bob@example.com")
+		require.NoError(t, err)
+		inbox, err := b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(bob.ID, "INBOX")
+		require.NoError(t, err)
+		inbox.Name = "Renamed"
+		require.NoError(t, b.mailboxRepo.UpdateMailbox(inbox))
+
+		results, err := b.AddMail(state("first attempt"))
+		require.NoError(t, err)
+		assert.NoError(t, results[0].Err)
+		assert.Error(t, results[1].Err)
+
+		// The retry has new trace headers but is recognized for Alice
+		inbox.Name = "INBOX"
+		require.NoError(t, b.mailboxRepo.UpdateMailbox(inbox))
+		results, err = b.AddMail(state("second attempt"))
+		require.NoError(t, err)
+		assert.NoError(t, results[0].Err)
+		assert.True(t, results[0].Duplicate)
+		assert.Equal(t, "INBOX", results[0].Mailbox)
+		assert.NoError(t, results[1].Err)
+		assert.False(t, results[1].Duplicate)
+
+		assert.Len(t, messagesIn(t, b, "alice@example.com", "INBOX"), 1)
+		assert.Len(t, messagesIn(t, b, "bob@example.com", "INBOX"), 1)
+	})
+
+	t.Run("TestEncryptedRecipient", func(t *testing.T) {
+		b := newTestBackend(t, "alice@example.com", "bob@example.com")
+
+		bob, err := b.userRepo.FindUserByEmail("bob@example.com")
+		require.NoError(t, err)
+		key, wrapped, err := encryption.GenerateKey("password")
+		require.NoError(t, err)
+		bob.EncryptionPublicKey = key.PublicKey[:]
+		bob.EncryptionPrivateKey = wrapped
+		require.NoError(t, b.userRepo.UpdateUser(bob))
+
+		results, err := b.AddMail(state("first attempt"))
+		require.NoError(t, err)
+		assert.NoError(t, results[1].Err)
+
+		// Bob's copy is encrypted as a whole and isn't shared with Alice
+		inbox, err := b.mailboxRepo.GetMailBoxByUserIDAndMailboxName(bob.ID, "INBOX")
+		require.NoError(t, err)
+		messages, err := b.messageRepo.FindMessagesByMailboxID(inbox.ID, models.FindMessagesParameters{})
+		require.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.True(t, messages[0].Encrypted)
+		assert.Empty(t, messages[0].Prefix)
+		assert.NotContains(t, string(messages[0].Body), "Hello")
+		blobs, err := b.messageRepo.GetTotalBlobsCount()
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), blobs)
+
+		message := NewIMAPMessageFromMessage(messages[0], b.messageRepo, nil)
+		assert.Error(t, message.loadBodyIfEmpty())
+
+		message = NewIMAPMessageFromMessage(messages[0], b.messageRepo, key)
+		require.NoError(t, message.loadBodyIfEmpty())
+		assert.True(t, strings.HasPrefix(string(message.message.Body), "X-Original-To: bob@example.com\r\nDelivered-To: bob@example.com\r\n"))
+		assert.Equal(t, uint32(len(message.message.Body)), message.message.Size)
+	})
+
+}
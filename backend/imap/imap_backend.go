@@ -3,11 +3,16 @@ package imapbackend
 import (
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
 	loginattempts "github.com/mistralmail/mistralmail/backend/services/login-attempts"
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,10 +22,19 @@ type IMAPBackend struct {
 	mailboxRepo *models.MailboxRepository
 	messageRepo *models.MessageRepository
 
+	deliveryRepo *models.DeliveryRepository
+	pruneMutex   sync.Mutex
+	lastPrune    time.Time
+
 	loginAttempts *loginattempts.LoginAttempts
+	webhooks      *webhooks.Webhooks
+
+	deliveryScript *scripting.Script
+
+	updater *updater
 }
 
-func NewIMAPBackend(userRepo *models.UserRepository, mailboxRepo *models.MailboxRepository, messageRepo *models.MessageRepository, loginAttempts *loginattempts.LoginAttempts) (*IMAPBackend, error) {
+func NewIMAPBackend(userRepo *models.UserRepository, mailboxRepo *models.MailboxRepository, messageRepo *models.MessageRepository, deliveryRepo *models.DeliveryRepository, loginAttempts *loginattempts.LoginAttempts, webhooks *webhooks.Webhooks) (*IMAPBackend, error) {
 
 	/*
 
@@ -61,10 +75,37 @@ func NewIMAPBackend(userRepo *models.UserRepository, mailboxRepo *models.Mailbox
 		userRepo:      userRepo,
 		mailboxRepo:   mailboxRepo,
 		messageRepo:   messageRepo,
+		deliveryRepo:  deliveryRepo,
 		loginAttempts: loginAttempts,
+		webhooks:      webhooks,
+		updater:       &updater{},
 	}, nil
 }
 
+// Updates implements the go-imap BackendUpdater interface, the IMAP server sends the changes of mailboxes
+// to the sessions that have the mailbox selected.
+func (b *IMAPBackend) Updates() <-chan backend.Update {
+	return b.updater.Updates()
+}
+
+// notifyExists notifies the sessions of the user of the number of messages in the mailbox.
+func notifyExists(u *updater, messageRepo *models.MessageRepository, username string, mailbox *models.Mailbox) {
+	if !u.listening() {
+		return
+	}
+	count, err := messageRepo.GetNumberOfMessagesByMailboxID(mailbox.ID)
+	if err != nil {
+		log.Errorf("couldn't count the messages for the mailbox update: %v", err)
+		return
+	}
+	u.exists(username, mailbox.Name, uint32(count))
+}
+
+// SetDeliveryScript sets the script that decides in which mailbox incoming mail is delivered.
+func (b *IMAPBackend) SetDeliveryScript(script *scripting.Script) {
+	b.deliveryScript = script
+}
+
 func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, email string, password string) (backend.User, error) {
 
 	log.WithField("remote-address", connInfo.RemoteAddr).Println("IMAP login")
@@ -91,12 +132,23 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, email string, password stri
 			log.WithField("remote-address", connInfo.RemoteAddr).Errorf("couldn't increase log-in attempts: %v\n", err)
 		}
 		log.WithField("remote-address", connInfo.RemoteAddr).Errorf("bad username or password\n")
+		b.emitLoginFailed(email, remoteIP)
 		return nil, fmt.Errorf("bad username or password")
 	}
 
 	passwordCorrect, err := user.CheckPassword(password)
 	if err == nil && passwordCorrect {
 		u := b.wrapUser(user)
+
+		// Unlock the key of the user for this session, so the encrypted messages can be read
+		if user.EncryptionEnabled() {
+			u.key, err = encryption.Unwrap(user.EncryptionPublicKey, user.EncryptionPrivateKey, password)
+			if err != nil {
+				log.WithField("remote-address", connInfo.RemoteAddr).Errorf("couldn't unlock encryption key of user: %v\n", err)
+				return nil, fmt.Errorf("couldn't unlock encryption key")
+			}
+		}
+
 		return &u, nil
 	}
 	if err != nil {
@@ -107,15 +159,26 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, email string, password stri
 		log.WithField("remote-address", connInfo.RemoteAddr).Errorf("couldn't increase log-in attempts: %v\n", err)
 	}
 	log.WithField("remote-address", connInfo.RemoteAddr).Errorf("bad username or password\n")
+	b.emitLoginFailed(email, remoteIP)
 	return nil, fmt.Errorf("bad username or password")
 }
 
+// emitLoginFailed emits the login.failed event for an IMAP login.
+func (b *IMAPBackend) emitLoginFailed(username string, remoteIP string) {
+	b.webhooks.Emit(webhooks.EventLoginFailed, map[string]interface{}{
+		"protocol": "imap",
+		"username": username,
+		"ip":       remoteIP,
+	})
+}
+
 // wrapUser creates a new IMAPUser that contains the User and all repos.
 func (b *IMAPBackend) wrapUser(user *models.User) IMAPUser {
 	return IMAPUser{
 		user:        user,
 		mailboxRepo: b.mailboxRepo,
 		messageRepo: b.messageRepo,
+		updater:     b.updater,
 	}
 }
 
@@ -3,20 +3,36 @@ package imapbackend
 import (
 	"fmt"
 	"io"
+	"sort"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
 	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
 	log "github.com/sirupsen/logrus"
 )
 
 var Delimiter = "/"
 
+// The mailboxes keep the mod-sequences of their messages for CONDSTORE and QRESYNC.
+var _ modseq.Mailbox = (*IMAPMailbox)(nil)
+
 type IMAPMailbox struct {
 	mailbox     *models.Mailbox
 	messageRepo *models.MessageRepository
 	mailboxRepo *models.MailboxRepository
+
+	// key is set when encryption is enabled for the user.
+	key *encryption.Key
+
+	// username and updater notify the sessions of the user of changes.
+	username string
+	updater  *updater
+
+	// session numbers the messages for the session that selected the mailbox.
+	session *session
 }
 
 func (mbox *IMAPMailbox) Name() string {
@@ -34,28 +50,6 @@ func (mbox *IMAPMailbox) Info() (*imap.MailboxInfo, error) {
 	return info, nil
 }
 
-func (mbox *IMAPMailbox) uidNext() uint {
-
-	nextUID, err := mbox.messageRepo.GetNextMessageID(mbox.mailbox.ID)
-	if err != nil {
-		// TODO how to handle error?
-		log.Fatalf("couldn't find next uid: %v", err)
-	}
-
-	/*
-		var uid uint32
-		for _, msg := range mbox.Messages {
-			if msg.UID > uid {
-				uid = msg.UID
-			}
-		}
-		uid++
-		return uid
-	*/
-
-	return nextUID
-}
-
 func (mbox *IMAPMailbox) flags() []string {
 	/*
 		flagsMap := make(map[string]bool)
@@ -102,42 +96,53 @@ func (mbox *IMAPMailbox) flags() []string {
 
 }
 
-func (mbox *IMAPMailbox) unseenSeqNum() uint32 {
+// unseenSeqNum returns the sequence number of the first message without the \Seen flag, or 0 when there is none.
+func (mbox *IMAPMailbox) unseenSeqNum() (uint32, error) {
 
 	parameters := models.FindMessagesParameters{
+		Search:   &models.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}},
+		Limit:    1,
 		OmitBody: true,
 	}
 
-	// TODO, yep this is not performant at all, but let's hope it works
 	messages, err := mbox.messageRepo.FindMessagesByMailboxID(mbox.mailbox.ID, parameters)
 	if err != nil {
-		// TODO handle error
-		log.Fatalf("couldn't get messages: %v", err)
+		return 0, err
 	}
-
-	for i, msg := range messages {
-		seqNum := uint32(i + 1)
-
-		seen := false
-		for _, flag := range msg.Flags {
-			if flag == imap.SeenFlag {
-				seen = true
-				break
-			}
-		}
-
-		if !seen {
-			return seqNum
-		}
+	if len(messages) == 0 {
+		return 0, nil
 	}
-	return 0
+	return mbox.seqNum(messages[0]), nil
 }
 
 func (mbox *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
 
 	log.Debugln("Status")
 
-	count, err := mbox.messageRepo.GetNumberOfMessagesByMailboxID(mbox.mailbox.ID)
+	// The mailbox that is selected has the number of messages of the session, otherwise they are counted
+	var count uint32
+	for _, name := range items {
+		if name != imap.StatusMessages {
+			continue
+		}
+		if mbox.selected() {
+			s, err := mbox.lockSession()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't get status: %w", err)
+			}
+			count = uint32(len(s.uids))
+			s.mu.Unlock()
+			continue
+		}
+		messages, err := mbox.messageRepo.GetNumberOfMessagesByMailboxID(mbox.mailbox.ID)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get status: %w", err)
+		}
+		count = uint32(messages)
+	}
+
+	// The uids are allocated by the messages that are added, so the mailbox is read again
+	mailbox, err := mbox.mailboxRepo.GetMailboxByID(mbox.mailbox.ID)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get status: %w", err)
 	}
@@ -145,16 +150,21 @@ func (mbox *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, e
 	status := imap.NewMailboxStatus(mbox.mailbox.Name, items)
 	status.Flags = mbox.flags()
 	status.PermanentFlags = []string{`\Seen`, `\Answered`, `\Flagged`, `\Draft`, `\Deleted`, `\*`}
-	status.UnseenSeqNum = mbox.unseenSeqNum()
+	status.UnseenSeqNum, err = mbox.unseenSeqNum()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get status: %w", err)
+	}
 
 	for _, name := range items {
 		switch name {
 		case imap.StatusMessages:
-			status.Messages = uint32(count)
+			status.Messages = count
 		case imap.StatusUidNext:
-			status.UidNext = uint32(mbox.uidNext())
+			status.UidNext = uint32(mailbox.UIDNext)
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			status.UidValidity = mailbox.UIDValidity
+		case modseq.StatusHighestModSeq:
+			status.Items[name] = modseq.FormatHighestModSeq(mailbox.HighestModSeq)
 		case imap.StatusRecent:
 			status.Recent = 0 // TODO
 		case imap.StatusUnseen:
@@ -165,6 +175,15 @@ func (mbox *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, e
 	return status, nil
 }
 
+// HighestModSeq returns the mod-sequence of the last change in the mailbox.
+func (mbox *IMAPMailbox) HighestModSeq() (uint64, error) {
+	mailbox, err := mbox.mailboxRepo.GetMailboxByID(mbox.mailbox.ID)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get highest mod-sequence: %w", err)
+	}
+	return mailbox.HighestModSeq, nil
+}
+
 func (mbox *IMAPMailbox) SetSubscribed(subscribed bool) error {
 	log.Debugln("SetSubscribed")
 	// TODO
@@ -185,6 +204,11 @@ func (mbox *IMAPMailbox) Check() error {
 }
 
 func (mbox *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.ListMessagesChangedSince(uid, seqSet, items, 0, ch)
+}
+
+// ListMessagesChangedSince lists the messages that changed after the mod-sequence, or all of them when it is 0.
+func (mbox *IMAPMailbox) ListMessagesChangedSince(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error {
 	defer close(ch)
 
 	log.Debugln("ListMessages")
@@ -212,34 +236,32 @@ func (mbox *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []ima
 		}
 	*/
 
-	parameters := models.FindMessagesParameters{
-		OmitBody: true,
-	}
-	if uid {
-		parameters.UIDSet = sequenceSetToSequencesSlice(seqSet)
-	} else {
-		parameters.SequenceSet = sequenceSetToSequencesSlice(seqSet)
-	}
+	parameters := mbox.findParameters(uid, seqSet)
+	parameters.ChangedSince = changedSince
+	parameters.OmitBody = true
 
-	// TODO, yep this is not performant at all, but let's hope it works
-	messages, err := mbox.messageRepo.FindMessagesByMailboxID(mbox.mailbox.ID, parameters)
-	if err != nil {
-		return fmt.Errorf("couldn't get messages: %v", err)
-	}
+	// The messages are read in pages, so large mailboxes aren't loaded at once
+	err := mbox.messageRepo.ForEachMessageByMailboxID(mbox.mailbox.ID, parameters, func(message *models.Message) error {
 
-	log.Debugf("found %d messages in mailbox %q", len(messages), mbox.Name())
-
-	for _, message := range messages {
+		// The messages the session wasn't told about yet don't have a sequence number
+		seqNum := mbox.seqNum(message)
+		if seqNum == 0 {
+			return nil
+		}
 
-		msg := NewIMAPMessageFromMessage(message, mbox.messageRepo)
+		msg := NewIMAPMessageFromMessage(message, mbox.messageRepo, mbox.key)
 
-		m, err := msg.Fetch(uint32(message.SequenceNumber), items)
+		m, err := msg.Fetch(seqNum, items)
 		if err != nil {
 			log.Errorf("couldn't fetch message: %v", err)
-			continue
+			return nil
 		}
 
 		ch <- m
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't get messages: %v", err)
 	}
 
 	return nil
@@ -270,30 +292,41 @@ func (mbox *IMAPMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria)
 		return ids, nil
 	*/
 
+	// Only the messages that can't be matched in the database are matched against their bodies,
+	// e.g. when their header fields weren't extracted or their text isn't indexed
+	search, exact := searchCriteria(criteria, mbox.sessionUIDs)
 	parameters := models.FindMessagesParameters{
+		Search:   search,
 		OmitBody: true,
 	}
 
-	// TODO, yep this is not performant at all, but let's hope it works
 	messages, err := mbox.messageRepo.FindMessagesByMailboxID(mbox.mailbox.ID, parameters)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't search messages: %v", err)
 	}
-	var ids []uint32
-	for i, message := range messages {
-
-		msg := NewIMAPMessageFromMessage(message, mbox.messageRepo)
+	needsHeaders := search.NeedsHeaders()
+	needsText := search.NeedsText()
+	criteria = inclusiveSince(criteria)
 
-		seqNum := uint32(i + 1)
+	var ids []uint32
+	for _, message := range messages {
 
-		ok, err := msg.Match(seqNum, criteria)
-		if err != nil || !ok {
+		seqNum := mbox.seqNum(message)
+		if seqNum == 0 {
 			continue
 		}
 
+		if !exact || (needsHeaders && !message.Headers.Extracted) || (needsText && !message.TextIndexed) {
+			msg := NewIMAPMessageFromMessage(message, mbox.messageRepo, mbox.key)
+			ok, err := msg.Match(seqNum, criteria)
+			if err != nil || !ok {
+				continue
+			}
+		}
+
 		var id uint32
 		if uid {
-			id = uint32(msg.message.ID)
+			id = uint32(message.UID)
 		} else {
 			id = seqNum
 		}
@@ -326,7 +359,6 @@ func (mbox *IMAPMailbox) CreateMessage(flags []string, date time.Time, body imap
 	*/
 
 	message := &models.Message{
-		ID:    mbox.uidNext(),
 		Date:  date,
 		Size:  uint32(len(b)),
 		Flags: flags,
@@ -335,15 +367,35 @@ func (mbox *IMAPMailbox) CreateMessage(flags []string, date time.Time, body imap
 		MailboxID: mbox.mailbox.ID,
 	}
 
+	if mbox.key != nil {
+		message.Body, err = mbox.messageRepo.Compress(b)
+		if err == nil {
+			message.Body, err = encryption.Encrypt(mbox.key.PublicKey[:], message.Body)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't encrypt message: %v", err)
+		}
+		message.Encrypted = true
+	}
+
 	err = mbox.messageRepo.CreateMessage(message)
 	if err != nil {
 		return fmt.Errorf("couldn't create message: %v", err)
 	}
 
+	notifyExists(mbox.updater, mbox.messageRepo, mbox.username, mbox.mailbox)
+
 	return nil
 }
 
 func (mbox *IMAPMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	_, err := mbox.UpdateMessagesFlagsUnchangedSince(uid, seqset, op, flags, 0)
+	return err
+}
+
+// UpdateMessagesFlagsUnchangedSince updates the flags of the messages that didn't change after the mod-sequence,
+// or of all messages when it is 0. It returns the uids or sequence numbers of the messages that changed.
+func (mbox *IMAPMailbox) UpdateMessagesFlagsUnchangedSince(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string, unchangedSince uint64) ([]uint32, error) {
 
 	log.Debugf("UpdateMessagesFlags() %+v", op)
 
@@ -363,35 +415,27 @@ func (mbox *IMAPMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op i
 		}
 	*/
 
-	parameters := models.FindMessagesParameters{}
-
-	// TODO, yep this is not performant at all, but let's hope it works
-	messages, err := mbox.messageRepo.FindMessagesByMailboxID(mbox.mailbox.ID, parameters)
+	updated, changed, err := mbox.messageRepo.UpdateMessagesFlags(mbox.mailbox.ID, mbox.findParameters(uid, seqset), func(current []string) []string {
+		return backendutil.UpdateFlags(current, op, flags)
+	}, unchangedSince)
 	if err != nil {
-		return fmt.Errorf("couldn't update message flags: %v", err)
+		return nil, fmt.Errorf("couldn't update message flags: %v", err)
 	}
-	for i, message := range messages {
-
-		msg := NewIMAPMessageFromMessage(message, mbox.messageRepo)
 
-		var id uint32
+	modified := []uint32{}
+	for _, message := range changed {
 		if uid {
-			id = uint32(msg.message.ID)
-		} else {
-			id = uint32(i + 1)
-		}
-		if !seqset.Contains(id) {
-			continue
+			modified = append(modified, uint32(message.UID))
+		} else if seqNum := mbox.seqNum(message); seqNum != 0 {
+			modified = append(modified, seqNum)
 		}
+	}
 
-		msg.message.Flags = backendutil.UpdateFlags(msg.message.Flags, op, flags)
-		err = mbox.messageRepo.UpdateMessage(msg.message)
-		if err != nil {
-			return fmt.Errorf("couldn't update message flags: %v", err)
-		}
+	for _, message := range updated {
+		mbox.updater.flags(mbox.username, mbox.mailbox.Name, uint32(message.SequenceNumber), uint32(message.UID), message.Flags, message.ModSeq)
 	}
 
-	return nil
+	return modified, nil
 }
 
 func (mbox *IMAPMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
@@ -428,44 +472,19 @@ func (mbox *IMAPMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName st
 		mailbox:     destMailbox,
 		mailboxRepo: mbox.mailboxRepo,
 		messageRepo: mbox.messageRepo,
+		key:         mbox.key,
+		username:    mbox.username,
+		updater:     mbox.updater,
 	}
 
-	parameters := models.FindMessagesParameters{}
-
-	messages, err := mbox.messageRepo.FindMessagesByMailboxID(mbox.mailbox.ID, parameters)
+	// The copies refer to the same blob, so the bodies don't have to be loaded
+	copied, err := mbox.messageRepo.CopyMessages(mbox.mailbox.ID, mbox.findParameters(uid, seqset), dest.mailbox.ID)
 	if err != nil {
-		return fmt.Errorf("couldn't find messages: %v", err)
+		return fmt.Errorf("couldn't copy messages: %v", err)
 	}
 
-	messagesToCopy := []*models.Message{}
-	for i, msg := range messages {
-		var id uint32
-		if uid {
-			id = uint32(msg.ID)
-		} else {
-			id = uint32(i + 1)
-		}
-		if !seqset.Contains(id) {
-			continue
-		}
-
-		messagesToCopy = append(messagesToCopy, msg)
-	}
-
-	for _, message := range messagesToCopy {
-		m := models.Message{
-			ID:    dest.uidNext(),
-			Date:  message.Date,
-			Size:  message.Size,
-			Flags: message.Flags,
-			Body:  message.Body,
-
-			MailboxID: dest.mailbox.ID,
-		}
-		err = mbox.messageRepo.CreateMessage(&m)
-		if err != nil {
-			return fmt.Errorf("couldn't copy messages: %v", err)
-		}
+	if copied > 0 {
+		notifyExists(dest.updater, dest.messageRepo, dest.username, dest.mailbox)
 	}
 
 	return nil
@@ -494,36 +513,49 @@ func (mbox *IMAPMailbox) Expunge() error {
 	*/
 
 	parameters := models.FindMessagesParameters{
-		OmitBody: true,
+		Search: &models.SearchCriteria{WithFlags: []string{imap.DeletedFlag}},
 	}
 
-	// TODO, yep this is not performant at all, but let's hope it works
-	messages, err := mbox.messageRepo.FindMessagesByMailboxID(mbox.mailbox.ID, parameters)
+	deleted, err := mbox.messageRepo.DeleteMessages(mbox.mailbox.ID, parameters)
 	if err != nil {
-		return fmt.Errorf("couldn't find messages: %v", err)
+		return fmt.Errorf("couldn't delete messages: %v", err)
 	}
 
-	for i := len(messages) - 1; i >= 0; i-- {
-		msg := messages[i]
+	// The messages are announced from the last to the first, so the sequence numbers of the others don't change
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].SequenceNumber > deleted[j].SequenceNumber
+	})
+	for _, message := range deleted {
+		mbox.updater.expunge(mbox.username, mbox.mailbox.Name, uint32(message.SequenceNumber))
+	}
 
-		deleted := false
-		for _, flag := range msg.Flags {
-			if flag == imap.DeletedFlag {
-				deleted = true
-				break
-			}
-		}
+	return nil
+}
 
-		if deleted {
-			err := mbox.messageRepo.DeleteMessageByID(msg.ID)
-			if err != nil {
-				return fmt.Errorf("couldn't delete message: %v", err)
-			}
+// ExpungedSince returns the uids of the messages that were expunged after the mod-sequence,
+// and the highest mod-sequence of those expunges.
+func (mbox *IMAPMailbox) ExpungedSince(modSeq uint64) ([]uint32, uint64, error) {
+	expunged, err := mbox.messageRepo.FindExpungedMessages(mbox.mailbox.ID, modSeq)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't find expunged messages: %w", err)
+	}
 
+	uids := []uint32{}
+	for _, message := range expunged {
+		uids = append(uids, uint32(message.UID))
+		if message.ModSeq > modSeq {
+			modSeq = message.ModSeq
 		}
 	}
+	return uids, modSeq, nil
+}
 
-	return nil
+// setParameters returns the parameters to find the messages in the set of uids or sequence numbers.
+func setParameters(uid bool, seqSet *imap.SeqSet) models.FindMessagesParameters {
+	if uid {
+		return models.FindMessagesParameters{UIDSet: sequenceSetToSequencesSlice(seqSet)}
+	}
+	return models.FindMessagesParameters{SequenceSet: sequenceSetToSequencesSlice(seqSet)}
 }
 
 // sequenceSetToSequencesSlice converts a seqset from go-imap to a slice of Sequence from our own backend.
@@ -0,0 +1,118 @@
+package imapbackend
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailboxUIDs(t *testing.T) {
+
+	b := newTestBackend(t, "alice@example.com")
+	user, err := b.userRepo.FindUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	u := b.wrapUser(user)
+
+	inbox, err := u.GetMailbox("INBOX")
+	require.NoError(t, err)
+	junk, err := u.GetMailbox("Junk")
+	require.NoError(t, err)
+
+	// uids returns the uids of the messages in the mailbox.
+	uids := func(mbox backend.Mailbox) []uint32 {
+		seqSet, err := imap.ParseSeqSet("1:*")
+		require.NoError(t, err)
+		ch := make(chan *imap.Message, 10)
+		require.NoError(t, mbox.ListMessages(false, seqSet, []imap.FetchItem{imap.FetchUid}, ch))
+		uids := []uint32{}
+		for message := range ch {
+			uids = append(uids, message.Uid)
+		}
+		return uids
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString("Subject: Hello\r\n\r\nHello world!\r\n")))
+	}
+	require.NoError(t, junk.CreateMessage(nil, time.Now(), bytes.NewBufferString("Subject: Spam\r\n\r\nBuy now!\r\n")))
+	assert.Equal(t, []uint32{1, 2, 3}, uids(inbox))
+	assert.Equal(t, []uint32{1}, uids(junk))
+
+	t.Run("TestCopyMessages", func(t *testing.T) {
+		seqSet, err := imap.ParseSeqSet("2:3")
+		require.NoError(t, err)
+		require.NoError(t, inbox.CopyMessages(true, seqSet, "Junk"))
+		assert.Equal(t, []uint32{1, 2, 3}, uids(junk))
+	})
+
+	t.Run("TestStatus", func(t *testing.T) {
+		status, err := junk.Status([]imap.StatusItem{imap.StatusUidNext, imap.StatusUidValidity})
+		require.NoError(t, err)
+		assert.Equal(t, uint32(4), status.UidNext)
+		assert.NotZero(t, status.UidValidity)
+	})
+}
+
+func TestSearchMessages(t *testing.T) {
+
+	b := newTestBackend(t, "alice@example.com")
+	user, err := b.userRepo.FindUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	u := b.wrapUser(user)
+	inbox, err := u.GetMailbox("INBOX")
+	require.NoError(t, err)
+
+	date := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, inbox.CreateMessage(nil, date.AddDate(0, 0, -1), bytes.NewBufferString("From: bob@example.com\r\nSubject: Lunch\r\n\r\nPizza or pasta?\r\n")))
+	require.NoError(t, inbox.CreateMessage([]string{imap.SeenFlag}, date, bytes.NewBufferString("From: carol@example.com\r\nSubject: Re: Lunch\r\n\r\nPizza!\r\n")))
+	require.NoError(t, inbox.CreateMessage(nil, date.AddDate(0, 0, 1), bytes.NewBufferString("From: bob@example.com\r\nSubject: Dinner\r\n\r\nPasta tonight.\r\n")))
+
+	search := func(uid bool, criteria *imap.SearchCriteria) []uint32 {
+		ids, err := inbox.SearchMessages(uid, criteria)
+		require.NoError(t, err)
+		return ids
+	}
+	header := func(key, value string) *imap.SearchCriteria {
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Add(key, value)
+		return criteria
+	}
+
+	t.Run("TestDatabase", func(t *testing.T) {
+		assert.Equal(t, []uint32{1, 2}, search(false, header("Subject", "lunch")))
+		assert.Equal(t, []uint32{2}, search(true, &imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}}))
+		assert.Equal(t, []uint32{2, 3}, search(false, &imap.SearchCriteria{Since: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)}))
+		assert.Equal(t, []uint32{1, 2}, search(false, &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{header("From", "carol"), header("Subject", "lunch")}}}))
+	})
+
+	t.Run("TestBody", func(t *testing.T) {
+		assert.Equal(t, []uint32{1, 2}, search(false, &imap.SearchCriteria{Body: []string{"pizza"}}))
+		assert.Equal(t, []uint32{2}, search(false, &imap.SearchCriteria{Not: []*imap.SearchCriteria{{Body: []string{"pasta"}}}}))
+
+		criteria := header("From", "bob")
+		criteria.Body = []string{"pasta"}
+		criteria.Since = time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)
+		assert.Equal(t, []uint32{3}, search(true, criteria))
+	})
+
+	t.Run("TestBodyAndTextAreSubstrings", func(t *testing.T) {
+		// The subject is only in the header
+		assert.Empty(t, search(false, &imap.SearchCriteria{Body: []string{"lunch"}}))
+		assert.Equal(t, []uint32{1, 2}, search(false, &imap.SearchCriteria{Text: []string{"lunch"}}))
+
+		assert.Equal(t, []uint32{1, 2}, search(false, &imap.SearchCriteria{Body: []string{"IZZ"}}))
+		assert.Equal(t, []uint32{1}, search(false, &imap.SearchCriteria{Body: []string{"za or pas"}}))
+		assert.Empty(t, search(false, &imap.SearchCriteria{Body: []string{"pizza pasta"}}))
+		assert.Equal(t, []uint32{3}, search(false, &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{{Body: []string{"onigh"}}, {Text: []string{"re: lunch x"}}}}}))
+	})
+
+	t.Run("TestUnsearchableHeader", func(t *testing.T) {
+		assert.Equal(t, []uint32{1, 2, 3}, search(false, header("Subject", "")))
+		assert.Empty(t, search(false, header("X-Mailer", "")))
+	})
+}
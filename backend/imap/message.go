@@ -3,6 +3,7 @@ package imapbackend
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -10,18 +11,26 @@ import (
 	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/textproto"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
 	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/compression"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
 )
 
 type IMAPMessage struct {
 	message     *models.Message
 	messageRepo *models.MessageRepository
+
+	// key decrypts the body when the message is encrypted.
+	key       *encryption.Key
+	decrypted bool
 }
 
-func NewIMAPMessageFromMessage(message *models.Message, messageRepo *models.MessageRepository) IMAPMessage {
+func NewIMAPMessageFromMessage(message *models.Message, messageRepo *models.MessageRepository, key *encryption.Key) IMAPMessage {
 	return IMAPMessage{
 		message:     message,
 		messageRepo: messageRepo,
+		key:         key,
 	}
 }
 
@@ -30,7 +39,9 @@ func (m *IMAPMessage) entity() (*message.Entity, error) {
 }
 
 // loadBodyIfEmpty load the body if empty.
-// When the body isn't selected from the database, we need to get the message with its body
+// When the body isn't selected from the database, we need to get the message with its body.
+// Encrypted bodies are decrypted with the key that was unlocked at login and then decompressed,
+// other bodies are decompressed by the repository.
 func (m *IMAPMessage) loadBodyIfEmpty() error {
 	if m.message.Body == nil {
 		messageWithBody, err := m.messageRepo.GetMessageByID(m.message.ID)
@@ -40,6 +51,21 @@ func (m *IMAPMessage) loadBodyIfEmpty() error {
 		m.message.Body = messageWithBody.Body
 	}
 
+	if m.message.Encrypted && !m.decrypted {
+		if m.key == nil {
+			return fmt.Errorf("message is encrypted, but the key of the user isn't unlocked")
+		}
+		body, err := m.key.Decrypt(m.message.Body)
+		if err == nil {
+			body, err = compression.Decompress(body)
+		}
+		if err != nil {
+			return err
+		}
+		m.message.Body = body
+		m.decrypted = true
+	}
+
 	return nil
 }
 
@@ -50,31 +76,99 @@ func (m *IMAPMessage) headerAndBody() (textproto.Header, io.Reader, error) {
 	return hdr, body, err
 }
 
+// header returns the header of the message, from the stored header when it was extracted
+// so the body doesn't have to be loaded.
+func (m *IMAPMessage) header() (textproto.Header, error) {
+	if m.message.Headers.Raw != nil && !m.message.Encrypted {
+		return textproto.ReadHeader(bufio.NewReader(bytes.NewReader(m.message.Headers.Raw)))
+	}
+
+	err := m.loadBodyIfEmpty()
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	hdr, _, err := m.headerAndBody()
+	return hdr, err
+}
+
+// bodyStructure returns the body structure of the message, from the stored body structure when it was parsed
+// so the body doesn't have to be loaded.
+func (m *IMAPMessage) bodyStructure(extended bool) (*imap.BodyStructure, error) {
+	if m.message.BodyStructure != nil && !m.message.Encrypted {
+		var bs imap.BodyStructure
+		err := json.Unmarshal(m.message.BodyStructure, &bs)
+		if err == nil {
+			if !extended {
+				withoutExtensionData(&bs)
+			}
+			return &bs, nil
+		}
+	}
+
+	err := m.loadBodyIfEmpty()
+	if err != nil {
+		return nil, err
+	}
+	hdr, body, err := m.headerAndBody()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get header and body: %w", err)
+	}
+	bs, _ := backendutil.FetchBodyStructure(hdr, body, extended)
+	return bs, nil
+}
+
+// ParseBodyStructure parses the extended body structure of the message and serializes it as JSON, so it can be stored with the message.
+func ParseBodyStructure(message []byte) ([]byte, error) {
+	body := bufio.NewReader(bytes.NewReader(message))
+	hdr, err := textproto.ReadHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := backendutil.FetchBodyStructure(hdr, body, true)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(bs)
+}
+
+// withoutExtensionData removes the extension data from the body structure and its parts, for FETCH BODY.
+func withoutExtensionData(bs *imap.BodyStructure) {
+	bs.Extended = false
+	bs.Disposition = ""
+	bs.DispositionParams = nil
+	bs.Language = nil
+	bs.Location = nil
+	bs.MD5 = ""
+	for _, part := range bs.Parts {
+		withoutExtensionData(part)
+	}
+	if bs.BodyStructure != nil {
+		withoutExtensionData(bs.BodyStructure)
+	}
+}
+
+// isHeaderSection returns whether the section only refers to the header of the message.
+func isHeaderSection(section *imap.BodySectionName) bool {
+	return len(section.Path) == 0 && section.Specifier == imap.HeaderSpecifier
+}
+
 func (m *IMAPMessage) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
 
 	fetched := imap.NewMessage(seqNum, items)
 	for _, item := range items {
 		switch item {
 		case imap.FetchEnvelope:
-			err := m.loadBodyIfEmpty()
+			hdr, err := m.header()
 			if err != nil {
-				return nil, err
-			}
-			hdr, _, err := m.headerAndBody()
-			if err != nil {
-				return nil, fmt.Errorf("couldn't get header and body: %w", err)
+				return nil, fmt.Errorf("couldn't get header: %w", err)
 			}
 			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
 		case imap.FetchBody, imap.FetchBodyStructure:
-			err := m.loadBodyIfEmpty()
+			bs, err := m.bodyStructure(item == imap.FetchBodyStructure)
 			if err != nil {
 				return nil, err
 			}
-			hdr, body, err := m.headerAndBody()
-			if err != nil {
-				return nil, fmt.Errorf("couldn't get header and body: %w", err)
-			}
-			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+			fetched.BodyStructure = bs
 		case imap.FetchFlags:
 			fetched.Flags = m.message.Flags
 		case imap.FetchInternalDate:
@@ -82,17 +176,29 @@ func (m *IMAPMessage) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Messag
 		case imap.FetchRFC822Size:
 			fetched.Size = m.message.Size
 		case imap.FetchUid:
-			fetched.Uid = uint32(m.message.ID)
+			fetched.Uid = uint32(m.message.UID)
+		case modseq.FetchModSeq:
+			fetched.Items[item] = modseq.FormatModSeq(m.message.ModSeq)
 		default:
-			err := m.loadBodyIfEmpty()
-			if err != nil {
-				return nil, err
-			}
 			section, err := imap.ParseBodySectionName(item)
 			if err != nil {
 				break
 			}
 
+			if isHeaderSection(section) {
+				hdr, err := m.header()
+				if err != nil {
+					return nil, err
+				}
+				l, _ := backendutil.FetchBodySection(hdr, bytes.NewReader(nil), section)
+				fetched.Body[section] = l
+				break
+			}
+
+			err = m.loadBodyIfEmpty()
+			if err != nil {
+				return nil, err
+			}
 			body := bufio.NewReader(bytes.NewReader(m.message.Body))
 			hdr, err := textproto.ReadHeader(body)
 			if err != nil {
@@ -107,6 +213,8 @@ func (m *IMAPMessage) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Messag
 	return fetched, nil
 }
 
+// Match returns whether the message meets the criteria.
+// BODY and TEXT match the decoded text of the message, like the full-text index does.
 func (m *IMAPMessage) Match(seqNum uint32, c *imap.SearchCriteria) (bool, error) {
 
 	// Maybe only load body if searching trough body?
@@ -116,5 +224,46 @@ func (m *IMAPMessage) Match(seqNum uint32, c *imap.SearchCriteria) (bool, error)
 	}
 
 	e, _ := m.entity()
-	return backendutil.Match(e, seqNum, uint32(m.message.ID), m.message.Date, m.message.Flags, c)
+	return m.match(e, seqNum, c)
+}
+
+func (m *IMAPMessage) match(e *message.Entity, seqNum uint32, c *imap.SearchCriteria) (bool, error) {
+	criteria := *c
+	criteria.Body, criteria.Text, criteria.Not, criteria.Or = nil, nil, nil, nil
+	ok, err := backendutil.Match(e, seqNum, uint32(m.message.UID), m.message.Date, m.message.Flags, &criteria)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if len(c.Body) > 0 || len(c.Text) > 0 {
+		text := models.ParseMessageText(m.message.Body)
+		for _, body := range c.Body {
+			if !text.BodyContains(body) {
+				return false, nil
+			}
+		}
+		for _, t := range c.Text {
+			if !text.Contains(t) {
+				return false, nil
+			}
+		}
+	}
+
+	for _, not := range c.Not {
+		ok, err := m.match(e, seqNum, not)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	for _, or := range c.Or {
+		ok1, err := m.match(e, seqNum, or[0])
+		if err != nil {
+			return false, err
+		}
+		ok2, err := m.match(e, seqNum, or[1])
+		if err != nil || (!ok1 && !ok2) {
+			return false, err
+		}
+	}
+	return true, nil
 }
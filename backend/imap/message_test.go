@@ -0,0 +1,85 @@
+package imapbackend
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchMetadata(t *testing.T) {
+
+	b := newTestBackend(t, "alice@example.com")
+	user, err := b.userRepo.FindUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	u := b.wrapUser(user)
+	inbox, err := u.GetMailbox("INBOX")
+	require.NoError(t, err)
+
+	body := "From: Bob <bob@example.com>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: Photos\r\n" +
+		"Date: Sat, 2 Mar 2024 12:00:00 +0000\r\n" +
+		"Message-ID: <photos@example.com>\r\n" +
+		"In-Reply-To: <request@example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Here they are.\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: attachment; filename=photo.png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--b--\r\n"
+	require.NoError(t, inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)))
+
+	messages, err := b.messageRepo.FindMessagesByMailboxID(inbox.(*IMAPMailbox).mailbox.ID, models.FindMessagesParameters{OmitBody: true})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	message := messages[0]
+	assert.Equal(t, "<photos@example.com>", message.Headers.MessageID)
+	assert.Equal(t, "<request@example.com>", message.Headers.InReplyTo)
+	assert.NotNil(t, message.BodyStructure)
+
+	header, err := imap.ParseBodySectionName("BODY[HEADER.FIELDS (Subject)]")
+	require.NoError(t, err)
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchBody, imap.FetchBodyStructure, header.FetchItem()}
+
+	// The metadata is fetched without loading the body
+	stored := NewIMAPMessageFromMessage(message, b.messageRepo, nil)
+	fetchedStored, err := stored.Fetch(1, items)
+	require.NoError(t, err)
+	assert.Nil(t, message.Body)
+
+	// It is the same as when it is parsed from the body
+	parsed := NewIMAPMessageFromMessage(&models.Message{Body: []byte(body)}, b.messageRepo, nil)
+	fetchedParsed, err := parsed.Fetch(1, items)
+	require.NoError(t, err)
+
+	assert.Equal(t, fetchedParsed.Envelope.Format(), fetchedStored.Envelope.Format())
+	assert.Equal(t, "<photos@example.com>", fetchedStored.Envelope.MessageId)
+	assert.Equal(t, fetchedParsed.BodyStructure.Format(), fetchedStored.BodyStructure.Format())
+	assert.Equal(t, "attachment", fetchedStored.BodyStructure.Parts[1].Disposition)
+
+	body1, err := io.ReadAll(fetchedStored.GetBody(header))
+	require.NoError(t, err)
+	body2, err := io.ReadAll(fetchedParsed.GetBody(header))
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: Photos\r\n\r\n", string(body1))
+	assert.Equal(t, body2, body1)
+
+	// BODY doesn't have the extension data of BODYSTRUCTURE
+	fetchedBody, err := stored.Fetch(1, []imap.FetchItem{imap.FetchBody})
+	require.NoError(t, err)
+	assert.False(t, fetchedBody.BodyStructure.Extended)
+	assert.Empty(t, fetchedBody.BodyStructure.Parts[1].Disposition)
+}
@@ -0,0 +1,70 @@
+// Package modseq contains the mailbox interfaces and items of the CONDSTORE and QRESYNC extensions (RFC 7162)
+// that the IMAP backend implements and the extension of the IMAP server uses.
+package modseq
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+const (
+	// FetchModSeq is the fetch item with the mod-sequence of a message.
+	FetchModSeq imap.FetchItem = "MODSEQ"
+	// StatusHighestModSeq is the status item with the highest mod-sequence of a mailbox.
+	StatusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+)
+
+// Mailbox is a mailbox that keeps a mod-sequence for every message.
+// It lists the mod-sequences of the messages with the MODSEQ fetch item and its highest mod-sequence
+// with the HIGHESTMODSEQ status item.
+type Mailbox interface {
+	backend.Mailbox
+
+	// HighestModSeq returns the mod-sequence of the last change in the mailbox.
+	HighestModSeq() (uint64, error)
+
+	// ListMessagesChangedSince is like ListMessages, but only lists the messages that changed after the mod-sequence.
+	ListMessagesChangedSince(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error
+
+	// UpdateMessagesFlagsUnchangedSince is like UpdateMessagesFlags, but leaves the messages that changed
+	// after the mod-sequence alone. It returns their uids or sequence numbers.
+	UpdateMessagesFlagsUnchangedSince(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string, unchangedSince uint64) ([]uint32, error)
+
+	// ExpungedSince returns the uids of the messages that were expunged after the mod-sequence,
+	// and the highest mod-sequence of those expunges.
+	ExpungedSince(modSeq uint64) ([]uint32, uint64, error)
+}
+
+// SessionMailbox is a mailbox that numbers its messages for the session that selected it (RFC 3501 section 2.3.1.2).
+// The sequence numbers only change when the session is told about new and expunged messages,
+// so they stay the same while other sessions add and expunge messages.
+type SessionMailbox interface {
+	Mailbox
+
+	// Select numbers the messages for the session that selects the mailbox with SELECT or EXAMINE,
+	// before the status with their number is read. The status of a mailbox that isn't selected is counted in the database.
+	Select() error
+
+	// SyncExpunged removes the messages that were expunged since the session was told last.
+	// It returns their sequence numbers from the last to the first, and their uids.
+	SyncExpunged() ([]uint32, []uint32, error)
+
+	// SyncExists adds the messages that were added since the session was told last,
+	// and returns the number of messages for the session.
+	SyncExists() (uint32, error)
+
+	// SeqNum returns the sequence number of the message with the uid for the session, or 0 when the session doesn't know it.
+	SeqNum(uid uint32) uint32
+}
+
+// FormatModSeq formats a mod-sequence as the value of the MODSEQ fetch item.
+func FormatModSeq(modSeq uint64) interface{} {
+	return []interface{}{imap.RawString(strconv.FormatUint(modSeq, 10))}
+}
+
+// FormatHighestModSeq formats a mod-sequence as the value of the HIGHESTMODSEQ status item.
+func FormatHighestModSeq(modSeq uint64) interface{} {
+	return imap.RawString(strconv.FormatUint(modSeq, 10))
+}
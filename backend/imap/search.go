@@ -0,0 +1,126 @@
+package imapbackend
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/mistralmail/mistralmail/backend/models"
+)
+
+// searchCriteria converts the IMAP search criteria into criteria messages can be found with in the database.
+// The criteria that can't be searched for in the database are left out, so more messages might be found.
+// It returns whether nothing was left out.
+// The text of the body and header fields is only looked up in the full-text index to find fewer messages,
+// the index matches words and the start of words while the messages have to contain the text.
+// The sequence numbers are translated into uids by sessionUIDs, unless it returns nil.
+func searchCriteria(c *imap.SearchCriteria, sessionUIDs func(seqSet *imap.SeqSet) []models.Sequence) (*models.SearchCriteria, bool) {
+	exact := true
+	criteria := &models.SearchCriteria{
+		Since:        c.Since,
+		Before:       c.Before,
+		SentSince:    c.SentSince,
+		SentBefore:   c.SentBefore,
+		WithFlags:    c.WithFlags,
+		WithoutFlags: c.WithoutFlags,
+		Larger:       c.Larger,
+		Smaller:      c.Smaller,
+	}
+	if c.SeqNum != nil {
+		criteria.UIDSet = sessionUIDs(c.SeqNum)
+		if criteria.UIDSet == nil {
+			criteria.SequenceSet = sequenceSetToSequencesSlice(c.SeqNum)
+		}
+	}
+	if c.Uid != nil {
+		uids := sequenceSetToSequencesSlice(c.Uid)
+		if criteria.UIDSet != nil {
+			uids = intersectSequences(criteria.UIDSet, uids)
+		}
+		criteria.UIDSet = uids
+	}
+
+	if len(c.Body) > 0 || len(c.Text) > 0 {
+		exact = false
+	}
+	for _, text := range c.Body {
+		if words := models.SubstringWords(text); len(words) > 0 {
+			criteria.Body = append(criteria.Body, strings.Join(words, " "))
+		}
+	}
+	for _, text := range c.Text {
+		if words := models.SubstringWords(text); len(words) > 0 {
+			criteria.Text = append(criteria.Text, strings.Join(words, " "))
+		}
+	}
+
+	for key, values := range c.Header {
+		searchable := models.IsSearchableHeaderField(key)
+		for _, value := range values {
+			// An empty value only requires the field to be present, even when it's empty
+			if !searchable || value == "" {
+				exact = false
+				continue
+			}
+			if criteria.Headers == nil {
+				criteria.Headers = map[string][]string{}
+			}
+			criteria.Headers[key] = append(criteria.Headers[key], value)
+		}
+	}
+
+	// Leaving out criteria the messages may not meet would find fewer messages, so those are left out completely
+	for _, not := range c.Not {
+		notCriteria, notExact := searchCriteria(not, sessionUIDs)
+		if !notExact {
+			exact = false
+			continue
+		}
+		criteria.Not = append(criteria.Not, notCriteria)
+	}
+	for _, or := range c.Or {
+		criteria1, exact1 := searchCriteria(or[0], sessionUIDs)
+		criteria2, exact2 := searchCriteria(or[1], sessionUIDs)
+		exact = exact && exact1 && exact2
+		criteria.Or = append(criteria.Or, [2]*models.SearchCriteria{criteria1, criteria2})
+	}
+
+	return criteria, exact
+}
+
+// intersectSequences returns the sequences of the numbers that are in both lists of sequences, a Stop of 0 is unbounded.
+func intersectSequences(a, b []models.Sequence) []models.Sequence {
+	sequences := []models.Sequence{}
+	for _, x := range a {
+		for _, y := range b {
+			start, stop := x.Start, x.Stop
+			if y.Start > start {
+				start = y.Start
+			}
+			if stop == 0 || (y.Stop != 0 && y.Stop < stop) {
+				stop = y.Stop
+			}
+			if stop == 0 || start <= stop {
+				sequences = append(sequences, models.Sequence{Start: start, Stop: stop})
+			}
+		}
+	}
+	return sequences
+}
+
+// inclusiveSince returns a copy of the criteria that can be matched by backendutil, which doesn't include
+// the day of SINCE in contrast to RFC 3501 and the search in the database.
+func inclusiveSince(c *imap.SearchCriteria) *imap.SearchCriteria {
+	criteria := *c
+	if !c.Since.IsZero() {
+		criteria.Since = c.Since.AddDate(0, 0, -1)
+	}
+	criteria.Not = nil
+	for _, not := range c.Not {
+		criteria.Not = append(criteria.Not, inclusiveSince(not))
+	}
+	criteria.Or = nil
+	for _, or := range c.Or {
+		criteria.Or = append(criteria.Or, [2]*imap.SearchCriteria{inclusiveSince(or[0]), inclusiveSince(or[1])})
+	}
+	return &criteria
+}
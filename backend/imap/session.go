@@ -0,0 +1,216 @@
+package imapbackend
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+	"github.com/mistralmail/mistralmail/backend/models"
+)
+
+// The mailboxes number their messages for the session that selected them.
+var _ modseq.SessionMailbox = (*IMAPMailbox)(nil)
+
+// session keeps the uids of the messages of a mailbox the way the session that selected it knows them,
+// the sequence number of a message is its position in the uids (RFC 3501 section 2.3.1.2).
+// The sequence numbers only change when the session is told about new and expunged messages,
+// so they stay the same while other sessions add and expunge messages.
+type session struct {
+	mu sync.Mutex
+	// loaded denotes that the mailbox was selected with SELECT or EXAMINE.
+	// Until then the messages are numbered the way they are in the database.
+	loaded bool
+	uids   []uint32
+	// expungedSince is the highest mod-sequence of the expunges the session knows of.
+	expungedSince uint64
+}
+
+// seqNum returns the sequence number of the message with the uid, or 0 when the session doesn't know it.
+func (s *session) seqNum(uid uint32) uint32 {
+	i := sort.Search(len(s.uids), func(i int) bool { return s.uids[i] >= uid })
+	if i == len(s.uids) || s.uids[i] != uid {
+		return 0
+	}
+	return uint32(i + 1)
+}
+
+// uidSequences translates the sequence numbers into the ranges of the uids of those messages.
+// The messages between the first and the last uid of a range are the ones in between for the session,
+// since the messages that were added later have higher uids.
+func (s *session) uidSequences(seqSet *imap.SeqSet) []models.Sequence {
+	count := uint32(len(s.uids))
+	sequences := []models.Sequence{}
+	for _, seq := range seqSet.Set {
+		// * is the last message (RFC 3501 section 9)
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = count
+		}
+		if stop == 0 {
+			stop = count
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start == 0 || start > count {
+			continue
+		}
+		if stop > count {
+			stop = count
+		}
+		sequences = append(sequences, models.Sequence{Start: int(s.uids[start-1]), Stop: int(s.uids[stop-1])})
+	}
+	return sequences
+}
+
+// lockSession locks the session and numbers the messages first when that didn't happen yet.
+// The highest mod-sequence is read before the uids, so no expunge is missed.
+func (mbox *IMAPMailbox) lockSession() (*session, error) {
+	s := mbox.session
+	s.mu.Lock()
+	if s.loaded {
+		return s, nil
+	}
+
+	expungedSince, err := mbox.HighestModSeq()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	uids, err := mbox.messageRepo.FindUIDsByMailboxID(mbox.mailbox.ID, 0)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("couldn't number messages: %w", err)
+	}
+	s.uids = make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		s.uids = append(s.uids, uint32(uid))
+	}
+	s.expungedSince = expungedSince
+	s.loaded = true
+	return s, nil
+}
+
+// Select numbers the messages for the session that selects the mailbox.
+func (mbox *IMAPMailbox) Select() error {
+	s, err := mbox.lockSession()
+	if err != nil {
+		return err
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// selected returns whether the messages are numbered for the session.
+func (mbox *IMAPMailbox) selected() bool {
+	if mbox.session == nil {
+		return false
+	}
+	mbox.session.mu.Lock()
+	defer mbox.session.mu.Unlock()
+	return mbox.session.loaded
+}
+
+// findParameters returns the parameters to find the messages in the set of uids or sequence numbers,
+// the sequence numbers of the session are translated into uids.
+func (mbox *IMAPMailbox) findParameters(uid bool, seqSet *imap.SeqSet) models.FindMessagesParameters {
+	if !uid {
+		if uids := mbox.sessionUIDs(seqSet); uids != nil {
+			return models.FindMessagesParameters{UIDSet: uids}
+		}
+	}
+	return setParameters(uid, seqSet)
+}
+
+// sessionUIDs returns the ranges of uids of the messages with the sequence numbers of the session,
+// or nil when the messages are numbered the way they are in the database.
+func (mbox *IMAPMailbox) sessionUIDs(seqSet *imap.SeqSet) []models.Sequence {
+	if !mbox.selected() {
+		return nil
+	}
+	s, err := mbox.lockSession()
+	if err != nil {
+		return nil
+	}
+	defer s.mu.Unlock()
+	return s.uidSequences(seqSet)
+}
+
+// seqNum returns the sequence number of the message for the session, or 0 when the session doesn't know it.
+func (mbox *IMAPMailbox) seqNum(message *models.Message) uint32 {
+	if !mbox.selected() {
+		return uint32(message.SequenceNumber)
+	}
+	return mbox.SeqNum(uint32(message.UID))
+}
+
+// SeqNum returns the sequence number of the message with the uid for the session, or 0 when the session doesn't know it.
+func (mbox *IMAPMailbox) SeqNum(uid uint32) uint32 {
+	s, err := mbox.lockSession()
+	if err != nil {
+		return 0
+	}
+	defer s.mu.Unlock()
+	return s.seqNum(uid)
+}
+
+// SyncExpunged removes the messages that were expunged since the session was told last.
+// It returns their sequence numbers from the last to the first, and their uids.
+func (mbox *IMAPMailbox) SyncExpunged() ([]uint32, []uint32, error) {
+	s, err := mbox.lockSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.mu.Unlock()
+
+	expunged, modSeq, err := mbox.ExpungedSince(s.expungedSince)
+	if err != nil {
+		return nil, nil, err
+	}
+	gone := map[uint32]bool{}
+	for _, uid := range expunged {
+		gone[uid] = true
+	}
+
+	seqNums := []uint32{}
+	uids := []uint32{}
+	kept := s.uids[:0]
+	for i, uid := range s.uids {
+		if gone[uid] {
+			seqNums = append(seqNums, uint32(i+1))
+			uids = append(uids, uid)
+			continue
+		}
+		kept = append(kept, uid)
+	}
+	// The sequence numbers of the other expunged messages don't change when the last one is reported first
+	sort.Slice(seqNums, func(i, j int) bool { return seqNums[i] > seqNums[j] })
+	s.uids = kept
+	s.expungedSince = modSeq
+	return seqNums, uids, nil
+}
+
+// SyncExists adds the messages that were added since the session was told last,
+// and returns the number of messages for the session.
+func (mbox *IMAPMailbox) SyncExists() (uint32, error) {
+	s, err := mbox.lockSession()
+	if err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	last := uint(0)
+	if len(s.uids) > 0 {
+		last = uint(s.uids[len(s.uids)-1])
+	}
+	uids, err := mbox.messageRepo.FindUIDsByMailboxID(mbox.mailbox.ID, last)
+	if err != nil {
+		return 0, err
+	}
+	for _, uid := range uids {
+		s.uids = append(s.uids, uint32(uid))
+	}
+	return uint32(len(s.uids)), nil
+}
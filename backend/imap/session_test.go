@@ -0,0 +1,118 @@
+package imapbackend
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionSequenceNumbers(t *testing.T) {
+
+	b := newTestBackend(t, "alice@example.com")
+	user, err := b.userRepo.FindUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	u := b.wrapUser(user)
+
+	inbox, err := u.GetMailbox("INBOX")
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(fmt.Sprintf("Subject: Message %d\r\n\r\nHello!\r\n", i))))
+	}
+
+	// Two sessions select the mailbox
+	sessions := []backend.Mailbox{}
+	for i := 0; i < 2; i++ {
+		mbox, err := u.GetMailbox("INBOX")
+		require.NoError(t, err)
+		require.NoError(t, mbox.(*IMAPMailbox).Select())
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		require.NoError(t, err)
+		assert.Equal(t, uint32(5), status.Messages)
+		sessions = append(sessions, mbox)
+	}
+	first, second := sessions[0].(*IMAPMailbox), sessions[1].(*IMAPMailbox)
+
+	// fetch returns the sequence numbers and uids of the messages in the set for the session.
+	fetch := func(mbox backend.Mailbox, set string) [][2]uint32 {
+		seqSet, err := imap.ParseSeqSet(set)
+		require.NoError(t, err)
+		ch := make(chan *imap.Message, 10)
+		require.NoError(t, mbox.ListMessages(false, seqSet, []imap.FetchItem{imap.FetchUid}, ch))
+		messages := [][2]uint32{}
+		for message := range ch {
+			messages = append(messages, [2]uint32{message.SeqNum, message.Uid})
+		}
+		return messages
+	}
+
+	// The second session expunges the second and fourth message
+	seqSet, err := imap.ParseSeqSet("2,4")
+	require.NoError(t, err)
+	require.NoError(t, second.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag}))
+	require.NoError(t, second.Expunge())
+
+	t.Run("TestNumbersDontChangeUntilTheSessionIsTold", func(t *testing.T) {
+		assert.Equal(t, [][2]uint32{{3, 3}, {5, 5}}, fetch(first, "3:*"))
+		assert.Equal(t, [][2]uint32{{5, 5}}, fetch(first, "*"))
+
+		ids, err := first.SearchMessages(false, imap.NewSearchCriteria())
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{1, 3, 5}, ids)
+	})
+
+	t.Run("TestExpungesAreReportedFromTheLastToTheFirst", func(t *testing.T) {
+		for _, mbox := range []*IMAPMailbox{first, second} {
+			seqNums, uids, err := mbox.SyncExpunged()
+			require.NoError(t, err)
+			assert.Equal(t, []uint32{4, 2}, seqNums)
+			assert.Equal(t, []uint32{2, 4}, uids)
+		}
+		assert.Equal(t, [][2]uint32{{1, 1}, {2, 3}, {3, 5}}, fetch(first, "1:*"))
+
+		// They are only reported once
+		seqNums, _, err := first.SyncExpunged()
+		require.NoError(t, err)
+		assert.Empty(t, seqNums)
+	})
+
+	t.Run("TestNewMessagesAreNumberedWhenTheSessionIsTold", func(t *testing.T) {
+		require.NoError(t, second.CreateMessage(nil, time.Now(), bytes.NewBufferString("Subject: New\r\n\r\nHello!\r\n")))
+		assert.Equal(t, [][2]uint32{{3, 5}}, fetch(first, "3:*"))
+		assert.Zero(t, first.SeqNum(6))
+
+		// STATUS doesn't number the messages, it counts them
+		mbox, err := u.GetMailbox("INBOX")
+		require.NoError(t, err)
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		require.NoError(t, err)
+		assert.Equal(t, uint32(4), status.Messages)
+		assert.False(t, mbox.(*IMAPMailbox).selected())
+		status, err = first.Status([]imap.StatusItem{imap.StatusMessages})
+		require.NoError(t, err)
+		assert.Equal(t, uint32(3), status.Messages)
+
+		count, err := first.SyncExists()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(4), count)
+		assert.Equal(t, [][2]uint32{{3, 5}, {4, 6}}, fetch(first, "3:*"))
+		assert.Empty(t, fetch(first, "5:7"))
+	})
+
+	t.Run("TestSearchSequenceNumbers", func(t *testing.T) {
+		criteria := imap.NewSearchCriteria()
+		criteria.SeqNum, err = imap.ParseSeqSet("2:*")
+		require.NoError(t, err)
+		criteria.Uid, err = imap.ParseSeqSet("1:5")
+		require.NoError(t, err)
+
+		ids, err := first.SearchMessages(true, criteria)
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{3, 5}, ids)
+	})
+}
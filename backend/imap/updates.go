@@ -0,0 +1,97 @@
+package imapbackend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+)
+
+// UpdateTimeout is how long a change waits for the IMAP servers to pass its update on to the sessions.
+const UpdateTimeout = 5 * time.Second
+
+// updater publishes the changes of mailboxes to the IMAP servers, which notify every session
+// of the user that has the mailbox selected, e.g. while it is idling.
+//
+// Every IMAP server that serves the backend subscribes with Updates and gets its own copy of the updates,
+// since an update can only be broadcast once.
+type updater struct {
+	mu          sync.Mutex
+	subscribers []chan backend.Update
+}
+
+// Updates subscribes to the updates.
+func (u *updater) Updates() <-chan backend.Update {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ch := make(chan backend.Update)
+	u.subscribers = append(u.subscribers, ch)
+	return ch
+}
+
+// listening returns whether there are subscribers, so the updates don't have to be created when nobody listens.
+func (u *updater) listening() bool {
+	if u == nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.subscribers) > 0
+}
+
+// publish sends an update to every subscriber and waits until it was sent to the sessions,
+// so the untagged responses are sent before the command that caused them completes.
+func (u *updater) publish(newUpdate func() backend.Update) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	subscribers := u.subscribers
+	u.mu.Unlock()
+
+	for _, ch := range subscribers {
+		update := newUpdate()
+		done := update.Done()
+
+		timeout := time.NewTimer(UpdateTimeout)
+		select {
+		case ch <- update:
+			select {
+			case <-done:
+			case <-timeout.C:
+			}
+		case <-timeout.C:
+		}
+		timeout.Stop()
+	}
+}
+
+// exists notifies the sessions of the new number of messages in the mailbox.
+func (u *updater) exists(username string, mailbox string, messages uint32) {
+	u.publish(func() backend.Update {
+		status := imap.NewMailboxStatus(mailbox, []imap.StatusItem{imap.StatusMessages})
+		status.Messages = messages
+		return &backend.MailboxUpdate{Update: backend.NewUpdate(username, mailbox), MailboxStatus: status}
+	})
+}
+
+// flags notifies the sessions of the new flags of a message.
+// The mod-sequence is always included, sessions that use CONDSTORE need it and the others ignore it.
+func (u *updater) flags(username string, mailbox string, seqNum uint32, uid uint32, flags []string, modSeq uint64) {
+	u.publish(func() backend.Update {
+		message := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid, modseq.FetchModSeq})
+		message.Flags = flags
+		message.Uid = uid
+		message.Items[modseq.FetchModSeq] = modseq.FormatModSeq(modSeq)
+		return &backend.MessageUpdate{Update: backend.NewUpdate(username, mailbox), Message: message}
+	})
+}
+
+// expunge notifies the sessions that a message was removed from the mailbox.
+func (u *updater) expunge(username string, mailbox string, seqNum uint32) {
+	u.publish(func() backend.Update {
+		return &backend.ExpungeUpdate{Update: backend.NewUpdate(username, mailbox), SeqNum: seqNum}
+	})
+}
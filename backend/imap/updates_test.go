@@ -0,0 +1,115 @@
+package imapbackend
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdates(t *testing.T) {
+
+	b := newTestBackend(t, "alice@example.com")
+	updates := b.Updates()
+
+	// run runs the change and returns the updates it published.
+	run := func(change func() error) []backend.Update {
+		errs := make(chan error, 1)
+		go func() { errs <- change() }()
+
+		received := []backend.Update{}
+		for {
+			select {
+			case update := <-updates:
+				assert.Equal(t, "alice@example.com", update.Username())
+				assert.Equal(t, "INBOX", update.Mailbox())
+				received = append(received, update)
+				close(update.Done())
+			case err := <-errs:
+				require.NoError(t, err)
+				return received
+			case <-time.After(UpdateTimeout):
+				t.Fatal("change didn't complete")
+			}
+		}
+	}
+
+	user, err := b.userRepo.FindUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	u := b.wrapUser(user)
+	mbox, err := u.GetMailbox("INBOX")
+	require.NoError(t, err)
+
+	t.Run("TestAddMail", func(t *testing.T) {
+		received := run(func() error {
+			_, err := b.AddMail(&smtp.State{
+				From: &smtp.MailAddress{Address: "bob@example.net"},
+				To:   []*smtp.MailAddress{{Address: "alice@example.com"}},
+				Data: []byte("Subject: Hello\r\n\r\nHello world!\r\n"),
+			})
+			return err
+		})
+		require.Len(t, received, 1)
+		update, ok := received[0].(*backend.MailboxUpdate)
+		require.True(t, ok)
+		assert.Equal(t, uint32(1), update.Messages)
+	})
+
+	t.Run("TestCreateMessage", func(t *testing.T) {
+		received := run(func() error {
+			return mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString("Subject: Appended\r\n\r\nHello!\r\n"))
+		})
+		require.Len(t, received, 1)
+		update, ok := received[0].(*backend.MailboxUpdate)
+		require.True(t, ok)
+		assert.Equal(t, uint32(2), update.Messages)
+	})
+
+	t.Run("TestUpdateMessagesFlags", func(t *testing.T) {
+		seqSet, err := imap.ParseSeqSet("1")
+		require.NoError(t, err)
+		received := run(func() error {
+			return mbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+		})
+		require.Len(t, received, 1)
+		update, ok := received[0].(*backend.MessageUpdate)
+		require.True(t, ok)
+		assert.Equal(t, uint32(1), update.SeqNum)
+		assert.Equal(t, []string{imap.DeletedFlag}, update.Flags)
+	})
+
+	t.Run("TestExpunge", func(t *testing.T) {
+		received := run(mbox.Expunge)
+		require.Len(t, received, 1)
+		update, ok := received[0].(*backend.ExpungeUpdate)
+		require.True(t, ok)
+		assert.Equal(t, uint32(1), update.SeqNum)
+	})
+
+}
+
+func TestUpdatesForEverySubscriber(t *testing.T) {
+
+	u := &updater{}
+	first := u.Updates()
+	second := u.Updates()
+
+	done := make(chan struct{})
+	go func() {
+		u.expunge("alice@example.com", "INBOX", 3)
+		close(done)
+	}()
+
+	// Every subscriber gets its own update, which can be marked as done separately
+	for _, ch := range []<-chan backend.Update{first, second} {
+		update := <-ch
+		assert.Equal(t, uint32(3), update.(*backend.ExpungeUpdate).SeqNum)
+		close(update.Done())
+	}
+	<-done
+}
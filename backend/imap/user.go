@@ -5,6 +5,7 @@ import (
 
 	"github.com/emersion/go-imap/backend"
 	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
 )
 
 // IMAPUser implements the emersion/go-imap User interface.
@@ -13,6 +14,11 @@ type IMAPUser struct {
 	user        *models.User
 	mailboxRepo *models.MailboxRepository
 	messageRepo *models.MessageRepository
+
+	// key is the unlocked key of a user with encryption enabled, for the duration of the session.
+	key *encryption.Key
+
+	updater *updater
 }
 
 func (u *IMAPUser) Username() string {
@@ -105,11 +111,16 @@ func (u *IMAPUser) DeleteMailbox(name string) error {
 		return fmt.Errorf("Cannot delete INBOX")
 	}
 
-	_, err := u.mailboxRepo.GetMailBoxByUserIDAndMailboxName(u.user.ID, name)
+	mailbox, err := u.mailboxRepo.GetMailBoxByUserIDAndMailboxName(u.user.ID, name)
 	if err != nil {
 		return fmt.Errorf("couldn't find mailbox: %w", err)
 	}
 
+	err = u.messageRepo.DeleteMessagesByMailboxID(mailbox.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't delete messages of mailbox: %w", err)
+	}
+
 	err = u.mailboxRepo.DeleteMailboxByUserIDAndMailboxName(u.user.ID, name)
 	if err != nil {
 		return fmt.Errorf("couldn't delete mailbox: %w", err)
@@ -162,5 +173,9 @@ func (u *IMAPUser) wrapMailbox(mailbox *models.Mailbox) IMAPMailbox {
 		mailbox:     mailbox,
 		mailboxRepo: u.mailboxRepo,
 		messageRepo: u.messageRepo,
+		key:         u.key,
+		username:    u.user.Username,
+		updater:     u.updater,
+		session:     &session{},
 	}
 }
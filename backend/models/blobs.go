@@ -0,0 +1,535 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend/services/compression"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxBlobAttempts is how many times storing a message is tried when its blob is collected at the same time.
+	maxBlobAttempts = 5
+	// blobRetryDelay is the time between those attempts.
+	blobRetryDelay = 100 * time.Millisecond
+)
+
+// errBlobCollected is returned when a blob is being deleted while a new reference to it is added.
+var errBlobCollected = errors.New("blob is being collected")
+
+// Blob refers to the content of a message, it is stored once and shared by all messages with the same content.
+type Blob struct {
+	// Hash is the hex encoded SHA-256 hash of the data.
+	Hash string `gorm:"primaryKey;size:64"`
+	// Store is the name of the BlobStore that contains the data.
+	Store string `gorm:"size:255"`
+	// RefCount is the number of messages that point to the blob.
+	// It is -1 while the blob is being deleted.
+	RefCount int64 `gorm:"not_null"`
+}
+
+// blobHash returns the content address of the data.
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetBlobStores sets the store new blobs are written to.
+// The other stores still contain blobs, e.g. while they are moved to the new store, and are only read from.
+// Blobs in the database can always be read.
+func (r *MessageRepository) SetBlobStores(store BlobStore, others ...BlobStore) {
+	r.blobStore = store
+	r.blobStores = map[string]BlobStore{DatabaseBlobStoreName: NewDatabaseBlobStore(r.db)}
+	for _, other := range append(others, store) {
+		r.blobStores[other.Name()] = other
+	}
+}
+
+// getBlobStore returns the store with the given name.
+func (r *MessageRepository) getBlobStore(name string) (BlobStore, error) {
+	store, ok := r.blobStores[name]
+	if !ok {
+		return nil, fmt.Errorf("blob store %q isn't configured", name)
+	}
+	return store, nil
+}
+
+// createMessage stores the blob of the message and creates the message.
+// When create is set it is called within the same transaction to create the message instead.
+func (r *MessageRepository) createMessage(message *Message, create func(tx *gorm.DB) error) error {
+	if create == nil {
+		create = func(tx *gorm.DB) error {
+			return insertMessage(tx, message)
+		}
+	}
+
+	// A copy refers to the blob of the original message, which can't be deleted in the meantime
+	isCopy := message.BlobHash != ""
+	if !isCopy && !bytes.HasPrefix(message.Body, message.Prefix) {
+		return fmt.Errorf("the body of the message doesn't start with its prefix")
+	}
+
+	// A copy has the metadata and text of the original message, those of encrypted messages aren't stored unencrypted
+	var text *MessageText
+	if !isCopy {
+		r.extractMetadata(message)
+		text, message.TextIndexed = r.indexableText(message)
+	}
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		store := ""
+		if !isCopy {
+			message.BlobHash, store, err = r.putBlob(message.Body[len(message.Prefix):], !message.Encrypted)
+		}
+		if err == nil {
+			err = r.db.Transaction(func(tx *gorm.DB) error {
+				err := referenceBlob(tx, message.BlobHash, store)
+				if err != nil {
+					return err
+				}
+				err = create(tx)
+				if err != nil {
+					return err
+				}
+				return r.indexText(tx, message, isCopy, text)
+			})
+		}
+
+		if isCopy || !errors.Is(err, errBlobCollected) || attempt == maxBlobAttempts {
+			return err
+		}
+		time.Sleep(blobRetryDelay)
+	}
+}
+
+// putBlob writes the data to the blob store unless a blob with the same content exists already.
+// It returns the name of the store when the data was written.
+// The hash is that of the uncompressed data, so compressed and uncompressed blobs with the same content are shared.
+// This happens outside of the transaction that creates the message, so the database isn't locked while uploading.
+func (r *MessageRepository) putBlob(data []byte, compress bool) (string, string, error) {
+	hash := blobHash(data)
+
+	var blobs []*Blob
+	err := r.db.Where("hash = ?", hash).Limit(1).Find(&blobs).Error
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't find blob: %w", err)
+	}
+	if len(blobs) > 0 {
+		if blobs[0].RefCount < 0 {
+			return "", "", errBlobCollected
+		}
+		return hash, "", nil
+	}
+
+	if compress {
+		data, err = r.Compress(data)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	err = r.blobStore.Put(hash, data)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't store blob: %w", err)
+	}
+	return hash, r.blobStore.Name(), nil
+}
+
+// referenceBlob adds a reference to the blob.
+// When the data was just written to a store, the blob is created if it doesn't exist.
+func referenceBlob(tx *gorm.DB, hash string, store string) error {
+	result := tx.Model(&Blob{}).Where("hash = ? AND ref_count >= 0", hash).UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+	if result.Error != nil {
+		return fmt.Errorf("couldn't reference blob: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+	if store == "" {
+		// The blob existed before, but is being deleted now
+		return fmt.Errorf("couldn't reference blob %s: %w", hash, errBlobCollected)
+	}
+
+	err := tx.Create(&Blob{Hash: hash, Store: store, RefCount: 1}).Error
+	if err != nil {
+		// Another transaction created or is deleting the blob, the next attempt will find out
+		return fmt.Errorf("couldn't create blob: %v: %w", err, errBlobCollected)
+	}
+	return nil
+}
+
+// referenceBlobCopies adds references to a blob that is already referenced by the messages that are copied.
+func referenceBlobCopies(tx *gorm.DB, hash string, count int) error {
+	result := tx.Model(&Blob{}).Where("hash = ? AND ref_count >= 0", hash).UpdateColumn("ref_count", gorm.Expr("ref_count + ?", count))
+	if result.Error != nil {
+		return fmt.Errorf("couldn't reference blob: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("couldn't reference blob %s: %w", hash, errBlobCollected)
+	}
+	return nil
+}
+
+// releaseBlob removes a reference to the blob.
+func releaseBlob(tx *gorm.DB, hash string) error {
+	return releaseBlobs(tx, hash, 1)
+}
+
+// releaseBlobs removes references to the blob.
+func releaseBlobs(tx *gorm.DB, hash string, count int) error {
+	if hash == "" {
+		return nil
+	}
+
+	err := tx.Model(&Blob{}).Where("hash = ? AND ref_count >= ?", hash, count).UpdateColumn("ref_count", gorm.Expr("ref_count - ?", count)).Error
+	if err != nil {
+		return fmt.Errorf("couldn't release blob: %w", err)
+	}
+	return nil
+}
+
+// collectBlobs deletes the given blobs when they aren't referenced anymore.
+func (r *MessageRepository) collectBlobs(hashes ...string) error {
+	for _, hash := range hashes {
+		// Claim the blob, so no new references are added while its data is deleted
+		result := r.db.Model(&Blob{}).Where("hash = ? AND ref_count = 0", hash).UpdateColumn("ref_count", -1)
+		if result.Error != nil {
+			return fmt.Errorf("couldn't collect blob: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		err := r.deleteClaimedBlob(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteClaimedBlob deletes the data and the record of a claimed blob.
+func (r *MessageRepository) deleteClaimedBlob(hash string) error {
+	var blob Blob
+	err := r.db.Where("hash = ?", hash).First(&blob).Error
+	if err != nil {
+		return fmt.Errorf("couldn't find blob: %w", err)
+	}
+
+	store, err := r.getBlobStore(blob.Store)
+	if err == nil {
+		err = store.Delete(hash)
+	}
+	if err != nil {
+		// Give up the claim, so the blob can be used or collected again later
+		r.db.Model(&Blob{}).Where("hash = ? AND ref_count = -1", hash).UpdateColumn("ref_count", 0)
+		return fmt.Errorf("couldn't delete data of blob %s: %w", hash, err)
+	}
+
+	err = r.db.Where("hash = ? AND ref_count = -1", hash).Delete(&Blob{}).Error
+	if err != nil {
+		return fmt.Errorf("couldn't delete blob: %w", err)
+	}
+	return nil
+}
+
+// CollectBlobs deletes all blobs that aren't referenced anymore, but weren't deleted because of an error or a crash.
+func (r *MessageRepository) CollectBlobs() error {
+	var blobs []*Blob
+	err := r.db.Where("ref_count <= 0").Find(&blobs).Error
+	if err != nil {
+		return fmt.Errorf("couldn't find unreferenced blobs: %w", err)
+	}
+
+	for _, blob := range blobs {
+		if blob.RefCount < 0 {
+			err = r.deleteClaimedBlob(blob.Hash)
+		} else {
+			err = r.collectBlobs(blob.Hash)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBlobs fills in the body of the messages with the data of their blobs.
+// Compressed blobs are decompressed, except for encrypted messages, which are compressed before they are encrypted.
+func (r *MessageRepository) loadBlobs(messages ...*Message) error {
+	hashes := []string{}
+	for _, message := range messages {
+		if message.BlobHash != "" {
+			hashes = append(hashes, message.BlobHash)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	var blobs []*Blob
+	err := r.db.Where("hash IN ?", hashes).Find(&blobs).Error
+	if err != nil {
+		return fmt.Errorf("couldn't load blobs: %w", err)
+	}
+	stores := map[string]string{}
+	for _, blob := range blobs {
+		stores[blob.Hash] = blob.Store
+	}
+
+	data := map[string][]byte{}
+	for _, message := range messages {
+		if message.BlobHash == "" {
+			continue
+		}
+
+		blob, ok := data[message.BlobHash]
+		if !ok {
+			storeName, ok := stores[message.BlobHash]
+			if !ok {
+				return fmt.Errorf("couldn't load blob %s of message %d", message.BlobHash, message.ID)
+			}
+			blob, err = r.getBlob(message.BlobHash, storeName)
+			if err == nil && !message.Encrypted {
+				blob, err = compression.Decompress(blob)
+			}
+			if err != nil {
+				return fmt.Errorf("couldn't load blob %s of message %d: %w", message.BlobHash, message.ID, err)
+			}
+			data[message.BlobHash] = blob
+		}
+
+		message.Body = make([]byte, 0, len(message.Prefix)+len(blob))
+		message.Body = append(message.Body, message.Prefix...)
+		message.Body = append(message.Body, blob...)
+	}
+
+	return nil
+}
+
+// getBlob reads the data of the blob from the given store.
+// When the blob was moved to another store in the meantime, it is read from there.
+func (r *MessageRepository) getBlob(hash string, storeName string) ([]byte, error) {
+	store, err := r.getBlobStore(storeName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Get(hash)
+	if !errors.Is(err, ErrBlobNotFound) {
+		return data, err
+	}
+
+	var blob Blob
+	if r.db.Where("hash = ?", hash).First(&blob).Error != nil || blob.Store == storeName {
+		return nil, err
+	}
+	store, err = r.getBlobStore(blob.Store)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(hash)
+}
+
+// MoveBlobs moves all blobs that aren't in the given store yet to it, and returns the number of moved blobs.
+// The store must be configured as the store of the repository or one of the others.
+// It can run while the server is running: new messages use the blob in its new store,
+// and readers look for it in the new store when it was moved while reading.
+func (r *MessageRepository) MoveBlobs(to BlobStore) (int, error) {
+	if _, err := r.getBlobStore(to.Name()); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	lastHash := ""
+	for {
+		var blobs []*Blob
+		err := r.db.Where("hash > ? AND store <> ? AND ref_count > 0", lastHash, to.Name()).Order("hash").Limit(100).Find(&blobs).Error
+		if err != nil {
+			return moved, fmt.Errorf("couldn't find blobs to move: %w", err)
+		}
+		if len(blobs) == 0 {
+			return moved, nil
+		}
+
+		for _, blob := range blobs {
+			lastHash = blob.Hash
+			ok, err := r.moveBlob(blob, to)
+			if err != nil {
+				return moved, fmt.Errorf("couldn't move blob %s: %w", blob.Hash, err)
+			}
+			if ok {
+				moved++
+			}
+		}
+	}
+}
+
+// moveBlob copies the data of the blob to the given store, points the blob to it and deletes the old data.
+// It returns false when the blob was deleted in the meantime.
+func (r *MessageRepository) moveBlob(blob *Blob, to BlobStore) (bool, error) {
+	from, err := r.getBlobStore(blob.Store)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := from.Get(blob.Hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = to.Put(blob.Hash, data)
+	if err != nil {
+		return false, err
+	}
+
+	result := r.db.Model(&Blob{}).Where("hash = ? AND store = ? AND ref_count >= 0", blob.Hash, blob.Store).Update("store", to.Name())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// The copy is left behind, since a new message might have stored the same content in the meantime
+		return false, nil
+	}
+
+	return true, from.Delete(blob.Hash)
+}
+
+// CompressBlobs compresses the blobs that were stored without compression, and returns the number of compressed blobs.
+// It can run in the background while the server is running: readers recognize compressed data,
+// so they can read a blob both before and after it is replaced by its compressed version.
+func (r *MessageRepository) CompressBlobs() (int, error) {
+	if r.compressionLevel == 0 {
+		return 0, nil
+	}
+
+	compressed := 0
+	lastHash := ""
+	for {
+		// Encrypted blobs don't compress
+		var blobs []*Blob
+		err := r.db.Where("hash > ? AND ref_count > 0", lastHash).
+			Where("NOT EXISTS (SELECT 1 FROM messages WHERE messages.blob_hash = blobs.hash AND messages.encrypted = ?)", true).
+			Order("hash").Limit(100).Find(&blobs).Error
+		if err != nil {
+			return compressed, fmt.Errorf("couldn't find blobs to compress: %w", err)
+		}
+		if len(blobs) == 0 {
+			return compressed, nil
+		}
+
+		for _, blob := range blobs {
+			lastHash = blob.Hash
+			ok, err := r.compressBlob(blob)
+			if err != nil {
+				return compressed, fmt.Errorf("couldn't compress blob %s: %w", blob.Hash, err)
+			}
+			if ok {
+				compressed++
+			}
+		}
+	}
+}
+
+// compressBlob replaces the data of the blob with its compressed version.
+// It returns false when the blob is compressed already, doesn't get smaller or was deleted in the meantime.
+func (r *MessageRepository) compressBlob(blob *Blob) (bool, error) {
+	store, err := r.getBlobStore(blob.Store)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := store.Get(blob.Hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if compression.IsCompressed(data) {
+		return false, nil
+	}
+
+	compressed, err := r.Compress(data)
+	if err != nil {
+		return false, err
+	}
+	if !compression.IsCompressed(compressed) {
+		return false, nil
+	}
+
+	// When the blob is moved or deleted at the same time, the compressed copy might be left behind in the store
+	err = store.Put(blob.Hash, compressed)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MigrateMessageBodies moves the bodies that are stored in the messages table by older versions into blobs in the database.
+func MigrateMessageBodies(db *gorm.DB) error {
+
+	store := NewDatabaseBlobStore(db)
+
+	// Blobs that kept their data in the blobs table
+	if db.Migrator().HasColumn(&Blob{}, "data") {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec("INSERT INTO blob_data (hash, data) SELECT hash, data FROM blobs WHERE data IS NOT NULL").Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE blobs SET data = NULL, store = ? WHERE data IS NOT NULL", DatabaseBlobStoreName).Error
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't move blob data: %w", err)
+		}
+	}
+
+	if !db.Migrator().HasColumn(&Message{}, "body") {
+		return nil
+	}
+
+	type legacyMessage struct {
+		ID   uint
+		Body []byte
+	}
+
+	for {
+		var messages []*legacyMessage
+		err := db.Table("messages").Select("id, body").
+			Where("deleted_at IS NULL AND body IS NOT NULL AND (blob_hash IS NULL OR blob_hash = '')").
+			Order("id").Limit(100).Find(&messages).Error
+		if err != nil {
+			return fmt.Errorf("couldn't find messages to migrate: %w", err)
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		for _, message := range messages {
+			hash := blobHash(message.Body)
+			err := store.Put(hash, message.Body)
+			if err == nil {
+				err = db.Transaction(func(tx *gorm.DB) error {
+					err := referenceBlob(tx, hash, store.Name())
+					if err != nil {
+						return err
+					}
+					return tx.Table("messages").Where("id = ?", message.ID).
+						Updates(map[string]interface{}{"blob_hash": hash, "body": nil}).Error
+				})
+			}
+			if err != nil {
+				return fmt.Errorf("couldn't migrate body of message %d: %w", message.ID, err)
+			}
+		}
+	}
+}
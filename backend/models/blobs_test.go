@@ -0,0 +1,207 @@
+package models
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/mistralmail/mistralmail/backend/services/compression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore is a BlobStore in memory.
+type memoryStore struct {
+	name  string
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemoryStore(name string) *memoryStore {
+	return &memoryStore{name: name, blobs: map[string][]byte{}}
+}
+
+func (s *memoryStore) Name() string { return s.name }
+
+func (s *memoryStore) Put(hash string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[hash] = data
+	return nil
+}
+
+func (s *memoryStore) Get(hash string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[hash]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, hash)
+	return nil
+}
+
+func TestBlobStores(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+	database := NewDatabaseBlobStore(db)
+
+	// An old message in the database
+	old := &Message{Body: []byte("Subject: Old\r\n\r\nOld message\r\n"), MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(old))
+
+	// New messages are written to the new store
+	store := newMemoryStore("memory")
+	repo.SetBlobStores(store)
+	message := &Message{Body: []byte("Subject: New\r\n\r\nNew message\r\n"), MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(message))
+	assert.Contains(t, store.blobs, message.BlobHash)
+	assert.NotContains(t, store.blobs, old.BlobHash)
+
+	messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{})
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "Subject: Old\r\n\r\nOld message\r\n", string(messages[0].Body))
+	assert.Equal(t, "Subject: New\r\n\r\nNew message\r\n", string(messages[1].Body))
+
+	t.Run("TestMoveBlobs", func(t *testing.T) {
+		moved, err := repo.MoveBlobs(store)
+		require.NoError(t, err)
+		assert.Equal(t, 1, moved)
+		assert.Contains(t, store.blobs, old.BlobHash)
+		_, err = database.Get(old.BlobHash)
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+
+		moved, err = repo.MoveBlobs(store)
+		require.NoError(t, err)
+		assert.Zero(t, moved)
+
+		message, err := repo.GetMessageByID(old.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Subject: Old\r\n\r\nOld message\r\n", string(message.Body))
+
+		_, err = repo.MoveBlobs(newMemoryStore("unknown"))
+		assert.Error(t, err)
+	})
+
+	t.Run("TestReadAfterMove", func(t *testing.T) {
+		// A reader that found the blob in its old store looks again after it moved
+		other := newMemoryStore("other")
+		repo.SetBlobStores(store, other)
+		_, err := repo.MoveBlobs(other)
+		require.NoError(t, err)
+
+		data, err := repo.getBlob(message.BlobHash, "memory")
+		require.NoError(t, err)
+		assert.Equal(t, "Subject: New\r\n\r\nNew message\r\n", string(data))
+
+		_, err = repo.MoveBlobs(store)
+		require.NoError(t, err)
+	})
+
+	t.Run("TestDataIsDeleted", func(t *testing.T) {
+		require.NoError(t, repo.DeleteMessageByID(message.ID))
+		assert.NotContains(t, store.blobs, message.BlobHash)
+		assert.Equal(t, int64(-1), refCount(t, db, message.BlobHash))
+	})
+
+	t.Run("TestCollectBlobs", func(t *testing.T) {
+		// Left behind by a crash while the blob was deleted
+		require.NoError(t, db.Model(&Blob{}).Where("hash = ?", old.BlobHash).Update("ref_count", -1).Error)
+		require.NoError(t, repo.CollectBlobs())
+		assert.NotContains(t, store.blobs, old.BlobHash)
+		assert.Equal(t, int64(-1), refCount(t, db, old.BlobHash))
+	})
+
+	t.Run("TestClaimedBlobIsRecreated", func(t *testing.T) {
+		// Storing a message waits until a blob with the same content is deleted and stores it again
+		message := &Message{Body: []byte("Subject: Again\r\n\r\nAgain\r\n"), MailboxID: 1}
+		hash := blobHash(message.Body)
+		require.NoError(t, db.Create(&Blob{Hash: hash, Store: store.Name(), RefCount: -1}).Error)
+		done := make(chan error)
+		go func() {
+			done <- repo.deleteClaimedBlob(hash)
+		}()
+
+		require.NoError(t, repo.CreateMessage(message))
+		require.NoError(t, <-done)
+		assert.Equal(t, int64(1), refCount(t, db, hash))
+		assert.Contains(t, store.blobs, hash)
+	})
+
+}
+
+func TestBlobCompression(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+	store := newMemoryStore("memory")
+	repo.SetBlobStores(store)
+
+	body := []byte("Subject: Hello\r\n\r\n" + string(bytes.Repeat([]byte("Hello world!\r\n"), 100)))
+
+	// Stored before compression was enabled
+	require.NoError(t, repo.SetCompressionLevel(0))
+	old := &Message{Body: body, Size: uint32(len(body)), MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(old))
+	assert.Equal(t, body, store.blobs[old.BlobHash])
+
+	require.NoError(t, repo.SetCompressionLevel(compression.DefaultLevel))
+	assert.Error(t, repo.SetCompressionLevel(compression.MaxLevel+1))
+	message := &Message{Body: append([]byte("Delivered-To: bob@example.com\r\n"), body...), MailboxID: 1}
+	message.Prefix = message.Body[:len(message.Body)-len(body)]
+	message.Size = uint32(len(message.Body))
+	require.NoError(t, repo.CreateMessage(message))
+	assert.Equal(t, old.BlobHash, message.BlobHash)
+
+	other := &Message{Body: append(body, "Bye\r\n"...), MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(other))
+	assert.True(t, compression.IsCompressed(store.blobs[other.BlobHash]))
+	assert.Less(t, len(store.blobs[other.BlobHash]), len(other.Body))
+
+	// Encrypted blobs aren't compressed
+	encrypted := &Message{Body: bytes.Repeat([]byte("x"), 1000), Encrypted: true, MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(encrypted))
+	assert.False(t, compression.IsCompressed(store.blobs[encrypted.BlobHash]))
+
+	t.Run("TestRead", func(t *testing.T) {
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{})
+		require.NoError(t, err)
+		require.Len(t, messages, 4)
+		assert.Equal(t, body, messages[0].Body)
+		assert.Equal(t, uint32(len(body)), messages[0].Size)
+		assert.Equal(t, "Delivered-To: bob@example.com\r\n"+string(body), string(messages[1].Body))
+		assert.Equal(t, string(body)+"Bye\r\n", string(messages[2].Body))
+	})
+
+	t.Run("TestCompressBlobs", func(t *testing.T) {
+		compressed, err := repo.CompressBlobs()
+		require.NoError(t, err)
+		assert.Equal(t, 1, compressed)
+		assert.True(t, compression.IsCompressed(store.blobs[old.BlobHash]))
+		assert.False(t, compression.IsCompressed(store.blobs[encrypted.BlobHash]))
+
+		compressed, err = repo.CompressBlobs()
+		require.NoError(t, err)
+		assert.Zero(t, compressed)
+
+		message, err := repo.GetMessageByID(old.ID)
+		require.NoError(t, err)
+		assert.Equal(t, body, message.Body)
+		assert.Equal(t, uint32(len(body)), message.Size)
+
+		message, err = repo.GetMessageByID(encrypted.ID)
+		require.NoError(t, err)
+		assert.Equal(t, encrypted.Body, message.Body)
+	})
+
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when it doesn't contain the requested blob.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the content of messages by their hash.
+// Storing a blob that already exists replaces it, e.g. with its compressed version.
+// Both versions have the same content, so readers may get either of them.
+type BlobStore interface {
+	// Name identifies the store. It is recorded with every blob, so blobs can still be found after switching stores.
+	Name() string
+	// Put stores the data of a blob.
+	Put(hash string, data []byte) error
+	// Get returns the data of a blob or ErrBlobNotFound.
+	Get(hash string) ([]byte, error)
+	// Delete deletes a blob, it is not an error when the blob doesn't exist.
+	Delete(hash string) error
+}
+
+// DatabaseBlobStoreName is the name of the store that keeps the blobs in the database.
+const DatabaseBlobStoreName = "database"
+
+// BlobData contains the data of a blob that is kept in the database.
+type BlobData struct {
+	Hash string `gorm:"primaryKey;size:64"`
+	Data []byte
+}
+
+// DatabaseBlobStore is a BlobStore that keeps the blobs in the database.
+type DatabaseBlobStore struct {
+	db *gorm.DB
+}
+
+// NewDatabaseBlobStore creates a new DatabaseBlobStore.
+func NewDatabaseBlobStore(db *gorm.DB) *DatabaseBlobStore {
+	return &DatabaseBlobStore{db: db}
+}
+
+// Name implements the BlobStore interface.
+func (s *DatabaseBlobStore) Name() string {
+	return DatabaseBlobStoreName
+}
+
+// Put implements the BlobStore interface.
+func (s *DatabaseBlobStore) Put(hash string, data []byte) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data"}),
+	}).Create(&BlobData{Hash: hash, Data: data}).Error
+}
+
+// Get implements the BlobStore interface.
+func (s *DatabaseBlobStore) Get(hash string) ([]byte, error) {
+	var blobs []*BlobData
+	err := s.db.Where("hash = ?", hash).Limit(1).Find(&blobs).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 {
+		return nil, ErrBlobNotFound
+	}
+	return blobs[0].Data, nil
+}
+
+// Delete implements the BlobStore interface.
+func (s *DatabaseBlobStore) Delete(hash string) error {
+	return s.db.Where("hash = ?", hash).Delete(&BlobData{}).Error
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DeliveryWindow denotes how long a delivery is remembered, so a retry of the sending server within this window
+// doesn't deliver the message a second time. RFC 5321 suggests that servers give up after 4-5 days.
+const DeliveryWindow = 5 * 24 * time.Hour
+
+// Delivery records that an incoming message was stored, forwarded or posted for a recipient,
+// so a retry of the same message by the sending server doesn't deliver it twice.
+type Delivery struct {
+	gorm.Model
+
+	ID uint `gorm:"primary_key;auto_increment;not_null"`
+
+	// DeliveryKey identifies the message and recipient, it is the same for every retry of the message.
+	DeliveryKey string `gorm:"index;not_null"`
+	// Recipient is the envelope recipient.
+	Recipient string
+	// MessageID is the stored message, it is 0 when the message was forwarded or posted instead.
+	MessageID uint
+	// MailboxID is the mailbox the message was stored in.
+	MailboxID uint
+}
+
+// DeliveryRepository implements the Delivery repository
+type DeliveryRepository struct {
+	db          *gorm.DB
+	messageRepo *MessageRepository
+}
+
+// NewDeliveryRepository creates a new DeliveryRepository
+func NewDeliveryRepository(db *gorm.DB, messageRepo *MessageRepository) (*DeliveryRepository, error) {
+	return &DeliveryRepository{db: db, messageRepo: messageRepo}, nil
+}
+
+// CreateMessageWithDelivery stores the message and records its delivery in a single transaction.
+func (r *DeliveryRepository) CreateMessageWithDelivery(message *Message, delivery *Delivery) error {
+	return r.messageRepo.createMessage(message, func(tx *gorm.DB) error {
+		err := insertMessage(tx, message)
+		if err != nil {
+			return err
+		}
+		delivery.MessageID = message.ID
+		delivery.MailboxID = message.MailboxID
+		return tx.Create(delivery).Error
+	})
+}
+
+// CreateDelivery records a delivery of a message that isn't stored.
+func (r *DeliveryRepository) CreateDelivery(delivery *Delivery) error {
+	return r.db.Create(delivery).Error
+}
+
+// FindDeliverySince retrieves the latest delivery with the given key that was recorded after the given time.
+// It returns nil when there is none.
+func (r *DeliveryRepository) FindDeliverySince(key string, since time.Time) (*Delivery, error) {
+	var deliveries []*Delivery
+	err := r.db.Where("delivery_key = ? AND created_at > ?", key, since).Order("id desc").Limit(1).Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+	return deliveries[0], nil
+}
+
+// DeleteDeliveriesBefore deletes the deliveries that were recorded before the given time.
+func (r *DeliveryRepository) DeleteDeliveriesBefore(before time.Time) error {
+	return r.db.Unscoped().Where("created_at < ?", before).Delete(&Delivery{}).Error
+}
+
+// DeliveryKey identifies a message for a recipient across retries of the sending server.
+// The trace headers that are added while receiving the message differ for every attempt,
+// so only the body and the header fields set by the author are used.
+func DeliveryKey(recipient string, data []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(strings.ToLower(recipient)))
+	hash.Write([]byte{0})
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		hash.Write(data)
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	for _, key := range []string{"Message-Id", "Date", "From", "To", "Cc", "Subject"} {
+		for _, value := range msg.Header[key] {
+			hash.Write([]byte(key + ": " + value))
+			hash.Write([]byte{0})
+		}
+	}
+	_, _ = io.Copy(hash, msg.Body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,32 @@
+package models
+
+import "gorm.io/gorm"
+
+// ExpungedMessage is the tombstone of a message that was expunged from its mailbox,
+// so clients that synchronize with QRESYNC (RFC 7162) can find out which messages vanished.
+type ExpungedMessage struct {
+	ID uint `gorm:"primaryKey"`
+
+	MailboxID uint   `gorm:"index:idx_expunged_mod_seq"`
+	UID       uint   `gorm:"not null"`
+	ModSeq    uint64 `gorm:"index:idx_expunged_mod_seq;not null"`
+}
+
+// expungeMessage records that the message was expunged, with the next mod-sequence of its mailbox.
+func expungeMessage(tx *gorm.DB, message *Message) error {
+	modSeq, err := nextModSeq(tx, message.MailboxID)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&ExpungedMessage{MailboxID: message.MailboxID, UID: message.UID, ModSeq: modSeq}).Error
+}
+
+// FindExpungedMessages finds the messages that were expunged from the mailbox after the mod-sequence, ordered by uid.
+func (r *MessageRepository) FindExpungedMessages(mailboxID uint, since uint64) ([]*ExpungedMessage, error) {
+	var messages []*ExpungedMessage
+	err := r.db.Where("mailbox_id = ? AND mod_seq > ?", mailboxID, since).Order("uid").Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
@@ -0,0 +1,83 @@
+package models
+
+import "gorm.io/gorm"
+
+// Forward represents an external address to which all mail of a user is forwarded.
+type Forward struct {
+	gorm.Model
+
+	ID uint `gorm:"primary_key;auto_increment;not_null"`
+
+	// Address is the external address mail is forwarded to.
+	Address string `gorm:"index:idx_forward_user_address,unique;not_null"`
+	// KeepCopy denotes whether a copy is still delivered in the local mailbox.
+	KeepCopy bool
+	// Confirmed is set once the owner of the external address confirmed the forward.
+	Confirmed bool
+	// ConfirmationToken is the secret token that was mailed to the external address.
+	ConfirmationToken string `gorm:"index" json:"-"`
+
+	UserID uint  `gorm:"index:idx_forward_user_address,unique;foreignKey:User"`
+	User   *User `json:"-"`
+}
+
+// ForwardRepository implements the Forward repository
+type ForwardRepository struct {
+	db *gorm.DB
+}
+
+// NewForwardRepository creates a new ForwardRepository
+func NewForwardRepository(db *gorm.DB) (*ForwardRepository, error) {
+	return &ForwardRepository{db: db}, nil
+}
+
+// CreateForward creates a new forward in the database.
+func (r *ForwardRepository) CreateForward(forward *Forward) error {
+	return r.db.Create(forward).Error
+}
+
+// UpdateForward updates an existing forward in the database.
+func (r *ForwardRepository) UpdateForward(forward *Forward) error {
+	return r.db.Save(forward).Error
+}
+
+// DeleteForwardByUserIDAndForwardID deletes a forward of the given user from the database.
+// Forwards are deleted permanently so the same address can be added again later on.
+func (r *ForwardRepository) DeleteForwardByUserIDAndForwardID(userID uint, forwardID uint) error {
+	return r.db.Unscoped().Delete(&Forward{}, "user_id = ? AND id = ?", userID, forwardID).Error
+}
+
+// DeleteForwardsByUserID deletes all forwards of the given user from the database.
+func (r *ForwardRepository) DeleteForwardsByUserID(userID uint) error {
+	return r.db.Unscoped().Delete(&Forward{}, "user_id = ?", userID).Error
+}
+
+// FindForwardsByUserID finds all forwards of the given user.
+func (r *ForwardRepository) FindForwardsByUserID(userID uint) ([]*Forward, error) {
+	var forwards []*Forward
+	err := r.db.Where("user_id = ?", userID).Find(&forwards).Error
+	if err != nil {
+		return nil, err
+	}
+	return forwards, nil
+}
+
+// FindConfirmedForwardsByUserID finds all active forwards of the given user.
+func (r *ForwardRepository) FindConfirmedForwardsByUserID(userID uint) ([]*Forward, error) {
+	var forwards []*Forward
+	err := r.db.Where("user_id = ? AND confirmed = ?", userID, true).Find(&forwards).Error
+	if err != nil {
+		return nil, err
+	}
+	return forwards, nil
+}
+
+// GetForwardByConfirmationToken retrieves a forward from the database by its confirmation token.
+func (r *ForwardRepository) GetForwardByConfirmationToken(token string) (*Forward, error) {
+	var forward Forward
+	err := r.db.Where("confirmation_token = ?", token).First(&forward).Error
+	if err != nil {
+		return nil, err
+	}
+	return &forward, nil
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset" // decode non UTF-8 charsets
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// MessageHeaders are header fields that are extracted from a message when it is stored,
+// so messages can be searched for them and their header can be fetched without loading their bodies.
+type MessageHeaders struct {
+	// Extracted denotes that the header fields were extracted from the message.
+	// This isn't the case for encrypted messages and for messages that were stored by older versions.
+	Extracted bool `gorm:"default:false;not null"`
+
+	// From, To, Cc, Bcc, Subject, MessageID, InReplyTo and References contain the decoded values of the header fields, one per line.
+	From       string
+	To         string
+	Cc         string
+	Bcc        string
+	Subject    string
+	MessageID  string `gorm:"index"`
+	InReplyTo  string `gorm:"index"`
+	References string
+	// Date is the day of the Date header field, it is nil when the field is missing or invalid.
+	Date *time.Time
+
+	// Raw is the header of the message including the empty line after it, its length is the offset of the body.
+	Raw []byte
+}
+
+// BodyStructureParser parses the body structure of a message and serializes it, so it can be stored with the message.
+type BodyStructureParser func(body []byte) ([]byte, error)
+
+// SetBodyStructureParser sets the parser of the body structure of new messages.
+// The body structure isn't stored when it isn't set.
+func (r *MessageRepository) SetBodyStructureParser(parser BodyStructureParser) {
+	r.bodyStructureParser = parser
+}
+
+// extractHeaders extracts the header and the header fields that can be searched from the message.
+// They aren't extracted when the header can't be parsed.
+func extractHeaders(body []byte) MessageHeaders {
+	r := bytes.NewReader(body)
+	br := bufio.NewReader(r)
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return MessageHeaders{}
+	}
+	offset := len(body) - r.Len() - br.Buffered()
+	h := mail.Header{Header: message.Header{Header: header}}
+
+	headers := MessageHeaders{
+		Extracted:  true,
+		From:       headerText(h, "From"),
+		To:         headerText(h, "To"),
+		Cc:         headerText(h, "Cc"),
+		Bcc:        headerText(h, "Bcc"),
+		Subject:    headerText(h, "Subject"),
+		MessageID:  headerText(h, "Message-Id"),
+		InReplyTo:  headerText(h, "In-Reply-To"),
+		References: headerText(h, "References"),
+		Raw:        append([]byte{}, body[:offset]...),
+	}
+	date, err := h.Date()
+	if err == nil && !date.IsZero() {
+		// Dates are compared without their time and time zone (RFC 3501 section 6.4.4)
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		headers.Date = &day
+	}
+	return headers
+}
+
+// headerText returns the decoded values of the header fields with the key, one per line.
+func headerText(h mail.Header, key string) string {
+	values := []string{}
+	fields := h.FieldsByKey(key)
+	for fields.Next() {
+		value, _ := fields.Text()
+		values = append(values, value)
+	}
+	return strings.Join(values, "\n")
+}
+
+// columns returns the values of the header fields by their columns.
+func (h MessageHeaders) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"header_extracted":   h.Extracted,
+		"header_from":        h.From,
+		"header_to":          h.To,
+		"header_cc":          h.Cc,
+		"header_bcc":         h.Bcc,
+		"header_subject":     h.Subject,
+		"header_message_id":  h.MessageID,
+		"header_in_reply_to": h.InReplyTo,
+		"header_references":  h.References,
+		"header_date":        h.Date,
+		"header_raw":         h.Raw,
+	}
+}
+
+// extractMetadata extracts the header fields and the body structure of the message, unless it is encrypted.
+func (r *MessageRepository) extractMetadata(message *Message) {
+	message.Headers = MessageHeaders{}
+	message.BodyStructure = nil
+	if message.Encrypted {
+		return
+	}
+	message.Headers = extractHeaders(message.Body)
+	if r.bodyStructureParser != nil {
+		structure, err := r.bodyStructureParser(message.Body)
+		if err == nil {
+			message.BodyStructure = structure
+		}
+	}
+}
+
+// BackfillMetadata extracts the header fields and body structure of the messages that were stored by older versions,
+// and returns the number of updated messages. It can run while the server is running.
+func (r *MessageRepository) BackfillMetadata() (int, error) {
+	updated := 0
+	lastID := uint(0)
+	for {
+		query := r.db.Where("id > ? AND encrypted = ?", lastID, false)
+		if r.bodyStructureParser != nil {
+			query = query.Where("header_raw IS NULL OR body_structure IS NULL")
+		} else {
+			query = query.Where("header_raw IS NULL")
+		}
+		var messages []*Message
+		err := query.Order("id").Limit(100).Find(&messages).Error
+		if err != nil {
+			return updated, fmt.Errorf("couldn't find messages without metadata: %w", err)
+		}
+		if len(messages) == 0 {
+			return updated, nil
+		}
+
+		for _, message := range messages {
+			lastID = message.ID
+			err := r.loadBlobs(message)
+			if err != nil {
+				return updated, fmt.Errorf("couldn't load message %d: %w", message.ID, err)
+			}
+
+			r.extractMetadata(message)
+			columns := message.Headers.columns()
+			columns["body_structure"] = message.BodyStructure
+			// The message might have been encrypted in the meantime
+			result := r.db.Model(&Message{}).Where("id = ? AND encrypted = ?", message.ID, false).Updates(columns)
+			if result.Error != nil {
+				return updated, fmt.Errorf("couldn't update message %d: %w", message.ID, result.Error)
+			}
+			if result.RowsAffected > 0 && message.Headers.Extracted {
+				updated++
+			}
+		}
+	}
+}
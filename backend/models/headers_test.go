@@ -0,0 +1,56 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackfillMetadata(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+
+	body := "Subject: Lunch\r\nMessage-ID: <lunch@example.com>\r\nReferences: <a@example.com>\r\n <b@example.com>\r\n\r\nPizza?\r\n"
+	message := &Message{Body: []byte(body), MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(message))
+	encrypted := &Message{Body: []byte("encrypted"), Encrypted: true, MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(encrypted))
+
+	// Without a parser only the header fields are extracted
+	assert.Equal(t, "<lunch@example.com>", message.Headers.MessageID)
+	assert.Equal(t, "<a@example.com> <b@example.com>", message.Headers.References)
+	assert.Equal(t, body[:len(body)-len("Pizza?\r\n")], string(message.Headers.Raw))
+	assert.Nil(t, message.BodyStructure)
+
+	// The message as it was stored by older versions
+	require.NoError(t, db.Model(&Message{}).Where("id = ?", message.ID).Updates(map[string]interface{}{
+		"header_extracted": false, "header_message_id": "", "header_raw": nil,
+	}).Error)
+
+	repo.SetBodyStructureParser(func(body []byte) ([]byte, error) {
+		return []byte(`{"MIMEType":"text"}`), nil
+	})
+	updated, err := repo.BackfillMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, 1, updated)
+
+	backfilled, err := repo.GetMessageByID(message.ID)
+	require.NoError(t, err)
+	assert.True(t, backfilled.Headers.Extracted)
+	assert.Equal(t, "<lunch@example.com>", backfilled.Headers.MessageID)
+	assert.Equal(t, message.Headers.Raw, backfilled.Headers.Raw)
+	assert.Equal(t, `{"MIMEType":"text"}`, string(backfilled.BodyStructure))
+
+	notBackfilled, err := repo.GetMessageByID(encrypted.ID)
+	require.NoError(t, err)
+	assert.Nil(t, notBackfilled.Headers.Raw)
+	assert.Nil(t, notBackfilled.BodyStructure)
+
+	// Nothing is left
+	updated, err = repo.BackfillMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, 0, updated)
+}
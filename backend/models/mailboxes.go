@@ -1,6 +1,11 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 // Mailbox represent a mailbox.
 type Mailbox struct {
@@ -13,6 +18,14 @@ type Mailbox struct {
 	Name   string `gorm:"index:idx_mailbox_user,unique"`
 	UserID uint   `gorm:"index:idx_mailbox_user,unique;foreignKey:User"`
 	User   *User
+
+	// UIDNext is the uid the next message in the mailbox gets, uids are never reused within a mailbox.
+	UIDNext uint `gorm:"default:1;not null"`
+	// UIDValidity identifies the uids of the mailbox, a mailbox that is created again with the same name
+	// gets another value so clients don't mix up its messages with the ones they cached before.
+	UIDValidity uint32
+	// HighestModSeq is the mod-sequence of the last change in the mailbox (RFC 7162).
+	HighestModSeq uint64 `gorm:"default:1;not null"`
 }
 
 // MailboxRepository implements the Mailbox repository
@@ -26,8 +39,24 @@ func NewMailboxRepository(db *gorm.DB) (*MailboxRepository, error) {
 }
 
 // CreateMailbox creates a new mailbox in the database.
+// The mailbox gets the current time as its uid validity, or the one after the last uid validity that was given out
+// when that is later, so a mailbox that is created again in the same second doesn't get the same one.
 func (r *MailboxRepository) CreateMailbox(mailbox *Mailbox) error {
-	return r.db.Create(mailbox).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if mailbox.UIDValidity == 0 {
+			// The deleted mailboxes are included, their uid validities were given out as well
+			var last uint32
+			err := tx.Unscoped().Model(&Mailbox{}).Select("COALESCE(MAX(uid_validity), 0)").Scan(&last).Error
+			if err != nil {
+				return fmt.Errorf("couldn't find last uid validity: %w", err)
+			}
+			mailbox.UIDValidity = uint32(time.Now().Unix())
+			if mailbox.UIDValidity <= last {
+				mailbox.UIDValidity = last + 1
+			}
+		}
+		return tx.Create(mailbox).Error
+	})
 }
 
 // GetMailboxByID retrieves a mailbox from the database by its ID.
@@ -41,8 +70,9 @@ func (r *MailboxRepository) GetMailboxByID(id uint) (*Mailbox, error) {
 }
 
 // UpdateMailbox updates an existing mailbox in the database.
+// The uids and mod-sequences are left alone, they are only changed by the changes of the messages.
 func (r *MailboxRepository) UpdateMailbox(mailbox *Mailbox) error {
-	return r.db.Save(mailbox).Error
+	return r.db.Omit("uid_next", "uid_validity", "highest_mod_seq").Save(mailbox).Error
 }
 
 // DeleteMailbox deletes a mailbox from the database by its ID.
@@ -74,3 +104,81 @@ func (r *MailboxRepository) GetMailBoxByUserIDAndMailboxName(userID uint, mailbo
 	}
 	return &mailbox, nil
 }
+
+// nextUID allocates the next uid of the mailbox in the transaction of the new message.
+// The mailbox stays locked until the transaction ends, so no other message gets the same uid.
+func nextUID(tx *gorm.DB, mailboxID uint) (uint, error) {
+	return nextUIDs(tx, mailboxID, 1)
+}
+
+// nextUIDs allocates the next count uids of the mailbox in the transaction of the new messages, it returns the first one.
+func nextUIDs(tx *gorm.DB, mailboxID uint, count int) (uint, error) {
+	result := tx.Model(&Mailbox{}).Where("id = ?", mailboxID).UpdateColumn("uid_next", gorm.Expr("uid_next + ?", count))
+	if result.Error != nil {
+		return 0, fmt.Errorf("couldn't allocate uid: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return 0, fmt.Errorf("couldn't allocate uid: mailbox %d: %w", mailboxID, gorm.ErrRecordNotFound)
+	}
+
+	var uidNext uint
+	err := tx.Model(&Mailbox{}).Select("uid_next").Where("id = ?", mailboxID).Scan(&uidNext).Error
+	if err != nil {
+		return 0, fmt.Errorf("couldn't allocate uid: %w", err)
+	}
+	return uidNext - uint(count), nil
+}
+
+// nextModSeq allocates the next mod-sequence of the mailbox in the transaction of the change.
+func nextModSeq(tx *gorm.DB, mailboxID uint) (uint64, error) {
+	result := tx.Model(&Mailbox{}).Where("id = ?", mailboxID).UpdateColumn("highest_mod_seq", gorm.Expr("highest_mod_seq + 1"))
+	if result.Error != nil {
+		return 0, fmt.Errorf("couldn't allocate mod-sequence: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return 0, fmt.Errorf("couldn't allocate mod-sequence: mailbox %d: %w", mailboxID, gorm.ErrRecordNotFound)
+	}
+
+	var modSeq uint64
+	err := tx.Model(&Mailbox{}).Select("highest_mod_seq").Where("id = ?", mailboxID).Scan(&modSeq).Error
+	if err != nil {
+		return 0, fmt.Errorf("couldn't allocate mod-sequence: %w", err)
+	}
+	return modSeq, nil
+}
+
+// MigrateMailboxUIDs gives the messages stored by older versions, which used the message id as uid, their uid.
+// The uids stay the same, so clients don't have to fetch the mailboxes again.
+// It must run before the unique index on the uids is created.
+func MigrateMailboxUIDs(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&Message{}) || db.Migrator().HasColumn(&Message{}, "uid") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Migrator().AddColumn(&Message{}, "UID")
+		if err != nil {
+			return fmt.Errorf("couldn't add uids: %w", err)
+		}
+		err = tx.Exec("UPDATE messages SET uid = id").Error
+		if err != nil {
+			return fmt.Errorf("couldn't set uids: %w", err)
+		}
+
+		for _, field := range []string{"UIDNext", "UIDValidity"} {
+			if !tx.Migrator().HasColumn(&Mailbox{}, field) {
+				err = tx.Migrator().AddColumn(&Mailbox{}, field)
+				if err != nil {
+					return fmt.Errorf("couldn't add uids to mailboxes: %w", err)
+				}
+			}
+		}
+		// The uid validity used to be 1 for every mailbox
+		err = tx.Exec("UPDATE mailboxes SET uid_validity = 1, uid_next = " +
+			"(SELECT COALESCE(MAX(messages.id), 0) + 1 FROM messages WHERE messages.mailbox_id = mailboxes.id)").Error
+		if err != nil {
+			return fmt.Errorf("couldn't set next uids of mailboxes: %w", err)
+		}
+		return nil
+	})
+}
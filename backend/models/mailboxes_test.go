@@ -0,0 +1,31 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailboxUIDValidity(t *testing.T) {
+
+	db := newTestDB(t)
+	mailboxRepo, err := NewMailboxRepository(db)
+	require.NoError(t, err)
+
+	t.Run("TestMailboxesCreatedAgainGetAnotherUIDValidity", func(t *testing.T) {
+		seen := map[uint32]bool{}
+		for i := 0; i < 3; i++ {
+			mailbox := &Mailbox{Name: "Drafts", UserID: 1}
+			require.NoError(t, mailboxRepo.CreateMailbox(mailbox))
+			assert.False(t, seen[mailbox.UIDValidity], "uid validity %d is reused", mailbox.UIDValidity)
+			seen[mailbox.UIDValidity] = true
+
+			// The old mailbox is renamed and deleted, so the name can be used again
+			mailbox.Name = fmt.Sprintf("Old %d", i)
+			require.NoError(t, mailboxRepo.UpdateMailbox(mailbox))
+			require.NoError(t, mailboxRepo.DeleteMailbox(mailbox.ID))
+		}
+	})
+}
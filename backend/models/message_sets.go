@@ -0,0 +1,303 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// messagePageSize is the number of messages that are read and changed at once when going through the messages of a mailbox.
+const messagePageSize = 100
+
+// errNoMessages denotes that no messages were found to change, the transaction is rolled back.
+var errNoMessages = errors.New("no messages")
+
+// forEachPage calls fn with the pages of messages of the mailbox that are found with the parameters, ordered by uid.
+// Only the columns are selected, or all of them when there are none.
+func (r *MessageRepository) forEachPage(tx *gorm.DB, mailboxID uint, parameters FindMessagesParameters, columns []string, fn func(messages []*Message) error) error {
+	parameters.AfterUID = 0
+	parameters.Limit = messagePageSize
+	for {
+		query, err := r.findMessagesQuery(tx, mailboxID, parameters)
+		if err != nil {
+			return err
+		}
+		if len(columns) > 0 {
+			query = query.Select(columns)
+		}
+
+		var messages []*Message
+		err = query.Find(&messages).Error
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		err = fn(messages)
+		if err != nil {
+			return err
+		}
+		if len(messages) < messagePageSize {
+			return nil
+		}
+		parameters.AfterUID = messages[len(messages)-1].UID
+	}
+}
+
+// ForEachMessageByMailboxID calls fn for the messages of the mailbox that are found with the parameters, ordered by uid.
+// The messages are read in pages with their uid as cursor, so the mailbox isn't loaded at once. AfterUID and Limit are ignored.
+func (r *MessageRepository) ForEachMessageByMailboxID(mailboxID uint, parameters FindMessagesParameters, fn func(message *Message) error) error {
+	return r.forEachPage(r.db, mailboxID, parameters, nil, func(messages []*Message) error {
+		if !parameters.OmitBody {
+			err := r.loadBlobs(messages...)
+			if err != nil {
+				return err
+			}
+		}
+		for _, message := range messages {
+			err := fn(message)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateMessagesFlags updates the flags of the messages of the mailbox that are found with the parameters in a single transaction,
+// update returns the new flags of a message. The updated messages get the same next mod-sequence of the mailbox.
+// When unchangedSince isn't 0, only the messages that didn't change after that mod-sequence are updated.
+// It returns the updated messages and the messages that weren't updated because they changed, without their bodies.
+func (r *MessageRepository) UpdateMessagesFlags(mailboxID uint, parameters FindMessagesParameters, update func(flags []string) []string, unchangedSince uint64) ([]*Message, []*Message, error) {
+	var updated, changed []*Message
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		updated, changed = nil, nil
+
+		// The mod-sequence is allocated first, so the mailbox is locked while the messages are read
+		modSeq, err := nextModSeq(tx, mailboxID)
+		if err != nil {
+			return err
+		}
+
+		columns := []string{"id", "uid", "sequence_number", "mailbox_id", "flags", "mod_seq"}
+		err = r.forEachPage(tx, mailboxID, parameters, columns, func(messages []*Message) error {
+			// The messages that get the same flags are updated at once
+			ids := map[string][]uint{}
+			flags := map[string]StringSlice{}
+			for _, message := range messages {
+				if unchangedSince != 0 && message.ModSeq > unchangedSince {
+					changed = append(changed, message)
+					continue
+				}
+				message.Flags = update(message.Flags)
+				message.ModSeq = modSeq
+				updated = append(updated, message)
+
+				key, err := json.Marshal(message.Flags)
+				if err != nil {
+					return err
+				}
+				ids[string(key)] = append(ids[string(key)], message.ID)
+				flags[string(key)] = message.Flags
+			}
+
+			for key, ids := range ids {
+				err := tx.Model(&Message{}).Where("id IN ?", ids).UpdateColumns(map[string]interface{}{"flags": flags[key], "mod_seq": modSeq}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(updated) == 0 {
+			// Roll back the mod-sequence, nothing changed
+			return errNoMessages
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoMessages) {
+		return nil, nil, fmt.Errorf("couldn't update flags: %w", err)
+	}
+	return updated, changed, nil
+}
+
+// CopyMessages copies the messages of the mailbox that are found with the parameters to the destination mailbox in a single transaction,
+// and returns the number of copies. The copies refer to the same blobs and have the same metadata and text in the full-text index.
+// They get the next uids of the destination mailbox in the order of the uids of the messages, and the same next mod-sequence.
+func (r *MessageRepository) CopyMessages(mailboxID uint, parameters FindMessagesParameters, destMailboxID uint) (int, error) {
+	copied := 0
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		copied = 0
+
+		modSeq, err := nextModSeq(tx, destMailboxID)
+		if err != nil {
+			return err
+		}
+
+		// The copies in the same mailbox come after its current messages, they aren't copied again
+		var uidNext uint
+		err = tx.Model(&Mailbox{}).Select("uid_next").Where("id = ?", mailboxID).Scan(&uidNext).Error
+		if err != nil {
+			return err
+		}
+
+		parameters.OmitBody = true
+		err = r.forEachPage(tx, mailboxID, parameters, nil, func(messages []*Message) error {
+			for len(messages) > 0 && messages[len(messages)-1].UID >= uidNext {
+				messages = messages[:len(messages)-1]
+			}
+			if len(messages) == 0 {
+				return nil
+			}
+
+			uid, err := nextUIDs(tx, destMailboxID, len(messages))
+			if err != nil {
+				return err
+			}
+
+			copies := make([]*Message, 0, len(messages))
+			references := map[string]int{}
+			for i, message := range messages {
+				copies = append(copies, &Message{
+					UID:   uid + uint(i),
+					Date:  message.Date,
+					Size:  message.Size,
+					Flags: message.Flags,
+
+					Prefix:        message.Prefix,
+					BlobHash:      message.BlobHash,
+					Encrypted:     message.Encrypted,
+					Headers:       message.Headers,
+					BodyStructure: message.BodyStructure,
+					TextIndexed:   message.TextIndexed,
+
+					MailboxID: destMailboxID,
+					ModSeq:    modSeq,
+				})
+				references[message.BlobHash]++
+			}
+
+			err = tx.Create(&copies).Error
+			if err != nil {
+				return err
+			}
+			for hash, count := range references {
+				err = referenceBlobCopies(tx, hash, count)
+				if err != nil {
+					return err
+				}
+			}
+			for _, message := range copies {
+				err = r.indexText(tx, message, true, nil)
+				if err != nil {
+					return err
+				}
+			}
+
+			copied += len(copies)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if copied == 0 {
+			// Roll back the uids and mod-sequence, nothing was copied
+			return errNoMessages
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoMessages) {
+		return 0, fmt.Errorf("couldn't copy messages: %w", err)
+	}
+	return copied, nil
+}
+
+// DeleteMessages deletes the messages of the mailbox that are found with the parameters in a single transaction,
+// and returns them ordered by uid without their bodies. Their uids are kept as expunged messages with the same next mod-sequence.
+// The blobs that aren't referenced anymore are deleted as well.
+func (r *MessageRepository) DeleteMessages(mailboxID uint, parameters FindMessagesParameters) ([]*Message, error) {
+	var deleted []*Message
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		deleted = nil
+
+		modSeq, err := nextModSeq(tx, mailboxID)
+		if err != nil {
+			return err
+		}
+
+		// The messages are found before any of them is deleted, so their sequence numbers don't change in the meantime
+		columns := []string{"id", "uid", "sequence_number", "mailbox_id", "blob_hash"}
+		err = r.forEachPage(tx, mailboxID, parameters, columns, func(messages []*Message) error {
+			deleted = append(deleted, messages...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(deleted) == 0 {
+			// Roll back the mod-sequence, nothing was deleted
+			return errNoMessages
+		}
+
+		for start := 0; start < len(deleted); start += messagePageSize {
+			end := start + messagePageSize
+			if end > len(deleted) {
+				end = len(deleted)
+			}
+			err = r.deleteMessages(tx, deleted[start:end], modSeq)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errNoMessages) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't delete messages: %w", err)
+	}
+
+	hashes := []string{}
+	for _, message := range deleted {
+		hashes = append(hashes, message.BlobHash)
+	}
+	return deleted, r.collectBlobs(hashes...)
+}
+
+// deleteMessages deletes the messages of a mailbox permanently with a statement per table,
+// and keeps their uids as expunged messages with the mod-sequence.
+func (r *MessageRepository) deleteMessages(tx *gorm.DB, messages []*Message, modSeq uint64) error {
+	ids := []uint{}
+	references := map[string]int{}
+	expunged := []*ExpungedMessage{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+		references[message.BlobHash]++
+		expunged = append(expunged, &ExpungedMessage{MailboxID: message.MailboxID, UID: message.UID, ModSeq: modSeq})
+	}
+
+	err := tx.Unscoped().Where("id IN ?", ids).Delete(&Message{}).Error
+	if err != nil {
+		return err
+	}
+	if r.textIndex != nil {
+		err = r.textIndex.Delete(tx, ids...)
+		if err != nil {
+			return err
+		}
+	}
+	for hash, count := range references {
+		err = releaseBlobs(tx, hash, count)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Create(&expunged).Error
+}
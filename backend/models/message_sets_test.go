@@ -0,0 +1,158 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageSets(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+	mailboxRepo, err := NewMailboxRepository(db)
+	require.NoError(t, err)
+
+	// More messages than fit in a page, every tenth message has the same content
+	count := messagePageSize*2 + 50
+	for i := 1; i <= count; i++ {
+		body := fmt.Sprintf("Subject: Message %d\r\n\r\nHello!\r\n", i)
+		if i%10 == 0 {
+			body = "Subject: Same\r\n\r\nHello!\r\n"
+		}
+		require.NoError(t, repo.CreateMessage(&Message{Body: []byte(body), MailboxID: 1}))
+	}
+	same := blobHash([]byte("Subject: Same\r\n\r\nHello!\r\n"))
+	assert.Equal(t, int64(count/10), refCount(t, db, same))
+
+	uids := func(mailboxID uint, parameters FindMessagesParameters) []uint {
+		uids := []uint{}
+		require.NoError(t, repo.ForEachMessageByMailboxID(mailboxID, parameters, func(message *Message) error {
+			uids = append(uids, message.UID)
+			return nil
+		}))
+		return uids
+	}
+	highestModSeq := func(mailboxID uint) uint64 {
+		mailbox, err := mailboxRepo.GetMailboxByID(mailboxID)
+		require.NoError(t, err)
+		return mailbox.HighestModSeq
+	}
+
+	t.Run("TestForEachMessage", func(t *testing.T) {
+		all := uids(1, FindMessagesParameters{OmitBody: true})
+		require.Len(t, all, count)
+		for i, uid := range all {
+			assert.Equal(t, uint(i+1), uid)
+		}
+
+		assert.Equal(t, []uint{99, 100, 101, 102, 250}, uids(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 99, Stop: 102}, {Start: 250, Stop: 0}}}))
+
+		// The bodies are loaded unless they are omitted
+		require.NoError(t, repo.ForEachMessageByMailboxID(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 10, Stop: 10}}}, func(message *Message) error {
+			assert.Equal(t, "Subject: Same\r\n\r\nHello!\r\n", string(message.Body))
+			return nil
+		}))
+	})
+
+	t.Run("TestUpdateMessagesFlags", func(t *testing.T) {
+		modSeq := highestModSeq(1)
+		addSeen := func(flags []string) []string {
+			return append(flags, `\Seen`)
+		}
+
+		updated, changed, err := repo.UpdateMessagesFlags(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 1, Stop: 150}}}, addSeen, 0)
+		require.NoError(t, err)
+		assert.Len(t, updated, 150)
+		assert.Empty(t, changed)
+		assert.Equal(t, modSeq+1, highestModSeq(1))
+		assert.Equal(t, modSeq+1, updated[149].ModSeq)
+		assert.Equal(t, StringSlice{`\Seen`}, updated[149].Flags)
+
+		// The messages that changed after the mod-sequence aren't updated
+		updated, changed, err = repo.UpdateMessagesFlags(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 149, Stop: 152}}}, func(flags []string) []string {
+			return []string{`\Deleted`}
+		}, modSeq)
+		require.NoError(t, err)
+		assert.Equal(t, []uint{151, 152}, messageUIDs(updated))
+		assert.Equal(t, []uint{149, 150}, messageUIDs(changed))
+		assert.Equal(t, modSeq+2, highestModSeq(1))
+
+		seen := uids(1, FindMessagesParameters{Search: &SearchCriteria{WithFlags: []string{`\Seen`}}, OmitBody: true})
+		assert.Len(t, seen, 150)
+		assert.Len(t, uids(1, FindMessagesParameters{ChangedSince: modSeq, OmitBody: true}), 152)
+
+		// Nothing changes when no message is found
+		updated, changed, err = repo.UpdateMessagesFlags(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 1000, Stop: 0}}}, addSeen, 0)
+		require.NoError(t, err)
+		assert.Empty(t, updated)
+		assert.Empty(t, changed)
+		assert.Equal(t, modSeq+2, highestModSeq(1))
+	})
+
+	t.Run("TestCopyMessages", func(t *testing.T) {
+		copied, err := repo.CopyMessages(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 1, Stop: 0}}}, 2)
+		require.NoError(t, err)
+		assert.Equal(t, count, copied)
+		assert.Equal(t, int64(count/10*2), refCount(t, db, same))
+
+		copies, err := repo.FindMessagesByMailboxID(2, FindMessagesParameters{UIDSet: []Sequence{{Start: 151, Stop: 151}}})
+		require.NoError(t, err)
+		require.Len(t, copies, 1)
+		assert.Equal(t, StringSlice{`\Deleted`}, copies[0].Flags)
+		assert.Equal(t, "Subject: Message 151\r\n\r\nHello!\r\n", string(copies[0].Body))
+		assert.Equal(t, "Message 151", copies[0].Headers.Subject)
+		assert.Equal(t, uint64(2), copies[0].ModSeq)
+
+		junk, err := mailboxRepo.GetMailboxByID(2)
+		require.NoError(t, err)
+		assert.Equal(t, uint(count+1), junk.UIDNext)
+
+		// The copies in the same mailbox aren't copied again
+		copied, err = repo.CopyMessages(2, FindMessagesParameters{SequenceSet: []Sequence{{Start: 1, Stop: 0}}}, 2)
+		require.NoError(t, err)
+		assert.Equal(t, count, copied)
+		assert.Len(t, uids(2, FindMessagesParameters{OmitBody: true}), count*2)
+	})
+
+	t.Run("TestDeleteMessages", func(t *testing.T) {
+		modSeq := highestModSeq(1)
+		deleted, err := repo.DeleteMessages(1, FindMessagesParameters{Search: &SearchCriteria{WithFlags: []string{`\Deleted`}}})
+		require.NoError(t, err)
+		assert.Equal(t, []uint{151, 152}, messageUIDs(deleted))
+		assert.Equal(t, []uint{151, 152}, []uint{deleted[0].SequenceNumber, deleted[1].SequenceNumber})
+		assert.Equal(t, modSeq+1, highestModSeq(1))
+		assert.Len(t, uids(1, FindMessagesParameters{OmitBody: true}), count-2)
+
+		expunged, err := repo.FindExpungedMessages(1, modSeq)
+		require.NoError(t, err)
+		require.Len(t, expunged, 2)
+		assert.Equal(t, modSeq+1, expunged[1].ModSeq)
+
+		// The blobs are deleted with the last messages that refer to them
+		hash := blobHash([]byte("Subject: Message 1\r\n\r\nHello!\r\n"))
+		assert.Equal(t, int64(3), refCount(t, db, hash))
+		deleted, err = repo.DeleteMessages(2, FindMessagesParameters{UIDSet: []Sequence{{Start: 1, Stop: 0}}})
+		require.NoError(t, err)
+		assert.Len(t, deleted, count*2)
+		assert.Equal(t, int64(1), refCount(t, db, hash))
+		assert.Equal(t, int64(-1), refCount(t, db, blobHash([]byte("Subject: Message 151\r\n\r\nHello!\r\n"))))
+
+		// Nothing changes when no message is found
+		deleted, err = repo.DeleteMessages(2, FindMessagesParameters{})
+		require.NoError(t, err)
+		assert.Empty(t, deleted)
+	})
+}
+
+// messageUIDs returns the uids of the messages.
+func messageUIDs(messages []*Message) []uint {
+	uids := []uint{}
+	for _, message := range messages {
+		uids = append(uids, message.UID)
+	}
+	return uids
+}
@@ -3,9 +3,9 @@ package models
 import (
 	"errors"
 	"fmt"
-	"math"
 	"time"
 
+	"github.com/mistralmail/mistralmail/backend/services/compression"
 	"gorm.io/gorm"
 )
 
@@ -13,25 +13,46 @@ import (
 type Message struct {
 	gorm.Model
 
-	ID    uint `gorm:"primary_key;auto_increment;not_null"`
+	ID uint `gorm:"primary_key;auto_increment;not_null"`
+	// UID is the IMAP uid of the message, it is unique within its mailbox.
+	UID   uint `gorm:"index:idx_message_uid,unique"`
 	Date  time.Time
 	Size  uint32
 	Flags StringSlice
-	Body  []byte
 
-	MailboxID uint `gorm:"foreignKey:Mailbox"`
+	// Body is the full message, it is the prefix followed by the data of the blob.
+	// It isn't a column, the blob is shared by all copies of the message.
+	Body []byte `gorm:"-"`
+	// Prefix contains the header fields that only belong to this copy of the message, like Delivered-To.
+	Prefix []byte
+	// BlobHash is the hash of the blob with the rest of the message.
+	BlobHash string `gorm:"index;size:64"`
+	// Encrypted denotes that the body is encrypted to the public key of the user, the prefix is empty then.
+	Encrypted bool
+
+	MailboxID uint `gorm:"index:idx_message_uid,unique;foreignKey:Mailbox"`
+	// ModSeq is the mod-sequence of the last change of the message, it is increased when its flags change (RFC 7162).
+	ModSeq uint64 `gorm:"default:1;not null"`
+
+	// Headers are the header fields messages can be searched for and the header of the message.
+	Headers MessageHeaders `gorm:"embedded;embeddedPrefix:header_"`
+	// BodyStructure is the serialized body structure of the message, it is nil when it wasn't parsed.
+	BodyStructure []byte
+	// TextIndexed denotes that the text of the message is in the full-text index.
+	TextIndexed bool `gorm:"default:false;not null"`
 
 	SequenceNumber uint `gorm:"->;-:migration"` // read only and skip in migrations because its the column from a view.
 }
 
 // MessageWithSequenceNumberViewName is the name of the view that represents all messages with their corresponding sequence number.
+// The messages of a mailbox are numbered in the order of their uids (RFC 3501 section 2.3.1.2).
 const MessageWithSequenceNumberViewName = "messages_sequence_numbers"
 
 // MessageWithSequenceNumberViewQuery query that selects this view.
 const MessageWithSequenceNumberViewQuery = `
 	SELECT
 		*,
-		ROW_NUMBER() OVER (PARTITION BY mailbox_id ORDER BY 'date') AS sequence_number
+		ROW_NUMBER() OVER (PARTITION BY mailbox_id ORDER BY uid) AS sequence_number
 	FROM messages
 	WHERE deleted_at IS NULL;
 	`
@@ -39,16 +60,66 @@ const MessageWithSequenceNumberViewQuery = `
 // MessageRepository implements the Message repository
 type MessageRepository struct {
 	db *gorm.DB
+
+	blobStore  BlobStore
+	blobStores map[string]BlobStore
+
+	compressionLevel int
+
+	// textIndex is the full-text index of the messages, it is nil when the database doesn't have one.
+	textIndex TextIndex
+
+	// bodyStructureParser parses the body structure of new messages, it isn't stored when it is nil.
+	bodyStructureParser BodyStructureParser
 }
 
 // NewMessageRepository creates a new MessageRepository
+// The blobs are kept in the database until other blob stores are set.
+// The messages are indexed in the full-text index when it was created with MigrateTextIndex.
 func NewMessageRepository(db *gorm.DB) (*MessageRepository, error) {
-	return &MessageRepository{db: db}, nil
+	r := &MessageRepository{db: db, compressionLevel: compression.DefaultLevel, textIndex: newTextIndex(db)}
+	r.SetBlobStores(NewDatabaseBlobStore(db))
+	return r, nil
+}
+
+// SetCompressionLevel sets the zstd level new blobs are compressed with, 0 disables compression.
+func (r *MessageRepository) SetCompressionLevel(level int) error {
+	err := compression.ValidLevel(level)
+	if err != nil {
+		return err
+	}
+	r.compressionLevel = level
+	return nil
+}
+
+// Compress compresses data with the compression level of the repository.
+// The body of an encrypted message can't be compressed anymore, so it should be compressed before it is encrypted.
+func (r *MessageRepository) Compress(data []byte) ([]byte, error) {
+	return compression.Compress(data, r.compressionLevel)
 }
 
 // CreateMessage creates a new message in the database.
+// When the message has a blob hash it is a copy of another message and only a reference to the blob is added,
+// otherwise the body after the prefix is stored as a blob, which is compressed unless the message is encrypted.
+// The size of the message isn't changed by the compression.
+// The message gets the next uid of its mailbox.
 func (r *MessageRepository) CreateMessage(message *Message) error {
-	return r.db.Create(message).Error
+	return r.createMessage(message, nil)
+}
+
+// insertMessage inserts the message with the next uid and mod-sequence of its mailbox.
+func insertMessage(tx *gorm.DB, message *Message) error {
+	uid, err := nextUID(tx, message.MailboxID)
+	if err != nil {
+		return err
+	}
+	modSeq, err := nextModSeq(tx, message.MailboxID)
+	if err != nil {
+		return err
+	}
+	message.UID = uid
+	message.ModSeq = modSeq
+	return tx.Create(message).Error
 }
 
 // GetMessageByID retrieves a message from the database by its ID.
@@ -58,17 +129,145 @@ func (r *MessageRepository) GetMessageByID(id uint) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = r.loadBlobs(&message)
+	if err != nil {
+		return nil, err
+	}
 	return &message, nil
 }
 
+// UpdateMessageBody replaces the stored content of the message with its body.
+func (r *MessageRepository) UpdateMessageBody(message *Message) error {
+	oldHash := message.BlobHash
+	message.BlobHash = ""
+
+	err := r.createMessage(message, func(tx *gorm.DB) error {
+		columns := message.Headers.columns()
+		columns["prefix"] = message.Prefix
+		columns["blob_hash"] = message.BlobHash
+		columns["encrypted"] = message.Encrypted
+		columns["body_structure"] = message.BodyStructure
+		columns["text_indexed"] = message.TextIndexed
+		err := tx.Model(message).Updates(columns).Error
+		if err != nil {
+			return err
+		}
+		return releaseBlob(tx, oldHash)
+	})
+	if err != nil {
+		message.BlobHash = oldHash
+		return err
+	}
+
+	return r.collectBlobs(oldHash)
+}
+
 // UpdateMessage updates an existing message in the database.
 func (r *MessageRepository) UpdateMessage(message *Message) error {
 	return r.db.Save(message).Error
 }
 
+// UpdateMessageFlags stores the flags of the message with the next mod-sequence of its mailbox.
+// When unchangedSince isn't 0, the message is only updated if it didn't change after that mod-sequence,
+// it returns whether the message was updated.
+func (r *MessageRepository) UpdateMessageFlags(message *Message, unchangedSince uint64) (bool, error) {
+	var modSeq uint64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		modSeq, err = nextModSeq(tx, message.MailboxID)
+		if err != nil {
+			return err
+		}
+
+		query := tx.Model(&Message{}).Where("id = ?", message.ID)
+		if unchangedSince != 0 {
+			query = query.Where("mod_seq <= ?", unchangedSince)
+		}
+		result := query.UpdateColumns(map[string]interface{}{"flags": message.Flags, "mod_seq": modSeq})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Roll back the mod-sequence, nothing changed
+			return errMessageChanged
+		}
+		return nil
+	})
+	if errors.Is(err, errMessageChanged) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("couldn't update flags: %w", err)
+	}
+	message.ModSeq = modSeq
+	return true, nil
+}
+
+// errMessageChanged denotes that a message was changed after the given mod-sequence.
+var errMessageChanged = errors.New("message changed")
+
 // DeleteMessageByID deletes a message from the database by its ID.
+// Its blob is deleted as well when no other message refers to it.
+// The uid of the message is kept as an expunged message, so clients can find out that it vanished.
 func (r *MessageRepository) DeleteMessageByID(id uint) error {
-	return r.db.Delete(&Message{}, id).Error
+	var message Message
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Select("id", "uid", "blob_hash", "mailbox_id").First(&message, id).Error
+		if err != nil {
+			return err
+		}
+		err = r.deleteMessage(tx, &message)
+		if err != nil {
+			return err
+		}
+		return expungeMessage(tx, &message)
+	})
+	if err != nil {
+		return err
+	}
+	return r.collectBlobs(message.BlobHash)
+}
+
+// DeleteMessagesByMailboxID deletes all messages of a mailbox and the blobs that aren't referenced anymore.
+func (r *MessageRepository) DeleteMessagesByMailboxID(mailboxID uint) error {
+	var messages []*Message
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Select("id", "blob_hash").Where("mailbox_id = ?", mailboxID).Find(&messages).Error
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			err = r.deleteMessage(tx, message)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Where("mailbox_id = ?", mailboxID).Delete(&ExpungedMessage{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	hashes := []string{}
+	for _, message := range messages {
+		hashes = append(hashes, message.BlobHash)
+	}
+	return r.collectBlobs(hashes...)
+}
+
+// deleteMessage deletes the message permanently, so it doesn't refer to a blob that might be deleted.
+func (r *MessageRepository) deleteMessage(tx *gorm.DB, message *Message) error {
+	err := tx.Unscoped().Delete(&Message{}, message.ID).Error
+	if err != nil {
+		return err
+	}
+	if r.textIndex != nil {
+		err = r.textIndex.Delete(tx, message.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return releaseBlob(tx, message.BlobHash)
 }
 
 // Sequence represents a sequence of messages going from Start to Stop.
@@ -85,87 +284,100 @@ type FindMessagesParameters struct {
 	// SequenceSet is a list of sequences with sequence numbers.
 	SequenceSet []Sequence
 
-	// UIDSet is a list of sequences with uids.
+	// UIDSet is a list of sequences with uids, no message is found when it is empty but not nil.
 	UIDSet []Sequence
 
+	// ChangedSince only includes the messages that changed after this mod-sequence if it isn't 0.
+	ChangedSince uint64
+
+	// Search only includes the messages that meet the criteria if it isn't nil.
+	Search *SearchCriteria
+
+	// AfterUID only includes the messages with a higher uid if it isn't 0, it is the cursor to page through the messages.
+	AfterUID uint
+
+	// Limit is the maximum number of messages that are found if it isn't 0.
+	Limit int
+
 	// OmitBody excludes the email body in the message if set to true.
 	OmitBody bool
 }
 
-// FindMessagesByMailboxID finds messages in the database by their mailbox ID.
+// FindMessagesByMailboxID finds messages in the database by their mailbox ID, ordered by uid.
 func (r *MessageRepository) FindMessagesByMailboxID(mailboxID uint, parameters FindMessagesParameters) ([]*Message, error) {
+	query, err := r.findMessagesQuery(r.db, mailboxID, parameters)
+	if err != nil {
+		return nil, err
+	}
+
 	var messages []*Message
-	query := r.db.Table(MessageWithSequenceNumberViewName).Where("mailbox_id = ?", mailboxID)
+	err = query.Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
 
-	if parameters.OmitBody {
-		query = query.Omit("Body")
+	if !parameters.OmitBody {
+		err = r.loadBlobs(messages...)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	return messages, nil
+}
+
+// findMessagesQuery returns the query for the messages of the mailbox that are found with the parameters, ordered by uid.
+func (r *MessageRepository) findMessagesQuery(tx *gorm.DB, mailboxID uint, parameters FindMessagesParameters) (*gorm.DB, error) {
 	if len(parameters.SequenceSet) > 0 && len(parameters.UIDSet) > 0 {
 		return nil, fmt.Errorf("can't filter by both sequence numbers and uids at the same time")
 	}
 
-	// Handle find by sequence numbers
-	var seqSetWhere *gorm.DB
-	for i, sequence := range parameters.SequenceSet {
-
-		if sequence.Stop == 0 {
-			sequence.Stop = math.MaxInt
-		}
-
-		if i == 0 {
-			seqSetWhere = r.db.Where("sequence_number BETWEEN ? AND ?", sequence.Start, sequence.Stop)
-
-		} else {
-			seqSetWhere = seqSetWhere.Or("sequence_number BETWEEN ? AND ?", sequence.Start, sequence.Stop)
-		}
+	query := tx.Table(MessageWithSequenceNumberViewName).Where("mailbox_id = ?", mailboxID).Order("uid")
 
+	if len(parameters.SequenceSet) > 0 {
+		condition, args := sequencesCondition("sequence_number", parameters.SequenceSet)
+		query = query.Where(condition, args...)
 	}
-	if seqSetWhere != nil {
-		query.Where(seqSetWhere)
+	if parameters.UIDSet != nil {
+		condition, args := sequencesCondition("uid", parameters.UIDSet)
+		query = query.Where(condition, args...)
 	}
 
-	// Handle find by uids
-	var uidWhere *gorm.DB
-	for i, sequence := range parameters.UIDSet {
+	if parameters.ChangedSince != 0 {
+		query = query.Where("mod_seq > ?", parameters.ChangedSince)
+	}
 
-		if sequence.Stop == 0 {
-			sequence.Stop = math.MaxInt
+	if parameters.Search != nil {
+		condition, args := parameters.Search.condition(r.textIndex)
+		if parameters.Search.NeedsText() {
+			condition = "(text_indexed = ? OR " + condition + ")"
+			args = append([]interface{}{false}, args...)
 		}
-
-		if i == 0 {
-			uidWhere = r.db.Where("id BETWEEN ? AND ?", sequence.Start, sequence.Stop)
-
-		} else {
-			uidWhere = uidWhere.Or("id BETWEEN ? AND ?", sequence.Start, sequence.Stop)
+		if parameters.Search.NeedsHeaders() {
+			condition = "(header_extracted = ? OR " + condition + ")"
+			args = append([]interface{}{false}, args...)
 		}
-	}
-	if uidWhere != nil {
-		query.Where(uidWhere)
+		query = query.Where(condition, args...)
 	}
 
-	err := query.Find(&messages).Error
-	if err != nil {
-		return nil, err
+	if parameters.AfterUID != 0 {
+		query = query.Where("uid > ?", parameters.AfterUID)
+	}
+	if parameters.Limit != 0 {
+		query = query.Limit(parameters.Limit)
 	}
-	return messages, nil
-}
 
-// GetNextMessageID gets the next available message id.
-func (r *MessageRepository) GetNextMessageID(mailboxID uint) (uint, error) {
+	return query, nil
+}
 
-	message := &Message{}
-	err := r.db.Order("id desc").First(&message).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return 1, nil
-	}
+// FindUIDsByMailboxID returns the uids of the messages in the mailbox that come after the uid, in ascending order.
+func (r *MessageRepository) FindUIDsByMailboxID(mailboxID uint, afterUID uint) ([]uint, error) {
+	uids := []uint{}
+	err := r.db.Model(&Message{}).Where("mailbox_id = ? AND uid > ?", mailboxID, afterUID).Order("uid").Pluck("uid", &uids).Error
 	if err != nil {
-		// TODO handle error?
-		return 0, fmt.Errorf("couldn't find next id: %w", err)
+		return nil, fmt.Errorf("couldn't find uids: %w", err)
 	}
-
-	return message.ID + 1, nil
-
+	return uids, nil
 }
 
 // GetNumberOfMessagesByMailboxID counts the number of messages in the given mailbox.
@@ -186,3 +398,12 @@ func (r *MessageRepository) GetTotalMessagesCount() (int64, error) {
 	}
 	return count, nil
 }
+
+// GetTotalBlobsCount returns the total number of distinct message contents in the database.
+func (r *MessageRepository) GetTotalBlobsCount() (int64, error) {
+	var count int64
+	if err := r.db.Model(&Blob{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
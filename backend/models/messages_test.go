@@ -0,0 +1,333 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestDB creates a migrated sqlite database with the mailboxes 1, 2 and 3.
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&Mailbox{}, &Message{}, &Blob{}, &BlobData{}, &ExpungedMessage{}))
+	require.NoError(t, db.Migrator().CreateView(MessageWithSequenceNumberViewName, gorm.ViewOption{Query: db.Raw(MessageWithSequenceNumberViewQuery)}))
+
+	mailboxRepo, err := NewMailboxRepository(db)
+	require.NoError(t, err)
+	for _, name := range []string{"INBOX", "Junk", "Archive"} {
+		require.NoError(t, mailboxRepo.CreateMailbox(&Mailbox{Name: name, UserID: 1}))
+	}
+	return db
+}
+
+// refCount returns the reference count of the blob, or -1 when it doesn't exist.
+func refCount(t *testing.T, db *gorm.DB, hash string) int64 {
+	var blobs []*Blob
+	require.NoError(t, db.Where("hash = ?", hash).Find(&blobs).Error)
+	if len(blobs) == 0 {
+		return -1
+	}
+	return blobs[0].RefCount
+}
+
+func TestMessageBlobs(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+
+	content := []byte("Subject: Hello\r\n\r\nHello world!\r\n")
+
+	// Two deliveries of the same content with their own delivery headers
+	first := &Message{Body: append([]byte("Delivered-To: alice@example.com\r\n"), content...), MailboxID: 1}
+	first.Prefix = first.Body[:len(first.Body)-len(content)]
+	require.NoError(t, repo.CreateMessage(first))
+	second := &Message{Body: append([]byte("Delivered-To: bob@example.com\r\n"), content...), MailboxID: 2}
+	second.Prefix = second.Body[:len(second.Body)-len(content)]
+	require.NoError(t, repo.CreateMessage(second))
+
+	assert.Equal(t, first.BlobHash, second.BlobHash)
+	assert.Equal(t, int64(2), refCount(t, db, first.BlobHash))
+
+	t.Run("TestBodyIsLoaded", func(t *testing.T) {
+		message, err := repo.GetMessageByID(second.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Delivered-To: bob@example.com\r\n"+string(content), string(message.Body))
+
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{})
+		require.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, "Delivered-To: alice@example.com\r\n"+string(content), string(messages[0].Body))
+
+		messages, err = repo.FindMessagesByMailboxID(1, FindMessagesParameters{OmitBody: true})
+		require.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Nil(t, messages[0].Body)
+	})
+
+	t.Run("TestCopyAddsReference", func(t *testing.T) {
+		copied := &Message{Prefix: first.Prefix, BlobHash: first.BlobHash, MailboxID: 3}
+		require.NoError(t, repo.CreateMessage(copied))
+		assert.Equal(t, int64(3), refCount(t, db, first.BlobHash))
+
+		message, err := repo.GetMessageByID(copied.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Delivered-To: alice@example.com\r\n"+string(content), string(message.Body))
+
+		assert.Error(t, repo.CreateMessage(&Message{BlobHash: "unknown", MailboxID: 3}))
+	})
+
+	t.Run("TestUnreferencedBlobsAreDeleted", func(t *testing.T) {
+		require.NoError(t, repo.DeleteMessageByID(first.ID))
+		assert.Equal(t, int64(2), refCount(t, db, first.BlobHash))
+
+		require.NoError(t, repo.DeleteMessagesByMailboxID(3))
+		assert.Equal(t, int64(1), refCount(t, db, first.BlobHash))
+
+		require.NoError(t, repo.DeleteMessagesByMailboxID(2))
+		assert.Equal(t, int64(-1), refCount(t, db, first.BlobHash))
+
+		count, err := repo.GetTotalMessagesCount()
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+
+}
+
+func TestMigrateMessageBodies(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+
+	// Older versions stored the body in the messages table
+	require.NoError(t, db.Exec("ALTER TABLE messages ADD COLUMN body blob").Error)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.Exec("INSERT INTO messages (created_at, mailbox_id, body) VALUES (CURRENT_TIMESTAMP, 1, ?)", []byte("Subject: Old\r\n\r\nOld message\r\n")).Error)
+	}
+
+	require.NoError(t, MigrateMessageBodies(db))
+	require.NoError(t, MigrateMessageBodies(db))
+
+	messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{})
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	for _, message := range messages {
+		assert.Equal(t, "Subject: Old\r\n\r\nOld message\r\n", string(message.Body))
+	}
+	assert.Equal(t, int64(2), refCount(t, db, messages[0].BlobHash))
+}
+
+func TestMessageUIDs(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+	mailboxRepo, err := NewMailboxRepository(db)
+	require.NoError(t, err)
+
+	inbox, err := mailboxRepo.GetMailboxByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), inbox.UIDNext)
+	assert.NotZero(t, inbox.UIDValidity)
+
+	create := func(mailboxID uint) *Message {
+		message := &Message{Body: []byte("Subject: Hello\r\n\r\nHello world!\r\n"), MailboxID: mailboxID}
+		require.NoError(t, repo.CreateMessage(message))
+		return message
+	}
+
+	t.Run("TestUIDsPerMailbox", func(t *testing.T) {
+		assert.Equal(t, uint(1), create(1).UID)
+		assert.Equal(t, uint(1), create(2).UID)
+		assert.Equal(t, uint(2), create(1).UID)
+
+		// A copy gets a new uid in its mailbox
+		copied := create(1)
+		copied.ID = 0
+		copied.MailboxID = 2
+		require.NoError(t, repo.CreateMessage(copied))
+		assert.Equal(t, uint(2), copied.UID)
+
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 2, Stop: 0}}, OmitBody: true})
+		require.NoError(t, err)
+		require.Len(t, messages, 2)
+		assert.Equal(t, uint(2), messages[0].UID)
+		assert.Equal(t, uint(3), messages[1].UID)
+	})
+
+	t.Run("TestUIDsAreNotReused", func(t *testing.T) {
+		last := create(3)
+		require.NoError(t, repo.DeleteMessageByID(last.ID))
+		assert.Equal(t, last.UID+1, create(3).UID)
+	})
+
+	t.Run("TestUpdateMailboxKeepsUIDs", func(t *testing.T) {
+		// The mailbox was read before the messages were added
+		inbox.Subscribed = true
+		require.NoError(t, mailboxRepo.UpdateMailbox(inbox))
+
+		updated, err := mailboxRepo.GetMailboxByID(1)
+		require.NoError(t, err)
+		assert.True(t, updated.Subscribed)
+		assert.Equal(t, uint(4), updated.UIDNext)
+		assert.Equal(t, inbox.UIDValidity, updated.UIDValidity)
+	})
+
+	t.Run("TestUnknownMailbox", func(t *testing.T) {
+		err := repo.CreateMessage(&Message{Body: []byte("Subject: Hello\r\n\r\n"), MailboxID: 42})
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	})
+}
+
+func TestSequenceNumbers(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+
+	// The messages are stored in another order than their uids, e.g. after they were imported
+	for _, uid := range []uint{3, 1, 4, 2} {
+		require.NoError(t, db.Create(&Message{UID: uid, MailboxID: 1}).Error)
+		require.NoError(t, db.Create(&Message{UID: uid, MailboxID: 2}).Error)
+	}
+	require.NoError(t, db.Where("uid = ? AND mailbox_id = ?", 2, 1).Delete(&Message{}).Error)
+
+	messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{OmitBody: true})
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	for i, uid := range []uint{1, 3, 4} {
+		assert.Equal(t, uid, messages[i].UID)
+		assert.Equal(t, uint(i+1), messages[i].SequenceNumber)
+	}
+
+	messages, err = repo.FindMessagesByMailboxID(2, FindMessagesParameters{SequenceSet: []Sequence{{Start: 2, Stop: 3}}, OmitBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{2, 3}, messageUIDs(messages))
+
+	uids, err := repo.FindUIDsByMailboxID(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{3, 4}, uids)
+
+	// An empty set of uids doesn't find any message
+	messages, err = repo.FindMessagesByMailboxID(1, FindMessagesParameters{UIDSet: []Sequence{}, OmitBody: true})
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestMigrateMailboxUIDs(t *testing.T) {
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+
+	// The tables of older versions, which used the message id as uid
+	type legacyMailbox struct {
+		gorm.Model
+		Name   string
+		UserID uint
+	}
+	type legacyMessage struct {
+		gorm.Model
+		Flags     StringSlice
+		MailboxID uint
+	}
+	require.NoError(t, db.Table("mailboxes").AutoMigrate(&legacyMailbox{}))
+	require.NoError(t, db.Table("messages").AutoMigrate(&legacyMessage{}))
+	require.NoError(t, db.Table("mailboxes").Create([]*legacyMailbox{{Name: "INBOX", UserID: 1}, {Name: "Junk", UserID: 1}}).Error)
+	require.NoError(t, db.Table("messages").Create([]*legacyMessage{{MailboxID: 1}, {MailboxID: 2}, {MailboxID: 1}}).Error)
+
+	require.NoError(t, MigrateMailboxUIDs(db))
+	// Running it again doesn't change anything
+	require.NoError(t, MigrateMailboxUIDs(db))
+	require.NoError(t, db.AutoMigrate(&Mailbox{}, &Message{}))
+
+	var uids []uint
+	require.NoError(t, db.Model(&Message{}).Order("id").Pluck("uid", &uids).Error)
+	assert.Equal(t, []uint{1, 2, 3}, uids)
+
+	mailboxRepo, err := NewMailboxRepository(db)
+	require.NoError(t, err)
+	inbox, err := mailboxRepo.GetMailboxByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), inbox.UIDNext)
+	assert.Equal(t, uint32(1), inbox.UIDValidity)
+	junk, err := mailboxRepo.GetMailboxByID(2)
+	require.NoError(t, err)
+	assert.Equal(t, uint(3), junk.UIDNext)
+}
+
+func TestModSeqs(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+	mailboxRepo, err := NewMailboxRepository(db)
+	require.NoError(t, err)
+
+	highestModSeq := func() uint64 {
+		mailbox, err := mailboxRepo.GetMailboxByID(1)
+		require.NoError(t, err)
+		return mailbox.HighestModSeq
+	}
+	assert.Equal(t, uint64(1), highestModSeq())
+
+	messages := []*Message{}
+	for i := 0; i < 3; i++ {
+		message := &Message{Body: []byte("Subject: Hello\r\n\r\nHello world!\r\n"), MailboxID: 1}
+		require.NoError(t, repo.CreateMessage(message))
+		messages = append(messages, message)
+	}
+	assert.Equal(t, uint64(4), messages[2].ModSeq)
+	assert.Equal(t, uint64(4), highestModSeq())
+
+	t.Run("TestUpdateMessageFlags", func(t *testing.T) {
+		messages[0].Flags = StringSlice{"\\Seen"}
+		updated, err := repo.UpdateMessageFlags(messages[0], 0)
+		require.NoError(t, err)
+		assert.True(t, updated)
+		assert.Equal(t, uint64(5), messages[0].ModSeq)
+
+		// The message changed after the mod-sequence of the client
+		messages[0].Flags = StringSlice{"\\Seen", "\\Flagged"}
+		updated, err = repo.UpdateMessageFlags(messages[0], 4)
+		require.NoError(t, err)
+		assert.False(t, updated)
+		assert.Equal(t, uint64(5), highestModSeq())
+
+		updated, err = repo.UpdateMessageFlags(messages[1], 4)
+		require.NoError(t, err)
+		assert.True(t, updated)
+		assert.Equal(t, uint64(6), messages[1].ModSeq)
+
+		changed, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{ChangedSince: 4, OmitBody: true})
+		require.NoError(t, err)
+		require.Len(t, changed, 2)
+		assert.ElementsMatch(t, []uint{messages[0].UID, messages[1].UID}, []uint{changed[0].UID, changed[1].UID})
+	})
+
+	t.Run("TestExpunge", func(t *testing.T) {
+		require.NoError(t, repo.DeleteMessageByID(messages[2].ID))
+		assert.Equal(t, uint64(7), highestModSeq())
+
+		expunged, err := repo.FindExpungedMessages(1, 6)
+		require.NoError(t, err)
+		require.Len(t, expunged, 1)
+		assert.Equal(t, messages[2].UID, expunged[0].UID)
+		assert.Equal(t, uint64(7), expunged[0].ModSeq)
+
+		expunged, err = repo.FindExpungedMessages(1, 7)
+		require.NoError(t, err)
+		assert.Empty(t, expunged)
+
+		// The tombstones are removed with the mailbox
+		require.NoError(t, repo.DeleteMessagesByMailboxID(1))
+		expunged, err = repo.FindExpungedMessages(1, 0)
+		require.NoError(t, err)
+		assert.Empty(t, expunged)
+	})
+}
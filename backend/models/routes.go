@@ -0,0 +1,100 @@
+package models
+
+import (
+	"path"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// RouteFormat denotes how a message is posted to the endpoint of a route.
+type RouteFormat string
+
+const (
+	// RouteFormatJSON posts the parsed message as JSON with base64 encoded attachments.
+	RouteFormatJSON RouteFormat = "json"
+	// RouteFormatMultipart posts the parsed message as a multipart form with the attachments as files.
+	RouteFormatMultipart RouteFormat = "multipart"
+)
+
+// Route represents an inbound route that delivers mail for matching recipients to an HTTP endpoint.
+type Route struct {
+	gorm.Model
+
+	ID uint `gorm:"primary_key;auto_increment;not_null"`
+
+	// Pattern is matched against the recipient address, e.g. "support@example.com" or "*@support.example.com".
+	Pattern string `gorm:"not_null"`
+	// Priority orders the routes, the route with the lowest priority that matches is used.
+	Priority int
+	// URL is the endpoint the parsed message is posted to.
+	URL string `gorm:"not_null"`
+	// Format denotes whether the message is posted as JSON or as a multipart form.
+	Format RouteFormat
+	// Secret is used to sign the payloads with HMAC-SHA256, it is only shown when the route is created.
+	Secret string `json:"-"`
+	// Store denotes whether the message is also stored in the local mailbox of the recipient.
+	Store bool
+	// Enabled denotes whether the route is used.
+	Enabled bool
+}
+
+// Matches checks whether the route pattern matches the given address.
+// Patterns are case insensitive and support the shell wildcards of path.Match.
+func (r *Route) Matches(address string) bool {
+	matched, err := path.Match(strings.ToLower(r.Pattern), strings.ToLower(address))
+	return err == nil && matched
+}
+
+// RouteRepository implements the Route repository
+type RouteRepository struct {
+	db *gorm.DB
+}
+
+// NewRouteRepository creates a new RouteRepository
+func NewRouteRepository(db *gorm.DB) (*RouteRepository, error) {
+	return &RouteRepository{db: db}, nil
+}
+
+// CreateRoute creates a new route in the database.
+func (r *RouteRepository) CreateRoute(route *Route) error {
+	return r.db.Create(route).Error
+}
+
+// UpdateRoute updates an existing route in the database.
+func (r *RouteRepository) UpdateRoute(route *Route) error {
+	return r.db.Save(route).Error
+}
+
+// DeleteRoute deletes a route from the database by its ID.
+func (r *RouteRepository) DeleteRoute(id uint) error {
+	return r.db.Delete(&Route{}, id).Error
+}
+
+// GetAllRoutes retrieves all routes from the database ordered by priority.
+func (r *RouteRepository) GetAllRoutes() ([]*Route, error) {
+	var routes []*Route
+	err := r.db.Order("priority, id").Find(&routes).Error
+	if err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// FindMatchingRoute finds the enabled route with the lowest priority that matches the given address.
+// Returns nil when no route matches.
+func (r *RouteRepository) FindMatchingRoute(address string) (*Route, error) {
+	var routes []*Route
+	err := r.db.Where("enabled = ?", true).Order("priority, id").Find(&routes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		if route.Matches(address) {
+			return route, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+)
+
+// headerColumns are the columns of the header fields that can be searched, by their canonical keys.
+var headerColumns = map[string]string{
+	"From":        "header_from",
+	"To":          "header_to",
+	"Cc":          "header_cc",
+	"Bcc":         "header_bcc",
+	"Subject":     "header_subject",
+	"Message-Id":  "header_message_id",
+	"In-Reply-To": "header_in_reply_to",
+	"References":  "header_references",
+}
+
+// IsSearchableHeaderField returns whether messages can be searched for the header field with the canonical key.
+func IsSearchableHeaderField(key string) bool {
+	_, ok := headerColumns[key]
+	return ok
+}
+
+// SearchCriteria are the conditions messages have to meet to be found.
+// All of them have to be met, the zero value matches every message.
+type SearchCriteria struct {
+	// SequenceSet and UIDSet are lists of sequences with sequence numbers and uids.
+	// No message is found when UIDSet is empty but not nil.
+	SequenceSet []Sequence
+	UIDSet      []Sequence
+
+	// Since and Before compare the day of the internal date, Since is inclusive.
+	Since  time.Time
+	Before time.Time
+	// SentSince and SentBefore compare the day of the Date header field.
+	SentSince  time.Time
+	SentBefore time.Time
+
+	// Text contains text the header fields or body of the messages contain, as words or the start of words,
+	// and Body text the body contains. They are searched for in the full-text index,
+	// the messages that aren't indexed are found anyway.
+	Text []string
+	Body []string
+
+	// Headers contains the text the header fields contain, by their canonical keys.
+	// Only the header fields for which IsSearchableHeaderField returns true can be searched.
+	Headers map[string][]string
+
+	WithFlags    []string
+	WithoutFlags []string
+
+	// Larger and Smaller compare the size of the message.
+	Larger  uint32
+	Smaller uint32
+
+	// Not contains criteria the messages may not meet and Or pairs of criteria of which they have to meet one.
+	Not []*SearchCriteria
+	Or  [][2]*SearchCriteria
+}
+
+// NeedsHeaders returns whether the criteria refer to the extracted header fields.
+// The messages of which the header fields weren't extracted are found anyway, they have to be matched in another way.
+func (c *SearchCriteria) NeedsHeaders() bool {
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() || len(c.Headers) > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if not.NeedsHeaders() {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if or[0].NeedsHeaders() || or[1].NeedsHeaders() {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsText returns whether the criteria refer to the full-text index.
+// The messages that aren't indexed are found anyway, they have to be matched in another way.
+func (c *SearchCriteria) NeedsText() bool {
+	if len(c.Text) > 0 || len(c.Body) > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if not.NeedsText() {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if or[0].NeedsText() || or[1].NeedsText() {
+			return true
+		}
+	}
+	return false
+}
+
+// condition returns the SQL condition for the criteria and its arguments.
+// The text is searched for in the index, no message is indexed when it is nil.
+func (c *SearchCriteria) condition(index TextIndex) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	add := func(condition string, arguments ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arguments...)
+	}
+
+	if len(c.SequenceSet) > 0 {
+		condition, arguments := sequencesCondition("sequence_number", c.SequenceSet)
+		add(condition, arguments...)
+	}
+	if c.UIDSet != nil {
+		condition, arguments := sequencesCondition("uid", c.UIDSet)
+		add(condition, arguments...)
+	}
+
+	if !c.Since.IsZero() {
+		add("date >= ?", c.Since)
+	}
+	if !c.Before.IsZero() {
+		add("date < ?", c.Before)
+	}
+	if !c.SentSince.IsZero() {
+		add("header_date >= ?", c.SentSince)
+	}
+	if !c.SentBefore.IsZero() {
+		add("header_date < ?", c.SentBefore)
+	}
+
+	for key, values := range c.Headers {
+		column, ok := headerColumns[key]
+		if !ok {
+			// The caller should have left it out
+			add("1 = 0")
+			continue
+		}
+		for _, value := range values {
+			add("LOWER("+column+") LIKE ? ESCAPE '!'", "%"+escapeLike(strings.ToLower(value))+"%")
+		}
+	}
+
+	for i, text := range append(append([]string{}, c.Text...), c.Body...) {
+		words := SearchWords(text)
+		if index == nil || len(words) == 0 {
+			// The caller should have left it out
+			add("1 = 0")
+			continue
+		}
+		add(index.Condition(words, i >= len(c.Text)))
+	}
+
+	// The flags are stored as a JSON array
+	for _, flag := range c.WithFlags {
+		add("flags LIKE ? ESCAPE '!'", "%"+escapeLike(jsonString(flag))+"%")
+	}
+	for _, flag := range c.WithoutFlags {
+		add("flags NOT LIKE ? ESCAPE '!'", "%"+escapeLike(jsonString(flag))+"%")
+	}
+
+	if c.Larger > 0 {
+		add("size > ?", c.Larger)
+	}
+	if c.Smaller > 0 {
+		add("size < ?", c.Smaller)
+	}
+
+	for _, not := range c.Not {
+		condition, arguments := not.condition(index)
+		add("NOT "+condition, arguments...)
+	}
+	for _, or := range c.Or {
+		condition1, arguments1 := or[0].condition(index)
+		condition2, arguments2 := or[1].condition(index)
+		add("("+condition1+" OR "+condition2+")", append(arguments1, arguments2...)...)
+	}
+
+	if len(conditions) == 0 {
+		return "(1 = 1)", nil
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+// sequencesCondition returns the condition that the column is in one of the sequences, which is never met without sequences.
+func sequencesCondition(column string, sequences []Sequence) (string, []interface{}) {
+	if len(sequences) == 0 {
+		return "(1 = 0)", nil
+	}
+	conditions := []string{}
+	args := []interface{}{}
+	for _, sequence := range sequences {
+		if sequence.Stop == 0 {
+			sequence.Stop = math.MaxInt
+		}
+		conditions = append(conditions, column+" BETWEEN ? AND ?")
+		args = append(args, sequence.Start, sequence.Stop)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern with an exclamation mark.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// jsonString returns the string as it is encoded in a JSON array.
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchMessages(t *testing.T) {
+
+	db := newTestDB(t)
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+
+	day := func(d int) time.Time {
+		return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	bodies := []string{
+		"From: Alice <alice@example.com>\r\nSubject: Lunch on Friday?\r\nDate: Fri, 1 Mar 2024 10:00:00 +0000\r\n\r\nShall we?\r\n",
+		"From: Bob <bob@example.com>\r\nTo: alice@example.com\r\nSubject: =?utf-8?q?Caf=C3=A9_100%?=\r\nDate: Sun, 3 Mar 2024 23:30:00 -0800\r\n\r\nSee you there.\r\n",
+		"From: carol@example.com\r\nSubject: Re: Lunch on Friday?\r\n\r\nYes!\r\n",
+	}
+	for i, body := range bodies {
+		message := &Message{Body: []byte(body), Size: uint32(len(body)), Date: day(i + 1).Add(12 * time.Hour), MailboxID: 1}
+		if i == 1 {
+			message.Flags = StringSlice{`\Seen`, "$Important_1"}
+		}
+		require.NoError(t, repo.CreateMessage(message))
+	}
+
+	// An encrypted message can't be searched for its header fields
+	encrypted := &Message{Body: []byte("encrypted"), Size: 1000, Date: day(1), Encrypted: true, MailboxID: 1}
+	require.NoError(t, repo.CreateMessage(encrypted))
+	assert.False(t, encrypted.Headers.Extracted)
+
+	search := func(criteria *SearchCriteria) []uint {
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{Search: criteria, OmitBody: true})
+		require.NoError(t, err)
+		uids := []uint{}
+		for _, message := range messages {
+			uids = append(uids, message.UID)
+		}
+		return uids
+	}
+
+	t.Run("TestHeaders", func(t *testing.T) {
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{UIDSet: []Sequence{{Start: 2, Stop: 2}}, OmitBody: true})
+		require.NoError(t, err)
+		require.Len(t, messages, 1)
+		headers := messages[0].Headers
+		assert.True(t, headers.Extracted)
+		assert.Equal(t, "Bob <bob@example.com>", headers.From)
+		assert.Equal(t, "Café 100%", headers.Subject)
+		require.NotNil(t, headers.Date)
+		assert.True(t, day(3).Equal(*headers.Date))
+	})
+
+	t.Run("TestAll", func(t *testing.T) {
+		assert.Equal(t, []uint{1, 2, 3, 4}, search(&SearchCriteria{}))
+	})
+
+	t.Run("TestHeaderFields", func(t *testing.T) {
+		// The encrypted message is found as well, it has to be matched against its body
+		assert.Equal(t, []uint{1, 3, 4}, search(&SearchCriteria{Headers: map[string][]string{"Subject": {"LUNCH"}}}))
+		assert.Equal(t, []uint{2, 4}, search(&SearchCriteria{Headers: map[string][]string{"Subject": {"café 100%"}}}))
+		assert.Equal(t, []uint{4}, search(&SearchCriteria{Headers: map[string][]string{"Subject": {"1_0"}}}))
+		assert.Equal(t, []uint{2, 4}, search(&SearchCriteria{Headers: map[string][]string{"To": {"alice"}}}))
+		assert.Equal(t, []uint{2, 3, 4}, search(&SearchCriteria{Not: []*SearchCriteria{{Headers: map[string][]string{"From": {"alice"}}}}}))
+	})
+
+	t.Run("TestDates", func(t *testing.T) {
+		assert.Equal(t, []uint{2, 3}, search(&SearchCriteria{Since: day(2)}))
+		assert.Equal(t, []uint{1, 4}, search(&SearchCriteria{Before: day(2)}))
+		assert.Equal(t, []uint{2, 4}, search(&SearchCriteria{SentSince: day(2)}))
+		assert.Equal(t, []uint{1, 4}, search(&SearchCriteria{SentBefore: day(3)}))
+	})
+
+	t.Run("TestFlags", func(t *testing.T) {
+		assert.Equal(t, []uint{2}, search(&SearchCriteria{WithFlags: []string{`\Seen`}}))
+		assert.Equal(t, []uint{2}, search(&SearchCriteria{WithFlags: []string{"$Important_1"}}))
+		assert.Equal(t, []uint{}, search(&SearchCriteria{WithFlags: []string{"$Important"}}))
+		assert.Equal(t, []uint{1, 3, 4}, search(&SearchCriteria{WithoutFlags: []string{`\Seen`}}))
+	})
+
+	t.Run("TestSizeAndSets", func(t *testing.T) {
+		assert.Equal(t, []uint{1, 2}, search(&SearchCriteria{Larger: 80, Smaller: 150}))
+		assert.Equal(t, []uint{2, 3, 4}, search(&SearchCriteria{UIDSet: []Sequence{{Start: 2, Stop: 0}}}))
+		assert.Equal(t, []uint{1, 3}, search(&SearchCriteria{Or: [][2]*SearchCriteria{
+			{{UIDSet: []Sequence{{Start: 1, Stop: 1}}}, {SequenceSet: []Sequence{{Start: 3, Stop: 3}}}},
+		}}))
+	})
+}
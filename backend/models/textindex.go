@@ -0,0 +1,404 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	"golang.org/x/net/html"
+	"gorm.io/gorm"
+)
+
+// TextIndexTableName is the name of the table with the full-text index.
+const TextIndexTableName = "message_texts"
+
+// maxIndexedText is the maximum size of the text of a message in the index,
+// longer texts aren't indexed and those messages are searched by reading them.
+const maxIndexedText = 512 * 1024
+
+// ErrTextIndexUnsupported is returned when the database doesn't support a full-text index.
+var ErrTextIndexUnsupported = errors.New("the database doesn't support a full-text index")
+
+// TextIndex is a full-text index of the text of messages, so they can be searched for words without reading them.
+// The words of the header fields and the body are indexed separately. Encrypted messages aren't indexed.
+type TextIndex interface {
+	// Index sets the words of the header fields and the body of the message in the index.
+	Index(tx *gorm.DB, messageID uint, header string, body string) error
+	// Copy indexes the message with the text of another message with the same blob,
+	// it returns false when there is no such message in the index.
+	Copy(tx *gorm.DB, messageID uint, blobHash string) (bool, error)
+	// Delete removes the messages from the index.
+	Delete(tx *gorm.DB, messageIDs ...uint) error
+	// Condition returns the SQL condition that the message with the id column contains words starting with all the words,
+	// in its body or, when body is false, in its header fields or body.
+	Condition(words []string, body bool) (string, []interface{})
+}
+
+// MigrateTextIndex creates the full-text index for SQLite (FTS5) and Postgres.
+// Nothing is done for other databases and when SQLite is built without FTS5, their messages aren't indexed.
+//
+// The index of older versions, which didn't keep the header fields and the body apart, is dropped.
+// Those messages are searched by reading them until the index is rebuilt.
+func MigrateTextIndex(db *gorm.DB) error {
+	switch db.Dialector.Name() {
+	case "sqlite":
+		err := dropCombinedTextIndex(db)
+		if err == nil {
+			err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + TextIndexTableName + " USING fts5(header, body)").Error
+		}
+		if err != nil && strings.Contains(err.Error(), "no such module") {
+			return nil
+		}
+		return err
+
+	case "postgres":
+		err := dropCombinedTextIndex(db)
+		if err != nil {
+			return err
+		}
+		err = db.Exec("CREATE TABLE IF NOT EXISTS " + TextIndexTableName + " (message_id bigint PRIMARY KEY, header tsvector NOT NULL, body tsvector NOT NULL)").Error
+		if err != nil {
+			return err
+		}
+		err = db.Exec("CREATE INDEX IF NOT EXISTS idx_message_texts_body ON " + TextIndexTableName + " USING GIN (body)").Error
+		if err != nil {
+			return err
+		}
+		return db.Exec("CREATE INDEX IF NOT EXISTS idx_message_texts_header_body ON " + TextIndexTableName + " USING GIN ((header || body))").Error
+	}
+	return nil
+}
+
+// dropCombinedTextIndex drops the index of older versions with a single text column,
+// and marks the messages as not indexed.
+func dropCombinedTextIndex(db *gorm.DB) error {
+	if !db.Migrator().HasTable(TextIndexTableName) {
+		return nil
+	}
+
+	var columns int64
+	var err error
+	if db.Dialector.Name() == "sqlite" {
+		err = db.Raw("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'text'", TextIndexTableName).Scan(&columns).Error
+	} else if db.Migrator().HasColumn(TextIndexTableName, "text") {
+		columns = 1
+	}
+	if err != nil || columns == 0 {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("DROP TABLE " + TextIndexTableName).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Message{}).Where("text_indexed = ?", true).UpdateColumn("text_indexed", false).Error
+	})
+}
+
+// newTextIndex returns the full-text index of the database, or nil when it wasn't migrated.
+func newTextIndex(db *gorm.DB) TextIndex {
+	if !db.Migrator().HasTable(TextIndexTableName) {
+		return nil
+	}
+	switch db.Dialector.Name() {
+	case "sqlite":
+		return sqliteTextIndex{}
+	case "postgres":
+		return postgresTextIndex{}
+	}
+	return nil
+}
+
+// sqliteTextIndex is an FTS5 table with the text of every message as its row with the id of the message.
+type sqliteTextIndex struct{}
+
+func (sqliteTextIndex) Index(tx *gorm.DB, messageID uint, header string, body string) error {
+	err := tx.Exec("DELETE FROM "+TextIndexTableName+" WHERE rowid = ?", messageID).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec("INSERT INTO "+TextIndexTableName+" (rowid, header, body) VALUES (?, ?, ?)", messageID, header, body).Error
+}
+
+func (sqliteTextIndex) Copy(tx *gorm.DB, messageID uint, blobHash string) (bool, error) {
+	result := tx.Exec("INSERT INTO "+TextIndexTableName+" (rowid, header, body) SELECT ?, header, body FROM "+TextIndexTableName+
+		" WHERE rowid IN (SELECT id FROM messages WHERE blob_hash = ? AND id <> ?) LIMIT 1", messageID, blobHash, messageID)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (sqliteTextIndex) Delete(tx *gorm.DB, messageIDs ...uint) error {
+	return tx.Exec("DELETE FROM "+TextIndexTableName+" WHERE rowid IN ?", messageIDs).Error
+}
+
+func (sqliteTextIndex) Condition(words []string, body bool) (string, []interface{}) {
+	query := []string{}
+	for _, word := range words {
+		if body {
+			query = append(query, `body : "`+word+`"*`)
+			continue
+		}
+		query = append(query, `"`+word+`"*`)
+	}
+	return "id IN (SELECT rowid FROM " + TextIndexTableName + " WHERE " + TextIndexTableName + " MATCH ?)", []interface{}{strings.Join(query, " ")}
+}
+
+// postgresTextIndex is a table with a tsvector of the header fields and one of the body of every message, with GIN indexes.
+type postgresTextIndex struct{}
+
+func (postgresTextIndex) Index(tx *gorm.DB, messageID uint, header string, body string) error {
+	return tx.Exec("INSERT INTO "+TextIndexTableName+" (message_id, header, body) VALUES (?, to_tsvector('simple', ?), to_tsvector('simple', ?)) "+
+		"ON CONFLICT (message_id) DO UPDATE SET header = excluded.header, body = excluded.body", messageID, header, body).Error
+}
+
+func (postgresTextIndex) Copy(tx *gorm.DB, messageID uint, blobHash string) (bool, error) {
+	result := tx.Exec("INSERT INTO "+TextIndexTableName+" (message_id, header, body) SELECT ?, header, body FROM "+TextIndexTableName+
+		" WHERE message_id IN (SELECT id FROM messages WHERE blob_hash = ? AND id <> ?) LIMIT 1 ON CONFLICT DO NOTHING", messageID, blobHash, messageID)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (postgresTextIndex) Delete(tx *gorm.DB, messageIDs ...uint) error {
+	return tx.Exec("DELETE FROM "+TextIndexTableName+" WHERE message_id IN ?", messageIDs).Error
+}
+
+func (postgresTextIndex) Condition(words []string, body bool) (string, []interface{}) {
+	query := []string{}
+	for _, word := range words {
+		query = append(query, word+":*")
+	}
+	column := "(header || body)"
+	if body {
+		column = "body"
+	}
+	return "id IN (SELECT message_id FROM " + TextIndexTableName + " WHERE " + column + " @@ to_tsquery('simple', ?))", []interface{}{strings.Join(query, " & ")}
+}
+
+// SearchWords splits the text into the words it can be searched for in the full-text index.
+func SearchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), isSeparator)
+}
+
+// SubstringWords returns the words that a text containing the substring has as words or the start of words,
+// so the full-text index finds every message that contains it.
+// The first word is left out when the substring starts with it, since it might be the end of a longer word.
+func SubstringWords(substr string) []string {
+	words := SearchWords(substr)
+	first, _ := utf8.DecodeRuneInString(substr)
+	if len(words) > 0 && !isSeparator(first) {
+		words = words[1:]
+	}
+	return words
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// HasTextIndex returns whether the messages are indexed in a full-text index.
+func (r *MessageRepository) HasTextIndex() bool {
+	return r.textIndex != nil
+}
+
+// indexableText returns the text of the message that is indexed and whether it can be indexed.
+func (r *MessageRepository) indexableText(message *Message) (*MessageText, bool) {
+	if r.textIndex == nil || message.Encrypted {
+		return nil, false
+	}
+	text := ParseMessageText(message.Body)
+	return text, text.size() <= maxIndexedText
+}
+
+// indexText adds the text of the message to the full-text index, or removes the message when it isn't indexed.
+// A copy gets the text of the message it is a copy of.
+func (r *MessageRepository) indexText(tx *gorm.DB, message *Message, isCopy bool, text *MessageText) error {
+	if r.textIndex == nil {
+		return nil
+	}
+	if !message.TextIndexed {
+		return r.textIndex.Delete(tx, message.ID)
+	}
+	if !isCopy {
+		header := strings.Join(SearchWords(strings.Join(text.Header, "\n")), " ")
+		return r.textIndex.Index(tx, message.ID, header, strings.Join(SearchWords(text.Body), " "))
+	}
+
+	copied, err := r.textIndex.Copy(tx, message.ID, message.BlobHash)
+	if err != nil || copied {
+		return err
+	}
+	message.TextIndexed = false
+	return tx.Model(&Message{}).Where("id = ?", message.ID).UpdateColumn("text_indexed", false).Error
+}
+
+// RebuildTextIndex indexes the text of all messages that aren't encrypted again, and returns the number of indexed messages.
+// It can run while the server is running.
+func (r *MessageRepository) RebuildTextIndex() (int, error) {
+	if r.textIndex == nil {
+		return 0, ErrTextIndexUnsupported
+	}
+
+	indexed := 0
+	lastID := uint(0)
+	for {
+		var messages []*Message
+		err := r.db.Where("id > ? AND encrypted = ?", lastID, false).Order("id").Limit(100).Find(&messages).Error
+		if err != nil {
+			return indexed, fmt.Errorf("couldn't find messages to index: %w", err)
+		}
+		if len(messages) == 0 {
+			return indexed, nil
+		}
+
+		for _, message := range messages {
+			lastID = message.ID
+			err := r.loadBlobs(message)
+			if err != nil {
+				return indexed, fmt.Errorf("couldn't load message %d: %w", message.ID, err)
+			}
+
+			var text *MessageText
+			text, message.TextIndexed = r.indexableText(message)
+			err = r.db.Transaction(func(tx *gorm.DB) error {
+				// The message might have been deleted in the meantime
+				result := tx.Model(&Message{}).Where("id = ?", message.ID).UpdateColumn("text_indexed", message.TextIndexed)
+				if result.Error != nil || result.RowsAffected == 0 {
+					return result.Error
+				}
+				return r.indexText(tx, message, false, text)
+			})
+			if err != nil {
+				return indexed, fmt.Errorf("couldn't index message %d: %w", message.ID, err)
+			}
+			if message.TextIndexed {
+				indexed++
+			}
+		}
+	}
+}
+
+// MessageText is the text of a message that BODY and TEXT searches match, and that is indexed.
+// Runs of white space are replaced by a single space, so text is found regardless of how it is wrapped.
+type MessageText struct {
+	// Header contains the decoded header fields as "Key: value".
+	Header []string
+	// Body is the decoded text of the text parts, HTML parts are converted to text.
+	Body string
+}
+
+// ParseMessageText returns the text of the message.
+func ParseMessageText(body []byte) *MessageText {
+	text := &MessageText{}
+	entity, err := message.Read(bytes.NewReader(body))
+	if entity == nil {
+		return text
+	}
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return text
+	}
+
+	for fields := entity.Header.Fields(); fields.Next(); {
+		value, _ := fields.Text()
+		text.Header = append(text.Header, normalizeSpace(fields.Key()+": "+value))
+	}
+
+	var b strings.Builder
+	_ = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return nil
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		switch mediaType {
+		case "", "text/plain":
+			_, _ = io.Copy(&b, part.Body)
+		case "text/html":
+			htmlText(&b, part.Body)
+		default:
+			return nil
+		}
+		b.WriteString("\n")
+		return nil
+	})
+	text.Body = normalizeSpace(strings.TrimSpace(b.String()))
+	return text
+}
+
+// BodyContains returns whether the body contains the text, case-insensitively.
+func (t *MessageText) BodyContains(substr string) bool {
+	return containsFold(t.Body, substr)
+}
+
+// Contains returns whether a header field or the body contains the text, case-insensitively.
+func (t *MessageText) Contains(substr string) bool {
+	for _, field := range t.Header {
+		if containsFold(field, substr) {
+			return true
+		}
+	}
+	return t.BodyContains(substr)
+}
+
+// size returns the size of the text in the index.
+func (t *MessageText) size() int {
+	size := len(t.Body)
+	for _, field := range t.Header {
+		size += len(field) + 1
+	}
+	return size
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(normalizeSpace(substr)))
+}
+
+// normalizeSpace replaces the runs of white space in the text by a single space.
+func normalizeSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// htmlText writes the text of the HTML document without its scripts and styles.
+func htmlText(w *strings.Builder, r io.Reader) {
+	skip := 0
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				w.Write(tokenizer.Text())
+				w.WriteString(" ")
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageText(t *testing.T) {
+
+	body := "From: =?iso-8859-1?q?Andr=E9?= <andre@example.com>\r\n" +
+		"Subject: Menu\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Cr=E8me br=FBl=E9e\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PHN0eWxlPnAgeyBjb2xvcjogcmVkIH08L3N0eWxlPjxwPkFwcGxlICZhbXA7IHBlYXI8L3A+\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"\r\n" +
+		"binary\r\n" +
+		"--b--\r\n"
+
+	text := ParseMessageText([]byte(body))
+	assert.Contains(t, text.Header, "From: André <andre@example.com>")
+	assert.Contains(t, text.Body, "Crème brûlée")
+	assert.Contains(t, text.Body, "Apple & pear")
+	assert.NotContains(t, text.Body, "color")
+	assert.NotContains(t, text.Body, "binary")
+
+	// The body only contains the text of the body, and text is found regardless of how it is wrapped
+	assert.True(t, text.BodyContains("ME BRÛ"))
+	assert.True(t, text.BodyContains("brûlée\r\n apple"))
+	assert.False(t, text.BodyContains("menu"))
+	assert.True(t, text.Contains("subject: menu"))
+
+	assert.Equal(t, []string{"crème", "brûlée", "3", "times"}, SearchWords("Crème-brûlée, 3 times!"))
+	assert.Equal(t, []string{"brûlée", "3"}, SubstringWords("me-brûlée, 3"))
+	assert.Equal(t, []string{"crème", "brûlée"}, SubstringWords(" crème brûlée"))
+	assert.Empty(t, SubstringWords("ell"))
+}
+
+func TestTextIndex(t *testing.T) {
+
+	db := newTestDB(t)
+	require.NoError(t, MigrateTextIndex(db))
+	repo, err := NewMessageRepository(db)
+	require.NoError(t, err)
+	if !repo.HasTextIndex() {
+		t.Skip("SQLite is built without FTS5, build with -tags sqlite_fts5")
+	}
+
+	create := func(body string, encrypted bool) *Message {
+		message := &Message{Body: []byte(body), Encrypted: encrypted, MailboxID: 1}
+		require.NoError(t, repo.CreateMessage(message))
+		return message
+	}
+	find := func(criteria *SearchCriteria) []uint {
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{Search: criteria, OmitBody: true})
+		require.NoError(t, err)
+		uids := []uint{}
+		for _, message := range messages {
+			if message.TextIndexed {
+				uids = append(uids, message.UID)
+			}
+		}
+		return uids
+	}
+	search := func(text ...string) []uint {
+		return find(&SearchCriteria{Text: text})
+	}
+
+	pizza := create("Subject: Lunch\r\n\r\nPizza or pasta?\r\n", false)
+	create("Subject: Dinner\r\nContent-Type: text/html\r\n\r\n<p>Pasta <b>tonight</b></p>\r\n", false)
+	encrypted := create("Pizza", true)
+	assert.True(t, pizza.TextIndexed)
+	assert.False(t, encrypted.TextIndexed)
+
+	t.Run("TestSearch", func(t *testing.T) {
+		assert.Equal(t, []uint{1, 2}, search("PASTA"))
+		assert.Equal(t, []uint{1}, search("pizza pas"))
+		assert.Equal(t, []uint{2}, search("tonight", "dinner"))
+		assert.Equal(t, []uint{}, search("izza"))
+
+		// The header fields are only searched for TEXT
+		assert.Equal(t, []uint{1}, search("lunch"))
+		assert.Equal(t, []uint{}, find(&SearchCriteria{Body: []string{"lunch"}}))
+		assert.Equal(t, []uint{2}, find(&SearchCriteria{Body: []string{"tonight"}}))
+
+		// The encrypted message isn't indexed, it is found anyway
+		messages, err := repo.FindMessagesByMailboxID(1, FindMessagesParameters{Search: &SearchCriteria{Text: []string{"pizza"}}, OmitBody: true})
+		require.NoError(t, err)
+		assert.Len(t, messages, 2)
+	})
+
+	t.Run("TestCopyAndDelete", func(t *testing.T) {
+		copied := &Message{BlobHash: pizza.BlobHash, Prefix: pizza.Prefix, TextIndexed: true, MailboxID: 1}
+		require.NoError(t, repo.CreateMessage(copied))
+		assert.True(t, copied.TextIndexed)
+		assert.Equal(t, []uint{1, 4}, search("pizza"))
+
+		require.NoError(t, repo.DeleteMessageByID(pizza.ID))
+		assert.Equal(t, []uint{4}, search("pizza"))
+	})
+
+	t.Run("TestRebuild", func(t *testing.T) {
+		require.NoError(t, db.Exec("DELETE FROM "+TextIndexTableName).Error)
+		assert.Equal(t, []uint{}, search("pasta"))
+
+		indexed, err := repo.RebuildTextIndex()
+		require.NoError(t, err)
+		assert.Equal(t, 2, indexed)
+		assert.Equal(t, []uint{2, 4}, search("pasta"))
+	})
+
+	t.Run("TestMigrateCombinedIndex", func(t *testing.T) {
+		require.NoError(t, db.Exec("DROP TABLE "+TextIndexTableName).Error)
+		require.NoError(t, db.Exec("CREATE VIRTUAL TABLE "+TextIndexTableName+" USING fts5(text)").Error)
+
+		require.NoError(t, MigrateTextIndex(db))
+		var indexed int64
+		require.NoError(t, db.Model(&Message{}).Where("text_indexed = ?", true).Count(&indexed).Error)
+		assert.Zero(t, indexed)
+
+		_, err := repo.RebuildTextIndex()
+		require.NoError(t, err)
+		assert.Equal(t, []uint{2}, find(&SearchCriteria{Body: []string{"tonight"}}))
+	})
+}
@@ -15,6 +15,16 @@ type User struct {
 	Username string `gorm:"unique;not_null"`
 	Password string `gorm:"not_null" json:"-"`
 	Email    string `gorm:"unique;not_null"`
+
+	// EncryptionPublicKey is the key incoming mail is encrypted to when encryption is enabled for the user.
+	EncryptionPublicKey []byte `json:"-"`
+	// EncryptionPrivateKey is the private key, wrapped with a key derived from the password.
+	EncryptionPrivateKey []byte `json:"-"`
+}
+
+// EncryptionEnabled returns whether the messages of the user are encrypted at rest.
+func (u *User) EncryptionEnabled() bool {
+	return len(u.EncryptionPublicKey) > 0
 }
 
 // NewUser creates a new user and hashes the plaintext password.
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook represents an HTTP endpoint that receives events.
+type Webhook struct {
+	gorm.Model
+
+	ID uint `gorm:"primary_key;auto_increment;not_null"`
+
+	// URL is the endpoint the events are posted to.
+	URL string `gorm:"not_null"`
+	// Secret is used to sign the payloads with HMAC-SHA256, it is only shown when the webhook is created.
+	Secret string `gorm:"not_null" json:"-"`
+	// Events is the list of subscribed event types, an empty list subscribes to all events.
+	Events StringSlice
+	// Enabled denotes whether events are delivered to the endpoint.
+	Enabled bool
+}
+
+// Subscribed checks whether the webhook wants to receive the given event type.
+func (w *Webhook) Subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDeliveryStatus denotes the state of a webhook delivery.
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookDeliveryPending is a delivery that still has to be (re)tried.
+	WebhookDeliveryPending WebhookDeliveryStatus = "pending"
+	// WebhookDeliverySucceeded is a delivery that was accepted by the endpoint.
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	// WebhookDeliveryFailed is a delivery that was given up on.
+	WebhookDeliveryFailed WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery represents a single event for a single webhook.
+// It serves both as the persistent retry queue and as the delivery log.
+type WebhookDelivery struct {
+	gorm.Model
+
+	ID uint `gorm:"primary_key;auto_increment;not_null"`
+
+	WebhookID uint `gorm:"index;foreignKey:Webhook"`
+	EventID   string
+	EventType string
+	Payload   []byte `json:"-"`
+
+	Status         WebhookDeliveryStatus `gorm:"index:idx_webhook_delivery_due"`
+	Attempts       uint
+	NextAttemptAt  time.Time `gorm:"index:idx_webhook_delivery_due"`
+	LastStatusCode int
+	LastError      string
+	DeliveredAt    *time.Time
+}
+
+// WebhookRepository implements the Webhook and WebhookDelivery repository
+type WebhookRepository struct {
+	db *gorm.DB
+}
+
+// NewWebhookRepository creates a new WebhookRepository
+func NewWebhookRepository(db *gorm.DB) (*WebhookRepository, error) {
+	return &WebhookRepository{db: db}, nil
+}
+
+// CreateWebhook creates a new webhook in the database.
+func (r *WebhookRepository) CreateWebhook(webhook *Webhook) error {
+	return r.db.Create(webhook).Error
+}
+
+// GetWebhookByID retrieves a webhook from the database by its ID.
+func (r *WebhookRepository) GetWebhookByID(id uint) (*Webhook, error) {
+	var webhook Webhook
+	err := r.db.First(&webhook, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// DeleteWebhook deletes a webhook from the database by its ID.
+func (r *WebhookRepository) DeleteWebhook(id uint) error {
+	return r.db.Delete(&Webhook{}, id).Error
+}
+
+// GetAllWebhooks retrieves all webhooks from the database.
+func (r *WebhookRepository) GetAllWebhooks() ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := r.db.Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// FindEnabledWebhooks finds all enabled webhooks.
+func (r *WebhookRepository) FindEnabledWebhooks() ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := r.db.Where("enabled = ?", true).Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// CreateDelivery creates a new delivery in the database.
+func (r *WebhookRepository) CreateDelivery(delivery *WebhookDelivery) error {
+	return r.db.Create(delivery).Error
+}
+
+// UpdateDelivery updates an existing delivery in the database.
+func (r *WebhookRepository) UpdateDelivery(delivery *WebhookDelivery) error {
+	return r.db.Save(delivery).Error
+}
+
+// FindDueDeliveries finds the pending deliveries that should be attempted before the given time.
+func (r *WebhookRepository) FindDueDeliveries(before time.Time, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := r.db.
+		Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryPending, before).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// FindDeliveriesByWebhookID finds the most recent deliveries of the given webhook.
+func (r *WebhookRepository) FindDeliveriesByWebhookID(webhookID uint, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := r.db.Where("webhook_id = ?", webhookID).Order("id desc").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
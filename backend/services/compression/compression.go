@@ -0,0 +1,94 @@
+// Package compression compresses the stored content of messages with zstd.
+//
+// Compressed data is recognized by the zstd magic number, so data that was stored before compression was enabled
+// can still be read. Messages never start with those bytes, and data that does is always compressed.
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultLevel is the default zstd compression level, which is fast and compresses mail well.
+	DefaultLevel = 3
+	// MaxLevel is the highest zstd compression level.
+	MaxLevel = 22
+)
+
+// magic is the start of every zstd frame.
+var magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+
+	encodersMu sync.Mutex
+	encoders   = map[int]*zstd.Encoder{}
+)
+
+// ValidLevel returns an error when the level isn't a zstd compression level or 0, which disables compression.
+func ValidLevel(level int) error {
+	if level < 0 || level > MaxLevel {
+		return fmt.Errorf("compression level must be between 0 and %d", MaxLevel)
+	}
+	return nil
+}
+
+// encoder returns the encoder for the level, encoders can be used concurrently.
+func encoder(level int) (*zstd.Encoder, error) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	enc, ok := encoders[level]
+	if !ok {
+		var err error
+		enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create zstd encoder: %w", err)
+		}
+		encoders[level] = enc
+	}
+	return enc, nil
+}
+
+// IsCompressed returns whether the data is compressed.
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Compress compresses the data with the given level.
+// The data is returned as it is when compression is disabled or doesn't make it smaller,
+// unless it would be mistaken for compressed data.
+func Compress(data []byte, level int) ([]byte, error) {
+	if level == 0 && !IsCompressed(data) {
+		return data, nil
+	}
+	if level == 0 {
+		level = 1
+	}
+
+	enc, err := encoder(level)
+	if err != nil {
+		return nil, err
+	}
+	compressed := enc.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if len(compressed) >= len(data) && !IsCompressed(data) {
+		return data, nil
+	}
+	return compressed, nil
+}
+
+// Decompress returns the original data of compressed data, other data is returned as it is.
+func Decompress(data []byte) ([]byte, error) {
+	if !IsCompressed(data) {
+		return data, nil
+	}
+	decompressed, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress data: %w", err)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,66 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+
+	message := []byte("Subject: Hello\r\n\r\n" + string(bytes.Repeat([]byte("Hello world!\r\n"), 100)))
+
+	t.Run("TestCompress", func(t *testing.T) {
+		for _, level := range []int{1, DefaultLevel, 9, MaxLevel} {
+			compressed, err := Compress(message, level)
+			require.NoError(t, err)
+			assert.True(t, IsCompressed(compressed))
+			assert.Less(t, len(compressed), len(message))
+
+			decompressed, err := Decompress(compressed)
+			require.NoError(t, err)
+			assert.Equal(t, message, decompressed)
+		}
+	})
+
+	t.Run("TestUncompressed", func(t *testing.T) {
+		// Data that was stored before compression is read as it is
+		data, err := Decompress(message)
+		require.NoError(t, err)
+		assert.Equal(t, message, data)
+
+		data, err = Compress(message, 0)
+		require.NoError(t, err)
+		assert.Equal(t, message, data)
+
+		random := make([]byte, 1000)
+		_, err = rand.Read(random)
+		require.NoError(t, err)
+		random[0] = 'X'
+		data, err = Compress(random, DefaultLevel)
+		require.NoError(t, err)
+		assert.Equal(t, random, data)
+	})
+
+	t.Run("TestLooksCompressed", func(t *testing.T) {
+		data := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "not compressed"...)
+		for _, level := range []int{0, DefaultLevel} {
+			compressed, err := Compress(data, level)
+			require.NoError(t, err)
+			decompressed, err := Decompress(compressed)
+			require.NoError(t, err)
+			assert.Equal(t, data, decompressed)
+		}
+	})
+
+	t.Run("TestValidLevel", func(t *testing.T) {
+		assert.NoError(t, ValidLevel(0))
+		assert.NoError(t, ValidLevel(MaxLevel))
+		assert.Error(t, ValidLevel(-1))
+		assert.Error(t, ValidLevel(MaxLevel+1))
+	})
+
+}
@@ -0,0 +1,127 @@
+// Package encryption encrypts the stored messages of a user, so they can only be read with the password of the user.
+//
+// Every user has an X25519 keypair. Messages are sealed to the public key, so incoming mail can be encrypted
+// without the password. The private key is stored wrapped with a key that is derived from the password with Argon2id.
+package encryption
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Argon2id parameters as recommended by RFC 9106 for memory constrained environments.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+const (
+	// wrapVersion is the first byte of a wrapped private key, so the format can change later.
+	wrapVersion = 1
+	saltLength  = 16
+	nonceLength = 24
+	keyLength   = 32
+)
+
+var (
+	// ErrWrongPassword is returned when the private key can't be unwrapped with the password.
+	ErrWrongPassword = errors.New("couldn't unwrap private key: wrong password")
+	// ErrDecrypt is returned when a message can't be decrypted with the private key.
+	ErrDecrypt = errors.New("couldn't decrypt message")
+)
+
+// Key is an unwrapped keypair, it should only be kept in memory.
+type Key struct {
+	PublicKey  *[keyLength]byte
+	privateKey *[keyLength]byte
+}
+
+// GenerateKey creates a new keypair and returns it with the private key wrapped with the password.
+func GenerateKey(password string) (*Key, []byte, error) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't generate key: %w", err)
+	}
+
+	key := &Key{PublicKey: publicKey, privateKey: privateKey}
+	wrapped, err := key.Wrap(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+// Wrap encrypts the private key with a key derived from the password.
+func (k *Key) Wrap(password string) ([]byte, error) {
+	var salt [saltLength]byte
+	var nonce [nonceLength]byte
+	if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+		return nil, fmt.Errorf("couldn't create salt: %w", err)
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, fmt.Errorf("couldn't create nonce: %w", err)
+	}
+
+	wrapped := []byte{wrapVersion}
+	wrapped = append(wrapped, salt[:]...)
+	wrapped = append(wrapped, nonce[:]...)
+	return secretbox.Seal(wrapped, k.privateKey[:], &nonce, passwordKey(password, salt[:])), nil
+}
+
+// Unwrap decrypts the wrapped private key with the password.
+func Unwrap(publicKey []byte, wrapped []byte, password string) (*Key, error) {
+	if len(publicKey) != keyLength {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	if len(wrapped) < 1+saltLength+nonceLength || wrapped[0] != wrapVersion {
+		return nil, fmt.Errorf("invalid wrapped private key")
+	}
+
+	salt := wrapped[1 : 1+saltLength]
+	var nonce [nonceLength]byte
+	copy(nonce[:], wrapped[1+saltLength:])
+
+	privateKey, ok := secretbox.Open(nil, wrapped[1+saltLength+nonceLength:], &nonce, passwordKey(password, salt))
+	if !ok || len(privateKey) != keyLength {
+		return nil, ErrWrongPassword
+	}
+
+	key := &Key{PublicKey: new([keyLength]byte), privateKey: new([keyLength]byte)}
+	copy(key.PublicKey[:], publicKey)
+	copy(key.privateKey[:], privateKey)
+	return key, nil
+}
+
+// passwordKey derives the key that wraps the private key from the password.
+func passwordKey(password string, salt []byte) *[keyLength]byte {
+	var key [keyLength]byte
+	copy(key[:], argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, keyLength))
+	return &key
+}
+
+// Encrypt seals the data to the public key, only the owner of the private key can decrypt it.
+func Encrypt(publicKey []byte, data []byte) ([]byte, error) {
+	if len(publicKey) != keyLength {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	var recipient [keyLength]byte
+	copy(recipient[:], publicKey)
+
+	return box.SealAnonymous(nil, data, &recipient, rand.Reader)
+}
+
+// Decrypt opens data that was sealed to the public key of the keypair.
+func (k *Key) Decrypt(data []byte) ([]byte, error) {
+	message, ok := box.OpenAnonymous(nil, data, k.PublicKey, k.privateKey)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return message, nil
+}
@@ -0,0 +1,54 @@
+package encryption
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+
+	key, wrapped, err := GenerateKey("password")
+	require.NoError(t, err)
+
+	message := []byte("Subject: Secret\r\n\r\nHello\r\n")
+	encrypted, err := Encrypt(key.PublicKey[:], message)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "Secret")
+
+	t.Run("TestUnwrap", func(t *testing.T) {
+		unwrapped, err := Unwrap(key.PublicKey[:], wrapped, "password")
+		require.NoError(t, err)
+
+		decrypted, err := unwrapped.Decrypt(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, message, decrypted)
+
+		_, err = Unwrap(key.PublicKey[:], wrapped, "wrong")
+		assert.ErrorIs(t, err, ErrWrongPassword)
+	})
+
+	t.Run("TestRewrap", func(t *testing.T) {
+		rewrapped, err := key.Wrap("new password")
+		require.NoError(t, err)
+
+		unwrapped, err := Unwrap(key.PublicKey[:], rewrapped, "new password")
+		require.NoError(t, err)
+		decrypted, err := unwrapped.Decrypt(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, message, decrypted)
+
+		_, err = Unwrap(key.PublicKey[:], rewrapped, "password")
+		assert.ErrorIs(t, err, ErrWrongPassword)
+	})
+
+	t.Run("TestOtherKey", func(t *testing.T) {
+		other, _, err := GenerateKey("password")
+		require.NoError(t, err)
+
+		_, err = other.Decrypt(encrypted)
+		assert.ErrorIs(t, err, ErrDecrypt)
+	})
+
+}
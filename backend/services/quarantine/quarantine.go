@@ -0,0 +1,52 @@
+// Package quarantine contains the header that marks quarantined messages.
+// It is shared by the SMTP handlers that quarantine messages and the IMAP backend that delivers them.
+package quarantine
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Header is added by the SMTP handlers to messages that are quarantined, its value is the reason.
+// Quarantined messages are delivered in the Junk mailbox.
+const Header = "X-MistralMail-Quarantine"
+
+// Strip removes the quarantine header from the message,
+// so a sender can't decide itself that its message is quarantined.
+func Strip(data []byte) []byte {
+	var out bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(data))
+	skipping := false
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			break
+		}
+
+		// The header ends at the first empty line, the body is copied as is
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out.Write(line)
+			rest, _ := io.ReadAll(reader)
+			out.Write(rest)
+			break
+		}
+
+		continuation := line[0] == ' ' || line[0] == '\t'
+		if !continuation {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = strings.EqualFold(strings.TrimSpace(string(name)), Header)
+		}
+		if !skipping {
+			out.Write(line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return out.Bytes()
+}
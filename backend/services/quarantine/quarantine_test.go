@@ -0,0 +1,23 @@
+package quarantine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrip(t *testing.T) {
+
+	data := "X-Mistralmail-Quarantine: not spam\r\n" +
+		"Subject: Hello\r\n" +
+		"X-MistralMail-Quarantine: folded\r\n" +
+		"\tover two lines\r\n" +
+		"\r\n" +
+		"X-MistralMail-Quarantine: in the body\r\n"
+
+	assert.Equal(t, "Subject: Hello\r\n\r\nX-MistralMail-Quarantine: in the body\r\n", string(Strip([]byte(data))))
+
+	// Messages without the header are left alone
+	assert.Equal(t, "Subject: Hello\r\n\r\nHello world!", string(Strip([]byte("Subject: Hello\r\n\r\nHello world!"))))
+
+}
@@ -0,0 +1,96 @@
+package scripting
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.starlark.net/starlark"
+)
+
+// enhancedCodeRegexp matches an enhanced status code (RFC 3463).
+var enhancedCodeRegexp = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// builtins are the predeclared functions of every script.
+var builtins = starlark.StringDict{
+	"accept":     starlark.NewBuiltin("accept", accept),
+	"reject":     starlark.NewBuiltin("reject", reply(ActionReject, 500, 599)),
+	"tempfail":   starlark.NewBuiltin("tempfail", reply(ActionTempFail, 400, 499)),
+	"discard":    starlark.NewBuiltin("discard", withReason(ActionDiscard)),
+	"quarantine": starlark.NewBuiltin("quarantine", withReason(ActionQuarantine)),
+}
+
+// verdict is the Starlark value returned by the verdict builtins.
+type verdict struct {
+	action       Action
+	code         int
+	enhancedCode string
+	message      string
+	reason       string
+}
+
+var _ starlark.Value = (*verdict)(nil)
+
+// String implements the starlark.Value interface.
+func (v *verdict) String() string {
+	if v.code != 0 {
+		return fmt.Sprintf("%s(%d, %q)", v.action, v.code, v.message)
+	}
+	return fmt.Sprintf("%s(%q)", v.action, v.reason)
+}
+
+// Type implements the starlark.Value interface.
+func (v *verdict) Type() string { return "verdict" }
+
+// Freeze implements the starlark.Value interface, verdicts are immutable.
+func (v *verdict) Freeze() {}
+
+// Truth implements the starlark.Value interface.
+func (v *verdict) Truth() starlark.Bool { return starlark.True }
+
+// Hash implements the starlark.Value interface.
+func (v *verdict) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: verdict")
+}
+
+// accept implements accept().
+func accept(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return &verdict{action: ActionAccept}, nil
+}
+
+// reply returns the implementation of reject(code, message, enhanced_code="") and tempfail(code, message, enhanced_code="").
+func reply(action Action, minCode int, maxCode int) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var code int
+		var message, enhancedCode string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "code", &code, "message", &message, "enhanced_code?", &enhancedCode); err != nil {
+			return nil, err
+		}
+		if code < minCode || code > maxCode {
+			return nil, fmt.Errorf("%s: code should be between %d and %d", b.Name(), minCode, maxCode)
+		}
+		if enhancedCode != "" && !enhancedCodeRegexp.MatchString(enhancedCode) {
+			return nil, fmt.Errorf("%s: invalid enhanced status code %q", b.Name(), enhancedCode)
+		}
+		if enhancedCode != "" && enhancedCode[0] != byte('0'+code/100) {
+			return nil, fmt.Errorf("%s: enhanced status code %q doesn't match code %d", b.Name(), enhancedCode, code)
+		}
+		return &verdict{action: action, code: code, enhancedCode: enhancedCode, message: message}, nil
+	}
+}
+
+// withReason returns the implementation of discard(reason="") and quarantine(reason="").
+func withReason(action Action) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		reason := ""
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "reason?", &reason); err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("%s by script", action)
+		}
+		return &verdict{action: action, reason: reason}, nil
+	}
+}
@@ -0,0 +1,383 @@
+package scripting
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// DefaultMaxSteps denotes the max number of Starlark computation steps of a single run.
+	DefaultMaxSteps uint64 = 1000000
+	// DefaultTimeout denotes how long a single run of the script is allowed to take.
+	DefaultTimeout = time.Second
+)
+
+// Functions of the script that are called by MistralMail.
+const (
+	// FunctionSMTP is called by the script handler in the SMTP handler pipeline.
+	FunctionSMTP = "smtp"
+	// FunctionDeliver is called by the IMAP backend for every local recipient before the message is stored.
+	FunctionDeliver = "deliver"
+)
+
+// Action denotes what happens with the message after running the script.
+type Action string
+
+const (
+	// ActionContinue continues handling the message as usual.
+	ActionContinue Action = "continue"
+	// ActionAccept accepts the message without running the remaining handlers.
+	ActionAccept Action = "accept"
+	// ActionReject rejects the message permanently.
+	ActionReject Action = "reject"
+	// ActionTempFail asks the client to retry later.
+	ActionTempFail Action = "tempfail"
+	// ActionDiscard accepts the message but silently drops it.
+	ActionDiscard Action = "discard"
+	// ActionQuarantine quarantines the message.
+	ActionQuarantine Action = "quarantine"
+)
+
+// Message contains the envelope and the message that are exposed to the script.
+type Message struct {
+	Sender            string
+	Recipients        []string
+	ClientIP          string
+	Helo              string
+	AuthenticatedUser string
+	Data              []byte
+
+	// Recipient and Mailbox are only set when delivering to a local recipient.
+	Recipient string
+	Mailbox   string
+}
+
+// NewMessage creates the message that is exposed to the script from an SMTP state.
+func NewMessage(state *smtp.State) *Message {
+
+	recipients := make([]string, len(state.To))
+	for i, to := range state.To {
+		recipients[i] = to.GetAddress()
+	}
+
+	msg := &Message{
+		Recipients: recipients,
+		Helo:       state.Hostname,
+		Data:       state.Data,
+	}
+	if state.From != nil {
+		msg.Sender = state.From.GetAddress()
+	}
+	if state.Ip != nil {
+		msg.ClientIP = state.Ip.String()
+	}
+	if state.Authenticated && state.User != nil {
+		msg.AuthenticatedUser = state.User.Username()
+	}
+
+	return msg
+}
+
+// Header is a header field added by the script.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Result is the outcome of running the script.
+type Result struct {
+	Action Action
+	// Code, EnhancedCode and Message are the SMTP reply for rejects and tempfails.
+	Code         int
+	EnhancedCode string
+	Message      string
+	// Reason is given for discards and quarantines.
+	Reason string
+	// Headers are the header fields added by the script, in order.
+	Headers []Header
+	// Mailbox is the destination mailbox set by the script, it is only used when delivering.
+	Mailbox string
+}
+
+// RejectedError is returned by the IMAP backend when the delivery script rejected a message.
+type RejectedError struct {
+	Result *Result
+}
+
+// Error implements the error interface.
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected by delivery script: %d %s %s", e.Result.Code, e.Result.EnhancedCode, e.Result.Message)
+}
+
+// Script is a Starlark script that decides what happens with a message.
+//
+// The script defines the functions smtp(mail) and/or deliver(mail), which either return nothing to continue as usual
+// or the result of one of the builtins accept(), reject(code, message, enhanced_code=""),
+// tempfail(code, message, enhanced_code=""), discard(reason="") and quarantine(reason="").
+//
+// The script is reloaded when the file changes. Every run is limited in computation steps and time.
+type Script struct {
+	path     string
+	maxSteps uint64
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	globals starlark.StringDict
+}
+
+// New loads the script at the given path.
+func New(path string, maxSteps uint64, timeout time.Duration) (*Script, error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("no script given")
+	}
+
+	s := &Script{
+		path:     path,
+		maxSteps: maxSteps,
+		timeout:  timeout,
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read script: %w", err)
+	}
+
+	err = s.load(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Run calls the given function of the script for the message.
+// When the script doesn't define the function, the message continues as usual.
+func (s *Script) Run(function string, msg *Message) (*Result, error) {
+
+	globals := s.reload()
+
+	fn, ok := globals[function].(starlark.Callable)
+	if !ok {
+		return &Result{Action: ActionContinue}, nil
+	}
+
+	result := &Result{Action: ActionContinue}
+
+	thread := s.newThread(function)
+	timer := time.AfterFunc(s.timeout, func() {
+		thread.Cancel(fmt.Sprintf("script took longer than %s", s.timeout))
+	})
+	defer timer.Stop()
+
+	value, err := starlark.Call(thread, fn, starlark.Tuple{newMail(msg, result, function == FunctionDeliver)}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in %s(): %w", function, err)
+	}
+
+	switch v := value.(type) {
+	case starlark.NoneType:
+	case *verdict:
+		result.Action = v.action
+		result.Code = v.code
+		result.EnhancedCode = v.enhancedCode
+		result.Message = v.message
+		result.Reason = v.reason
+	default:
+		return nil, fmt.Errorf("%s() returned a %s instead of a verdict", function, value.Type())
+	}
+
+	return result, nil
+}
+
+// reload loads the script again when the file changed and returns its globals.
+// When the new version can't be loaded, the previous version stays in use.
+func (s *Script) reload() starlark.StringDict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		log.WithField("Script", s.path).Errorf("Couldn't read script, keeping the previous version: %v", err)
+		return s.globals
+	}
+
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.globals
+	}
+
+	err = s.loadLocked(info)
+	if err != nil {
+		log.WithField("Script", s.path).Errorf("Couldn't reload script, keeping the previous version: %v", err)
+		// Don't retry until the file changes again
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+		return s.globals
+	}
+
+	log.WithField("Script", s.path).Info("Reloaded script")
+	return s.globals
+}
+
+// load loads the script.
+func (s *Script) load(info os.FileInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked(info)
+}
+
+// loadLocked loads the script, s.mu must be held.
+func (s *Script) loadLocked(info os.FileInfo) error {
+
+	src, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("couldn't read script: %w", err)
+	}
+
+	thread := s.newThread("load")
+	timer := time.AfterFunc(s.timeout, func() {
+		thread.Cancel(fmt.Sprintf("loading took longer than %s", s.timeout))
+	})
+	defer timer.Stop()
+
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, s.path, src, builtins)
+	if err != nil {
+		return fmt.Errorf("couldn't load script: %w", err)
+	}
+	globals.Freeze()
+
+	s.globals = globals
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
+
+// newThread creates a Starlark thread with the execution limits.
+func (s *Script) newThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.WithField("Script", s.path).Info(msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(s.maxSteps)
+	return thread
+}
+
+// newMail creates the mail value that is passed to the script.
+// The helpers of the mail value record their changes in the result.
+func newMail(msg *Message, result *Result, delivering bool) *starlarkstruct.Struct {
+
+	recipients := make([]starlark.Value, len(msg.Recipients))
+	for i, recipient := range msg.Recipients {
+		recipients[i] = starlark.String(recipient)
+	}
+
+	header := mail.Header{}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(msg.Data)); err == nil {
+		header = parsed.Header
+	}
+
+	headers := starlark.NewDict(len(header))
+	for key, values := range header {
+		list := make([]starlark.Value, len(values))
+		for i, value := range values {
+			list[i] = starlark.String(value)
+		}
+		_ = headers.SetKey(starlark.String(strings.ToLower(key)), starlark.NewList(list))
+	}
+	headers.Freeze()
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+
+	getHeader := starlark.NewBuiltin("header", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name); err != nil {
+			return nil, err
+		}
+		values := header[textproto.CanonicalMIMEHeaderKey(name)]
+		if len(values) == 0 {
+			return starlark.None, nil
+		}
+		return starlark.String(values[0]), nil
+	})
+
+	addHeader := starlark.NewBuiltin("add_header", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name, value string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "value", &value); err != nil {
+			return nil, err
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("%s: invalid header name %q", b.Name(), name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("%s: header value cannot contain line breaks", b.Name())
+		}
+		result.Headers = append(result.Headers, Header{Name: name, Value: value})
+		return starlark.None, nil
+	})
+
+	setMailbox := starlark.NewBuiltin("set_mailbox", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name); err != nil {
+			return nil, err
+		}
+		if !delivering {
+			return nil, fmt.Errorf("%s: the mailbox can only be set in %s()", b.Name(), FunctionDeliver)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s: mailbox name cannot be empty", b.Name())
+		}
+		result.Mailbox = name
+		return starlark.None, nil
+	})
+
+	fields := starlark.StringDict{
+		"sender":             starlark.String(msg.Sender),
+		"recipients":         starlark.Tuple(recipients),
+		"recipient":          starlark.String(msg.Recipient),
+		"mailbox":            starlark.String(msg.Mailbox),
+		"client_ip":          starlark.String(msg.ClientIP),
+		"helo":               starlark.String(msg.Helo),
+		"authenticated_user": starlark.String(msg.AuthenticatedUser),
+		"size":               starlark.MakeInt(len(msg.Data)),
+		"subject":            starlark.String(subject),
+		"headers":            headers,
+		"header":             getHeader,
+		"add_header":         addHeader,
+		"set_mailbox":        setMailbox,
+	}
+
+	return starlarkstruct.FromStringDict(starlark.String("mail"), fields)
+}
+
+// validHeaderName checks whether the name only contains printable characters without colon (RFC 5322).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r > '~' || r == ':' {
+			return false
+		}
+	}
+	return true
+}
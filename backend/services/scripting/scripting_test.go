@@ -0,0 +1,163 @@
+package scripting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeScript writes the script to a file in a temporary directory and returns its path.
+func writeScript(t *testing.T, dir string, src string) string {
+	path := filepath.Join(dir, "policy.star")
+	require.NoError(t, os.WriteFile(path, []byte(src), 0o600))
+	return path
+}
+
+func TestScript(t *testing.T) {
+
+	msg := &Message{
+		Sender:     "sender@example.net",
+		Recipients: []string{"one@example.com", "two@example.com"},
+		ClientIP:   "192.168.0.10",
+		Helo:       "client.example.net",
+		Data:       []byte("Subject: =?utf-8?q?Caf=C3=A9?=\r\nList-Id: <news.example.net>\r\n\r\nHello world!\r\n"),
+	}
+
+	t.Run("TestEnvelopeAndHeaders", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), `
+def smtp(mail):
+    mail.add_header("X-Envelope", "%s %s %d" % (mail.sender, ",".join(mail.recipients), mail.size))
+    mail.add_header("X-Subject", mail.subject)
+    if mail.header("list-id") and "list-id" in mail.headers:
+        mail.add_header("X-List", mail.headers["list-id"][0])
+`)
+		s, err := New(path, DefaultMaxSteps, DefaultTimeout)
+		require.NoError(t, err)
+
+		result, err := s.Run(FunctionSMTP, msg)
+		require.NoError(t, err)
+		assert.Equal(t, ActionContinue, result.Action)
+		assert.Equal(t, []Header{
+			{Name: "X-Envelope", Value: "sender@example.net one@example.com,two@example.com 77"},
+			{Name: "X-Subject", Value: "Café"},
+			{Name: "X-List", Value: "<news.example.net>"},
+		}, result.Headers)
+	})
+
+	t.Run("TestVerdicts", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), `
+def smtp(mail):
+    if mail.client_ip == "192.168.0.10":
+        return reject(550, "Go away", enhanced_code="5.7.1")
+    return tempfail(451, "Later")
+
+def deliver(mail):
+    if mail.recipient == "two@example.com":
+        return discard()
+    mail.set_mailbox("Lists")
+`)
+		s, err := New(path, DefaultMaxSteps, DefaultTimeout)
+		require.NoError(t, err)
+
+		result, err := s.Run(FunctionSMTP, msg)
+		require.NoError(t, err)
+		assert.Equal(t, &Result{Action: ActionReject, Code: 550, EnhancedCode: "5.7.1", Message: "Go away"}, result)
+
+		delivery := *msg
+		delivery.Recipient = "one@example.com"
+		delivery.Mailbox = "INBOX"
+		result, err = s.Run(FunctionDeliver, &delivery)
+		require.NoError(t, err)
+		assert.Equal(t, ActionContinue, result.Action)
+		assert.Equal(t, "Lists", result.Mailbox)
+
+		delivery.Recipient = "two@example.com"
+		result, err = s.Run(FunctionDeliver, &delivery)
+		require.NoError(t, err)
+		assert.Equal(t, ActionDiscard, result.Action)
+	})
+
+	t.Run("TestInvalidUse", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), `
+def smtp(mail):
+    mail.set_mailbox("Lists")
+
+def deliver(mail):
+    return reject(451, "Not a permanent code")
+`)
+		s, err := New(path, DefaultMaxSteps, DefaultTimeout)
+		require.NoError(t, err)
+
+		_, err = s.Run(FunctionSMTP, msg)
+		assert.Error(t, err)
+
+		_, err = s.Run(FunctionDeliver, msg)
+		assert.Error(t, err)
+
+		// Undefined functions continue as usual
+		path = writeScript(t, t.TempDir(), `x = 1`)
+		s, err = New(path, DefaultMaxSteps, DefaultTimeout)
+		require.NoError(t, err)
+		result, err := s.Run(FunctionDeliver, msg)
+		require.NoError(t, err)
+		assert.Equal(t, ActionContinue, result.Action)
+
+		// Scripts that don't compile are refused
+		path = writeScript(t, t.TempDir(), `def smtp(mail)`)
+		_, err = New(path, DefaultMaxSteps, DefaultTimeout)
+		assert.Error(t, err)
+	})
+
+	t.Run("TestExecutionLimits", func(t *testing.T) {
+		path := writeScript(t, t.TempDir(), `
+def smtp(mail):
+    for i in range(100000000):
+        pass
+`)
+		s, err := New(path, 1000, DefaultTimeout)
+		require.NoError(t, err)
+		_, err = s.Run(FunctionSMTP, msg)
+		assert.ErrorContains(t, err, "too many steps")
+
+		s, err = New(path, 0, 50*time.Millisecond)
+		require.NoError(t, err)
+		_, err = s.Run(FunctionSMTP, msg)
+		assert.ErrorContains(t, err, "took longer than")
+	})
+
+	t.Run("TestReload", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeScript(t, dir, `
+def smtp(mail):
+    return accept()
+`)
+		s, err := New(path, DefaultMaxSteps, DefaultTimeout)
+		require.NoError(t, err)
+
+		result, err := s.Run(FunctionSMTP, msg)
+		require.NoError(t, err)
+		assert.Equal(t, ActionAccept, result.Action)
+
+		// A changed script is used for the next run
+		writeScript(t, dir, `
+def smtp(mail):
+    return quarantine("suspicious")
+`)
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+		result, err = s.Run(FunctionSMTP, msg)
+		require.NoError(t, err)
+		assert.Equal(t, &Result{Action: ActionQuarantine, Reason: "suspicious"}, result)
+
+		// A broken script keeps the previous version in use
+		writeScript(t, dir, `def smtp(mail) broken`)
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+		result, err = s.Run(FunctionSMTP, msg)
+		require.NoError(t, err)
+		assert.Equal(t, ActionQuarantine, result.Action)
+	})
+
+}
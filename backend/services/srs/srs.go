@@ -0,0 +1,241 @@
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAge denotes how long a rewritten address stays valid for bounces.
+const DefaultMaxAge = 21 * 24 * time.Hour
+
+const (
+	srs0Prefix = "SRS0"
+	srs1Prefix = "SRS1"
+
+	// separator is the character that separates the SRS fields.
+	separator = "="
+
+	// hashLength is the number of base64 characters of the HMAC that are kept.
+	hashLength = 4
+
+	// timestampPrecision is the resolution of the SRS timestamp (one day).
+	timestampPrecision = 24 * time.Hour
+	// timestampSlots is the number of distinct timestamps (2 base32 characters).
+	timestampSlots = 32 * 32
+
+	base32Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+var (
+	// ErrNotSRS is returned when reversing an address that isn't an SRS address.
+	ErrNotSRS = errors.New("not an SRS address")
+	// ErrInvalidHash is returned when the hash of an SRS address doesn't match.
+	ErrInvalidHash = errors.New("invalid SRS hash")
+	// ErrExpired is returned when the timestamp of an SRS address is too old.
+	ErrExpired = errors.New("SRS address expired")
+	// ErrMalformed is returned when an SRS address can't be parsed.
+	ErrMalformed = errors.New("malformed SRS address")
+)
+
+// SRS implements the Sender Rewriting Scheme (SRS0 and SRS1) used for forwarding mail
+// without breaking SPF. See https://www.libsrs2.org/srs/srs.pdf.
+type SRS struct {
+	secret []byte
+	domain string
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// New creates a new SRS service that rewrites addresses into the given domain.
+// The SRS secret is derived from the given server secret.
+func New(secret string, domain string, maxAge time.Duration) (*SRS, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret cannot be empty")
+	}
+	if domain == "" {
+		return nil, fmt.Errorf("domain cannot be empty")
+	}
+
+	// Derive a dedicated key so the server secret itself is never used directly.
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("mistralmail-srs"))
+
+	return &SRS{
+		secret: mac.Sum(nil),
+		domain: strings.ToLower(domain),
+		maxAge: maxAge,
+		now:    time.Now,
+	}, nil
+}
+
+// Domain returns the domain in which addresses are rewritten.
+func (s *SRS) Domain() string {
+	return s.domain
+}
+
+// IsSRS checks whether the given address is an SRS address.
+func IsSRS(address string) bool {
+	local := address
+	if index := strings.LastIndex(address, "@"); index != -1 {
+		local = address[:index]
+	}
+	upper := strings.ToUpper(local)
+	return strings.HasPrefix(upper, srs0Prefix+separator) || strings.HasPrefix(upper, srs1Prefix+separator)
+}
+
+// Forward rewrites the envelope sender so it can be forwarded from our domain.
+// Addresses that are already SRS0 are rewritten to SRS1, SRS1 addresses keep pointing to the first forwarder.
+// The null sender is returned as is.
+func (s *SRS) Forward(address string) (string, error) {
+
+	if address == "" {
+		return "", nil
+	}
+
+	local, domain, err := splitAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	// Our own addresses don't need rewriting.
+	if strings.EqualFold(domain, s.domain) {
+		return address, nil
+	}
+
+	upperLocal := strings.ToUpper(local)
+
+	// SRS0=HHH=TT=orig-domain=orig-local@forwarder
+	// becomes SRS1=HHH=forwarder==HHH=TT=orig-domain=orig-local@our-domain
+	if strings.HasPrefix(upperLocal, srs0Prefix) && len(local) > len(srs0Prefix) && isSeparator(local[len(srs0Prefix)]) {
+		opaque := local[len(srs0Prefix):]
+		hash := s.hash(domain, opaque)
+		return fmt.Sprintf("%s=%s=%s=%s@%s", srs1Prefix, hash, domain, opaque, s.domain), nil
+	}
+
+	// SRS1=HHH=first-forwarder==HHH=TT=... keeps the first forwarder and only gets a new hash.
+	if strings.HasPrefix(upperLocal, srs1Prefix) && len(local) > len(srs1Prefix) && isSeparator(local[len(srs1Prefix)]) {
+		parts := strings.SplitN(local[len(srs1Prefix)+1:], separator, 3)
+		if len(parts) < 3 {
+			return "", ErrMalformed
+		}
+		firstForwarder, opaque := parts[1], parts[2]
+		hash := s.hash(firstForwarder, opaque)
+		return fmt.Sprintf("%s=%s=%s=%s@%s", srs1Prefix, hash, firstForwarder, opaque, s.domain), nil
+	}
+
+	timestamp := s.timestamp()
+	hash := s.hash(timestamp, domain, local)
+	return fmt.Sprintf("%s=%s=%s=%s=%s@%s", srs0Prefix, hash, timestamp, domain, local, s.domain), nil
+}
+
+// Reverse validates an SRS address and returns the address it was rewritten from.
+// An SRS0 address returns the original sender, an SRS1 address returns the SRS0 address at the first forwarder.
+func (s *SRS) Reverse(address string) (string, error) {
+
+	local, _, err := splitAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	upperLocal := strings.ToUpper(local)
+
+	switch {
+	case strings.HasPrefix(upperLocal, srs0Prefix+separator):
+		parts := strings.SplitN(local[len(srs0Prefix)+1:], separator, 4)
+		if len(parts) < 4 {
+			return "", ErrMalformed
+		}
+		hash, timestamp, domain, originalLocal := parts[0], parts[1], parts[2], parts[3]
+
+		if !s.validHash(hash, timestamp, domain, originalLocal) {
+			return "", ErrInvalidHash
+		}
+		if err := s.checkTimestamp(timestamp); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s@%s", originalLocal, domain), nil
+
+	case strings.HasPrefix(upperLocal, srs1Prefix+separator):
+		parts := strings.SplitN(local[len(srs1Prefix)+1:], separator, 3)
+		if len(parts) < 3 {
+			return "", ErrMalformed
+		}
+		hash, firstForwarder, opaque := parts[0], parts[1], parts[2]
+
+		if !s.validHash(hash, firstForwarder, opaque) {
+			return "", ErrInvalidHash
+		}
+
+		return fmt.Sprintf("%s%s@%s", srs0Prefix, opaque, firstForwarder), nil
+	}
+
+	return "", ErrNotSRS
+}
+
+// hash calculates the truncated HMAC of the given fields.
+// Fields are lowercased since mail domains and (most) local parts are case insensitive.
+func (s *SRS) hash(fields ...string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	for _, field := range fields {
+		mac.Write([]byte(strings.ToLower(field)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// validHash checks the given hash in constant time.
+func (s *SRS) validHash(hash string, fields ...string) bool {
+	expected := s.hash(fields...)
+	return hmac.Equal([]byte(strings.ToLower(expected)), []byte(strings.ToLower(hash)))
+}
+
+// timestamp returns the current SRS timestamp: the number of days modulo 1024 in base32.
+func (s *SRS) timestamp() string {
+	days := int(s.now().Unix()/int64(timestampPrecision/time.Second)) % timestampSlots
+	return string([]byte{base32Alphabet[days>>5], base32Alphabet[days&31]})
+}
+
+// checkTimestamp checks whether the given SRS timestamp isn't older than the max age.
+func (s *SRS) checkTimestamp(timestamp string) error {
+	if len(timestamp) != 2 {
+		return ErrMalformed
+	}
+
+	then := 0
+	for _, c := range strings.ToUpper(timestamp) {
+		index := strings.IndexRune(base32Alphabet, c)
+		if index == -1 {
+			return ErrMalformed
+		}
+		then = then<<5 | index
+	}
+
+	now := int(s.now().Unix()/int64(timestampPrecision/time.Second)) % timestampSlots
+	age := (now - then + timestampSlots) % timestampSlots
+
+	if time.Duration(age)*timestampPrecision > s.maxAge {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// isSeparator checks whether the character following an SRS prefix is a valid separator.
+func isSeparator(c byte) bool {
+	return c == '=' || c == '-' || c == '+'
+}
+
+// splitAddress splits an address in its local and domain part.
+func splitAddress(address string) (string, string, error) {
+	index := strings.LastIndex(address, "@")
+	if index < 1 || index == len(address)-1 {
+		return "", "", fmt.Errorf("invalid address: %q", address)
+	}
+	return address[:index], address[index+1:], nil
+}
@@ -0,0 +1,91 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSRS(t *testing.T) {
+
+	s, err := New("some-secret", "forwarder.example.com", DefaultMaxAge)
+	require.NoError(t, err)
+
+	t.Run("TestForwardAndReverseSRS0", func(t *testing.T) {
+		rewritten, err := s.Forward("alice@example.org")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(rewritten, "SRS0="))
+		assert.True(t, strings.HasSuffix(rewritten, "=example.org=alice@forwarder.example.com"))
+		assert.True(t, IsSRS(rewritten))
+
+		original, err := s.Reverse(rewritten)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@example.org", original)
+
+		// Case shouldn't matter
+		original, err = s.Reverse(strings.ToLower(rewritten))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@example.org", original)
+	})
+
+	t.Run("TestForwardAndReverseSRS1", func(t *testing.T) {
+		other, err := New("other-secret", "first.example.net", DefaultMaxAge)
+		require.NoError(t, err)
+
+		srs0, err := other.Forward("alice@example.org")
+		require.NoError(t, err)
+
+		srs1, err := s.Forward(srs0)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(srs1, "SRS1="))
+		assert.True(t, strings.HasSuffix(srs1, "@forwarder.example.com"))
+
+		// Forwarding an SRS1 address again keeps the first forwarder
+		srs1Again, err := s.Forward(strings.Replace(srs1, "@forwarder.example.com", "@second.example.net", 1))
+		assert.NoError(t, err)
+		assert.Contains(t, srs1Again, "=first.example.net==")
+
+		reversed, err := s.Reverse(srs1)
+		assert.NoError(t, err)
+		assert.Equal(t, srs0, reversed)
+
+		original, err := other.Reverse(reversed)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@example.org", original)
+	})
+
+	t.Run("TestNullSenderAndLocalAddress", func(t *testing.T) {
+		rewritten, err := s.Forward("")
+		assert.NoError(t, err)
+		assert.Equal(t, "", rewritten)
+
+		rewritten, err = s.Forward("bob@forwarder.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "bob@forwarder.example.com", rewritten)
+	})
+
+	t.Run("TestReverseInvalid", func(t *testing.T) {
+		_, err := s.Reverse("alice@example.org")
+		assert.ErrorIs(t, err, ErrNotSRS)
+
+		_, err = s.Reverse("SRS0=abcd=AA=example.org=alice@forwarder.example.com")
+		assert.ErrorIs(t, err, ErrInvalidHash)
+
+		_, err = s.Reverse("SRS0=abcd@forwarder.example.com")
+		assert.ErrorIs(t, err, ErrMalformed)
+	})
+
+	t.Run("TestReverseExpired", func(t *testing.T) {
+		rewritten, err := s.Forward("alice@example.org")
+		require.NoError(t, err)
+
+		expired := *s
+		expired.now = func() time.Time { return time.Now().Add(DefaultMaxAge + 48*time.Hour) }
+
+		_, err = expired.Reverse(rewritten)
+		assert.ErrorIs(t, err, ErrExpired)
+	})
+}
@@ -0,0 +1,284 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mistralmail/mistralmail/backend/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventType denotes the type of an event.
+type EventType string
+
+const (
+	// EventMailReceived is emitted when incoming mail was stored in a local mailbox.
+	EventMailReceived EventType = "mail.received"
+	// EventMailRejected is emitted when incoming mail was refused.
+	EventMailRejected EventType = "mail.rejected"
+	// EventMailDelivered is emitted when outgoing mail was accepted by the relay.
+	EventMailDelivered EventType = "mail.delivered"
+	// EventMailDeferred is emitted when outgoing mail couldn't be delivered temporarily.
+	EventMailDeferred EventType = "mail.deferred"
+	// EventMailBounced is emitted when outgoing mail was refused permanently.
+	EventMailBounced EventType = "mail.bounced"
+	// EventLoginFailed is emitted on every failed SMTP or IMAP login.
+	EventLoginFailed EventType = "login.failed"
+)
+
+const (
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the payload, prefixed with "sha256=".
+	SignatureHeader = "X-MistralMail-Signature"
+	// EventHeader contains the event type.
+	EventHeader = "X-MistralMail-Event"
+	// DeliveryHeader contains the unique id of the delivery.
+	DeliveryHeader = "X-MistralMail-Delivery"
+)
+
+const (
+	// DefaultMaxAttempts denotes the number of attempts after which a delivery is given up.
+	DefaultMaxAttempts uint = 10
+	// DefaultPollInterval denotes how often the queue is checked for due deliveries.
+	DefaultPollInterval = 10 * time.Second
+	// DefaultTimeout denotes the HTTP timeout for a single delivery.
+	DefaultTimeout = 10 * time.Second
+
+	// backoffBase is the delay after the first failed attempt, it doubles with every attempt.
+	backoffBase = 30 * time.Second
+	// backoffMax caps the delay between two attempts.
+	backoffMax = 6 * time.Hour
+	// batchSize is the max number of deliveries handled per poll.
+	batchSize = 100
+)
+
+// Event is the JSON payload that is posted to the webhooks.
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      EventType              `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// Webhooks is a small service that queues events and posts them to the registered endpoints.
+type Webhooks struct {
+	repo        *models.WebhookRepository
+	client      *http.Client
+	maxAttempts uint
+
+	wakeUp chan struct{}
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a new Webhooks service.
+func New(repo *models.WebhookRepository, maxAttempts uint, timeout time.Duration) (*Webhooks, error) {
+	return &Webhooks{
+		repo:        repo,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		wakeUp:      make(chan struct{}, 1),
+	}, nil
+}
+
+// Emit queues an event for all enabled webhooks that are subscribed to it.
+// Emitting never fails the caller: errors are only logged.
+// It is safe to call Emit on a nil service.
+func (w *Webhooks) Emit(eventType EventType, data map[string]interface{}) {
+	if w == nil {
+		return
+	}
+
+	webhooks, err := w.repo.FindEnabledWebhooks()
+	if err != nil {
+		log.Errorf("couldn't find webhooks: %v", err)
+		return
+	}
+
+	event := Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("couldn't encode %s event: %v", eventType, err)
+		return
+	}
+
+	queued := false
+	for _, webhook := range webhooks {
+		if !webhook.Subscribed(string(eventType)) {
+			continue
+		}
+
+		delivery := &models.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       event.ID,
+			EventType:     string(eventType),
+			Payload:       payload,
+			Status:        models.WebhookDeliveryPending,
+			NextAttemptAt: time.Now(),
+		}
+		err := w.repo.CreateDelivery(delivery)
+		if err != nil {
+			log.Errorf("couldn't queue %s event for webhook %d: %v", eventType, webhook.ID, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		// Don't block when the worker was already woken up.
+		select {
+		case w.wakeUp <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start runs the worker that delivers the queued events in the background.
+func (w *Webhooks) Start(pollInterval time.Duration) {
+	w.stop = make(chan struct{})
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			w.deliverDue()
+
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			case <-w.wakeUp:
+			}
+		}
+	}()
+}
+
+// Stop stops the background worker and waits for it to finish.
+// Pending deliveries stay queued in the database.
+func (w *Webhooks) Stop() {
+	if w.stop == nil {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+	w.stop = nil
+}
+
+// deliverDue attempts all the deliveries that are due.
+func (w *Webhooks) deliverDue() {
+
+	deliveries, err := w.repo.FindDueDeliveries(time.Now(), batchSize)
+	if err != nil {
+		log.Errorf("couldn't find due webhook deliveries: %v", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		webhook, err := w.repo.GetWebhookByID(delivery.WebhookID)
+		if err != nil {
+			// The webhook was deleted in the mean time.
+			delivery.Status = models.WebhookDeliveryFailed
+			delivery.LastError = fmt.Sprintf("couldn't find webhook: %v", err)
+		} else {
+			w.attempt(webhook, delivery)
+		}
+
+		err = w.repo.UpdateDelivery(delivery)
+		if err != nil {
+			log.Errorf("couldn't update webhook delivery %d: %v", delivery.ID, err)
+		}
+	}
+}
+
+// attempt posts the delivery to the webhook and updates the delivery with the result.
+func (w *Webhooks) attempt(webhook *models.Webhook, delivery *models.WebhookDelivery) {
+
+	delivery.Attempts++
+
+	statusCode, err := w.post(webhook, delivery)
+	delivery.LastStatusCode = statusCode
+
+	if err == nil {
+		now := time.Now()
+		delivery.Status = models.WebhookDeliverySucceeded
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+		return
+	}
+
+	delivery.LastError = err.Error()
+
+	if delivery.Attempts >= w.maxAttempts {
+		log.Warnf("giving up webhook delivery %d to %s after %d attempts: %v", delivery.ID, webhook.URL, delivery.Attempts, err)
+		delivery.Status = models.WebhookDeliveryFailed
+		return
+	}
+
+	delivery.NextAttemptAt = time.Now().Add(Backoff(delivery.Attempts))
+}
+
+// post sends the signed payload to the webhook URL.
+func (w *Webhooks) post(webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MistralMail-Webhooks")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(webhook.Secret, delivery.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't post event: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Sign calculates the hex encoded HMAC-SHA256 of the payload with the given secret.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before the next attempt after the given number of failed attempts.
+func Backoff(attempts uint) time.Duration {
+	delay := backoffBase
+	for i := uint(1); i < attempts; i++ {
+		delay *= 2
+		if delay >= backoffMax {
+			return backoffMax
+		}
+	}
+	return delay
+}
@@ -0,0 +1,122 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestRepo(t *testing.T) *models.WebhookRepository {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Webhook{}, &models.WebhookDelivery{}))
+
+	repo, err := models.NewWebhookRepository(db)
+	require.NoError(t, err)
+	return repo
+}
+
+func TestWebhooks(t *testing.T) {
+
+	t.Run("TestDeliverSignedEvent", func(t *testing.T) {
+		repo := newTestRepo(t)
+
+		received := make(chan *http.Request, 1)
+		bodies := make(chan []byte, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			received <- r
+			bodies <- body
+		}))
+		defer server.Close()
+
+		require.NoError(t, repo.CreateWebhook(&models.Webhook{URL: server.URL, Secret: "secret", Enabled: true}))
+		require.NoError(t, repo.CreateWebhook(&models.Webhook{URL: server.URL, Secret: "secret", Enabled: true, Events: models.StringSlice{string(EventLoginFailed)}}))
+
+		w, err := New(repo, DefaultMaxAttempts, DefaultTimeout)
+		require.NoError(t, err)
+
+		w.Emit(EventMailReceived, map[string]interface{}{"from": "sender@example.com"})
+		w.deliverDue()
+
+		req := <-received
+		body := <-bodies
+		assert.Equal(t, string(EventMailReceived), req.Header.Get(EventHeader))
+		assert.Equal(t, "sha256="+Sign("secret", body), req.Header.Get(SignatureHeader))
+
+		event := Event{}
+		require.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, EventMailReceived, event.Type)
+		assert.Equal(t, "sender@example.com", event.Data["from"])
+
+		// Only the webhook that subscribed to all events received it
+		deliveries, err := repo.FindDeliveriesByWebhookID(1, 10)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, models.WebhookDeliverySucceeded, deliveries[0].Status)
+		assert.Equal(t, http.StatusOK, deliveries[0].LastStatusCode)
+
+		deliveries, err = repo.FindDeliveriesByWebhookID(2, 10)
+		require.NoError(t, err)
+		assert.Len(t, deliveries, 0)
+	})
+
+	t.Run("TestRetryAndGiveUp", func(t *testing.T) {
+		repo := newTestRepo(t)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		require.NoError(t, repo.CreateWebhook(&models.Webhook{URL: server.URL, Secret: "secret", Enabled: true}))
+
+		w, err := New(repo, 2, DefaultTimeout)
+		require.NoError(t, err)
+
+		w.Emit(EventLoginFailed, map[string]interface{}{"username": "test"})
+		w.deliverDue()
+
+		deliveries, err := repo.FindDeliveriesByWebhookID(1, 10)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, models.WebhookDeliveryPending, deliveries[0].Status)
+		assert.Equal(t, uint(1), deliveries[0].Attempts)
+		assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].LastStatusCode)
+		assert.True(t, deliveries[0].NextAttemptAt.After(time.Now()))
+
+		// Not due yet
+		w.deliverDue()
+		deliveries, _ = repo.FindDeliveriesByWebhookID(1, 10)
+		assert.Equal(t, uint(1), deliveries[0].Attempts)
+
+		// Make it due and fail for the last time
+		deliveries[0].NextAttemptAt = time.Now().Add(-time.Second)
+		require.NoError(t, repo.UpdateDelivery(deliveries[0]))
+		w.deliverDue()
+
+		deliveries, _ = repo.FindDeliveriesByWebhookID(1, 10)
+		assert.Equal(t, models.WebhookDeliveryFailed, deliveries[0].Status)
+		assert.Equal(t, uint(2), deliveries[0].Attempts)
+	})
+
+	t.Run("TestBackoff", func(t *testing.T) {
+		assert.Equal(t, 30*time.Second, Backoff(1))
+		assert.Equal(t, 60*time.Second, Backoff(2))
+		assert.Equal(t, 6*time.Hour, Backoff(20))
+	})
+
+	t.Run("TestEmitOnNilService", func(t *testing.T) {
+		var w *Webhooks
+		w.Emit(EventMailReceived, nil)
+	})
+}
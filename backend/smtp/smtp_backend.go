@@ -5,6 +5,7 @@ import (
 
 	"github.com/mistralmail/mistralmail/backend/models"
 	loginattempts "github.com/mistralmail/mistralmail/backend/services/login-attempts"
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
 	"github.com/mistralmail/smtp/server"
 	"github.com/mistralmail/smtp/smtp"
 )
@@ -24,13 +25,15 @@ func (u *SMTPUser) Username() string {
 type SMTPBackend struct {
 	userRepo      *models.UserRepository
 	loginAttempts *loginattempts.LoginAttempts
+	webhooks      *webhooks.Webhooks
 }
 
 // NewSMTPBackend creates a new SMTPBackend.
-func NewSMTPBackend(userRepo *models.UserRepository, loginAttempts *loginattempts.LoginAttempts) (*SMTPBackend, error) {
+func NewSMTPBackend(userRepo *models.UserRepository, loginAttempts *loginattempts.LoginAttempts, webhooks *webhooks.Webhooks) (*SMTPBackend, error) {
 	return &SMTPBackend{
 		userRepo:      userRepo,
 		loginAttempts: loginAttempts,
+		webhooks:      webhooks,
 	}, nil
 }
 
@@ -51,6 +54,7 @@ func (b *SMTPBackend) Login(state *smtp.State, username string, password string)
 		if _, err := b.loginAttempts.AddFailedAttempts(remoteIP); err != nil {
 			return nil, fmt.Errorf("couldn't increase log-in attempts: %w\n", err)
 		}
+		b.emitLoginFailed(username, remoteIP)
 		return nil, server.ErrInvalidCredentials
 	}
 
@@ -66,6 +70,16 @@ func (b *SMTPBackend) Login(state *smtp.State, username string, password string)
 		return nil, fmt.Errorf("couldn't increase log-in attempts: %w\n", err)
 	}
 
+	b.emitLoginFailed(username, remoteIP)
 	return nil, server.ErrInvalidCredentials
 
 }
+
+// emitLoginFailed emits the login.failed event for an SMTP login.
+func (b *SMTPBackend) emitLoginFailed(username string, remoteIP string) {
+	b.webhooks.Emit(webhooks.EventLoginFailed, map[string]interface{}{
+		"protocol": "smtp",
+		"username": username,
+		"ip":       remoteIP,
+	})
+}
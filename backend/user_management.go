@@ -1,9 +1,11 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/encryption"
 	"github.com/mistralmail/smtp/smtp"
 )
 
@@ -57,14 +59,68 @@ func (b *Backend) CreateNewUser(email string, password string) (*models.User, er
 
 }
 
+// DeleteUser deletes a user with its mailboxes, messages and forwards.
+// The message blobs that aren't referenced by other users anymore are deleted as well.
+func (b *Backend) DeleteUser(id uint) error {
+
+	mailboxes, err := b.MailboxRepo.FindMailboxesByUserID(id)
+	if err != nil {
+		return fmt.Errorf("couldn't find mailboxes of user: %w", err)
+	}
+
+	for _, mailbox := range mailboxes {
+		err = b.MessageRepo.DeleteMessagesByMailboxID(mailbox.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't delete messages of mailbox %q: %w", mailbox.Name, err)
+		}
+
+		err = b.MailboxRepo.DeleteMailbox(mailbox.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't delete mailbox %q: %w", mailbox.Name, err)
+		}
+	}
+
+	err = b.ForwardRepo.DeleteForwardsByUserID(id)
+	if err != nil {
+		return fmt.Errorf("couldn't delete forwards of user: %w", err)
+	}
+
+	err = b.UserRepo.DeleteUser(id)
+	if err != nil {
+		return fmt.Errorf("couldn't delete user: %w", err)
+	}
+
+	return nil
+}
+
+// ErrCurrentPasswordRequired is returned when resetting the password of a user with encryption enabled
+// without the current password, the messages of the user can't be read anymore otherwise.
+var ErrCurrentPasswordRequired = errors.New("the user has encrypted messages, the current password is required to keep them readable")
+
 // ResetUserPassword resets the passwords of a user.
-func (b *Backend) ResetUserPassword(email string, newPassword string) error {
+// When encryption is enabled for the user, the private key is wrapped with the new password,
+// which requires the current password.
+func (b *Backend) ResetUserPassword(email string, newPassword string, currentPassword string) error {
 
 	user, err := b.UserRepo.FindUserByEmail(email)
 	if err != nil {
 		return fmt.Errorf("couldn't find user: %w", err)
 	}
 
+	if user.EncryptionEnabled() {
+		if currentPassword == "" {
+			return ErrCurrentPasswordRequired
+		}
+		key, err := encryption.Unwrap(user.EncryptionPublicKey, user.EncryptionPrivateKey, currentPassword)
+		if err != nil {
+			return err
+		}
+		user.EncryptionPrivateKey, err = key.Wrap(newPassword)
+		if err != nil {
+			return fmt.Errorf("couldn't wrap encryption key: %w", err)
+		}
+	}
+
 	hashedPassword, err := models.HashPassword(newPassword)
 	if err != nil {
 		return fmt.Errorf("couldn't hash user password: %w", err)
@@ -79,3 +135,77 @@ func (b *Backend) ResetUserPassword(email string, newPassword string) error {
 
 	return nil
 }
+
+// EnableEncryption enables encryption at rest for a user: a keypair is created, whose private key is wrapped
+// with the password of the user, and all existing messages of the user are encrypted.
+func (b *Backend) EnableEncryption(email string, password string) error {
+
+	user, err := b.UserRepo.FindUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("couldn't find user: %w", err)
+	}
+
+	passwordCorrect, err := user.CheckPassword(password)
+	if err != nil {
+		return fmt.Errorf("couldn't check password: %w", err)
+	}
+	if !passwordCorrect {
+		return encryption.ErrWrongPassword
+	}
+
+	if !user.EncryptionEnabled() {
+		key, wrapped, err := encryption.GenerateKey(password)
+		if err != nil {
+			return err
+		}
+		user.EncryptionPublicKey = key.PublicKey[:]
+		user.EncryptionPrivateKey = wrapped
+
+		err = b.UserRepo.UpdateUser(user)
+		if err != nil {
+			return fmt.Errorf("couldn't save user: %w", err)
+		}
+	}
+
+	// New mail is encrypted from now on, encrypt the existing mail as well.
+	// This is also done when encryption was enabled already, in case a previous attempt failed halfway.
+	mailboxes, err := b.MailboxRepo.FindMailboxesByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't find mailboxes of user: %w", err)
+	}
+
+	for _, mailbox := range mailboxes {
+		messages, err := b.MessageRepo.FindMessagesByMailboxID(mailbox.ID, models.FindMessagesParameters{OmitBody: true})
+		if err != nil {
+			return fmt.Errorf("couldn't find messages of mailbox %q: %w", mailbox.Name, err)
+		}
+
+		for _, message := range messages {
+			if message.Encrypted {
+				continue
+			}
+
+			message, err := b.MessageRepo.GetMessageByID(message.ID)
+			if err != nil {
+				return fmt.Errorf("couldn't get message: %w", err)
+			}
+
+			message.Body, err = b.MessageRepo.Compress(message.Body)
+			if err == nil {
+				message.Body, err = encryption.Encrypt(user.EncryptionPublicKey, message.Body)
+			}
+			if err != nil {
+				return fmt.Errorf("couldn't encrypt message: %w", err)
+			}
+			message.Prefix = nil
+			message.Encrypted = true
+
+			err = b.MessageRepo.UpdateMessageBody(message)
+			if err != nil {
+				return fmt.Errorf("couldn't save encrypted message: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package backend
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteUser(t *testing.T) {
+
+	b, err := New("sqlite:"+filepath.Join(t.TempDir(), "test.db"), false)
+	require.NoError(t, err)
+	defer b.Close()
+
+	alice, err := b.CreateNewUser("alice@example.com", "password")
+	require.NoError(t, err)
+	bob, err := b.CreateNewUser("bob@example.com", "password")
+	require.NoError(t, err)
+	require.NoError(t, b.ForwardRepo.CreateForward(&models.Forward{Address: "alice@example.net", UserID: alice.ID}))
+	require.NoError(t, b.ForwardRepo.CreateForward(&models.Forward{Address: "bob@example.net", UserID: bob.ID}))
+
+	require.NoError(t, b.DeleteUser(alice.ID))
+
+	mailboxes, err := b.MailboxRepo.FindMailboxesByUserID(alice.ID)
+	require.NoError(t, err)
+	assert.Empty(t, mailboxes)
+
+	// The forwards of the user are deleted, the ones of other users are kept
+	forwards, err := b.ForwardRepo.FindForwardsByUserID(alice.ID)
+	require.NoError(t, err)
+	assert.Empty(t, forwards)
+	forwards, err = b.ForwardRepo.FindForwardsByUserID(bob.ID)
+	require.NoError(t, err)
+	assert.Len(t, forwards, 1)
+}
@@ -34,6 +34,11 @@ func main() {
 	}
 	defer backend.Close()
 
+	err = backend.MessageRepo.SetCompressionLevel(config.CompressionLevel)
+	if err != nil {
+		log.Fatalf("couldn't set compression level: %v", err)
+	}
+
 	var rootCmd = &cobra.Command{Use: "mistralmail-cli"}
 
 	var createUserCmd = &cobra.Command{
@@ -48,8 +53,30 @@ func main() {
 		Run:   handleResetPasswordCommand,
 	}
 
+	var enableEncryptionCmd = &cobra.Command{
+		Use:   "enable-encryption",
+		Short: "Encrypt the messages of a user with a key that is protected by the password of the user",
+		Run:   handleEnableEncryptionCommand,
+	}
+
+	var migrateBlobsCmd = &cobra.Command{
+		Use:   "migrate-blobs",
+		Short: "Move the content of all messages to another blob store, the server can keep running",
+		Run:   handleMigrateBlobsCommand,
+	}
+	migrateBlobsCmd.Flags().String("to", "", "URL of the blob store to move to (default BLOB_STORE)")
+
+	var rebuildSearchIndexCmd = &cobra.Command{
+		Use:   "rebuild-search-index",
+		Short: "Index the text of all messages that aren't encrypted again, the server can keep running",
+		Run:   handleRebuildSearchIndexCommand,
+	}
+
 	rootCmd.AddCommand(createUserCmd)
 	rootCmd.AddCommand(resetPasswordCmd)
+	rootCmd.AddCommand(migrateBlobsCmd)
+	rootCmd.AddCommand(enableEncryptionCmd)
+	rootCmd.AddCommand(rebuildSearchIndexCmd)
 	err = rootCmd.Execute()
 	if err != nil {
 		log.Fatalf("somethign went wrong: %v", err)
@@ -108,10 +135,73 @@ func handleResetPasswordCommand(cmd *cobra.Command, args []string) {
 		log.Fatalf("passwords don't match")
 	}
 
-	err := backend.ResetUserPassword(email, password)
+	// The key of a user with encrypted messages can only be wrapped with the new password using the current one
+	currentPassword := ""
+	user, err := backend.UserRepo.FindUserByEmail(email)
+	if err == nil && user.EncryptionEnabled() {
+		fmt.Printf("Current password (the user has encrypted messages): ")
+		currentPasswordBytes, _ := term.ReadPassword(int(syscall.Stdin))
+		fmt.Printf("\n")
+		currentPassword = strings.TrimSpace(string(currentPasswordBytes))
+	}
+
+	err = backend.ResetUserPassword(email, password, currentPassword)
 	if err != nil {
 		log.Fatalf("couldn't reset password of user: %v", err)
 	}
 	log.Printf("Password reset was successful!")
 
 }
+
+func handleMigrateBlobsCommand(cmd *cobra.Command, args []string) {
+	to, _ := cmd.Flags().GetString("to")
+	if to == "" {
+		to = config.BlobStore
+	}
+	if to != config.BlobStore {
+		log.Warnf("Moving blobs to %s while BLOB_STORE is %s, make sure the server can read from it as well", to, config.BlobStore)
+	}
+
+	err := backend.SetBlobStores(config.BlobStore, append(config.OldBlobStores, to))
+	if err != nil {
+		log.Fatalf("couldn't set blob stores: %v", err)
+	}
+
+	moved, err := backend.MoveBlobs(to)
+	if err != nil {
+		log.Fatalf("couldn't move blobs after moving %d: %v", moved, err)
+	}
+	log.Printf("Successfully moved %d blobs", moved)
+}
+
+func handleEnableEncryptionCommand(cmd *cobra.Command, args []string) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("Email: ")
+	email, _ := reader.ReadString('\n')
+	email = strings.TrimSpace(email)
+
+	fmt.Printf("Password of the user: ")
+	passwordBytes, _ := term.ReadPassword(int(syscall.Stdin))
+	fmt.Printf("\n")
+	password := strings.TrimSpace(string(passwordBytes))
+
+	err := backend.EnableEncryption(email, password)
+	if err != nil {
+		log.Fatalf("couldn't enable encryption for user: %v", err)
+	}
+	log.Printf("Encryption is enabled, note that the messages can't be read anymore when the password is lost")
+}
+
+func handleRebuildSearchIndexCommand(cmd *cobra.Command, args []string) {
+	err := backend.SetBlobStores(config.BlobStore, config.OldBlobStores)
+	if err != nil {
+		log.Fatalf("couldn't set blob stores: %v", err)
+	}
+
+	indexed, err := backend.MessageRepo.RebuildTextIndex()
+	if err != nil {
+		log.Fatalf("couldn't rebuild search index after indexing %d messages: %v", indexed, err)
+	}
+	log.Printf("Successfully indexed %d messages", indexed)
+}
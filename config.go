@@ -8,7 +8,9 @@ import (
 	"strings"
 
 	"github.com/mistralmail/imap"
+	"github.com/mistralmail/mistralmail/backend/services/compression"
 	"github.com/mistralmail/mistralmail/helpers"
+	"github.com/mistralmail/mistralmail/proxyprotocol"
 	"github.com/mistralmail/smtp/server"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,6 +30,7 @@ var (
 	defaultMetricsPort           = 9000
 	defaultMetricsAddress        = fmt.Sprintf(":%d", defaultMetricsPort)
 	defaultDatabaseURL           = "sqlite:test.db"
+	defaultBlobStore             = "database"
 	defaultAcmeEndpoint          = "https://acme-v02.api.letsencrypt.org/directory"
 	defaultCertificatesDirectory = "./certificates"
 	defaultBlacklistURL          = "https://raw.githubusercontent.com/bitwire-it/ipblocklist/refs/heads/main/ip-list.txt"
@@ -41,8 +44,28 @@ func BuildConfigFromEnv() (*Config, error) {
 	config.Hostname = getEnv("HOSTNAME", "")
 	config.SMTPAddressIncoming = getEnv("SMTP_ADDRESS_INCOMING", defaultSMTPAddressIncoming)
 	config.SMTPAddressOutgoing = getEnv("SMTP_ADDRESS_OUTGOING", defaultSMTPAddressOutgoing)
+	config.SMTPAddressOutgoingTLS = getEnv("SMTP_ADDRESS_OUTGOING_TLS", "")
 	config.IMAPAddress = getEnv("IMAP_ADDRESS", defaultIMAPAddress)
+	config.IMAPAddressTLS = getEnv("IMAP_ADDRESS_TLS", "")
+	config.LMTPAddress = getEnv("LMTP_ADDRESS", "")
 	config.DatabaseURL = getEnv("DATABASE_URL", defaultDatabaseURL)
+	config.BlobStore = getEnv("BLOB_STORE", defaultBlobStore)
+	for _, store := range strings.Split(getEnv("OLD_BLOB_STORES", ""), ",") {
+		if store = strings.TrimSpace(store); store != "" {
+			config.OldBlobStores = append(config.OldBlobStores, store)
+		}
+	}
+	config.CompressionLevel = compression.DefaultLevel
+	if level := getEnv("COMPRESSION_LEVEL", ""); level != "" {
+		var err error
+		config.CompressionLevel, err = strconv.Atoi(level)
+		if err == nil {
+			err = compression.ValidLevel(config.CompressionLevel)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse COMPRESSION_LEVEL: %w", err)
+		}
+	}
 
 	outgoingMode := getEnv("SMTP_OUTGOING_MODE", "")
 	if strings.ToUpper(outgoingMode) == string(SMTPOutgoingModeRelay) {
@@ -76,6 +99,10 @@ func BuildConfigFromEnv() (*Config, error) {
 	if strings.ToUpper(tlsDisable) == "TRUE" {
 		config.DisableTLS = true
 	}
+	tlsRequiredForAuth := getEnv("TLS_REQUIRED_FOR_AUTH", "")
+	if strings.ToUpper(tlsRequiredForAuth) == "TRUE" {
+		config.TLSRequiredForAuth = true
+	}
 	config.TLSCertificateFile = getEnv("TLS_CERTIFICATE_FILE", "")
 	config.TLSPrivateKeyFile = getEnv("TLS_PRIVATE_KEY_FILE", "")
 	acmeChallenge := getEnv("TLS_ACME_CHALLENGE", "")
@@ -91,8 +118,15 @@ func BuildConfigFromEnv() (*Config, error) {
 
 	config.TLSCertificatesDirectory = getEnv("TLS_CERTIFICATES_DIRECTORY", defaultCertificatesDirectory)
 
+	// Load balancers that send the address of the client with the PROXY protocol
+	config.TrustedProxies, err = proxyprotocol.ParseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse TRUSTED_PROXIES: %w", err)
+	}
+
 	// HTTP
 	config.HTTPAddress = getEnv("HTTP_ADDRESS", defaultHTTPAddress)
+	config.PublicURL = getEnv("PUBLIC_URL", fmt.Sprintf("https://%s", config.Hostname))
 
 	config.Secret = getEnv("SECRET", "")
 
@@ -117,6 +151,27 @@ func BuildConfigFromEnv() (*Config, error) {
 	// Blacklist URL
 	config.BlacklistURL = getEnv("BLACKLIST_URL", defaultBlacklistURL)
 
+	// Forwarding
+	config.SRSDomain = getEnv("SRS_DOMAIN", config.Hostname)
+
+	// Handler pipelines
+	config.PipelineFile = getEnv("PIPELINE_FILE", "")
+	if config.PipelineFile != "" {
+		err := helpers.DecodeFile(config.PipelineFile, &config.Pipelines)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read PIPELINE_FILE: %w", err)
+		}
+	}
+	if config.Pipelines.MTA == nil {
+		config.Pipelines.MTA = defaultMTAPipeline(config.EnableSpamCheck)
+	}
+	if config.Pipelines.MSA == nil {
+		config.Pipelines.MSA = defaultMSAPipeline()
+	}
+
+	// Delivery script
+	config.DeliveryScriptFile = getEnv("DELIVERY_SCRIPT_FILE", "")
+
 	return config, nil
 }
 
@@ -140,24 +195,37 @@ const (
 
 // Config contains all the config for serving MistralMail
 type Config struct {
-	Hostname            string
-	SubDomainIncoming   string
-	SMTPAddressIncoming string
-	SubDomainOutgoing   string
-	SMTPAddressOutgoing string
-	SMTPOutgoingMode    SMTPOutgoingMode
-	SubDomainIMAP       string
-	IMAPAddress         string
-	HTTPAddress         string
-	DatabaseURL         string
-	Secret              string
-	MetricsAddress      string
-	SentryDSN           string
-	LogFullQueries      bool
-	EnableSpamCheck     bool
-	BlacklistURL        string
+	Hostname               string
+	SubDomainIncoming      string
+	SMTPAddressIncoming    string
+	SubDomainOutgoing      string
+	SMTPAddressOutgoing    string
+	SMTPAddressOutgoingTLS string
+	SMTPOutgoingMode       SMTPOutgoingMode
+	SubDomainIMAP          string
+	IMAPAddress            string
+	IMAPAddressTLS         string
+	LMTPAddress            string
+	HTTPAddress            string
+	PublicURL              string
+	DatabaseURL            string
+	BlobStore              string
+	OldBlobStores          []string
+	CompressionLevel       int
+	TrustedProxies         []*net.IPNet
+	Secret                 string
+	MetricsAddress         string
+	SentryDSN              string
+	LogFullQueries         bool
+	EnableSpamCheck        bool
+	BlacklistURL           string
+	SRSDomain              string
+	PipelineFile           string
+	Pipelines              Pipelines
+	DeliveryScriptFile     string
 
 	DisableTLS               bool
+	TLSRequiredForAuth       bool
 	TLSCertificatesDirectory string
 	TLSCertificateFile       string
 	TLSPrivateKeyFile        string
@@ -227,6 +295,17 @@ func (config *Config) Validate() error {
 	}
 
 	// TLS config
+	if config.DisableTLS {
+		if config.SMTPAddressOutgoingTLS != "" {
+			return fmt.Errorf("SMTP_ADDRESS_OUTGOING_TLS cannot be used when TLS is disabled")
+		}
+		if config.IMAPAddressTLS != "" {
+			return fmt.Errorf("IMAP_ADDRESS_TLS cannot be used when TLS is disabled")
+		}
+		if config.TLSRequiredForAuth {
+			return fmt.Errorf("TLS_REQUIRED_FOR_AUTH cannot be used when TLS is disabled")
+		}
+	}
 	if !config.DisableTLS {
 		if config.TLSCertificateFile == "" && config.TLSPrivateKeyFile == "" {
 			// When using ACME
@@ -259,6 +338,32 @@ func (config *Config) Validate() error {
 	if config.Secret == "" {
 		return fmt.Errorf("SECRET cannot be empty")
 	}
+	if config.PublicURL == "" {
+		return fmt.Errorf("PUBLIC_URL cannot be empty")
+	}
+
+	// Forwarding
+	if config.SRSDomain == "" {
+		return fmt.Errorf("SRS_DOMAIN cannot be empty")
+	}
+
+	// Handler pipelines
+	if len(config.Pipelines.MTA) == 0 {
+		return fmt.Errorf("MTA pipeline cannot be empty")
+	}
+	if err := config.Pipelines.MTA.Validate(); err != nil {
+		return fmt.Errorf("invalid MTA pipeline: %w", err)
+	}
+	// SPAM_CHECK_ENABLE only changes the default MTA pipeline
+	if config.EnableSpamCheck && !config.Pipelines.MTA.Contains("spamcheck") {
+		return fmt.Errorf("SPAM_CHECK_ENABLE cannot be used when the MTA pipeline in PIPELINE_FILE doesn't contain the spamcheck handler")
+	}
+	if len(config.Pipelines.MSA) == 0 {
+		return fmt.Errorf("MSA pipeline cannot be empty")
+	}
+	if err := config.Pipelines.MSA.Validate(); err != nil {
+		return fmt.Errorf("invalid MSA pipeline: %w", err)
+	}
 
 	// Metrics
 	if config.MetricsAddress == "" {
@@ -318,6 +423,24 @@ func (config *Config) GenerateMSAConfig() *server.Config {
 	}
 }
 
+// GenerateMSAImplicitTLSConfig generates the SMTP config for the submission listener with implicit TLS
+// from the config of the MSA.
+func (config *Config) GenerateMSAImplicitTLSConfig(msaConfig *server.Config) *server.Config {
+
+	host, port, err := net.SplitHostPort(config.SMTPAddressOutgoingTLS)
+	if err != nil {
+		// TODO: handle
+		log.Fatalf("couldn't determine SMTP address/port: %v", err)
+	}
+
+	portInt, _ := strconv.Atoi(port)
+
+	c := *msaConfig
+	c.Ip = host
+	c.Port = uint32(portInt)
+	return &c
+}
+
 // GenerateIMAPBackendConfig generates the config object for the IMAP backend
 func (config *Config) GenerateIMAPBackendConfig() *imap.Config {
 	return &imap.Config{
@@ -1,6 +1,8 @@
 package mistralmail
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -90,3 +92,113 @@ func TestConfig(t *testing.T) {
 	})
 
 }
+
+func TestConfigImplicitTLSWithoutTLS(t *testing.T) {
+
+	Convey("When IMAP_ADDRESS_TLS is set and TLS is disabled", t, func() {
+		t.Setenv("HOSTNAME", "test")
+		t.Setenv("HTTP_ADDRESS", ":8080")
+		t.Setenv("METRICS_ADDRESS", ":9000")
+		t.Setenv("SECRET", "some-secret")
+		t.Setenv("TLS_DISABLE", "true")
+		t.Setenv("SMTP_ADDRESS_INCOMING", "")
+		t.Setenv("SMTP_ADDRESS_OUTGOING", "smtp.outgoing.example.com:587")
+		t.Setenv("SMTP_OUTGOING_MODE", "RELAY")
+		t.Setenv("EXTERNAL_RELAY_HOSTNAME", "somehost")
+		t.Setenv("EXTERNAL_RELAY_PORT", "587")
+		t.Setenv("IMAP_ADDRESS", "imap.example.com:143")
+		t.Setenv("IMAP_ADDRESS_TLS", "imap.example.com:993")
+		t.Setenv("DATABASE_URL", "sqlite:file.db")
+
+		config, err := BuildConfigFromEnv()
+		So(err, ShouldBeNil)
+
+		err = config.Validate()
+
+		Convey("Then it should return an error", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "IMAP_ADDRESS_TLS cannot be used when TLS is disabled")
+		})
+	})
+
+}
+
+func TestConfigPipelineFile(t *testing.T) {
+
+	Convey("When a pipeline file is given", t, func() {
+		t.Setenv("HOSTNAME", "test")
+		t.Setenv("HTTP_ADDRESS", ":8080")
+		t.Setenv("METRICS_ADDRESS", ":9000")
+		t.Setenv("SECRET", "some-secret")
+		t.Setenv("TLS_DISABLE", "true")
+		t.Setenv("SMTP_ADDRESS_OUTGOING", "smtp.outgoing.example.com:587")
+		t.Setenv("SMTP_OUTGOING_MODE", "RELAY")
+		t.Setenv("EXTERNAL_RELAY_HOSTNAME", "somehost")
+		t.Setenv("EXTERNAL_RELAY_PORT", "587")
+		t.Setenv("IMAP_ADDRESS", "imap.example.com:143")
+		t.Setenv("DATABASE_URL", "sqlite:file.db")
+		t.Setenv("SPAM_CHECK_ENABLE", "")
+
+		pipelineFile := filepath.Join(t.TempDir(), "pipelines.json")
+		t.Setenv("PIPELINE_FILE", pipelineFile)
+
+		Convey("Then the configured MTA pipeline is used and the MSA falls back to the default", func() {
+			err := os.WriteFile(pipelineFile, []byte(`{"mta": [{"handler": "received"}, {"handler": "route", "options": {"timeout": "5s"}}, {"handler": "imap"}]}`), 0644)
+			So(err, ShouldBeNil)
+
+			config, err := BuildConfigFromEnv()
+			So(err, ShouldBeNil)
+			So(config.Validate(), ShouldBeNil)
+
+			So(len(config.Pipelines.MTA), ShouldEqual, 3)
+			So(config.Pipelines.MTA[1].Handler, ShouldEqual, "route")
+			So(config.Pipelines.MSA, ShouldResemble, defaultMSAPipeline())
+		})
+
+		Convey("Then SPAM_CHECK_ENABLE is rejected when the MTA pipeline doesn't contain the spam check", func() {
+			t.Setenv("SPAM_CHECK_ENABLE", "true")
+
+			err := os.WriteFile(pipelineFile, []byte(`{"mta": [{"handler": "received"}, {"handler": "imap"}]}`), 0644)
+			So(err, ShouldBeNil)
+
+			config, err := BuildConfigFromEnv()
+			So(err, ShouldBeNil)
+
+			err = config.Validate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "SPAM_CHECK_ENABLE cannot be used when the MTA pipeline in PIPELINE_FILE doesn't contain the spamcheck handler")
+
+			err = os.WriteFile(pipelineFile, []byte(`{"mta": [{"handler": "received"}, {"handler": "spamcheck"}, {"handler": "imap"}]}`), 0644)
+			So(err, ShouldBeNil)
+
+			config, err = BuildConfigFromEnv()
+			So(err, ShouldBeNil)
+			So(config.Validate(), ShouldBeNil)
+		})
+
+		Convey("Then unknown handlers are rejected", func() {
+			err := os.WriteFile(pipelineFile, []byte(`{"mta": [{"handler": "received"}, {"handler": "does-not-exist"}]}`), 0644)
+			So(err, ShouldBeNil)
+
+			config, err := BuildConfigFromEnv()
+			So(err, ShouldBeNil)
+
+			err = config.Validate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `invalid MTA pipeline: handler 2: unknown handler "does-not-exist"`)
+		})
+
+		Convey("Then invalid options are rejected", func() {
+			err := os.WriteFile(pipelineFile, []byte(`{"mta": [{"handler": "route", "options": {"timeout": 30}}]}`), 0644)
+			So(err, ShouldBeNil)
+
+			config, err := BuildConfigFromEnv()
+			So(err, ShouldBeNil)
+
+			err = config.Validate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `invalid MTA pipeline: handler 1 (route): option "timeout": expected a value of type duration`)
+		})
+	})
+
+}
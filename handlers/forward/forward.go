@@ -0,0 +1,240 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/srs"
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Define a counter vector for forwarded SMTP messages.
+var smtpForwarded = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "smtp_forwarded",
+		Help: "SMTP messages forwarded to external addresses (forward, bounce, invalid-srs or error)",
+	},
+	[]string{"status"},
+)
+
+var (
+	// ErrInvalidSRSAddress is returned for bounces to SRS addresses that don't validate.
+	ErrInvalidSRSAddress = handlers.Reject(550, "5.1.1", "Invalid SRS address")
+	// ErrForwardRejected is returned when the destination permanently rejected the forwarded message.
+	ErrForwardRejected = handlers.Reject(554, "5.0.0", "Transaction failed: forwarded message rejected")
+)
+
+// ForwardStore finds the active forwards for a recipient.
+type ForwardStore interface {
+	// FindConfirmedForwardsByEmail returns the confirmed forwards for the given address.
+	FindConfirmedForwardsByEmail(email string) ([]*models.Forward, error)
+}
+
+// DeliveryStore records the messages that were forwarded, so retries of the sending server don't forward them again.
+type DeliveryStore interface {
+	// FindDeliverySince returns the latest delivery with the key after the given time, or nil.
+	FindDeliverySince(key string, since time.Time) (*models.Delivery, error)
+	// CreateDelivery records a delivery.
+	CreateDelivery(delivery *models.Delivery) error
+}
+
+// Sender sends mail to external addresses.
+type Sender interface {
+	// SendMail sends the message with the given envelope sender and recipients.
+	SendMail(from string, recipients []string, message []byte) error
+}
+
+// New creates a new Forward handler.
+func New(c *server.Config, srs *srs.SRS, forwards ForwardStore, deliveries DeliveryStore, sender Sender) *Forward {
+	return &Forward{
+		config:     c,
+		srs:        srs,
+		forwards:   forwards,
+		deliveries: deliveries,
+		sender:     sender,
+	}
+}
+
+// Forward is an SMTP handler that forwards mail to the external addresses configured by local users.
+// The envelope sender is rewritten with SRS so SPF keeps passing at the destination.
+// Bounces to SRS addresses are validated and sent back to the original sender.
+//
+// Recipients that are handled completely are removed from the state,
+// so handlers further down the chain only see the recipients that still need local delivery.
+// Every recipient is handled independently and the forwards that were sent are recorded,
+// so when the message fails for some recipients the retry of the sending server only forwards it to the others.
+type Forward struct {
+	config     *server.Config
+	srs        *srs.SRS
+	forwards   ForwardStore
+	deliveries DeliveryStore
+	sender     Sender
+}
+
+// Handle implements the Handler interface.
+// When the message couldn't be forwarded for some recipients, only those and the ones for local delivery are kept in the state.
+func (handler *Forward) Handle(state *smtp.State) error {
+
+	remaining := []*smtp.MailAddress{}
+	failed := []*smtp.MailAddress{}
+	var verdict *handlers.Verdict
+
+	for _, recipient := range state.To {
+		keep, err := handler.handleRecipient(state, recipient)
+		if err != nil {
+			failed = append(failed, recipient)
+			verdict = handlers.WorstVerdict(verdict, err)
+			continue
+		}
+		if keep {
+			remaining = append(remaining, recipient)
+		}
+	}
+
+	if verdict != nil {
+		state.To = append(failed, remaining...)
+		return verdict
+	}
+	state.To = remaining
+
+	return nil
+}
+
+// handleRecipient forwards or bounces the message for the recipient,
+// and returns whether the recipient still needs local delivery.
+func (handler *Forward) handleRecipient(state *smtp.State, recipient *smtp.MailAddress) (bool, error) {
+
+	// Bounces to one of our rewritten addresses
+	if srs.IsSRS(recipient.GetAddress()) && strings.EqualFold(recipient.GetDomain(), handler.srs.Domain()) {
+		return false, handler.bounce(state, recipient)
+	}
+
+	forwards, err := handler.forwards.FindConfirmedForwardsByEmail(recipient.GetAddress())
+	if err != nil {
+		smtpForwarded.WithLabelValues("error").Inc()
+		return false, handlers.ErrLocalError.Wrap(err)
+	}
+
+	if len(forwards) == 0 {
+		return true, nil
+	}
+
+	keepCopy := false
+	targets := []string{}
+	for _, forward := range forwards {
+		targets = append(targets, forward.Address)
+		keepCopy = keepCopy || forward.KeepCopy
+	}
+
+	err = handler.forward(state, recipient, targets)
+	if err != nil {
+		return false, err
+	}
+
+	return keepCopy, nil
+}
+
+// forward sends the message for the recipient to the given targets with an SRS rewritten envelope sender.
+func (handler *Forward) forward(state *smtp.State, recipient *smtp.MailAddress, targets []string) error {
+
+	from, err := handler.srs.Forward(state.From.GetAddress())
+	if err != nil {
+		smtpForwarded.WithLabelValues("error").Inc()
+		return handlers.ErrLocalError.Wrap(err)
+	}
+
+	err = handler.send(state, recipient, from, targets)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Hostname":  state.Hostname,
+		}).Errorf("Couldn't forward message: %v", err)
+		smtpForwarded.WithLabelValues("error").Inc()
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"Hostname":  state.Hostname,
+	}).Debugf("Forwarded message from %q to %v", from, targets)
+
+	smtpForwarded.WithLabelValues("forward").Inc()
+
+	return nil
+}
+
+// bounce reverses the SRS recipient and sends the message back to the original sender.
+func (handler *Forward) bounce(state *smtp.State, recipient *smtp.MailAddress) error {
+
+	original, err := handler.srs.Reverse(recipient.GetAddress())
+	if errors.Is(err, srs.ErrInvalidHash) || errors.Is(err, srs.ErrExpired) || errors.Is(err, srs.ErrMalformed) {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Hostname":  state.Hostname,
+		}).Warnf("Rejected bounce to invalid SRS address %q: %v", recipient.GetAddress(), err)
+		smtpForwarded.WithLabelValues("invalid-srs").Inc()
+		return ErrInvalidSRSAddress
+	}
+	if err != nil {
+		smtpForwarded.WithLabelValues("error").Inc()
+		return handlers.ErrLocalError.Wrap(err)
+	}
+
+	err = handler.send(state, recipient, state.From.GetAddress(), []string{original})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Hostname":  state.Hostname,
+		}).Errorf("Couldn't return bounce: %v", err)
+		smtpForwarded.WithLabelValues("error").Inc()
+		return err
+	}
+
+	smtpForwarded.WithLabelValues("bounce").Inc()
+
+	return nil
+}
+
+// send sends the message for the recipient, unless an earlier attempt of the sending server did already.
+// Permanent errors of the destination reject the message, everything else can be retried.
+func (handler *Forward) send(state *smtp.State, recipient *smtp.MailAddress, from string, targets []string) error {
+
+	key := models.DeliveryKey("forward:"+recipient.GetAddress(), state.Data)
+	delivery, err := handler.deliveries.FindDeliverySince(key, time.Now().Add(-models.DeliveryWindow))
+	if err != nil {
+		return handlers.ErrLocalError.Wrap(fmt.Errorf("couldn't check earlier forwards: %w", err))
+	}
+	if delivery != nil {
+		log.WithField("SessionId", state.SessionId.String()).Debugf("Message for %q was already forwarded", recipient.GetAddress())
+		return nil
+	}
+
+	err = handler.sender.SendMail(from, targets, state.Data)
+	var destinationErr *textproto.Error
+	if errors.As(err, &destinationErr) && destinationErr.Code >= 500 {
+		return ErrForwardRejected.Wrap(err)
+	}
+	if err != nil {
+		return handlers.ErrLocalError.Wrap(err)
+	}
+
+	// The message is sent, so failing now would only send it again
+	err = handler.deliveries.CreateDelivery(&models.Delivery{DeliveryKey: key, Recipient: recipient.GetAddress()})
+	if err != nil {
+		log.WithField("SessionId", state.SessionId.String()).Errorf("Couldn't record forward for %q: %v", recipient.GetAddress(), err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/srs"
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testForwardStore map[string][]*models.Forward
+
+func (s testForwardStore) FindConfirmedForwardsByEmail(email string) ([]*models.Forward, error) {
+	return s[email], nil
+}
+
+type testDeliveryStore map[string]*models.Delivery
+
+func (s testDeliveryStore) FindDeliverySince(key string, since time.Time) (*models.Delivery, error) {
+	return s[key], nil
+}
+
+func (s testDeliveryStore) CreateDelivery(delivery *models.Delivery) error {
+	s[delivery.DeliveryKey] = delivery
+	return nil
+}
+
+type sentMail struct {
+	from       string
+	recipients []string
+}
+
+type testSender struct {
+	sent []sentMail
+	err  error
+	// errs fails the mail to the given recipient
+	errs map[string]error
+}
+
+func (s *testSender) SendMail(from string, recipients []string, message []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.errs[recipients[0]]; err != nil {
+		return err
+	}
+	s.sent = append(s.sent, sentMail{from: from, recipients: recipients})
+	return nil
+}
+
+func TestForwardHandler(t *testing.T) {
+
+	Convey("Testing Forward handler", t, func() {
+
+		c := &server.Config{Hostname: "mx.example.com"}
+
+		rewriter, err := srs.New("some-secret", "example.com", srs.DefaultMaxAge)
+		So(err, ShouldBeNil)
+
+		store := testForwardStore{
+			"forward@example.com": {{Address: "external@example.org"}},
+			"copy@example.com":    {{Address: "other@example.org", KeepCopy: true}},
+		}
+		deliveries := testDeliveryStore{}
+		sender := &testSender{}
+
+		h := New(c, rewriter, store, deliveries, sender)
+
+		state := &smtp.State{
+			From: &smtp.MailAddress{Address: "sender@example.net"},
+			To: []*smtp.MailAddress{
+				{Address: "local@example.com"},
+				{Address: "forward@example.com"},
+				{Address: "copy@example.com"},
+			},
+			Data: []byte("Hello world!"),
+			Ip:   net.ParseIP("192.168.0.10"),
+		}
+
+		Convey("Forwards are sent with an SRS sender and only local recipients remain", func() {
+			err := h.Handle(state)
+			So(err, ShouldBeNil)
+
+			So(len(sender.sent), ShouldEqual, 2)
+			So(sender.sent[0].recipients, ShouldResemble, []string{"external@example.org"})
+			So(strings.HasPrefix(sender.sent[0].from, "SRS0="), ShouldBeTrue)
+			So(strings.HasSuffix(sender.sent[0].from, "=example.net=sender@example.com"), ShouldBeTrue)
+
+			So(len(state.To), ShouldEqual, 2)
+			So(state.To[0].Address, ShouldEqual, "local@example.com")
+			So(state.To[1].Address, ShouldEqual, "copy@example.com")
+		})
+
+		Convey("Failing to forward results in a temporary error", func() {
+			sender.err = fmt.Errorf("relay down")
+			err := h.Handle(state)
+			So(errors.Is(err, handlers.ErrLocalError), ShouldBeTrue)
+			So(len(deliveries), ShouldEqual, 0)
+		})
+
+		Convey("Forwards rejected by the destination result in a permanent error", func() {
+			sender.err = &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+			err := h.Handle(state)
+			So(errors.Is(err, ErrForwardRejected), ShouldBeTrue)
+		})
+
+		Convey("A retry doesn't forward again to the recipients that succeeded", func() {
+			sender.errs = map[string]error{"other@example.org": fmt.Errorf("relay down")}
+			err := h.Handle(state)
+			So(errors.Is(err, handlers.ErrLocalError), ShouldBeTrue)
+			So(len(sender.sent), ShouldEqual, 1)
+			So(sender.sent[0].recipients, ShouldResemble, []string{"external@example.org"})
+
+			// Only the failed recipient and the local one remain
+			So(len(state.To), ShouldEqual, 2)
+			So(state.To[0].Address, ShouldEqual, "copy@example.com")
+			So(state.To[1].Address, ShouldEqual, "local@example.com")
+
+			retry := &smtp.State{
+				From: state.From,
+				To: []*smtp.MailAddress{
+					{Address: "local@example.com"},
+					{Address: "forward@example.com"},
+					{Address: "copy@example.com"},
+				},
+				Data: state.Data,
+				Ip:   state.Ip,
+			}
+			sender.errs = nil
+			err = h.Handle(retry)
+			So(err, ShouldBeNil)
+			So(len(sender.sent), ShouldEqual, 2)
+			So(sender.sent[1].recipients, ShouldResemble, []string{"other@example.org"})
+			So(len(retry.To), ShouldEqual, 2)
+		})
+
+		Convey("Bounces to valid SRS addresses are returned to the original sender", func() {
+			rewritten, err := rewriter.Forward("sender@example.net")
+			So(err, ShouldBeNil)
+
+			bounce := &smtp.State{
+				From: &smtp.MailAddress{Address: ""},
+				To:   []*smtp.MailAddress{{Address: rewritten}},
+				Data: []byte("Delivery failed"),
+				Ip:   net.ParseIP("192.168.0.10"),
+			}
+
+			err = h.Handle(bounce)
+			So(err, ShouldBeNil)
+			So(len(sender.sent), ShouldEqual, 1)
+			So(sender.sent[0].from, ShouldEqual, "")
+			So(sender.sent[0].recipients, ShouldResemble, []string{"sender@example.net"})
+			So(len(bounce.To), ShouldEqual, 0)
+		})
+
+		Convey("Bounces to invalid SRS addresses are rejected", func() {
+			bounce := &smtp.State{
+				From: &smtp.MailAddress{Address: ""},
+				To:   []*smtp.MailAddress{{Address: "SRS0=abcd=AA=example.net=sender@example.com"}},
+				Data: []byte("Delivery failed"),
+				Ip:   net.ParseIP("192.168.0.10"),
+			}
+
+			err := h.Handle(bounce)
+			So(err, ShouldEqual, ErrInvalidSRSAddress)
+			So(len(sender.sent), ShouldEqual, 0)
+		})
+
+		Convey("An invalid SRS address doesn't stop the other recipients", func() {
+			state.To = append([]*smtp.MailAddress{{Address: "SRS0=abcd=AA=example.net=sender@example.com"}}, state.To...)
+
+			err := h.Handle(state)
+			So(err, ShouldEqual, ErrInvalidSRSAddress)
+			So(len(sender.sent), ShouldEqual, 2)
+			So(len(state.To), ShouldEqual, 3)
+			So(state.To[0].Address, ShouldEqual, "SRS0=abcd=AA=example.net=sender@example.com")
+		})
+
+	})
+
+}
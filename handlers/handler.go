@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"errors"
+
+	"github.com/mistralmail/mistralmail/backend/services/quarantine"
 	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
 )
 
 // Handler is an interface for SMTP handlers.
@@ -22,12 +26,62 @@ func (h *HandlerMachanism) AddHandler(handler ...Handler) {
 }
 
 // Handle implements the Handler interface.
+//
+// Handlers can return a *Verdict to decide what happens with the message:
+// reject verdicts stop the chain and are sent to the client as SMTP errors,
+// continue and quarantine verdicts run the next handler and
+// accept and discard verdicts stop the chain and accept the message.
+// Any other error stops the chain and is returned as is.
+//
+// The quarantine header is removed from the message before the chain runs,
+// only quarantine verdicts can add it.
 func (h *HandlerMachanism) Handle(state *smtp.State) error {
+	if state != nil {
+		state.Data = quarantine.Strip(state.Data)
+	}
+
 	for _, handler := range h.Handlers {
 		err := handler.Handle(state)
-		if err != nil {
+		if err == nil {
+			continue
+		}
+
+		var verdict *Verdict
+		if !errors.As(err, &verdict) {
 			return err
 		}
+
+		logger := log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Hostname":  state.Hostname,
+			"Action":    verdict.Action.String(),
+		})
+
+		switch verdict.Action {
+		case ActionContinue:
+			logger.Debugf("Handler continued: %v", verdict)
+			continue
+
+		case ActionQuarantine:
+			logger.Infof("Message quarantined: %s", verdict.Reason)
+			state.AddHeader(quarantine.Header, verdict.Reason)
+			continue
+
+		case ActionAccept:
+			logger.Debugf("Message accepted: %v", verdict)
+			return nil
+
+		case ActionDiscard:
+			logger.Infof("Message discarded: %s", verdict.Reason)
+			return nil
+
+		default:
+			if verdict.Err != nil {
+				logger.Warnf("Message rejected: %v", verdict)
+			}
+			return verdict.SMTPError()
+		}
 	}
 	return nil
 }
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/mistralmail/mistralmail/backend/services/quarantine"
 	"github.com/mistralmail/smtp/smtp"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -38,3 +41,89 @@ func TestHandlersAddress(t *testing.T) {
 	})
 
 }
+
+type verdictHandler struct {
+	err error
+}
+
+func (vh *verdictHandler) Handle(state *smtp.State) error {
+	return vh.err
+}
+
+func TestHandlerMechanismVerdicts(t *testing.T) {
+
+	Convey("Testing HandlerMechanism verdicts", t, func() {
+
+		state := &smtp.State{
+			From: &smtp.MailAddress{Address: "from@example.com"},
+			To:   []*smtp.MailAddress{{Address: "to@example.com"}},
+			Data: []byte("Subject: test\r\n\r\nHello world!"),
+		}
+		last := &TestHandler{}
+		count = 0
+
+		Convey("Reject verdicts stop the chain and are sent as SMTP error", func() {
+			hm := HandlerMachanism{Handlers: []Handler{&verdictHandler{err: ErrMailboxUnavailable}, last}}
+			err := hm.Handle(state)
+			So(err, ShouldResemble, smtp.SMTPError{Status: 550, Message: "5.1.1 Requested action not taken: mailbox unavailable"})
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("Wrapped temporary failures keep their code", func() {
+			hm := HandlerMachanism{Handlers: []Handler{&verdictHandler{err: ErrLocalError.Wrap(fmt.Errorf("database down"))}, last}}
+			err := hm.Handle(state)
+			So(err, ShouldResemble, smtp.SMTPError{Status: 451, Message: "4.3.0 Requested action aborted: local error in processing"})
+		})
+
+		Convey("Continue verdicts run the next handler", func() {
+			hm := HandlerMachanism{Handlers: []Handler{&verdictHandler{err: Continue("check failed")}, last}}
+			So(hm.Handle(state), ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("Accept and discard verdicts stop the chain without an error", func() {
+			hm := HandlerMachanism{Handlers: []Handler{&verdictHandler{err: Discard("blocked sender")}, last}}
+			So(hm.Handle(state), ShouldBeNil)
+			So(count, ShouldEqual, 0)
+
+			hm = HandlerMachanism{Handlers: []Handler{&verdictHandler{err: Accept()}, last}}
+			So(hm.Handle(state), ShouldBeNil)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("Quarantine verdicts add the quarantine header and continue", func() {
+			hm := HandlerMachanism{Handlers: []Handler{&verdictHandler{err: Quarantine("suspicious attachment")}, last}}
+			So(hm.Handle(state), ShouldBeNil)
+			So(count, ShouldEqual, 1)
+
+			reason, ok := state.GetHeader(quarantine.Header)
+			So(ok, ShouldBeTrue)
+			So(reason, ShouldEqual, "suspicious attachment")
+		})
+
+		Convey("Quarantine headers in the incoming message are removed", func() {
+			state.Data = []byte("X-MistralMail-Quarantine: forged\r\nSubject: test\r\n\r\nHello world!")
+
+			hm := HandlerMachanism{Handlers: []Handler{last}}
+			So(hm.Handle(state), ShouldBeNil)
+
+			_, ok := state.GetHeader(quarantine.Header)
+			So(ok, ShouldBeFalse)
+			So(string(state.Data), ShouldEqual, "Subject: test\r\n\r\nHello world!")
+		})
+
+		Convey("Other errors are returned as is", func() {
+			hm := HandlerMachanism{Handlers: []Handler{&verdictHandler{err: fmt.Errorf("boom")}, last}}
+			So(hm.Handle(state).Error(), ShouldEqual, "boom")
+		})
+
+		Convey("Verdicts can be compared with errors.Is", func() {
+			So(errors.Is(ErrLocalError.Wrap(fmt.Errorf("boom")), ErrLocalError), ShouldBeTrue)
+			So(errors.Is(ErrLocalError, ErrMailboxUnavailable), ShouldBeFalse)
+			So(ErrLocalError.Temporary(), ShouldBeTrue)
+			So(ErrMailboxUnavailable.Temporary(), ShouldBeFalse)
+		})
+
+	})
+
+}
@@ -1,27 +1,34 @@
 package imaphandler
 
 import (
+	"errors"
+
 	imapbackend "github.com/mistralmail/mistralmail/backend/imap"
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
+	"github.com/mistralmail/mistralmail/handlers"
 	"github.com/mistralmail/smtp/server"
 	"github.com/mistralmail/smtp/smtp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
 )
 
 // Define a counter vector for received SMTP requests.
 var smtpReceived = promauto.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "smtp_received",
-		Help: "SMTP requests received (success, mailbox-not-available or error)",
+		Help: "SMTP requests received (success, partial, mailbox-not-available, rejected or error)",
 	},
 	[]string{"status"}, // The label "status" can have values "success" or "error".
 )
 
 // New creates a new IMAP Handler
-func New(c *server.Config, imapbackend *imapbackend.IMAPBackend) *ImapHandler {
+func New(c *server.Config, imapbackend *imapbackend.IMAPBackend, webhooks *webhooks.Webhooks) *ImapHandler {
 	return &ImapHandler{
 		config:      c,
 		imapbackend: imapbackend,
+		webhooks:    webhooks,
 	}
 }
 
@@ -29,35 +36,157 @@ func New(c *server.Config, imapbackend *imapbackend.IMAPBackend) *ImapHandler {
 type ImapHandler struct {
 	config      *server.Config
 	imapbackend *imapbackend.IMAPBackend
+	webhooks    *webhooks.Webhooks
 }
 
 // Handle implements the SMTP Handle interface method.
 // it validates the recipients email address and
 // deliver the mail to the IMAP backend.
+// When the message couldn't be delivered to some recipients, only those are kept in the state.
 func (handler *ImapHandler) Handle(state *smtp.State) error {
 
 	// Check whether the recipients are known to the IMAP backend
 	for _, recipient := range state.To {
-		recipientExists, err := handler.imapbackend.MailaddressExists(recipient.GetAddress())
+		err := handler.CheckRecipient(recipient.GetAddress())
+		if errors.Is(err, handlers.ErrMailboxUnavailable) {
+			handler.webhooks.Emit(webhooks.EventMailRejected, eventData(state, "mailbox not available: "+recipient.GetAddress()))
+		}
 		if err != nil {
-			smtpReceived.WithLabelValues("error").Inc()
 			return err
 		}
+	}
 
-		if !recipientExists {
-			smtpReceived.WithLabelValues("mailbox-not-available").Inc()
-			return smtp.SMTPErrorPermanentMailboxNotAvailable
+	errs := handler.Deliver(state)
+
+	failed := []*smtp.MailAddress{}
+	var verdict *handlers.Verdict
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, state.To[i])
+			verdict = handlers.WorstVerdict(verdict, err)
 		}
 	}
+	if verdict == nil {
+		return nil
+	}
 
-	// Add mail in the backend
-	_, err := handler.imapbackend.AddMail(state)
+	// Only keep the recipients that weren't delivered
+	state.To = failed
+	return verdict
+
+}
+
+// CheckRecipient returns an error when mail can't be delivered to the address.
+func (handler *ImapHandler) CheckRecipient(address string) error {
+	recipientExists, err := handler.imapbackend.MailaddressExists(address)
 	if err != nil {
 		smtpReceived.WithLabelValues("error").Inc()
-		return err
+		return handlers.ErrLocalError.Wrap(err)
+	}
+
+	if !recipientExists {
+		smtpReceived.WithLabelValues("mailbox-not-available").Inc()
+		return handlers.ErrMailboxUnavailable
 	}
 
-	smtpReceived.WithLabelValues("success").Inc()
 	return nil
+}
+
+// Deliver adds the mail in the IMAP backend for every recipient independently,
+// and returns the result of every recipient: nil when it was delivered, or a *handlers.Verdict.
+// The recipients must have been checked with CheckRecipient.
+func (handler *ImapHandler) Deliver(state *smtp.State) []error {
+
+	errs := make([]error, len(state.To))
+
+	results, err := handler.imapbackend.AddMail(state)
+	if err != nil {
+		smtpReceived.WithLabelValues("error").Inc()
+		for i := range errs {
+			errs[i] = handlers.ErrLocalError.Wrap(err)
+		}
+		return errs
+	}
+
+	delivered := []*smtp.MailAddress{}
+	failed := []*smtp.MailAddress{}
+	var verdict *handlers.Verdict
+
+	for i, result := range results {
+		if result.Err == nil {
+			delivered = append(delivered, state.To[i])
+			continue
+		}
 
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Recipient": result.Recipient,
+		}).Warnf("Couldn't deliver message: %v", result.Err)
+
+		failed = append(failed, state.To[i])
+		errs[i] = deliveryVerdict(result.Err)
+		verdict = handlers.WorstVerdict(verdict, errs[i])
+	}
+
+	if len(delivered) > 0 {
+		deliveredState := *state
+		deliveredState.To = delivered
+		handler.webhooks.Emit(webhooks.EventMailReceived, eventData(&deliveredState, ""))
+	}
+
+	if verdict == nil {
+		smtpReceived.WithLabelValues("success").Inc()
+		return errs
+	}
+
+	switch {
+	case len(delivered) > 0:
+		smtpReceived.WithLabelValues("partial").Inc()
+	case verdict.Err == nil:
+		smtpReceived.WithLabelValues("rejected").Inc()
+	default:
+		smtpReceived.WithLabelValues("error").Inc()
+	}
+	failedState := *state
+	failedState.To = failed
+	handler.webhooks.Emit(webhooks.EventMailRejected, eventData(&failedState, verdict.Error()))
+
+	return errs
+
+}
+
+// deliveryVerdict returns the verdict for a recipient the message couldn't be delivered to.
+func deliveryVerdict(err error) *handlers.Verdict {
+	var rejected *scripting.RejectedError
+	if errors.As(err, &rejected) {
+		if rejected.Result.Action == scripting.ActionTempFail {
+			return handlers.TempFail(rejected.Result.Code, rejected.Result.EnhancedCode, rejected.Result.Message)
+		}
+		return handlers.Reject(rejected.Result.Code, rejected.Result.EnhancedCode, rejected.Result.Message)
+	}
+	return handlers.ErrLocalError.Wrap(err)
+}
+
+// eventData creates the webhook event data for the given state.
+func eventData(state *smtp.State, reason string) map[string]interface{} {
+	recipients := make([]string, len(state.To))
+	for i, to := range state.To {
+		recipients[i] = to.GetAddress()
+	}
+
+	data := map[string]interface{}{
+		"sessionId": state.SessionId.String(),
+		"ip":        state.Ip.String(),
+		"from":      state.From.GetAddress(),
+		"to":        recipients,
+		"size":      len(state.Data),
+	}
+	if messageID, ok := state.GetHeader("Message-ID"); ok {
+		data["messageId"] = messageID
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	return data
 }
@@ -0,0 +1,147 @@
+package milter
+
+import (
+	"bytes"
+	"strings"
+)
+
+// headerField is a single (possibly folded) header field of a message.
+type headerField struct {
+	Key   string
+	Value string
+	// raw is the original field, so unmodified fields are written back byte for byte (e.g. for DKIM signatures).
+	raw string
+}
+
+// message is a message split into its header fields and body,
+// so the modifications of the milters can be applied.
+type message struct {
+	Header []*headerField
+	Body   []byte
+	// separator is the original empty line between the header and the body.
+	separator string
+}
+
+// splitMessage splits the raw message into its header fields and body.
+// Folded header values are kept as they are (with CRLF line endings).
+func splitMessage(data []byte) *message {
+
+	msg := &message{Header: []*headerField{}}
+
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		var line []byte
+		if end == -1 {
+			line, rest = rest, nil
+		} else {
+			line, rest = rest[:end+1], rest[end+1:]
+		}
+		trimmed := strings.TrimRight(string(line), "\r\n")
+
+		// Empty line ends the header
+		if trimmed == "" {
+			msg.separator = string(line)
+			msg.Body = rest
+			return msg
+		}
+
+		// Continuation of the previous field
+		if (trimmed[0] == ' ' || trimmed[0] == '\t') && len(msg.Header) > 0 {
+			previous := msg.Header[len(msg.Header)-1]
+			previous.Value += "\r\n" + trimmed
+			previous.raw += string(line)
+			continue
+		}
+
+		colon := strings.IndexByte(trimmed, ':')
+		if colon <= 0 {
+			// Not a header field, so this is the start of the body
+			msg.separator = "\r\n"
+			msg.Body = data[len(data)-len(rest)-len(line):]
+			return msg
+		}
+
+		msg.Header = append(msg.Header, &headerField{
+			Key:   trimmed[:colon],
+			Value: strings.TrimLeft(trimmed[colon+1:], " \t"),
+			raw:   string(line),
+		})
+	}
+
+	msg.separator = "\r\n"
+	msg.Body = []byte{}
+	return msg
+}
+
+// Bytes returns the raw message.
+func (m *message) Bytes() []byte {
+	buffer := &bytes.Buffer{}
+	for _, field := range m.Header {
+		if field.raw != "" && strings.HasSuffix(field.raw, "\n") {
+			buffer.WriteString(field.raw)
+			continue
+		}
+		buffer.WriteString(field.Key)
+		buffer.WriteString(": ")
+		buffer.WriteString(field.Value)
+		buffer.WriteString("\r\n")
+	}
+	buffer.WriteString(m.separator)
+	buffer.Write(m.Body)
+	return buffer.Bytes()
+}
+
+// AddHeader appends a header field.
+func (m *message) AddHeader(key, value string) {
+	m.Header = append(m.Header, &headerField{Key: key, Value: normalizeValue(value)})
+}
+
+// InsertHeader inserts a header field at the given position, 0 being the top of the header.
+func (m *message) InsertHeader(index int, key, value string) {
+	if index < 0 {
+		index = 0
+	}
+	if index > len(m.Header) {
+		index = len(m.Header)
+	}
+	field := &headerField{Key: key, Value: normalizeValue(value)}
+	m.Header = append(m.Header[:index], append([]*headerField{field}, m.Header[index:]...)...)
+}
+
+// ChangeHeader changes the value of the index-th (1-based) field with the given key.
+// The field is deleted when the value is empty and added when it doesn't exist.
+func (m *message) ChangeHeader(index int, key, value string) {
+	occurrence := 0
+	for i, field := range m.Header {
+		if !strings.EqualFold(field.Key, key) {
+			continue
+		}
+		occurrence++
+		if occurrence != index {
+			continue
+		}
+		if value == "" {
+			m.Header = append(m.Header[:i], m.Header[i+1:]...)
+		} else {
+			field.Value = normalizeValue(value)
+			field.raw = ""
+		}
+		return
+	}
+
+	if value != "" {
+		m.AddHeader(key, value)
+	}
+}
+
+// normalizeValue converts the line endings of folded values from milters to CRLF.
+func normalizeValue(value string) string {
+	return strings.TrimLeft(string(toCRLF([]byte(value))), " \t")
+}
+
+// toCRLF converts LF line endings (as sent by milters) to CRLF.
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
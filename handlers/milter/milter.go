@@ -0,0 +1,375 @@
+package milter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	gomilter "github.com/emersion/go-milter"
+)
+
+// Define a counter vector for milter results.
+var smtpMilter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "smtp_milter",
+		Help: "Milter results (continue, reject, tempfail, discard, quarantine or error)",
+	},
+	[]string{"milter", "result"},
+)
+
+// DefaultTimeout denotes the connect, read and write timeout for a milter.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultAction denotes what happens with the message when a milter can't be reached.
+type DefaultAction string
+
+const (
+	// DefaultActionTempFail asks the client to retry later.
+	DefaultActionTempFail DefaultAction = "tempfail"
+	// DefaultActionAccept skips the milter.
+	DefaultActionAccept DefaultAction = "accept"
+	// DefaultActionReject rejects the message.
+	DefaultActionReject DefaultAction = "reject"
+)
+
+// actionMask contains all the modifications the handler can apply.
+// It is limited to the actions of protocol version 2, so older milters can downgrade the protocol.
+const actionMask = gomilter.OptAddHeader | gomilter.OptChangeHeader | gomilter.OptChangeBody |
+	gomilter.OptQuarantine | gomilter.OptAddRcpt | gomilter.OptRemoveRcpt
+
+// Errors returned when a milter rejects the message without a custom reply.
+var (
+	ErrRejected = handlers.Reject(550, "5.7.1", "Command rejected")
+	ErrTempFail = handlers.TempFail(451, "4.7.1", "Service unavailable - try again later")
+)
+
+// enhancedCodeRegexp matches an enhanced status code at the start of a reply text.
+var enhancedCodeRegexp = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3}) `)
+
+// New creates a new Milter handler for the given milter addresses.
+// Addresses are written like Postfix does: "inet:host:port" (or "tcp:host:port") and "unix:/path/to/socket".
+func New(c *server.Config, addresses []string, timeout time.Duration, defaultAction DefaultAction) (*Milter, error) {
+
+	switch defaultAction {
+	case DefaultActionTempFail, DefaultActionAccept, DefaultActionReject:
+	default:
+		return nil, fmt.Errorf("unknown default action %q", defaultAction)
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no milters given")
+	}
+
+	milters := []*client{}
+	for _, address := range addresses {
+		network, addr, err := parseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		milters = append(milters, &client{
+			name: address,
+			client: gomilter.NewClientWithOptions(network, addr, gomilter.ClientOptions{
+				Dialer:       &net.Dialer{Timeout: timeout},
+				ReadTimeout:  timeout,
+				WriteTimeout: timeout,
+				ActionMask:   actionMask,
+			}),
+		})
+	}
+
+	return &Milter{
+		config:        c,
+		milters:       milters,
+		defaultAction: defaultAction,
+	}, nil
+}
+
+// Milter is an SMTP handler that passes the message through one or more milters (Sendmail milter protocol v6),
+// like Postfix does for OpenDKIM, OpenDMARC, rspamd, ...
+//
+// The milters are called in order and every milter sees the modifications of the milters before it.
+type Milter struct {
+	config        *server.Config
+	milters       []*client
+	defaultAction DefaultAction
+}
+
+// client is a single milter.
+type client struct {
+	name   string
+	client *gomilter.Client
+}
+
+// Handle implements the Handler interface.
+func (handler *Milter) Handle(state *smtp.State) error {
+
+	quarantineReasons := []string{}
+
+	for _, milter := range handler.milters {
+		reason, err := handler.check(milter, state)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			quarantineReasons = append(quarantineReasons, reason)
+		}
+	}
+
+	if len(quarantineReasons) > 0 {
+		return handlers.Quarantine(strings.Join(quarantineReasons, "; "))
+	}
+
+	return nil
+}
+
+// check replays the SMTP session to a single milter and applies the returned modifications.
+// It returns the quarantine reason if the milter quarantined the message.
+func (handler *Milter) check(milter *client, state *smtp.State) (string, error) {
+
+	logger := log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"Hostname":  state.Hostname,
+		"Milter":    milter.name,
+	})
+
+	session, err := milter.client.Session()
+	if err != nil {
+		logger.Warnf("Couldn't connect to milter: %v", err)
+		smtpMilter.WithLabelValues(milter.name, "error").Inc()
+		return "", handler.unavailable(err)
+	}
+	defer session.Close()
+
+	msg := splitMessage(state.Data)
+
+	act, err := handler.replay(session, state, msg)
+	if err != nil {
+		logger.Warnf("Milter failed: %v", err)
+		smtpMilter.WithLabelValues(milter.name, "error").Inc()
+		return "", handler.unavailable(err)
+	}
+
+	var modifications []gomilter.ModifyAction
+	if act.Code == gomilter.ActContinue {
+		modifications, act, err = session.BodyReadFrom(bytes.NewReader(msg.Body))
+		if err != nil {
+			logger.Warnf("Milter failed: %v", err)
+			smtpMilter.WithLabelValues(milter.name, "error").Inc()
+			return "", handler.unavailable(err)
+		}
+	}
+
+	switch act.Code {
+	case gomilter.ActAccept, gomilter.ActContinue, gomilter.ActSkip:
+		// accepted, apply the modifications below
+
+	case gomilter.ActDiscard:
+		smtpMilter.WithLabelValues(milter.name, "discard").Inc()
+		return "", handlers.Discard(fmt.Sprintf("discarded by milter %s", milter.name))
+
+	case gomilter.ActReject:
+		smtpMilter.WithLabelValues(milter.name, "reject").Inc()
+		return "", ErrRejected
+
+	case gomilter.ActTempFail:
+		smtpMilter.WithLabelValues(milter.name, "tempfail").Inc()
+		return "", ErrTempFail
+
+	case gomilter.ActReplyCode:
+		smtpMilter.WithLabelValues(milter.name, replyResult(act.SMTPCode)).Inc()
+		return "", replyVerdict(act.SMTPCode, act.SMTPText)
+
+	default:
+		smtpMilter.WithLabelValues(milter.name, "error").Inc()
+		return "", handler.unavailable(fmt.Errorf("unexpected milter action %q", act.Code))
+	}
+
+	quarantine := ""
+	if len(modifications) > 0 {
+		quarantine = applyModifications(state, msg, modifications)
+		state.Data = msg.Bytes()
+	}
+
+	if quarantine != "" {
+		logger.Infof("Milter quarantined message: %s", quarantine)
+		smtpMilter.WithLabelValues(milter.name, "quarantine").Inc()
+		return quarantine, nil
+	}
+
+	smtpMilter.WithLabelValues(milter.name, "continue").Inc()
+	return "", nil
+}
+
+// replay sends the connect, HELO, envelope and header events to the milter.
+// It stops at the first action that isn't continue.
+func (handler *Milter) replay(session *gomilter.ClientSession, state *smtp.State, msg *message) (*gomilter.Action, error) {
+
+	// Connect
+	family := gomilter.FamilyUnknown
+	addr := ""
+	if state.Ip != nil {
+		family = gomilter.FamilyInet6
+		if state.Ip.To4() != nil {
+			family = gomilter.FamilyInet
+		}
+		addr = state.Ip.String()
+	}
+	err := session.Macros(gomilter.CodeConn,
+		"j", handler.config.Hostname,
+		"{daemon_name}", "mistralmail",
+		"_", fmt.Sprintf("[%s]", addr),
+	)
+	if err != nil {
+		return nil, err
+	}
+	act, err := session.Conn(fmt.Sprintf("[%s]", addr), family, 0, addr)
+	if err != nil || act.Code != gomilter.ActContinue {
+		return act, err
+	}
+
+	// HELO
+	act, err = session.Helo(state.Hostname)
+	if err != nil || act.Code != gomilter.ActContinue {
+		return act, err
+	}
+
+	// MAIL FROM, with the authenticated user so milters like OpenDKIM know which mail to sign.
+	// {auth_type} is left out since the SMTP state doesn't record the mechanism the user authenticated with.
+	macros := []string{"i", state.SessionId.String()}
+	if state.Authenticated && state.User != nil {
+		macros = append(macros, "{auth_authen}", state.User.Username())
+	}
+	err = session.Macros(gomilter.CodeMail, macros...)
+	if err != nil {
+		return nil, err
+	}
+	act, err = session.Mail(state.From.GetAddress(), nil)
+	if err != nil || act.Code != gomilter.ActContinue {
+		return act, err
+	}
+
+	// RCPT TO
+	for _, recipient := range state.To {
+		act, err = session.Rcpt(recipient.GetAddress(), nil)
+		if err != nil || act.Code != gomilter.ActContinue {
+			return act, err
+		}
+	}
+
+	// Header
+	for _, field := range msg.Header {
+		act, err = session.HeaderField(field.Key, field.Value)
+		if err != nil || act.Code != gomilter.ActContinue {
+			return act, err
+		}
+	}
+	return session.HeaderEnd()
+}
+
+// applyModifications applies the modifications of a milter to the state and message.
+// It returns the quarantine reason, if any.
+func applyModifications(state *smtp.State, msg *message, modifications []gomilter.ModifyAction) string {
+
+	quarantine := ""
+	var body []byte
+
+	for _, modification := range modifications {
+		switch modification.Code {
+		case gomilter.ActAddHeader:
+			msg.AddHeader(modification.HeaderName, modification.HeaderValue)
+		case gomilter.ActInsertHeader:
+			msg.InsertHeader(int(modification.HeaderIndex), modification.HeaderName, modification.HeaderValue)
+		case gomilter.ActChangeHeader:
+			msg.ChangeHeader(int(modification.HeaderIndex), modification.HeaderName, modification.HeaderValue)
+		case gomilter.ActReplBody:
+			// The new body can be sent in multiple chunks
+			body = append(body, modification.Body...)
+		case gomilter.ActAddRcpt:
+			state.To = append(state.To, &smtp.MailAddress{Address: strings.Trim(modification.Rcpt, "<>")})
+		case gomilter.ActDelRcpt:
+			address := strings.Trim(modification.Rcpt, "<>")
+			remaining := []*smtp.MailAddress{}
+			for _, recipient := range state.To {
+				if !strings.EqualFold(recipient.GetAddress(), address) {
+					remaining = append(remaining, recipient)
+				}
+			}
+			state.To = remaining
+		case gomilter.ActQuarantine:
+			quarantine = modification.Reason
+			if quarantine == "" {
+				quarantine = "quarantined by milter"
+			}
+		}
+	}
+
+	if body != nil {
+		msg.Body = toCRLF(body)
+	}
+
+	return quarantine
+}
+
+// unavailable returns the verdict for a milter that couldn't be reached or failed.
+func (handler *Milter) unavailable(err error) error {
+	switch handler.defaultAction {
+	case DefaultActionAccept:
+		return nil
+	case DefaultActionReject:
+		return ErrRejected.Wrap(err)
+	default:
+		return ErrTempFail.Wrap(err)
+	}
+}
+
+// replyVerdict creates the verdict for a custom reply of a milter.
+func replyVerdict(code int, text string) *handlers.Verdict {
+	enhancedCode := ""
+	if match := enhancedCodeRegexp.FindStringSubmatch(text); match != nil {
+		enhancedCode = match[1]
+		text = strings.TrimPrefix(text, match[0])
+	}
+
+	if code >= 400 && code < 500 {
+		return handlers.TempFail(code, enhancedCode, text)
+	}
+	return handlers.Reject(code, enhancedCode, text)
+}
+
+// replyResult returns the metrics result for a custom reply code.
+func replyResult(code int) string {
+	if code >= 400 && code < 500 {
+		return "tempfail"
+	}
+	return "reject"
+}
+
+// parseAddress parses a Postfix style milter address into a network and address.
+func parseAddress(address string) (string, string, error) {
+	network, addr, ok := strings.Cut(address, ":")
+	if !ok || addr == "" {
+		return "", "", fmt.Errorf("invalid milter address %q", address)
+	}
+
+	switch network {
+	case "inet", "tcp":
+		return "tcp", addr, nil
+	case "inet6", "tcp6":
+		return "tcp6", addr, nil
+	case "unix", "local":
+		return "unix", addr, nil
+	}
+
+	return "", "", fmt.Errorf("invalid milter address %q: unknown network %q", address, network)
+}
@@ -0,0 +1,249 @@
+package milter
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+
+	gomilter "github.com/emersion/go-milter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testMilter records what it receives and calls the given callbacks.
+type testMilter struct {
+	gomilter.NoOpMilter
+	from    *string
+	macros  *map[string]string
+	headers *textproto.MIMEHeader
+	rcpt    func(rcpt string) gomilter.Response
+	body    func(m *gomilter.Modifier) gomilter.Response
+}
+
+func (t *testMilter) MailFrom(from string, m *gomilter.Modifier) (gomilter.Response, error) {
+	if t.from != nil {
+		*t.from = from
+	}
+	if t.macros != nil {
+		*t.macros = map[string]string{}
+		for name, value := range m.Macros {
+			(*t.macros)[name] = value
+		}
+	}
+	return gomilter.RespContinue, nil
+}
+
+func (t *testMilter) RcptTo(rcpt string, m *gomilter.Modifier) (gomilter.Response, error) {
+	if t.rcpt != nil {
+		return t.rcpt(rcpt), nil
+	}
+	return gomilter.RespContinue, nil
+}
+
+func (t *testMilter) Headers(h textproto.MIMEHeader, m *gomilter.Modifier) (gomilter.Response, error) {
+	if t.headers != nil {
+		*t.headers = h
+	}
+	return gomilter.RespContinue, nil
+}
+
+func (t *testMilter) Body(m *gomilter.Modifier) (gomilter.Response, error) {
+	if t.body != nil {
+		return t.body(m), nil
+	}
+	return gomilter.RespAccept, nil
+}
+
+// testUser is an authenticated SMTP user.
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+// startMilter starts a milter server and returns its address.
+func startMilter(t *testing.T, milter *testMilter) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+
+	s := &gomilter.Server{
+		NewMilter: func() gomilter.Milter { return milter },
+		Actions:   gomilter.OptAddHeader | gomilter.OptChangeHeader | gomilter.OptChangeBody | gomilter.OptQuarantine,
+	}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+
+	return "inet:" + listener.Addr().String()
+}
+
+func TestMilterHandler(t *testing.T) {
+
+	Convey("Testing Milter handler", t, func() {
+
+		config := &server.Config{Hostname: "mx.example.com"}
+
+		state := &smtp.State{
+			From:     &smtp.MailAddress{Address: "sender@example.net"},
+			To:       []*smtp.MailAddress{{Address: "to@example.com"}},
+			Data:     []byte("Subject: Hello\r\nFrom: sender@example.net\r\n\r\nHello world!\r\n"),
+			Ip:       net.ParseIP("192.168.0.10"),
+			Hostname: "client.example.net",
+		}
+
+		Convey("Multiple milters are called in order and their modifications are applied", func() {
+			from := ""
+			first := startMilter(t, &testMilter{
+				from: &from,
+				body: func(m *gomilter.Modifier) gomilter.Response {
+					_ = m.AddHeader("X-First", "yes")
+					_ = m.ChangeHeader(1, "Subject", "Changed")
+					return gomilter.RespAccept
+				},
+			})
+
+			headers := textproto.MIMEHeader{}
+			second := startMilter(t, &testMilter{
+				headers: &headers,
+				body: func(m *gomilter.Modifier) gomilter.Response {
+					_ = m.ReplaceBody([]byte("Replaced body\r\n"))
+					return gomilter.RespAccept
+				},
+			})
+
+			h, err := New(config, []string{first, second}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+
+			err = h.Handle(state)
+			So(err, ShouldBeNil)
+
+			So(from, ShouldEqual, "sender@example.net")
+			So(headers.Get("X-First"), ShouldEqual, "yes")
+			So(headers.Get("Subject"), ShouldEqual, "Changed")
+			So(string(state.Data), ShouldEqual, "Subject: Changed\r\nFrom: sender@example.net\r\nX-First: yes\r\n\r\nReplaced body\r\n")
+		})
+
+		Convey("The authenticated user is sent without a made up mechanism", func() {
+			macros := map[string]string{}
+			address := startMilter(t, &testMilter{macros: &macros})
+
+			h, err := New(config, []string{address}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+
+			state.Authenticated = true
+			state.User = testUser("sender@example.net")
+			err = h.Handle(state)
+			So(err, ShouldBeNil)
+
+			So(macros["{auth_authen}"], ShouldEqual, "sender@example.net")
+			_, ok := macros["{auth_type}"]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Rejects are returned as verdicts", func() {
+			address := startMilter(t, &testMilter{
+				rcpt: func(rcpt string) gomilter.Response { return gomilter.RespReject },
+			})
+
+			h, err := New(config, []string{address}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+
+			err = h.Handle(state)
+			So(err, ShouldEqual, ErrRejected)
+		})
+
+		Convey("Custom replies keep their code and enhanced status code", func() {
+			address := startMilter(t, &testMilter{
+				body: func(m *gomilter.Modifier) gomilter.Response {
+					return gomilter.NewResponseStr('y', "550 5.7.1 Message looks like spam")
+				},
+			})
+
+			h, err := New(config, []string{address}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+
+			err = h.Handle(state)
+			So(err, ShouldResemble, handlers.Reject(550, "5.7.1", "Message looks like spam"))
+		})
+
+		Convey("Discard and quarantine are returned as verdicts", func() {
+			address := startMilter(t, &testMilter{
+				body: func(m *gomilter.Modifier) gomilter.Response {
+					return gomilter.RespDiscard
+				},
+			})
+			h, err := New(config, []string{address}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+
+			err = h.Handle(state)
+			verdict, ok := err.(*handlers.Verdict)
+			So(ok, ShouldBeTrue)
+			So(verdict.Action, ShouldEqual, handlers.ActionDiscard)
+
+			address = startMilter(t, &testMilter{
+				body: func(m *gomilter.Modifier) gomilter.Response {
+					_ = m.Quarantine("virus found")
+					return gomilter.RespAccept
+				},
+			})
+			h, err = New(config, []string{address}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+
+			err = h.Handle(state)
+			So(err, ShouldResemble, handlers.Quarantine("virus found"))
+		})
+
+		Convey("Unavailable milters use the default action", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			address := "inet:" + listener.Addr().String()
+			listener.Close()
+
+			h, err := New(config, []string{address}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldBeNil)
+			err = h.Handle(state)
+			So(strings.HasPrefix(err.Error(), ErrTempFail.Error()), ShouldBeTrue)
+
+			h, err = New(config, []string{address}, DefaultTimeout, DefaultActionAccept)
+			So(err, ShouldBeNil)
+			So(h.Handle(state), ShouldBeNil)
+		})
+
+		Convey("Invalid addresses are rejected", func() {
+			_, err := New(config, []string{"localhost:8891"}, DefaultTimeout, DefaultActionTempFail)
+			So(err, ShouldNotBeNil)
+
+			_, err = New(config, []string{"inet:localhost:8891"}, DefaultTimeout, "maybe")
+			So(err, ShouldNotBeNil)
+		})
+
+	})
+
+}
+
+func TestSplitMessage(t *testing.T) {
+
+	Convey("Testing splitting and rebuilding messages", t, func() {
+
+		data := "Subject: Hello\r\nDKIM-Signature: v=1;\r\n\tb=abc\r\nTo:to@example.com\r\n\r\nBody\r\n"
+		msg := splitMessage([]byte(data))
+
+		So(len(msg.Header), ShouldEqual, 3)
+		So(msg.Header[1].Value, ShouldEqual, "v=1;\r\n\tb=abc")
+		So(string(msg.Body), ShouldEqual, "Body\r\n")
+
+		// Unmodified messages are written back byte for byte
+		So(string(msg.Bytes()), ShouldEqual, data)
+
+		msg.ChangeHeader(1, "subject", "")
+		msg.InsertHeader(0, "X-Top", "1")
+		So(string(msg.Bytes()), ShouldEqual, "X-Top: 1\r\nDKIM-Signature: v=1;\r\n\tb=abc\r\nTo:to@example.com\r\n\r\nBody\r\n")
+
+	})
+
+}
@@ -0,0 +1,272 @@
+package pipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Define a counter vector for piped messages.
+var smtpPiped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "smtp_piped",
+		Help: "SMTP messages piped to external programs (accept, reject, tempfail, discard or error)",
+	},
+	[]string{"result"},
+)
+
+// DefaultTimeout denotes how long the program is allowed to run.
+const DefaultTimeout = 30 * time.Second
+
+// maxOutput is the maximum size of the output of the program that replaces the message.
+const maxOutput = 64 * 1024 * 1024
+
+// Exit codes of the program, based on sysexits.h.
+const (
+	// ExitAccept accepts the message.
+	ExitAccept = 0
+	// ExitDataErr rejects the message because of its content (EX_DATAERR).
+	ExitDataErr = 65
+	// ExitNoUser rejects the message because the recipient doesn't exist (EX_NOUSER).
+	ExitNoUser = 67
+	// ExitUnavailable rejects the message (EX_UNAVAILABLE).
+	ExitUnavailable = 69
+	// ExitTempFail asks the client to retry later (EX_TEMPFAIL).
+	ExitTempFail = 75
+	// ExitNoPerm rejects the message because it isn't allowed (EX_NOPERM).
+	ExitNoPerm = 77
+	// ExitDiscard accepts the message but silently drops it.
+	ExitDiscard = 99
+)
+
+// Errors returned for the exit codes of the program.
+var (
+	ErrContentRejected = handlers.Reject(554, "5.6.0", "Message content rejected")
+	ErrNoUser          = handlers.Reject(550, "5.1.1", "Requested action not taken: mailbox unavailable")
+	ErrRejected        = handlers.Reject(554, "5.7.1", "Message rejected")
+	ErrNotPermitted    = handlers.Reject(550, "5.7.1", "Message not permitted")
+	ErrTempFail        = handlers.TempFail(451, "4.3.0", "Requested action aborted: content filter unavailable")
+)
+
+// New creates a new Pipe handler that runs the given command.
+// When replaceMessage is set, the output of the program replaces the message.
+func New(c *server.Config, command string, args []string, timeout time.Duration, replaceMessage bool) (*Pipe, error) {
+
+	if command == "" {
+		return nil, fmt.Errorf("no command given")
+	}
+
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find command %q: %w", command, err)
+	}
+
+	return &Pipe{
+		config:         c,
+		command:        path,
+		args:           args,
+		timeout:        timeout,
+		replaceMessage: replaceMessage,
+	}, nil
+}
+
+// Pipe is an SMTP handler that pipes the message to an external program, like a content filter.
+//
+// The message is written to the standard input of the program and the envelope is passed in environment variables:
+// MISTRALMAIL_SENDER, MISTRALMAIL_RECIPIENTS (space separated), MISTRALMAIL_CLIENT_IP, MISTRALMAIL_HELO,
+// MISTRALMAIL_SESSION_ID, MISTRALMAIL_AUTHENTICATED_USER, MISTRALMAIL_HOSTNAME and MISTRALMAIL_SIZE.
+//
+// The exit code of the program decides what happens with the message, see the Exit* constants.
+// Other exit codes, crashes and timeouts ask the client to retry later.
+// The first line of the standard error of the program is used as reply text for rejects.
+type Pipe struct {
+	config         *server.Config
+	command        string
+	args           []string
+	timeout        time.Duration
+	replaceMessage bool
+}
+
+// Handle implements the Handler interface.
+func (handler *Pipe) Handle(state *smtp.State) error {
+
+	logger := log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"Hostname":  state.Hostname,
+		"Command":   handler.command,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), handler.timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: maxOutput}
+	stderr := &limitedBuffer{limit: 64 * 1024}
+
+	cmd := exec.CommandContext(ctx, handler.command, handler.args...)
+	cmd.Stdin = bytes.NewReader(state.Data)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), handler.environment(state)...)
+	// Don't wait for child processes that keep the output open after the program is killed
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+
+	if ctx.Err() != nil {
+		logger.Warnf("Program timed out after %s", handler.timeout)
+		smtpPiped.WithLabelValues("error").Inc()
+		return ErrTempFail.Wrap(ctx.Err())
+	}
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+			logger.Errorf("Couldn't run program: %v", err)
+			smtpPiped.WithLabelValues("error").Inc()
+			return ErrTempFail.Wrap(err)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	logger.Debugf("Program exited with code %d", exitCode)
+
+	switch exitCode {
+	case ExitAccept:
+		if stdout.overflow {
+			logger.Warnf("Output of program is larger than %d bytes", maxOutput)
+			smtpPiped.WithLabelValues("error").Inc()
+			return ErrTempFail
+		}
+		if handler.replaceMessage && stdout.Len() > 0 {
+			state.Data = stdout.Bytes()
+		}
+		smtpPiped.WithLabelValues("accept").Inc()
+		return nil
+
+	case ExitDiscard:
+		smtpPiped.WithLabelValues("discard").Inc()
+		return handlers.Discard(fmt.Sprintf("discarded by %s", handler.command))
+
+	case ExitDataErr:
+		smtpPiped.WithLabelValues("reject").Inc()
+		return withMessage(ErrContentRejected, stderr.Bytes())
+
+	case ExitNoUser:
+		smtpPiped.WithLabelValues("reject").Inc()
+		return withMessage(ErrNoUser, stderr.Bytes())
+
+	case ExitUnavailable:
+		smtpPiped.WithLabelValues("reject").Inc()
+		return withMessage(ErrRejected, stderr.Bytes())
+
+	case ExitNoPerm:
+		smtpPiped.WithLabelValues("reject").Inc()
+		return withMessage(ErrNotPermitted, stderr.Bytes())
+
+	case ExitTempFail:
+		smtpPiped.WithLabelValues("tempfail").Inc()
+		return withMessage(ErrTempFail, stderr.Bytes())
+	}
+
+	logger.Warnf("Program exited with unexpected code %d: %s", exitCode, firstLine(stderr.Bytes()))
+	smtpPiped.WithLabelValues("error").Inc()
+	return ErrTempFail
+}
+
+// environment returns the environment variables with the envelope information.
+func (handler *Pipe) environment(state *smtp.State) []string {
+
+	recipients := make([]string, len(state.To))
+	for i, to := range state.To {
+		recipients[i] = to.GetAddress()
+	}
+
+	sender := ""
+	if state.From != nil {
+		sender = state.From.GetAddress()
+	}
+
+	user := ""
+	if state.Authenticated && state.User != nil {
+		user = state.User.Username()
+	}
+
+	clientIP := ""
+	if state.Ip != nil {
+		clientIP = state.Ip.String()
+	}
+
+	return []string{
+		"MISTRALMAIL_SENDER=" + sender,
+		"MISTRALMAIL_RECIPIENTS=" + strings.Join(recipients, " "),
+		"MISTRALMAIL_CLIENT_IP=" + clientIP,
+		"MISTRALMAIL_HELO=" + state.Hostname,
+		"MISTRALMAIL_SESSION_ID=" + state.SessionId.String(),
+		"MISTRALMAIL_AUTHENTICATED_USER=" + user,
+		"MISTRALMAIL_HOSTNAME=" + handler.config.Hostname,
+		"MISTRALMAIL_SIZE=" + strconv.Itoa(len(state.Data)),
+	}
+}
+
+// withMessage uses the first line of the standard error as reply text, if there is one.
+func withMessage(verdict *handlers.Verdict, stderr []byte) *handlers.Verdict {
+	line := firstLine(stderr)
+	if line == "" {
+		return verdict
+	}
+	custom := *verdict
+	custom.Message = line
+	return &custom
+}
+
+// firstLine returns the first non-empty line of the output, with only printable characters.
+func firstLine(output []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		return strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			return r
+		}, line)
+	}
+	return ""
+}
+
+// limitedBuffer is a buffer that stops writing after the limit,
+// so a misbehaving program can't use all the memory.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+// Write implements the io.Writer interface.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		b.overflow = true
+		b.Buffer.Write(p[:b.limit-b.Len()])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,82 @@
+package pipe
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPipeHandler(t *testing.T) {
+
+	Convey("Testing Pipe handler", t, func() {
+
+		config := &server.Config{Hostname: "mx.example.com"}
+
+		state := &smtp.State{
+			From: &smtp.MailAddress{Address: "sender@example.net"},
+			To: []*smtp.MailAddress{
+				{Address: "one@example.com"},
+				{Address: "two@example.com"},
+			},
+			Data:     []byte("Subject: Hello\r\n\r\nHello world!\r\n"),
+			Ip:       net.ParseIP("192.168.0.10"),
+			Hostname: "client.example.net",
+		}
+
+		run := func(script string, replaceMessage bool) error {
+			h, err := New(config, "sh", []string{"-c", script}, time.Second, replaceMessage)
+			So(err, ShouldBeNil)
+			return h.Handle(state)
+		}
+
+		Convey("The message and envelope are passed to the program", func() {
+			err := run(`printf '%s|%s|%s|%s|' "$MISTRALMAIL_SENDER" "$MISTRALMAIL_RECIPIENTS" "$MISTRALMAIL_CLIENT_IP" "$MISTRALMAIL_HELO"; cat`, true)
+			So(err, ShouldBeNil)
+			So(string(state.Data), ShouldEqual, "sender@example.net|one@example.com two@example.com|192.168.0.10|client.example.net|Subject: Hello\r\n\r\nHello world!\r\n")
+		})
+
+		Convey("The message is only replaced when configured", func() {
+			err := run(`echo "Replaced"`, false)
+			So(err, ShouldBeNil)
+			So(string(state.Data), ShouldEqual, "Subject: Hello\r\n\r\nHello world!\r\n")
+		})
+
+		Convey("Exit codes are mapped to verdicts", func() {
+			err := run(`exit 67`, false)
+			So(err, ShouldEqual, ErrNoUser)
+
+			err = run(`echo "Virus found" >&2; exit 65`, false)
+			So(err, ShouldResemble, handlers.Reject(554, "5.6.0", "Virus found"))
+
+			err = run(`exit 75`, false)
+			So(err, ShouldEqual, ErrTempFail)
+
+			err = run(`exit 99`, false)
+			verdict, ok := err.(*handlers.Verdict)
+			So(ok, ShouldBeTrue)
+			So(verdict.Action, ShouldEqual, handlers.ActionDiscard)
+
+			err = run(`exit 3`, false)
+			So(err, ShouldEqual, ErrTempFail)
+		})
+
+		Convey("Programs that run too long are stopped", func() {
+			err := run(`exec sleep 5`, false)
+			So(err, ShouldNotBeNil)
+			So(err.(*handlers.Verdict).Temporary(), ShouldBeTrue)
+		})
+
+		Convey("Unknown commands are rejected", func() {
+			_, err := New(config, "does-not-exist-mistralmail", nil, time.Second, false)
+			So(err, ShouldNotBeNil)
+		})
+
+	})
+
+}
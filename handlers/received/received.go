@@ -1,51 +1,88 @@
 package received
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/mistralmail/mistralmail/smtpserver"
 	"github.com/mistralmail/smtp/server"
 	"github.com/mistralmail/smtp/smtp"
 	log "github.com/sirupsen/logrus"
 )
 
-func New(c *server.Config) *Received {
+// lookupTimeout denotes how long the reverse DNS lookup of the client may take.
+const lookupTimeout = 5 * time.Second
+
+// tlsVersions contains the names of the TLS versions, like Postfix writes them.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// New creates a new Received handler.
+// When includeAuthenticatedUser is set, the username of authenticated clients is added to the header.
+// When stripInternal is set, the Received headers that are already in the message are removed first,
+// so the internal network of a submitting client isn't disclosed.
+func New(c *server.Config, includeAuthenticatedUser bool, stripInternal bool) *Received {
 	return &Received{
-		config: c,
+		config:                   c,
+		includeAuthenticatedUser: includeAuthenticatedUser,
+		stripInternal:            stripInternal,
+		lookupAddr:               net.DefaultResolver.LookupAddr,
+		tlsConnectionState:       smtpserver.TLSConnectionState,
 	}
 }
 
+// Received is an SMTP handler that adds a Received trace header (RFC 5321 4.4) to the message.
 type Received struct {
-	config *server.Config
+	config                   *server.Config
+	includeAuthenticatedUser bool
+	stripInternal            bool
+
+	lookupAddr         func(ctx context.Context, addr string) ([]string, error)
+	tlsConnectionState func(state *smtp.State) *tls.ConnectionState
 }
 
+// Handle implements the Handler interface.
 func (handler *Received) Handle(state *smtp.State) error {
 
 	/*
-	   RFC 2076 3.2 Trace information
-
-	       Trace of MTAs which a message has passed.
-
+	   RFC 5321 4.4 Trace Information
 
-	   RFC 5322 3.6.7.
+	       Stamp          = From-domain By-domain Opt-info [CFWS] ";" FWS date-time
+	       From-domain    = "FROM" FWS Extended-Domain
+	       By-domain      = CFWS "BY" FWS Extended-Domain
+	       Opt-info       = [Via] [With] [ID] [For] [Additional-Registered-Clauses]
 
-	       received        =   "Received:" *received-token ";" date-time CRLF
 
-	       received-token  =   word / angle-addr / addr-spec / domain
+	   RFC 3848 and RFC 8314 add the ESMTPS, ESMTPA and ESMTPSA protocol types and the "tls" clause.
 
 
 	   Example:
 
-	       Received: from mail.example.com (192.168.0.10) by some.mail.server.example.com (192.168.0.11) with Microsoft SMTP Server id 14.3.319.2; Wed, 5 Oct 2016 14:57:46 +0200
+	       Received: from mail.example.com (mail.example.com [192.168.0.10])
+	       	(using TLSv1.3 with cipher TLS_AES_128_GCM_SHA256)
+	       	by mx.example.com ([192.168.0.11]) with ESMTPS id 1475672266.1
+	       	for <to@example.com> tls TLS_AES_128_GCM_SHA256; Wed, 5 Oct 2016 14:57:46 +0200
 	*/
-	headerKey := "Received"
 
-	date := time.Now().Format(time.RFC1123Z) // date-time in RFC 5322 is like RFC 1123Z
-	headerValue := fmt.Sprintf("from %s (%s) by %s (%s) with MistralMail; %s", state.Hostname, state.Ip, handler.config.Hostname, handler.config.Ip, date)
+	if handler.stripInternal {
+		state.Data = stripReceived(state.Data)
+	}
 
-	state.AddHeader(headerKey, headerValue)
+	headerKey := "Received"
+	headerValue := handler.stamp(state)
 
-	// TODO: 'by IP' is not necessarily set in config
+	state.AddHeader(headerKey, headerValue)
 
 	log.WithFields(log.Fields{
 		"Ip":        state.Ip.String(),
@@ -55,3 +92,138 @@ func (handler *Received) Handle(state *smtp.State) error {
 
 	return nil
 }
+
+// stamp creates the value of the Received header, folded over multiple lines.
+func (handler *Received) stamp(state *smtp.State) string {
+
+	lines := []string{}
+
+	// from helo (reverse-dns [ip])
+	ip := ""
+	if state.Ip != nil {
+		ip = state.Ip.String()
+	}
+	reverseDNS := handler.reverseDNS(ip)
+	helo := state.Hostname
+	if helo == "" {
+		helo = "unknown"
+	}
+	from := fmt.Sprintf("from %s (%s [%s])", helo, reverseDNS, ip)
+	if reverseDNS != "unknown" && !heloMatches(state.Hostname, reverseDNS, state.Ip) {
+		from += " (HELO does not match reverse DNS)"
+	}
+	lines = append(lines, from)
+
+	// TLS details
+	protocol := "ESMTP"
+	cipherSuite := ""
+	if state.Secure {
+		protocol = "ESMTPS"
+		if cs := handler.tlsConnectionState(state); cs != nil {
+			version, ok := tlsVersions[cs.Version]
+			if !ok {
+				version = fmt.Sprintf("TLS 0x%04x", cs.Version)
+			}
+			cipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+			lines = append(lines, fmt.Sprintf("(using %s with cipher %s)", version, cipherSuite))
+		}
+	}
+
+	// Authenticated user (RFC 3848)
+	if state.Authenticated {
+		protocol += "A"
+		if handler.includeAuthenticatedUser && state.User != nil {
+			lines = append(lines, fmt.Sprintf("(Authenticated sender: %s)", state.User.Username()))
+		}
+	}
+
+	// by hostname ([ip]) with protocol id session-id
+	by := "by " + handler.config.Hostname
+	if handler.config.Ip != "" {
+		by += fmt.Sprintf(" ([%s])", handler.config.Ip)
+	}
+	lines = append(lines, fmt.Sprintf("%s with %s id %s", by, protocol, state.SessionId.String()))
+
+	// for <recipient>, only for a single recipient so the other recipients aren't disclosed
+	last := ""
+	if len(state.To) == 1 {
+		last = fmt.Sprintf("for <%s>", state.To[0].GetAddress())
+	}
+	if cipherSuite != "" {
+		last = strings.TrimSpace(last + " tls " + cipherSuite)
+	}
+
+	date := time.Now().Format(time.RFC1123Z) // date-time in RFC 5322 is like RFC 1123Z
+	if last != "" {
+		lines = append(lines, last+"; "+date)
+	} else {
+		lines[len(lines)-1] += "; " + date
+	}
+
+	return strings.Join(lines, "\r\n\t")
+}
+
+// reverseDNS returns the reverse DNS name of the ip, or "unknown" when there is none.
+func (handler *Received) reverseDNS(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	names, err := handler.lookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// heloMatches checks whether the HELO name of the client matches its reverse DNS name or is its address literal.
+func heloMatches(helo string, reverseDNS string, ip net.IP) bool {
+	helo = strings.TrimSuffix(strings.ToLower(helo), ".")
+
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := net.ParseIP(strings.TrimPrefix(strings.Trim(helo, "[]"), "ipv6:"))
+		return literal != nil && literal.Equal(ip)
+	}
+
+	return helo != "" && helo == strings.ToLower(reverseDNS)
+}
+
+// stripReceived removes all Received header fields, including their continuation lines, from the message.
+func stripReceived(data []byte) []byte {
+	var out bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(data))
+	skipping := false
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			break
+		}
+
+		// The header ends at the first empty line, the body is copied as is
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out.Write(line)
+			rest, _ := io.ReadAll(reader)
+			out.Write(rest)
+			break
+		}
+
+		continuation := line[0] == ' ' || line[0] == '\t'
+		if !continuation {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = strings.EqualFold(strings.TrimSpace(string(name)), "Received")
+		}
+		if !skipping {
+			out.Write(line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return out.Bytes()
+}
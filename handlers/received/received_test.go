@@ -1,7 +1,9 @@
 package received
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"strings"
 	"testing"
@@ -12,6 +14,10 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+type testUser string
+
+func (u testUser) Username() string { return string(u) }
+
 func TestReceivedHandler(t *testing.T) {
 
 	Convey("Testing headerReceived() handler", t, func() {
@@ -22,27 +28,93 @@ func TestReceivedHandler(t *testing.T) {
 		}
 
 		state := smtp.State{
-			From:     &smtp.MailAddress{Address: "from@test.com"},
-			To:       []*smtp.MailAddress{&smtp.MailAddress{Address: "to@test.com"}},
-			Data:     []byte("Hello world!"),
-			Ip:       net.ParseIP("192.168.0.10"),
-			Hostname: "mail.example.com",
+			From:      &smtp.MailAddress{Address: "from@test.com"},
+			To:        []*smtp.MailAddress{&smtp.MailAddress{Address: "to@test.com"}},
+			Data:      []byte("Hello world!"),
+			Ip:        net.ParseIP("192.168.0.10"),
+			Hostname:  "mail.example.com",
+			SessionId: smtp.Id{Timestamp: 1475672266, Counter: 1},
+		}
+
+		h := New(&c, true, false)
+		h.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+			if addr == "192.168.0.10" {
+				return []string{"mail.example.com."}, nil
+			}
+			return nil, errors.New("not found")
+		}
+		h.tlsConnectionState = func(state *smtp.State) *tls.ConnectionState {
+			return &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+		}
+
+		// received returns the Received header without the date.
+		received := func() string {
+			header, _, found := strings.Cut(string(state.Data), "; ")
+			So(found, ShouldBeTrue)
+			return header
 		}
 
-		h := New(&c)
-		err := h.Handle(&state)
-		So(err, ShouldEqual, nil)
+		Convey("A plain session", func() {
+			err := h.Handle(&state)
+			So(err, ShouldEqual, nil)
+
+			So(strings.HasSuffix(string(state.Data), "\r\nHello world!"), ShouldBeTrue)
+			So(received(), ShouldEqual, "Received: from mail.example.com (mail.example.com [192.168.0.10])\r\n"+
+				"\tby some.mail.server.example.com ([192.168.0.11]) with ESMTP id "+state.SessionId.String()+"\r\n"+
+				"\tfor <to@test.com>")
+		})
+
+		Convey("An encrypted and authenticated session", func() {
+			state.Secure = true
+			state.Authenticated = true
+			state.User = testUser("from@test.com")
+
+			err := h.Handle(&state)
+			So(err, ShouldEqual, nil)
+			So(received(), ShouldEqual, "Received: from mail.example.com (mail.example.com [192.168.0.10])\r\n"+
+				"\t(using TLSv1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n"+
+				"\t(Authenticated sender: from@test.com)\r\n"+
+				"\tby some.mail.server.example.com ([192.168.0.11]) with ESMTPSA id "+state.SessionId.String()+"\r\n"+
+				"\tfor <to@test.com> tls TLS_AES_128_GCM_SHA256")
+
+			Convey("The authenticated user can be left out", func() {
+				h.includeAuthenticatedUser = false
+				err := h.Handle(&state)
+				So(err, ShouldEqual, nil)
+				So(received(), ShouldNotContainSubstring, "from@test.com")
+			})
+		})
+
+		Convey("Multiple recipients and a HELO mismatch", func() {
+			state.To = append(state.To, &smtp.MailAddress{Address: "other@test.com"})
+			state.Hostname = "forged.example.net"
+
+			err := h.Handle(&state)
+			So(err, ShouldEqual, nil)
+			So(received(), ShouldEqual, "Received: from forged.example.net (mail.example.com [192.168.0.10]) (HELO does not match reverse DNS)\r\n"+
+				"\tby some.mail.server.example.com ([192.168.0.11]) with ESMTP id "+state.SessionId.String())
+		})
 
-		buffer := bytes.NewBuffer(state.Data)
+		Convey("Unknown reverse DNS", func() {
+			state.Ip = net.ParseIP("192.168.0.12")
+			state.Hostname = "[192.168.0.12]"
 
-		header, err := buffer.ReadString('\n')
+			err := h.Handle(&state)
+			So(err, ShouldEqual, nil)
+			So(received(), ShouldStartWith, "Received: from [192.168.0.12] (unknown [192.168.0.12])\r\n")
+		})
 
-		// strip date from header for testing
-		So(len(strings.Split(header, ";")), ShouldEqual, 2)
-		header = strings.Split(header, ";")[0]
+		Convey("Internal Received headers are stripped", func() {
+			state.Data = []byte("Received: from laptop.internal (10.0.0.2)\r\n\tby gateway.internal; Wed, 5 Oct 2016 14:57:46 +0200\r\n" +
+				"Subject: Hello\r\nreceived: by localhost\r\n\r\nReceived: in the body\r\n")
+			h.stripInternal = true
 
-		So(err, ShouldEqual, nil)
-		So(header, ShouldEqual, "Received: from mail.example.com (192.168.0.10) by some.mail.server.example.com (192.168.0.11) with MistralMail")
+			err := h.Handle(&state)
+			So(err, ShouldEqual, nil)
+			So(strings.HasSuffix(string(state.Data), "\r\nSubject: Hello\r\n\r\nReceived: in the body\r\n"), ShouldBeTrue)
+			So(strings.Count(string(state.Data), "internal"), ShouldEqual, 0)
+			So(strings.Count(strings.ToLower(string(state.Data)), "received:"), ShouldEqual, 2)
+		})
 
 	})
 
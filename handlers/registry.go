@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend"
+	"github.com/mistralmail/mistralmail/backend/services/srs"
+	"github.com/mistralmail/smtp/server"
+)
+
+// OptionType denotes the type of a handler option.
+type OptionType string
+
+const (
+	// OptionString is a string option.
+	OptionString OptionType = "string"
+	// OptionInt is an integer option.
+	OptionInt OptionType = "int"
+	// OptionBool is a boolean option.
+	OptionBool OptionType = "bool"
+	// OptionDuration is a duration option written like "30s" or "5m".
+	OptionDuration OptionType = "duration"
+	// OptionStrings is a list of strings.
+	OptionStrings OptionType = "strings"
+)
+
+// OptionSpec describes a single option of a handler.
+type OptionSpec struct {
+	Name        string
+	Type        OptionType
+	Required    bool
+	Default     interface{}
+	Description string
+}
+
+// Relay is the outgoing relay that is shared by all listeners.
+type Relay interface {
+	Handler
+	// SendMail sends the message with the given envelope sender and recipients.
+	SendMail(from string, recipients []string, message []byte) error
+}
+
+// Environment contains the dependencies that are available to handler factories.
+type Environment struct {
+	// Listener is the name of the listener the pipeline is built for (e.g. "mta" or "msa").
+	Listener string
+	// Config is the SMTP config of the listener.
+	Config *server.Config
+	// Backend is the MistralMail backend.
+	Backend *backend.Backend
+	// Relay is the outgoing relay.
+	Relay Relay
+	// SRS rewrites the envelope sender of forwarded mail.
+	SRS *srs.SRS
+}
+
+// Factory creates a new handler with the given environment and (validated) options.
+type Factory func(env *Environment, options Options) (Handler, error)
+
+// Registration describes a handler that can be used in a pipeline.
+type Registration struct {
+	// Name is the unique name that is used in the pipeline config.
+	Name string
+	// Options is the schema of the options the handler accepts.
+	Options []OptionSpec
+	// New creates the handler.
+	New Factory
+}
+
+var (
+	registry     = map[string]*Registration{}
+	registryLock = sync.RWMutex{}
+)
+
+// Register registers a handler so it can be used in a pipeline.
+// It is meant to be called from an init function and panics when the name is already registered.
+func Register(registration Registration) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if registration.Name == "" || registration.New == nil {
+		panic("handlers: registration needs a name and a factory")
+	}
+	if _, ok := registry[registration.Name]; ok {
+		panic(fmt.Sprintf("handlers: handler %q registered twice", registration.Name))
+	}
+
+	registry[registration.Name] = &registration
+}
+
+// Registered returns the names of all registered handlers.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup finds the registration with the given name.
+func lookup(name string) (*Registration, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	registration, ok := registry[name]
+	return registration, ok
+}
+
+// PipelineEntry is a single handler in a pipeline config.
+type PipelineEntry struct {
+	Handler string                 `json:"handler"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// Pipeline is the ordered list of handlers of a listener.
+type Pipeline []PipelineEntry
+
+// Validate checks whether all handlers are registered and their options match the schema.
+func (p Pipeline) Validate() error {
+	for i, entry := range p {
+		registration, ok := lookup(entry.Handler)
+		if !ok {
+			return fmt.Errorf("handler %d: unknown handler %q", i+1, entry.Handler)
+		}
+		_, err := newOptions(registration.Options, entry.Options)
+		if err != nil {
+			return fmt.Errorf("handler %d (%s): %w", i+1, entry.Handler, err)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether the pipeline contains the given handler.
+func (p Pipeline) Contains(handler string) bool {
+	for _, entry := range p {
+		if entry.Handler == handler {
+			return true
+		}
+	}
+	return false
+}
+
+// Build validates the pipeline and creates all of its handlers in order.
+func (p Pipeline) Build(env *Environment) (*HandlerMachanism, error) {
+
+	mechanism := &HandlerMachanism{}
+
+	for i, entry := range p {
+		registration, ok := lookup(entry.Handler)
+		if !ok {
+			return nil, fmt.Errorf("handler %d: unknown handler %q", i+1, entry.Handler)
+		}
+
+		options, err := newOptions(registration.Options, entry.Options)
+		if err != nil {
+			return nil, fmt.Errorf("handler %d (%s): %w", i+1, entry.Handler, err)
+		}
+
+		handler, err := registration.New(env, options)
+		if err != nil {
+			return nil, fmt.Errorf("handler %d (%s): couldn't create handler: %w", i+1, entry.Handler, err)
+		}
+
+		mechanism.AddHandler(handler)
+	}
+
+	return mechanism, nil
+}
+
+// Options contains the validated options of a handler, with the defaults filled in.
+type Options map[string]interface{}
+
+// newOptions validates the raw options against the schema and converts them to their types.
+func newOptions(schema []OptionSpec, raw map[string]interface{}) (Options, error) {
+
+	specs := map[string]OptionSpec{}
+	for _, spec := range schema {
+		specs[spec.Name] = spec
+	}
+
+	for name := range raw {
+		if _, ok := specs[name]; !ok {
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	options := Options{}
+	for _, spec := range schema {
+		value, ok := raw[spec.Name]
+		if !ok || value == nil {
+			if spec.Required {
+				return nil, fmt.Errorf("option %q is required", spec.Name)
+			}
+			if spec.Default != nil {
+				options[spec.Name] = spec.Default
+			}
+			continue
+		}
+
+		converted, err := convertOption(spec.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %w", spec.Name, err)
+		}
+		options[spec.Name] = converted
+	}
+
+	return options, nil
+}
+
+// convertOption converts a value (as decoded from JSON) to the given option type.
+func convertOption(optionType OptionType, value interface{}) (interface{}, error) {
+	switch optionType {
+	case OptionString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case OptionInt:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		}
+	case OptionBool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case OptionDuration:
+		switch v := value.(type) {
+		case time.Duration:
+			return v, nil
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration: %w", err)
+			}
+			return d, nil
+		}
+	case OptionStrings:
+		switch v := value.(type) {
+		case []string:
+			return v, nil
+		case []interface{}:
+			strings := make([]string, len(v))
+			for i, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected a list of strings")
+				}
+				strings[i] = s
+			}
+			return strings, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown option type %q", optionType)
+	}
+
+	return nil, fmt.Errorf("expected a value of type %s", optionType)
+}
+
+// String returns the string option with the given name.
+func (o Options) String(name string) string {
+	s, _ := o[name].(string)
+	return s
+}
+
+// Int returns the integer option with the given name.
+func (o Options) Int(name string) int {
+	i, _ := o[name].(int)
+	return i
+}
+
+// Bool returns the boolean option with the given name.
+func (o Options) Bool(name string) bool {
+	b, _ := o[name].(bool)
+	return b
+}
+
+// Duration returns the duration option with the given name.
+func (o Options) Duration(name string) time.Duration {
+	d, _ := o[name].(time.Duration)
+	return d
+}
+
+// Strings returns the string list option with the given name.
+func (o Options) Strings(name string) []string {
+	s, _ := o[name].([]string)
+	return s
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mistralmail/smtp/server"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type optionsHandler struct {
+	TestHandler
+	options Options
+}
+
+func TestRegistry(t *testing.T) {
+
+	Convey("Testing the handler registry", t, func() {
+
+		Register(Registration{
+			Name: "registry-test",
+			Options: []OptionSpec{
+				{Name: "name", Type: OptionString, Required: true},
+				{Name: "limit", Type: OptionInt, Default: 10},
+				{Name: "enabled", Type: OptionBool},
+				{Name: "timeout", Type: OptionDuration, Default: time.Second},
+				{Name: "domains", Type: OptionStrings},
+			},
+			New: func(env *Environment, options Options) (Handler, error) {
+				return &optionsHandler{options: options}, nil
+			},
+		})
+		defer func() {
+			registryLock.Lock()
+			delete(registry, "registry-test")
+			registryLock.Unlock()
+		}()
+
+		So(Registered(), ShouldContain, "registry-test")
+
+		Convey("Registering the same name twice panics", func() {
+			So(func() {
+				Register(Registration{Name: "registry-test", New: func(env *Environment, options Options) (Handler, error) { return nil, nil }})
+			}, ShouldPanic)
+		})
+
+		Convey("Valid options are converted and defaults are filled in", func() {
+			pipeline := Pipeline{
+				{Handler: "registry-test", Options: map[string]interface{}{
+					"name":    "test",
+					"enabled": true,
+					"domains": []interface{}{"example.com", "example.net"},
+				}},
+			}
+			So(pipeline.Validate(), ShouldBeNil)
+
+			mechanism, err := pipeline.Build(&Environment{Config: &server.Config{}})
+			So(err, ShouldBeNil)
+			So(len(mechanism.Handlers), ShouldEqual, 1)
+
+			options := mechanism.Handlers[0].(*optionsHandler).options
+			So(options.String("name"), ShouldEqual, "test")
+			So(options.Int("limit"), ShouldEqual, 10)
+			So(options.Bool("enabled"), ShouldBeTrue)
+			So(options.Duration("timeout"), ShouldEqual, time.Second)
+			So(options.Strings("domains"), ShouldResemble, []string{"example.com", "example.net"})
+		})
+
+		Convey("Invalid pipelines are rejected", func() {
+			So(Pipeline{{Handler: "unknown"}}.Validate(), ShouldNotBeNil)
+			So(Pipeline{{Handler: "registry-test"}}.Validate(), ShouldNotBeNil)
+			So(Pipeline{{Handler: "registry-test", Options: map[string]interface{}{"name": "test", "other": 1}}}.Validate(), ShouldNotBeNil)
+			So(Pipeline{{Handler: "registry-test", Options: map[string]interface{}{"name": "test", "limit": 1.5}}}.Validate(), ShouldNotBeNil)
+			So(Pipeline{{Handler: "registry-test", Options: map[string]interface{}{"name": "test", "timeout": "soon"}}}.Validate(), ShouldNotBeNil)
+		})
+
+	})
+
+}
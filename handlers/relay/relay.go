@@ -2,8 +2,12 @@ package relay
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/textproto"
 
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
+	"github.com/mistralmail/mistralmail/handlers"
 	"github.com/mistralmail/smtp/smtp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -21,14 +25,22 @@ var smtpDelivered = promauto.NewCounterVec(
 	[]string{"status"}, // The label "status" can have values "success" or "error".
 )
 
+var (
+	// ErrRelayRejected is returned when the relay permanently rejected the message.
+	ErrRelayRejected = handlers.Reject(554, "5.0.0", "Transaction failed: message rejected by relay")
+	// ErrRelayUnavailable is returned when the message couldn't be delivered to the relay (yet).
+	ErrRelayUnavailable = handlers.TempFail(451, "4.4.0", "Requested action aborted: couldn't deliver message to relay")
+)
+
 // New creates a new Relay handler.
-func New(relayHostname string, relayPort int, relayUsername string, relayPassword string, relayInsecureSkipVerify bool) *Relay {
+func New(relayHostname string, relayPort int, relayUsername string, relayPassword string, relayInsecureSkipVerify bool, webhooks *webhooks.Webhooks) *Relay {
 	return &Relay{
 		relayHostname:           relayHostname,
 		relayPort:               relayPort,
 		relayUsername:           relayUsername,
 		relayPassword:           relayPassword,
 		relayInsecureSkipVerify: relayInsecureSkipVerify,
+		webhooks:                webhooks,
 	}
 }
 
@@ -39,6 +51,7 @@ type Relay struct {
 	relayUsername           string
 	relayPassword           string
 	relayInsecureSkipVerify bool
+	webhooks                *webhooks.Webhooks
 }
 
 // Handle handles the state.
@@ -49,7 +62,7 @@ func (handler *Relay) Handle(state *smtp.State) error {
 	for i, to := range state.To {
 		if to == nil {
 			// maybe this shouldn't even be a pointer at all?
-			return fmt.Errorf("state.To cannot be nil")
+			return handlers.ErrLocalError.Wrap(fmt.Errorf("state.To cannot be nil"))
 		}
 		recipients[i] = to.Address
 	}
@@ -65,7 +78,15 @@ func (handler *Relay) Handle(state *smtp.State) error {
 		// Increment the "error" counter.
 		smtpDelivered.WithLabelValues("error").Inc()
 
-		return err
+		// Permanent errors from the relay are bounces, everything else can be retried.
+		var relayErr *textproto.Error
+		if errors.As(err, &relayErr) && relayErr.Code >= 500 {
+			handler.webhooks.Emit(webhooks.EventMailBounced, eventData(state, recipients, err.Error()))
+			return ErrRelayRejected.Wrap(err)
+		}
+		handler.webhooks.Emit(webhooks.EventMailDeferred, eventData(state, recipients, err.Error()))
+
+		return ErrRelayUnavailable.Wrap(err)
 	}
 
 	log.WithFields(log.Fields{
@@ -77,9 +98,31 @@ func (handler *Relay) Handle(state *smtp.State) error {
 	// Increment the "success" counter.
 	smtpDelivered.WithLabelValues("success").Inc()
 
+	handler.webhooks.Emit(webhooks.EventMailDelivered, eventData(state, recipients, ""))
+
 	return nil
 }
 
+// eventData creates the webhook event data for the given state.
+func eventData(state *smtp.State, recipients []string, reason string) map[string]interface{} {
+	data := map[string]interface{}{
+		"sessionId": state.SessionId.String(),
+		"from":      state.From.GetAddress(),
+		"to":        recipients,
+		"size":      len(state.Data),
+	}
+	if state.User != nil {
+		data["username"] = state.User.Username()
+	}
+	if messageID, ok := state.GetHeader("Message-ID"); ok {
+		data["messageId"] = messageID
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	return data
+}
+
 // SendMail sends an SMTP message with a given from and to mail address.
 // code partially copy pasted from the net/smtp package to allow setting a custom TLS config.
 // should be moved to the SMTP package
@@ -136,7 +179,7 @@ func (handler *Relay) SendMail(from string, recipients []string, message []byte)
 	}
 	err = w.Close()
 	if err != nil {
-		return fmt.Errorf("failed to close the data connection: %v", err)
+		return fmt.Errorf("failed to close the data connection: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate creates a self-signed certificate for localhost.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testRelay starts an SMTP server that accepts everything until the end of the data,
+// which is answered with the given reply. It returns the port of the server.
+func testRelay(t *testing.T, dataReply string) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		_ = text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch command {
+			case "EHLO":
+				_ = text.PrintfLine("250-localhost")
+				_ = text.PrintfLine("250 STARTTLS")
+			case "STARTTLS":
+				_ = text.PrintfLine("220 Ready to start TLS")
+				conn = tls.Server(conn, config)
+				text = textproto.NewConn(conn)
+			case "DATA":
+				_ = text.PrintfLine("354 Go ahead")
+				_, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				_ = text.PrintfLine(dataReply)
+			case "QUIT":
+				_ = text.PrintfLine("221 Bye")
+				return
+			default:
+				_ = text.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestRelayRejectsAfterData(t *testing.T) {
+
+	state := &smtp.State{
+		From: &smtp.MailAddress{Address: "sender@example.com"},
+		To:   []*smtp.MailAddress{{Address: "recipient@example.org"}},
+		Data: []byte("Subject: Hello\r\n\r\nHello world!\r\n"),
+		Ip:   net.ParseIP("127.0.0.1"),
+	}
+
+	t.Run("Permanent", func(t *testing.T) {
+		port := testRelay(t, "554 5.7.1 Message rejected")
+		handler := New("localhost", port, "", "", true, nil)
+
+		err := handler.Handle(state)
+		assert.True(t, errors.Is(err, ErrRelayRejected), "got %v", err)
+
+		var relayErr *textproto.Error
+		require.True(t, errors.As(err, &relayErr))
+		assert.Equal(t, 554, relayErr.Code)
+	})
+
+	t.Run("Temporary", func(t *testing.T) {
+		port := testRelay(t, "451 4.3.0 Try again later")
+		handler := New("localhost", port, "", "", true, nil)
+
+		err := handler.Handle(state)
+		assert.True(t, errors.Is(err, ErrRelayUnavailable), "got %v", err)
+	})
+
+}
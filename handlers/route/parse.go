@@ -0,0 +1,115 @@
+package route
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	_ "github.com/emersion/go-message/charset" // decode non UTF-8 charsets
+	"github.com/emersion/go-message/mail"
+)
+
+// ParsedMessage is the representation of a message that is posted to a route endpoint.
+type ParsedMessage struct {
+	// From is the envelope sender.
+	From string `json:"from"`
+	// To is the envelope recipient that matched the route.
+	To string `json:"to"`
+
+	Headers     map[string][]string `json:"headers"`
+	Subject     string              `json:"subject"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []*Attachment       `json:"attachments"`
+}
+
+// Attachment is an attachment (or inline file) of a parsed message.
+// The content is base64 encoded when marshalled to JSON.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	ContentID   string `json:"contentId,omitempty"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"content"`
+}
+
+// parseMessage parses the raw message into its headers, text and html bodies and attachments.
+func parseMessage(data []byte) (*ParsedMessage, error) {
+
+	reader, err := mail.CreateReader(bytes.NewReader(data))
+	if err != nil && reader == nil {
+		return nil, fmt.Errorf("couldn't read message: %w", err)
+	}
+	defer reader.Close()
+
+	parsed := &ParsedMessage{
+		Headers:     map[string][]string{},
+		Attachments: []*Attachment{},
+	}
+
+	fields := reader.Header.Fields()
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		key := fields.Key()
+		parsed.Headers[key] = append(parsed.Headers[key], value)
+	}
+
+	parsed.Subject, err = reader.Header.Subject()
+	if err != nil {
+		parsed.Subject = reader.Header.Get("Subject")
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read message part: %w", err)
+		}
+
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read message part body: %w", err)
+		}
+
+		switch header := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := header.ContentType()
+			switch {
+			case contentType == "text/plain" && parsed.Text == "":
+				parsed.Text = string(body)
+			case contentType == "text/html" && parsed.HTML == "":
+				parsed.HTML = string(body)
+			case contentType == "" && parsed.Text == "":
+				parsed.Text = string(body)
+			default:
+				// Inline parts that aren't the main text (e.g. embedded images)
+				parsed.Attachments = append(parsed.Attachments, &Attachment{
+					ContentType: contentType,
+					ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+					Size:        len(body),
+					Content:     body,
+				})
+			}
+
+		case *mail.AttachmentHeader:
+			filename, _ := header.Filename()
+			contentType, _, _ := header.ContentType()
+			parsed.Attachments = append(parsed.Attachments, &Attachment{
+				Filename:    filename,
+				ContentType: contentType,
+				ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+				Size:        len(body),
+				Content:     body,
+			})
+		}
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,281 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Define a counter vector for routed SMTP messages.
+var smtpRouted = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "smtp_routed",
+		Help: "SMTP messages posted to HTTP routes (success, deferred or error)",
+	},
+	[]string{"status"},
+)
+
+// DefaultTimeout denotes the HTTP timeout for posting a message to a route.
+const DefaultTimeout = 30 * time.Second
+
+// ErrRouteUnavailable is returned when the endpoint of a route didn't accept the message,
+// so the sending server retries later.
+var ErrRouteUnavailable = handlers.TempFail(451, "4.3.0", "Requested action aborted: route endpoint unavailable")
+
+// IdempotencyKeyHeader is sent with every post. It is the same for every attempt to post a message for a recipient,
+// so endpoints can recognise a message they already received.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RouteStore finds the route for a recipient.
+type RouteStore interface {
+	// FindMatchingRoute returns the route for the given address or nil if none matches.
+	FindMatchingRoute(address string) (*models.Route, error)
+}
+
+// DeliveryStore records the messages that were posted, so retries of the sending server don't post them again.
+type DeliveryStore interface {
+	// FindDeliverySince returns the latest delivery with the key after the given time, or nil.
+	FindDeliverySince(key string, since time.Time) (*models.Delivery, error)
+	// CreateDelivery records a delivery.
+	CreateDelivery(delivery *models.Delivery) error
+}
+
+// New creates a new Route handler.
+func New(c *server.Config, routes RouteStore, deliveries DeliveryStore, timeout time.Duration) *Route {
+	return &Route{
+		config:     c,
+		routes:     routes,
+		deliveries: deliveries,
+		client:     &http.Client{Timeout: timeout},
+	}
+}
+
+// Route is an SMTP handler that posts mail for recipients matching a route to an HTTP endpoint.
+//
+// Recipients of routes that don't store the message are removed from the state,
+// so handlers further down the chain only see the recipients that still need local delivery.
+// Every recipient is handled independently and the posts that succeeded are recorded,
+// so when the message fails for some recipients the retry of the sending server only posts it for the others.
+type Route struct {
+	config     *server.Config
+	routes     RouteStore
+	deliveries DeliveryStore
+	client     *http.Client
+}
+
+// Handle implements the Handler interface.
+// When the message couldn't be posted for some recipients, only those and the ones for local delivery are kept in the state.
+func (handler *Route) Handle(state *smtp.State) error {
+
+	remaining := []*smtp.MailAddress{}
+	failed := []*smtp.MailAddress{}
+	var verdict *handlers.Verdict
+	var parsed *ParsedMessage
+
+	for _, recipient := range state.To {
+		keep, err := handler.handleRecipient(state, recipient, &parsed)
+		if err != nil {
+			failed = append(failed, recipient)
+			verdict = handlers.WorstVerdict(verdict, err)
+			continue
+		}
+		if keep {
+			remaining = append(remaining, recipient)
+		}
+	}
+
+	if verdict != nil {
+		state.To = append(failed, remaining...)
+		return verdict
+	}
+	state.To = remaining
+
+	return nil
+}
+
+// handleRecipient posts the message for the recipient when it matches a route,
+// and returns whether the recipient still needs local delivery.
+// The message is parsed once into parsed, even when multiple recipients are routed.
+func (handler *Route) handleRecipient(state *smtp.State, recipient *smtp.MailAddress, parsed **ParsedMessage) (bool, error) {
+
+	route, err := handler.routes.FindMatchingRoute(recipient.GetAddress())
+	if err != nil {
+		smtpRouted.WithLabelValues("error").Inc()
+		return false, handlers.ErrLocalError.Wrap(err)
+	}
+	if route == nil {
+		return true, nil
+	}
+
+	key := models.DeliveryKey(fmt.Sprintf("route:%d:%s", route.ID, recipient.GetAddress()), state.Data)
+	delivery, err := handler.deliveries.FindDeliverySince(key, time.Now().Add(-models.DeliveryWindow))
+	if err != nil {
+		smtpRouted.WithLabelValues("error").Inc()
+		return false, handlers.ErrLocalError.Wrap(fmt.Errorf("couldn't check earlier posts: %w", err))
+	}
+	if delivery != nil {
+		log.WithField("SessionId", state.SessionId.String()).Debugf("Message for %q was already posted to route %d", recipient.GetAddress(), route.ID)
+		return route.Store, nil
+	}
+
+	if *parsed == nil {
+		*parsed, err = parseMessage(state.Data)
+		if err != nil {
+			smtpRouted.WithLabelValues("error").Inc()
+			return false, handlers.ErrMessageInvalid.Wrap(err)
+		}
+		(*parsed).From = state.From.GetAddress()
+	}
+	(*parsed).To = recipient.GetAddress()
+
+	err = handler.post(route, *parsed, key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Ip":        state.Ip.String(),
+			"SessionId": state.SessionId.String(),
+			"Hostname":  state.Hostname,
+		}).Warnf("Couldn't post message to route %d: %v", route.ID, err)
+		smtpRouted.WithLabelValues("deferred").Inc()
+		return false, ErrRouteUnavailable.Wrap(err)
+	}
+
+	log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"Hostname":  state.Hostname,
+	}).Debugf("Posted message for %q to route %d", recipient.GetAddress(), route.ID)
+
+	smtpRouted.WithLabelValues("success").Inc()
+
+	// The message is posted, so failing now would only post it again
+	err = handler.deliveries.CreateDelivery(&models.Delivery{DeliveryKey: key, Recipient: recipient.GetAddress()})
+	if err != nil {
+		log.WithField("SessionId", state.SessionId.String()).Errorf("Couldn't record post for %q: %v", recipient.GetAddress(), err)
+	}
+
+	return route.Store, nil
+}
+
+// post sends the parsed message to the endpoint of the route, with the given idempotency key.
+func (handler *Route) post(route *models.Route, parsed *ParsedMessage, idempotencyKey string) error {
+
+	var body []byte
+	var contentType string
+	var err error
+
+	switch route.Format {
+	case models.RouteFormatMultipart:
+		body, contentType, err = encodeMultipart(parsed)
+	default:
+		body, err = json.Marshal(parsed)
+		contentType = "application/json"
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't encode message: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, route.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("couldn't create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "MistralMail-Routes")
+	req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	if route.Secret != "" {
+		req.Header.Set(webhooks.SignatureHeader, "sha256="+webhooks.Sign(route.Secret, body))
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't post message: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// encodeMultipart encodes the parsed message as a multipart form.
+// The headers are added as a JSON encoded field and attachments as files named attachment1, attachment2, ...
+func encodeMultipart(parsed *ParsedMessage) ([]byte, string, error) {
+
+	buffer := &bytes.Buffer{}
+	writer := multipart.NewWriter(buffer)
+
+	headers, err := json.Marshal(parsed.Headers)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fields := [][2]string{
+		{"from", parsed.From},
+		{"to", parsed.To},
+		{"subject", parsed.Subject},
+		{"headers", string(headers)},
+		{"text", parsed.Text},
+		{"html", parsed.HTML},
+		{"attachments", fmt.Sprintf("%d", len(parsed.Attachments))},
+	}
+	for _, field := range fields {
+		err := writer.WriteField(field[0], field[1])
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	for i, attachment := range parsed.Attachments {
+		filename := attachment.Filename
+		if filename == "" {
+			filename = fmt.Sprintf("attachment%d", i+1)
+		}
+
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="attachment%d"; filename="%s"`, i+1, escapeQuotes(filename)))
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		partHeader.Set("Content-Type", contentType)
+
+		part, err := writer.CreatePart(partHeader)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = part.Write(attachment.Content)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buffer.Bytes(), writer.FormDataContentType(), nil
+}
+
+// escapeQuotes escapes quotes like the mime/multipart package does.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
@@ -0,0 +1,196 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/mistralmail/backend/models"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testRouteStore []*models.Route
+
+func (s testRouteStore) FindMatchingRoute(address string) (*models.Route, error) {
+	for _, route := range s {
+		if route.Matches(address) {
+			return route, nil
+		}
+	}
+	return nil, nil
+}
+
+type testDeliveryStore map[string]*models.Delivery
+
+func (s testDeliveryStore) FindDeliverySince(key string, since time.Time) (*models.Delivery, error) {
+	return s[key], nil
+}
+
+func (s testDeliveryStore) CreateDelivery(delivery *models.Delivery) error {
+	s[delivery.DeliveryKey] = delivery
+	return nil
+}
+
+const testMessage = "From: Sender <sender@example.net>\r\n" +
+	"To: support@example.com\r\n" +
+	"Subject: Help\r\n" +
+	"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello world!\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"test.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--BOUNDARY--\r\n"
+
+func TestRouteHandler(t *testing.T) {
+
+	Convey("Testing Route handler", t, func() {
+
+		var received *ParsedMessage
+		var contentType string
+		statusCode := http.StatusOK
+		// failTo fails the posts for the given recipient
+		failTo := ""
+		posted := []string{}
+		idempotencyKeys := []string{}
+
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			if contentType == "application/json" {
+				body, _ := io.ReadAll(r.Body)
+				received = &ParsedMessage{}
+				_ = json.Unmarshal(body, received)
+			} else {
+				_ = r.ParseMultipartForm(1024 * 1024)
+				received = &ParsedMessage{
+					To:      r.FormValue("to"),
+					Subject: r.FormValue("subject"),
+					Text:    r.FormValue("text"),
+				}
+			}
+			idempotencyKeys = append(idempotencyKeys, r.Header.Get(IdempotencyKeyHeader))
+			if received.To == failTo {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			posted = append(posted, received.To)
+			w.WriteHeader(statusCode)
+		}))
+		defer endpoint.Close()
+
+		routes := testRouteStore{
+			{ID: 1, Pattern: "support@example.com", URL: endpoint.URL, Format: models.RouteFormatJSON},
+			{ID: 2, Pattern: "*@tickets.example.com", URL: endpoint.URL, Format: models.RouteFormatMultipart, Store: true},
+		}
+
+		deliveries := testDeliveryStore{}
+		h := New(&server.Config{Hostname: "mx.example.com"}, routes, deliveries, DefaultTimeout)
+
+		state := &smtp.State{
+			From: &smtp.MailAddress{Address: "sender@example.net"},
+			To: []*smtp.MailAddress{
+				{Address: "local@example.com"},
+				{Address: "Support@example.com"},
+			},
+			Data: []byte(testMessage),
+			Ip:   net.ParseIP("192.168.0.10"),
+		}
+
+		Convey("Matching recipients are posted as JSON and removed from the state", func() {
+			err := h.Handle(state)
+			So(err, ShouldBeNil)
+
+			So(received, ShouldNotBeNil)
+			So(received.From, ShouldEqual, "sender@example.net")
+			So(received.To, ShouldEqual, "Support@example.com")
+			So(received.Subject, ShouldEqual, "Help")
+			So(received.Text, ShouldEqual, "Hello world!")
+			So(received.Headers["Subject"], ShouldResemble, []string{"Help"})
+			So(len(received.Attachments), ShouldEqual, 1)
+			So(received.Attachments[0].Filename, ShouldEqual, "test.bin")
+			So(received.Attachments[0].Content, ShouldResemble, []byte{0, 1, 2})
+
+			So(len(state.To), ShouldEqual, 1)
+			So(state.To[0].Address, ShouldEqual, "local@example.com")
+		})
+
+		Convey("Routes that store the message keep the recipient", func() {
+			state.To = []*smtp.MailAddress{{Address: "123@tickets.example.com"}}
+
+			err := h.Handle(state)
+			So(err, ShouldBeNil)
+			So(contentType, ShouldStartWith, "multipart/form-data")
+			So(received.To, ShouldEqual, "123@tickets.example.com")
+			So(received.Text, ShouldEqual, "Hello world!")
+			So(len(state.To), ShouldEqual, 1)
+		})
+
+		Convey("A non-2xx response defers the message", func() {
+			statusCode = http.StatusBadGateway
+
+			err := h.Handle(state)
+			So(errors.Is(err, ErrRouteUnavailable), ShouldBeTrue)
+			So(len(deliveries), ShouldEqual, 0)
+		})
+
+		Convey("Posts have a stable idempotency key", func() {
+			statusCode = http.StatusBadGateway
+			_ = h.Handle(state)
+
+			statusCode = http.StatusOK
+			state.To = []*smtp.MailAddress{{Address: "Support@example.com"}}
+			err := h.Handle(state)
+			So(err, ShouldBeNil)
+
+			So(len(idempotencyKeys), ShouldEqual, 2)
+			So(idempotencyKeys[0], ShouldNotBeEmpty)
+			So(idempotencyKeys[1], ShouldEqual, idempotencyKeys[0])
+		})
+
+		Convey("A retry doesn't post again for the recipients that succeeded", func() {
+			recipients := func() []*smtp.MailAddress {
+				return []*smtp.MailAddress{
+					{Address: "Support@example.com"},
+					{Address: "123@tickets.example.com"},
+					{Address: "local@example.com"},
+				}
+			}
+			state.To = recipients()
+			failTo = "123@tickets.example.com"
+
+			err := h.Handle(state)
+			So(errors.Is(err, ErrRouteUnavailable), ShouldBeTrue)
+			So(posted, ShouldResemble, []string{"Support@example.com"})
+
+			// Only the failed recipient and the local one remain
+			So(len(state.To), ShouldEqual, 2)
+			So(state.To[0].Address, ShouldEqual, "123@tickets.example.com")
+			So(state.To[1].Address, ShouldEqual, "local@example.com")
+
+			failTo = ""
+			state.To = recipients()
+			err = h.Handle(state)
+			So(err, ShouldBeNil)
+			So(posted, ShouldResemble, []string{"Support@example.com", "123@tickets.example.com"})
+			So(len(state.To), ShouldEqual, 2)
+			So(state.To[0].Address, ShouldEqual, "123@tickets.example.com")
+			So(state.To[1].Address, ShouldEqual, "local@example.com")
+		})
+
+	})
+
+}
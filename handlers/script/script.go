@@ -0,0 +1,77 @@
+package script
+
+import (
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Define a counter vector for script results.
+var smtpScript = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "smtp_script",
+		Help: "Script results (continue, accept, reject, tempfail, discard, quarantine or error)",
+	},
+	[]string{"result"},
+)
+
+// ErrScriptFailed is returned when the script couldn't be run.
+var ErrScriptFailed = handlers.TempFail(451, "4.3.0", "Requested action aborted: error in processing")
+
+// New creates a new Script handler that runs the smtp(mail) function of the given script.
+func New(c *server.Config, script *scripting.Script) *Script {
+	return &Script{
+		config: c,
+		script: script,
+	}
+}
+
+// Script is an SMTP handler that lets a Starlark script decide what happens with the message.
+// Header fields added by the script are prepended to the message.
+type Script struct {
+	config *server.Config
+	script *scripting.Script
+}
+
+// Handle implements the Handler interface.
+func (handler *Script) Handle(state *smtp.State) error {
+
+	logger := log.WithFields(log.Fields{
+		"Ip":        state.Ip.String(),
+		"SessionId": state.SessionId.String(),
+		"Hostname":  state.Hostname,
+	})
+
+	result, err := handler.script.Run(scripting.FunctionSMTP, scripting.NewMessage(state))
+	if err != nil {
+		logger.Errorf("Couldn't run script: %v", err)
+		smtpScript.WithLabelValues("error").Inc()
+		return ErrScriptFailed.Wrap(err)
+	}
+
+	// AddHeader prepends, so add the header fields in reverse to keep the order of the script
+	for i := len(result.Headers) - 1; i >= 0; i-- {
+		state.AddHeader(result.Headers[i].Name, result.Headers[i].Value)
+	}
+
+	smtpScript.WithLabelValues(string(result.Action)).Inc()
+
+	switch result.Action {
+	case scripting.ActionAccept:
+		return handlers.Accept()
+	case scripting.ActionReject:
+		return handlers.Reject(result.Code, result.EnhancedCode, result.Message)
+	case scripting.ActionTempFail:
+		return handlers.TempFail(result.Code, result.EnhancedCode, result.Message)
+	case scripting.ActionDiscard:
+		return handlers.Discard(result.Reason)
+	case scripting.ActionQuarantine:
+		return handlers.Quarantine(result.Reason)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package script
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/mistralmail/handlers"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScriptHandler(t *testing.T) {
+
+	Convey("Testing Script handler", t, func() {
+
+		config := &server.Config{Hostname: "mx.example.com"}
+
+		state := &smtp.State{
+			From:     &smtp.MailAddress{Address: "sender@example.net"},
+			To:       []*smtp.MailAddress{{Address: "to@example.com"}},
+			Data:     []byte("Subject: Hello\r\n\r\nHello world!\r\n"),
+			Ip:       net.ParseIP("192.168.0.10"),
+			Hostname: "client.example.net",
+		}
+
+		run := func(src string) error {
+			path := filepath.Join(t.TempDir(), "policy.star")
+			So(os.WriteFile(path, []byte(src), 0o600), ShouldBeNil)
+			s, err := scripting.New(path, scripting.DefaultMaxSteps, scripting.DefaultTimeout)
+			So(err, ShouldBeNil)
+			return New(config, s).Handle(state)
+		}
+
+		Convey("Header fields are added in order", func() {
+			err := run(`
+def smtp(mail):
+    mail.add_header("X-First", mail.helo)
+    mail.add_header("X-Second", mail.subject)
+`)
+			So(err, ShouldBeNil)
+			So(string(state.Data), ShouldEqual, "X-First: client.example.net\r\nX-Second: Hello\r\nSubject: Hello\r\n\r\nHello world!\r\n")
+		})
+
+		Convey("Results are returned as verdicts", func() {
+			err := run(`
+def smtp(mail):
+    return reject(550, "Go away", enhanced_code="5.7.1")
+`)
+			So(err, ShouldResemble, handlers.Reject(550, "5.7.1", "Go away"))
+
+			err = run(`
+def smtp(mail):
+    return quarantine("suspicious")
+`)
+			So(err, ShouldResemble, handlers.Quarantine("suspicious"))
+		})
+
+		Convey("Failing scripts ask the client to retry later", func() {
+			err := run(`
+def smtp(mail):
+    return 1 // 0
+`)
+			So(err, ShouldNotBeNil)
+			So(err.(*handlers.Verdict).Temporary(), ShouldBeTrue)
+		})
+
+	})
+
+}
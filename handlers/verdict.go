@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/mistralmail/smtp/smtp"
+)
+
+// Action denotes what the handler mechanism does with a message after a handler returned a verdict.
+type Action int
+
+const (
+	// ActionReject stops the chain and replies with the code of the verdict.
+	// 4xx codes ask the client to retry later, 5xx codes reject the message permanently.
+	ActionReject Action = iota
+	// ActionContinue continues with the next handler, e.g. when a non-essential check failed.
+	ActionContinue
+	// ActionAccept stops the chain and accepts the message without running the remaining handlers.
+	ActionAccept
+	// ActionDiscard stops the chain and accepts the message, but silently drops it.
+	ActionDiscard
+	// ActionQuarantine marks the message as quarantined and continues with the next handler.
+	// The IMAP backend delivers quarantined messages in the Junk mailbox.
+	ActionQuarantine
+)
+
+// String returns the name of the action.
+func (a Action) String() string {
+	switch a {
+	case ActionReject:
+		return "reject"
+	case ActionContinue:
+		return "continue"
+	case ActionAccept:
+		return "accept"
+	case ActionDiscard:
+		return "discard"
+	case ActionQuarantine:
+		return "quarantine"
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// Verdict is returned by handlers to tell the handler mechanism what to do with the message
+// and what to reply to the client.
+type Verdict struct {
+	Action Action
+	// Code is the SMTP reply code, e.g. 550.
+	Code int
+	// EnhancedCode is the enhanced status code (RFC 3463), e.g. "5.1.1".
+	EnhancedCode string
+	// Message is the text that is sent to the client.
+	Message string
+	// Reason is logged for verdicts that don't reply to the client (continue, discard and quarantine).
+	Reason string
+	// Err is the underlying error, it is logged but never sent to the client.
+	Err error
+}
+
+// Reject creates a verdict that rejects the message permanently, code should be a 5xx code.
+func Reject(code int, enhancedCode string, message string) *Verdict {
+	return &Verdict{Action: ActionReject, Code: code, EnhancedCode: enhancedCode, Message: message}
+}
+
+// TempFail creates a verdict that asks the client to retry later, code should be a 4xx code.
+func TempFail(code int, enhancedCode string, message string) *Verdict {
+	return &Verdict{Action: ActionReject, Code: code, EnhancedCode: enhancedCode, Message: message}
+}
+
+// Continue creates a verdict that continues the chain, the reason is logged.
+func Continue(reason string) *Verdict {
+	return &Verdict{Action: ActionContinue, Reason: reason}
+}
+
+// Accept creates a verdict that accepts the message without running the remaining handlers.
+func Accept() *Verdict {
+	return &Verdict{Action: ActionAccept}
+}
+
+// Discard creates a verdict that accepts the message and silently drops it.
+func Discard(reason string) *Verdict {
+	return &Verdict{Action: ActionDiscard, Reason: reason}
+}
+
+// Quarantine creates a verdict that quarantines the message.
+func Quarantine(reason string) *Verdict {
+	return &Verdict{Action: ActionQuarantine, Reason: reason}
+}
+
+// Common verdicts.
+var (
+	// ErrLocalError is returned when the message couldn't be handled because of a local (temporary) problem.
+	ErrLocalError = TempFail(451, "4.3.0", "Requested action aborted: local error in processing")
+	// ErrMailboxUnavailable is returned when a recipient doesn't exist.
+	ErrMailboxUnavailable = Reject(550, "5.1.1", "Requested action not taken: mailbox unavailable")
+	// ErrMessageInvalid is returned when the message can't be parsed.
+	ErrMessageInvalid = Reject(554, "5.6.0", "Transaction failed: invalid message content")
+)
+
+// Wrap returns a copy of the verdict with the given underlying error.
+func (v *Verdict) Wrap(err error) *Verdict {
+	wrapped := *v
+	wrapped.Err = err
+	return &wrapped
+}
+
+// Error implements the error interface.
+func (v *Verdict) Error() string {
+	s := v.Action.String()
+	if v.Code != 0 {
+		s = fmt.Sprintf("%s %d %s %s", s, v.Code, v.EnhancedCode, v.Message)
+	}
+	if v.Reason != "" {
+		s = fmt.Sprintf("%s: %s", s, v.Reason)
+	}
+	if v.Err != nil {
+		s = fmt.Sprintf("%s: %v", s, v.Err)
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (v *Verdict) Unwrap() error {
+	return v.Err
+}
+
+// Is reports whether the target is a verdict with the same action and reply,
+// so errors.Is works with the common verdicts even when they are wrapped.
+func (v *Verdict) Is(target error) bool {
+	t, ok := target.(*Verdict)
+	if !ok {
+		return false
+	}
+	return v.Action == t.Action && v.Code == t.Code && v.EnhancedCode == t.EnhancedCode && v.Message == t.Message
+}
+
+// Temporary reports whether the verdict asks the client to retry later.
+func (v *Verdict) Temporary() bool {
+	return v.Action == ActionReject && v.Code >= 400 && v.Code < 500
+}
+
+// WorstVerdict returns the verdict that decides the reply when the message couldn't be handled for several recipients,
+// err is the result of another recipient. A temporary failure wins, so the client retries
+// and the handlers skip the recipients that were already handled.
+func WorstVerdict(verdict *Verdict, err error) *Verdict {
+	recipientVerdict, ok := err.(*Verdict)
+	if !ok {
+		recipientVerdict = ErrLocalError.Wrap(err)
+	}
+	if verdict == nil || (recipientVerdict.Temporary() && !verdict.Temporary()) {
+		return recipientVerdict
+	}
+	return verdict
+}
+
+// SMTPError returns the SMTP reply of the verdict.
+func (v *Verdict) SMTPError() smtp.SMTPError {
+	message := v.Message
+	if v.EnhancedCode != "" {
+		message = v.EnhancedCode + " " + message
+	}
+	return smtp.SMTPError{Status: smtp.StatusCode(v.Code), Message: message}
+}
@@ -0,0 +1,433 @@
+package condstore
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+)
+
+// Enable is the ENABLE command (RFC 5161), which enables QRESYNC for the connection.
+type Enable struct {
+	commands.Enable
+}
+
+func (cmd *Enable) Handle(c server.Conn) error {
+	if c.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	// CONDSTORE doesn't change anything for the connection, MODSEQ is always sent with the flags
+	enabled := []string{}
+	for _, name := range cmd.Caps {
+		switch name = strings.ToUpper(name); name {
+		case "CONDSTORE":
+			enabled = append(enabled, name)
+		case "QRESYNC":
+			conn := connOf(c)
+			if conn == nil {
+				continue
+			}
+			conn.enableQResync()
+			enabled = append(enabled, name)
+		}
+	}
+	return c.WriteResp(&responses.Enabled{Caps: enabled})
+}
+
+// qresyncParameters are the parameters of SELECT (QRESYNC ...),
+// with the state of the mailbox that is known by the client.
+type qresyncParameters struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *imap.SeqSet
+}
+
+// Select is the SELECT or EXAMINE command with the CONDSTORE or QRESYNC parameter.
+type Select struct {
+	server.Select
+
+	qresync *qresyncParameters
+}
+
+func (cmd *Select) Parse(fields []interface{}) error {
+	err := cmd.Select.Parse(fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+
+	parameters, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("SELECT parameters must be a list")
+	}
+	for i := 0; i < len(parameters); i++ {
+		name, _ := parameters[i].(string)
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+		case "QRESYNC":
+			if i+1 >= len(parameters) {
+				return errors.New("QRESYNC needs parameters")
+			}
+			i++
+			cmd.qresync, err = parseQResyncParameters(parameters[i])
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown SELECT parameter")
+		}
+	}
+	return nil
+}
+
+// parseQResyncParameters parses (uidvalidity modseq [known-uids [seq-match-data]]).
+// The sequence match data is ignored, it only helps to find out which messages vanished when there are no tombstones.
+func parseQResyncParameters(f interface{}) (*qresyncParameters, error) {
+	fields, ok := f.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, errors.New("QRESYNC parameters must be a list with the uid validity and mod-sequence")
+	}
+
+	uidValidity, err := imap.ParseNumber(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	modSeq, err := parseModSeq(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	parameters := &qresyncParameters{uidValidity: uidValidity, modSeq: modSeq}
+
+	if len(fields) > 2 {
+		if s, ok := fields[2].(string); ok {
+			parameters.knownUIDs, err = imap.ParseSeqSet(s)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return parameters, nil
+}
+
+// selectMailbox selects the mailbox like the server does, but a modseq.SessionMailbox numbers its messages
+// for the session before the status with their number is read.
+func (cmd *Select) selectMailbox(c server.Conn) error {
+	ctx := c.Context()
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	if mbox, ok := mbox.(modseq.SessionMailbox); ok {
+		err = mbox.Select()
+		if err != nil {
+			return err
+		}
+	}
+
+	status, err := mbox.Status([]imap.StatusItem{
+		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+		imap.StatusUidNext, imap.StatusUidValidity,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.Mailbox = mbox
+	ctx.MailboxReadOnly = cmd.ReadOnly || status.ReadOnly
+	err = c.WriteResp(&responses.Select{Mailbox: status})
+	if err != nil {
+		return err
+	}
+
+	code := imap.CodeReadWrite
+	if ctx.MailboxReadOnly {
+		code = imap.CodeReadOnly
+	}
+	return server.ErrStatusResp(&imap.StatusResp{Type: imap.StatusRespOk, Code: code})
+}
+
+func (cmd *Select) Handle(c server.Conn) error {
+	conn := connOf(c)
+	if cmd.qresync != nil && !conn.qresyncEnabled() {
+		return errors.New("QRESYNC isn't enabled")
+	}
+
+	// The tagged response of the mailbox is sent last
+	res := cmd.selectMailbox(c)
+	var statusErr *imap.ErrStatusResp
+	if !errors.As(res, &statusErr) || statusErr.Resp == nil || statusErr.Resp.Type != imap.StatusRespOk {
+		return res
+	}
+
+	mbox, ok := c.Context().Mailbox.(modseq.Mailbox)
+	if !ok {
+		conn.selected(nil, 0)
+		return res
+	}
+	highestModSeq, err := mbox.HighestModSeq()
+	if err != nil {
+		return err
+	}
+	conn.selected(mbox, highestModSeq)
+	err = c.WriteResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      CodeHighestModSeq,
+		Arguments: []interface{}{modseq.FormatHighestModSeq(highestModSeq)},
+		Info:      "Highest",
+	})
+	if err != nil {
+		return err
+	}
+
+	if cmd.qresync == nil {
+		return res
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return err
+	}
+	if status.UidValidity != cmd.qresync.uidValidity {
+		// The client has to synchronize the whole mailbox again
+		return res
+	}
+
+	err = writeVanished(c, mbox, cmd.qresync.modSeq, cmd.qresync.knownUIDs)
+	if err != nil {
+		return err
+	}
+
+	uids := cmd.qresync.knownUIDs
+	if uids == nil {
+		uids, _ = imap.ParseSeqSet("1:*")
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, modseq.FetchModSeq}
+	err = listMessages(c, mbox, true, uids, items, cmd.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	return res
+}
+
+// listMessages writes a FETCH response with the messages that changed after the mod-sequence.
+func listMessages(c server.Conn, mbox modseq.Mailbox, uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64) error {
+	ch := make(chan *imap.Message)
+	res := &responses.Fetch{Messages: ch}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WriteResp(res)
+		// Make sure to drain the message channel
+		for range ch {
+		}
+	}()
+
+	err := mbox.ListMessagesChangedSince(uid, seqSet, items, changedSince, ch)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// Fetch is the FETCH command with the CHANGEDSINCE and VANISHED modifiers.
+type Fetch struct {
+	server.Fetch
+
+	changedSince uint64
+	vanished     bool
+}
+
+func (cmd *Fetch) Parse(fields []interface{}) error {
+	err := cmd.Fetch.Parse(fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 {
+		return nil
+	}
+
+	modifiers, ok := fields[2].([]interface{})
+	if !ok {
+		return errors.New("FETCH modifiers must be a list")
+	}
+	for i := 0; i < len(modifiers); i++ {
+		name, _ := modifiers[i].(string)
+		switch strings.ToUpper(name) {
+		case "CHANGEDSINCE":
+			if i+1 >= len(modifiers) {
+				return errors.New("CHANGEDSINCE needs a mod-sequence")
+			}
+			i++
+			cmd.changedSince, err = parseModSeq(modifiers[i])
+			if err != nil {
+				return err
+			}
+		case "VANISHED":
+			cmd.vanished = true
+		default:
+			return errors.New("unknown FETCH modifier")
+		}
+	}
+	if cmd.vanished && cmd.changedSince == 0 {
+		return errors.New("VANISHED needs CHANGEDSINCE")
+	}
+	return nil
+}
+
+func (cmd *Fetch) handle(uid bool, c server.Conn) error {
+	ctx := c.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	mbox, ok := ctx.Mailbox.(modseq.Mailbox)
+	if !ok {
+		return errors.New("the mailbox doesn't support CHANGEDSINCE")
+	}
+
+	if cmd.vanished {
+		if !uid || !connOf(c).qresyncEnabled() {
+			return errors.New("VANISHED needs UID FETCH and QRESYNC")
+		}
+		err := writeVanished(c, mbox, cmd.changedSince, cmd.SeqSet)
+		if err != nil {
+			return err
+		}
+	}
+
+	items := cmd.Items
+	if !hasItem(items, modseq.FetchModSeq) {
+		items = append(items, modseq.FetchModSeq)
+	}
+	if uid && !hasItem(items, imap.FetchUid) {
+		items = append(items, imap.FetchUid)
+	}
+	return listMessages(c, mbox, uid, cmd.SeqSet, items, cmd.changedSince)
+}
+
+func (cmd *Fetch) Handle(c server.Conn) error {
+	if cmd.changedSince == 0 {
+		return cmd.Fetch.Handle(c)
+	}
+	return cmd.handle(false, c)
+}
+
+func (cmd *Fetch) UidHandle(c server.Conn) error {
+	if cmd.changedSince == 0 {
+		return cmd.Fetch.UidHandle(c)
+	}
+	return cmd.handle(true, c)
+}
+
+// hasItem returns whether the item is one of the items.
+func hasItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Store is the STORE command with the UNCHANGEDSINCE modifier.
+type Store struct {
+	server.Store
+
+	unchangedSince *uint64
+}
+
+func (cmd *Store) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		if modifiers, ok := fields[1].([]interface{}); ok {
+			if len(modifiers) != 2 {
+				return errors.New("STORE modifiers must be (UNCHANGEDSINCE mod-sequence)")
+			}
+			if name, _ := modifiers[0].(string); !strings.EqualFold(name, "UNCHANGEDSINCE") {
+				return errors.New("unknown STORE modifier")
+			}
+			unchangedSince, err := parseModSeq(modifiers[1])
+			if err != nil {
+				return err
+			}
+			cmd.unchangedSince = &unchangedSince
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+	return cmd.Store.Parse(fields)
+}
+
+func (cmd *Store) handle(uid bool, c server.Conn) error {
+	ctx := c.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mbox, ok := ctx.Mailbox.(modseq.Mailbox)
+	if !ok {
+		return errors.New("the mailbox doesn't support UNCHANGEDSINCE")
+	}
+
+	// The changed flags are sent by the updates of the backend, also when the store is silent
+	op, _, err := imap.ParseFlagsOp(cmd.Item)
+	if err != nil {
+		return err
+	}
+	var flags []string
+	if flagsList, ok := cmd.Value.([]interface{}); ok {
+		flags, err = imap.ParseStringList(flagsList)
+	} else {
+		var flag string
+		flag, err = imap.ParseString(cmd.Value)
+		flags = []string{flag}
+	}
+	if err != nil {
+		return err
+	}
+	for i, flag := range flags {
+		flags[i] = imap.CanonicalFlag(flag)
+	}
+
+	modified, err := mbox.UpdateMessagesFlagsUnchangedSince(uid, cmd.SeqSet, op, flags, *cmd.unchangedSince)
+	if err != nil {
+		return err
+	}
+	if len(modified) == 0 {
+		return nil
+	}
+
+	set := &imap.SeqSet{}
+	set.AddNum(modified...)
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      CodeModified,
+		Arguments: []interface{}{set},
+		Info:      "Conditional STORE failed for some messages",
+	}}
+}
+
+func (cmd *Store) Handle(c server.Conn) error {
+	if cmd.unchangedSince == nil {
+		return connOf(c).store(cmd.Item, func() error { return cmd.Store.Handle(c) })
+	}
+	return cmd.handle(false, c)
+}
+
+func (cmd *Store) UidHandle(c server.Conn) error {
+	if cmd.unchangedSince == nil {
+		return connOf(c).store(cmd.Item, func() error { return cmd.Store.UidHandle(c) })
+	}
+	return cmd.handle(true, c)
+}
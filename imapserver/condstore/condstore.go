@@ -0,0 +1,194 @@
+// Package condstore implements the CONDSTORE and QRESYNC extensions (RFC 7162) for the IMAP server,
+// so clients only have to fetch the changes since they last synchronized a mailbox.
+package condstore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+)
+
+const (
+	// CodeHighestModSeq is the response code with the highest mod-sequence of the selected mailbox.
+	CodeHighestModSeq imap.StatusRespCode = "HIGHESTMODSEQ"
+	// CodeModified is the response code with the messages that weren't stored because they changed.
+	CodeModified imap.StatusRespCode = "MODIFIED"
+)
+
+// parseModSeq parses a mod-sequence in a command.
+func parseModSeq(f interface{}) (uint64, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("mod-sequence must be a number")
+	}
+	modSeq, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mod-sequence: %w", err)
+	}
+	return modSeq, nil
+}
+
+// Extension adds CONDSTORE and QRESYNC to the server.
+// It passes the updates of the backend on to the connections itself, see Updates.
+type Extension struct {
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+}
+
+// NewExtension creates the extension that adds CONDSTORE and QRESYNC to the server.
+// Without QRESYNC clients are still told about expunged messages with EXPUNGE.
+func NewExtension() *Extension {
+	return &Extension{conns: map[*conn]struct{}{}}
+}
+
+func (ext *Extension) Capabilities(c server.Conn) []string {
+	return []string{"ENABLE", "CONDSTORE", "QRESYNC"}
+}
+
+func (ext *Extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "ENABLE":
+		return func() server.Handler { return &Enable{} }
+	case "SELECT":
+		return func() server.Handler { return &Select{} }
+	case "EXAMINE":
+		return func() server.Handler {
+			hdlr := &Select{}
+			hdlr.ReadOnly = true
+			return hdlr
+		}
+	case "FETCH":
+		return func() server.Handler { return &Fetch{} }
+	case "STORE":
+		return func() server.Handler { return &Store{} }
+	}
+	return nil
+}
+
+func (ext *Extension) NewConn(c server.Conn) server.Conn {
+	conn := &conn{Conn: c}
+
+	// The connection gets the updates of the backend until the client logs out
+	ext.mu.Lock()
+	ext.conns[conn] = struct{}{}
+	ext.mu.Unlock()
+	go func() {
+		<-c.Context().LoggedOut
+		ext.mu.Lock()
+		delete(ext.conns, conn)
+		ext.mu.Unlock()
+	}()
+
+	return conn
+}
+
+// conn is a connection that knows whether QRESYNC is enabled.
+type conn struct {
+	server.Conn
+
+	mu      sync.Mutex
+	qresync bool
+	// silent is set while the connection stores flags with .SILENT, so it isn't told about the new flags.
+	silent bool
+	// mailbox is the selected mailbox and expungedSince the highest mod-sequence of the expunges the client knows of.
+	mailbox       modseq.Mailbox
+	expungedSince uint64
+}
+
+// connOf returns the connection with the state of the extension.
+func connOf(c server.Conn) *conn {
+	conn, _ := c.(*conn)
+	return conn
+}
+
+func (c *conn) enableQResync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.qresync = true
+}
+
+func (c *conn) qresyncEnabled() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.qresync
+}
+
+// selected remembers the selected mailbox, the client knows of its expunges up to the mod-sequence.
+func (c *conn) selected(mailbox modseq.Mailbox, expungedSince uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mailbox = mailbox
+	c.expungedSince = expungedSince
+}
+
+// store runs a STORE of the server. Like the server does, a connection that stores flags with .SILENT
+// isn't told about the new flags.
+func (c *conn) store(item imap.StoreItem, handle func() error) error {
+	_, silent, err := imap.ParseFlagsOp(item)
+	if c == nil || err != nil || !silent {
+		return handle()
+	}
+	c.mu.Lock()
+	c.silent = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.silent = false
+		c.mu.Unlock()
+	}()
+	return handle()
+}
+
+// silenced returns whether the connection is storing flags with .SILENT.
+func (c *conn) silenced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.silent
+}
+
+// Vanished is a VANISHED response with the uids of expunged messages.
+// Earlier denotes that the messages were expunged before the command.
+type Vanished struct {
+	Earlier bool
+	UIDs    *imap.SeqSet
+}
+
+func (r *Vanished) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString("VANISHED")}
+	if r.Earlier {
+		fields = append(fields, []interface{}{imap.RawString("EARLIER")})
+	}
+	fields = append(fields, r.UIDs)
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// writeVanished writes a VANISHED (EARLIER) response with the messages that were expunged after the mod-sequence
+// and that are in the set of uids, if any.
+func writeVanished(c server.Conn, mbox modseq.Mailbox, modSeq uint64, uids *imap.SeqSet) error {
+	expunged, _, err := mbox.ExpungedSince(modSeq)
+	if err != nil {
+		return err
+	}
+
+	set := &imap.SeqSet{}
+	for _, uid := range expunged {
+		if uids == nil || uids.Contains(uid) {
+			set.AddNum(uid)
+		}
+	}
+	if len(set.Set) == 0 {
+		return nil
+	}
+	return c.WriteResp(&Vanished{Earlier: true, UIDs: set})
+}
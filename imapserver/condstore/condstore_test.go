@@ -0,0 +1,213 @@
+package condstore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+
+	t.Run("TestSelect", func(t *testing.T) {
+		cmd := &Select{}
+		require.NoError(t, cmd.Parse([]interface{}{"INBOX", []interface{}{"QRESYNC", []interface{}{"67890007", "20050715194045000", "41,43:211"}}}))
+		assert.Equal(t, "INBOX", cmd.Mailbox)
+		require.NotNil(t, cmd.qresync)
+		assert.Equal(t, uint32(67890007), cmd.qresync.uidValidity)
+		assert.Equal(t, uint64(20050715194045000), cmd.qresync.modSeq)
+		assert.Equal(t, "41,43:211", cmd.qresync.knownUIDs.String())
+
+		cmd = &Select{}
+		require.NoError(t, cmd.Parse([]interface{}{"INBOX", []interface{}{"CONDSTORE"}}))
+		assert.Nil(t, cmd.qresync)
+
+		assert.Error(t, (&Select{}).Parse([]interface{}{"INBOX", []interface{}{"QRESYNC", []interface{}{"1"}}}))
+		assert.Error(t, (&Select{}).Parse([]interface{}{"INBOX", []interface{}{"UNKNOWN"}}))
+	})
+
+	t.Run("TestFetch", func(t *testing.T) {
+		cmd := &Fetch{}
+		require.NoError(t, cmd.Parse([]interface{}{"1:*", []interface{}{"FLAGS"}, []interface{}{"CHANGEDSINCE", "12345", "VANISHED"}}))
+		assert.Equal(t, uint64(12345), cmd.changedSince)
+		assert.True(t, cmd.vanished)
+
+		assert.Error(t, (&Fetch{}).Parse([]interface{}{"1:*", "FLAGS", []interface{}{"VANISHED"}}))
+		assert.Error(t, (&Fetch{}).Parse([]interface{}{"1:*", "FLAGS", []interface{}{"CHANGEDSINCE", "-1"}}))
+	})
+
+	t.Run("TestStore", func(t *testing.T) {
+		cmd := &Store{}
+		require.NoError(t, cmd.Parse([]interface{}{"7,5,9", []interface{}{"UNCHANGEDSINCE", "320162338"}, "+FLAGS.SILENT", []interface{}{`\Deleted`}}))
+		require.NotNil(t, cmd.unchangedSince)
+		assert.Equal(t, uint64(320162338), *cmd.unchangedSince)
+		assert.Equal(t, imap.StoreItem("+FLAGS.SILENT"), cmd.Item)
+		assert.Equal(t, "5,7,9", cmd.SeqSet.String())
+
+		cmd = &Store{}
+		require.NoError(t, cmd.Parse([]interface{}{"1", "FLAGS", `\Seen`}))
+		assert.Nil(t, cmd.unchangedSince)
+	})
+}
+
+func TestVanished(t *testing.T) {
+
+	uids, err := imap.ParseSeqSet("41,43:116")
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, (&Vanished{Earlier: true, UIDs: uids}).WriteTo(imap.NewWriter(&b)))
+	assert.Equal(t, "* VANISHED (EARLIER) 41,43:116\r\n", b.String())
+}
+
+// sessionMailbox numbers the messages with uids 10, 12 and 15 and has the second and third one expunged.
+type sessionMailbox struct {
+	modseq.SessionMailbox
+}
+
+func (mbox *sessionMailbox) Name() string {
+	return "INBOX"
+}
+
+func (mbox *sessionMailbox) SyncExpunged() ([]uint32, []uint32, error) {
+	return []uint32{3, 2}, []uint32{12, 15}, nil
+}
+
+func (mbox *sessionMailbox) SyncExists() (uint32, error) {
+	return 4, nil
+}
+
+func (mbox *sessionMailbox) SeqNum(uid uint32) uint32 {
+	return map[uint32]uint32{10: 1, 12: 2, 15: 3}[uid]
+}
+
+// render returns the response the connection writes for the update, or an empty string when there is none.
+func render(t *testing.T, c *conn, update backend.Update) string {
+	res := c.translate(update)
+	if res == nil {
+		return ""
+	}
+	var b bytes.Buffer
+	require.NoError(t, res.WriteTo(imap.NewWriter(&b)))
+	return b.String()
+}
+
+// flagsUpdate is the update of the backend for the new flags of a message.
+func flagsUpdate(seqNum uint32, uid uint32) backend.Update {
+	message := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	message.Flags = []string{imap.SeenFlag}
+	message.Uid = uid
+	return &backend.MessageUpdate{Update: backend.NewUpdate("user", "INBOX"), Message: message}
+}
+
+// existsUpdate is the update of the backend for the new number of messages in a mailbox.
+func existsUpdate(messages uint32) backend.Update {
+	status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = messages
+	return &backend.MailboxUpdate{Update: backend.NewUpdate("user", "INBOX"), MailboxStatus: status}
+}
+
+func TestRenumber(t *testing.T) {
+
+	c := &conn{mailbox: &sessionMailbox{}}
+	update := flagsUpdate(5, 12)
+	assert.Equal(t, "* 2 FETCH (FLAGS (\\Seen) UID 12)\r\n", render(t, c, update))
+	assert.Equal(t, uint32(5), update.(*backend.MessageUpdate).Message.SeqNum, "the update is shared between the connections")
+	assert.Empty(t, render(t, c, flagsUpdate(6, 16)))
+	assert.Equal(t, "* 4 EXISTS\r\n", render(t, c, existsUpdate(9)))
+
+	alert := &imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeAlert, Info: "Hello"}
+	assert.Equal(t, "* OK [ALERT] Hello\r\n", render(t, c, &backend.StatusUpdate{StatusResp: alert}))
+
+	// Expunges are found out from the mailbox, the sequence number of the update is the one of another session
+	expunge := &backend.ExpungeUpdate{Update: backend.NewUpdate("user", "INBOX"), SeqNum: 7}
+	assert.Equal(t, "* 3 EXPUNGE\r\n* 2 EXPUNGE\r\n", render(t, c, expunge))
+
+	c.enableQResync()
+	assert.Equal(t, "* VANISHED 12,15\r\n", render(t, c, expunge))
+
+	// Without a session mailbox the updates are rendered like the server does
+	c = &conn{}
+	assert.Equal(t, "* 5 FETCH (FLAGS (\\Seen) UID 12)\r\n", render(t, c, flagsUpdate(5, 12)))
+	assert.Equal(t, "* 9 EXISTS\r\n", render(t, c, existsUpdate(9)))
+	assert.Equal(t, "* 7 EXPUNGE\r\n", render(t, c, expunge))
+}
+
+// testUser is the user of a test connection.
+type testUser struct {
+	backend.User
+}
+
+func (u *testUser) Username() string {
+	return "user"
+}
+
+// testConn is a connection with only a context.
+type testConn struct {
+	server.Conn
+	ctx *server.Context
+}
+
+func (c *testConn) Context() *server.Context {
+	return c.ctx
+}
+
+func TestUpdates(t *testing.T) {
+
+	responses := make(chan imap.WriterTo)
+	loggedOut := make(chan struct{})
+	defer close(loggedOut)
+
+	ext := NewExtension()
+	mbox := &sessionMailbox{}
+	ctx := &server.Context{User: &testUser{}, Mailbox: mbox, Responses: responses, LoggedOut: loggedOut}
+	c := ext.NewConn(&testConn{ctx: ctx}).(*conn)
+	c.selected(mbox, 0)
+
+	updates := make(chan backend.Update)
+	ext.Updates(updates)
+
+	// Like the backend, the channel that tells the update was sent is created before the update is
+	update := &backend.ExpungeUpdate{Update: backend.NewUpdate("user", "INBOX"), SeqNum: 7}
+	done := update.Done()
+	updates <- update
+	res := <-responses
+
+	// The update is only sent once the connection writes its translation
+	select {
+	case <-done:
+		t.Fatal("update was sent before the connection wrote it")
+	default:
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, res.WriteTo(imap.NewWriter(&b)))
+	assert.Equal(t, "* 3 EXPUNGE\r\n* 2 EXPUNGE\r\n", b.String())
+	<-done
+
+	// Updates of other mailboxes aren't sent to the connection
+	other := &backend.ExpungeUpdate{Update: backend.NewUpdate("user", "Archive"), SeqNum: 1}
+	done = other.Done()
+	updates <- other
+	<-done
+
+	// Connections that store flags silently aren't told about the new flags
+	err := c.store("+FLAGS.SILENT", func() error {
+		update := flagsUpdate(1, 10)
+		done := update.Done()
+		updates <- update
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("update was sent to the connection that stored silently")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,61 @@
+package condstore
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+)
+
+// exists returns the status of an update with the number of messages for the session,
+// or nil when it can't be counted. The other items of the status aren't reported, since they aren't the session's.
+func exists(mbox modseq.SessionMailbox, status *imap.MailboxStatus) *imap.MailboxStatus {
+	if _, ok := status.Items[imap.StatusMessages]; !ok {
+		return status
+	}
+	count, err := mbox.SyncExists()
+	if err != nil {
+		return nil
+	}
+	// The status is shared between the connections
+	numbered := imap.NewMailboxStatus(status.Name, []imap.StatusItem{imap.StatusMessages})
+	numbered.Messages = count
+	return numbered
+}
+
+// renumber returns the message of an update with its sequence number for the session,
+// or nil when the session doesn't know the message.
+func renumber(mbox modseq.SessionMailbox, message *imap.Message) *imap.Message {
+	if message.Uid == 0 {
+		return message
+	}
+	seqNum := mbox.SeqNum(message.Uid)
+	if seqNum == 0 {
+		return nil
+	}
+	// The message is shared between the connections
+	numbered := *message
+	numbered.SeqNum = seqNum
+	return &numbered
+}
+
+// expunged reports the messages that were expunged since the session was told last with EXPUNGE responses,
+// or with a VANISHED response when QRESYNC is enabled. It returns nil when there is nothing to report.
+func (c *conn) expunged(mbox modseq.SessionMailbox) imap.WriterTo {
+	seqNums, uids, err := mbox.SyncExpunged()
+	if err != nil || len(seqNums) == 0 {
+		return nil
+	}
+
+	if c.qresyncEnabled() {
+		set := &imap.SeqSet{}
+		set.AddNum(uids...)
+		return &Vanished{UIDs: set}
+	}
+
+	ch := make(chan uint32, len(seqNums))
+	for _, seqNum := range seqNums {
+		ch <- seqNum
+	}
+	close(ch)
+	return &responses.Expunge{SeqNums: ch}
+}
@@ -0,0 +1,168 @@
+package condstore
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/mistralmail/mistralmail/backend/imap/modseq"
+)
+
+// Updates passes the updates of the backend on to the connections, and returns the updates for the server,
+// which never get any.
+//
+// The server would turn every update into one response for all connections, but the extension translates the update
+// for every connection: the messages are numbered for the session and expunges are reported as vanished messages
+// when QRESYNC is enabled. The server still has to get a channel, otherwise it fetches the flags itself after a STORE.
+func (ext *Extension) Updates(updates <-chan backend.Update) <-chan backend.Update {
+	go func() {
+		for update := range updates {
+			ext.dispatch(update)
+		}
+	}()
+	return make(chan backend.Update)
+}
+
+// dispatch sends the update to the connections of the user that have the mailbox selected,
+// and tells the backend it was sent once all of them wrote it.
+func (ext *Extension) dispatch(update backend.Update) {
+	ext.mu.Lock()
+	conns := []*conn{}
+	for c := range ext.conns {
+		ctx := c.Context()
+		if update.Username() != "" && (ctx.User == nil || ctx.User.Username() != update.Username()) {
+			continue
+		}
+		if update.Mailbox() != "" && (ctx.Mailbox == nil || ctx.Mailbox.Name() != update.Mailbox()) {
+			continue
+		}
+		if _, ok := update.(*backend.MessageUpdate); ok && c.silenced() {
+			continue
+		}
+		conns = append(conns, c)
+	}
+	ext.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *conn) {
+			defer wg.Done()
+			c.send(update)
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(update.Done())
+	}()
+}
+
+// send sends the update to the client and returns once it was written, or the client logged out.
+func (c *conn) send(update backend.Update) {
+	ctx := c.Context()
+	res := &updateResponse{conn: c, update: update, done: make(chan struct{})}
+	select {
+	case ctx.Responses <- res:
+	case <-ctx.LoggedOut:
+		return
+	}
+	select {
+	case <-res.done:
+	case <-ctx.LoggedOut:
+	}
+}
+
+// updateResponse is the response of an update, which is translated for the connection when it is written.
+// The server only lets the command that caused an update complete once it was written,
+// so the untagged responses are sent before the tagged one.
+type updateResponse struct {
+	conn   *conn
+	update backend.Update
+	done   chan struct{}
+}
+
+func (r *updateResponse) WriteTo(w *imap.Writer) error {
+	defer close(r.done)
+	res := r.conn.translate(r.update)
+	if res == nil {
+		return nil
+	}
+	return res.WriteTo(w)
+}
+
+// translate turns the update into the response for the connection, it returns nil when there is nothing to report.
+// The messages of a modseq.SessionMailbox are numbered for the session, otherwise only expunges are reported differently
+// when QRESYNC is enabled.
+func (c *conn) translate(update backend.Update) imap.WriterTo {
+	c.mu.Lock()
+	mbox, session := c.mailbox.(modseq.SessionMailbox)
+	c.mu.Unlock()
+
+	switch update := update.(type) {
+	case *backend.StatusUpdate:
+		return update.StatusResp
+
+	case *backend.MailboxInfoUpdate:
+		ch := make(chan *imap.MailboxInfo, 1)
+		ch <- update.MailboxInfo
+		close(ch)
+		return &responses.List{Mailboxes: ch}
+
+	case *backend.MailboxUpdate:
+		status := update.MailboxStatus
+		if session {
+			status = exists(mbox, status)
+			if status == nil {
+				return nil
+			}
+		}
+		return &responses.Select{Mailbox: status}
+
+	case *backend.MessageUpdate:
+		message := update.Message
+		if session {
+			message = renumber(mbox, message)
+			if message == nil {
+				return nil
+			}
+		}
+		ch := make(chan *imap.Message, 1)
+		ch <- message
+		close(ch)
+		return &responses.Fetch{Messages: ch}
+
+	case *backend.ExpungeUpdate:
+		if session {
+			return c.expunged(mbox)
+		}
+		if c.qresyncEnabled() {
+			return c.vanished()
+		}
+		ch := make(chan uint32, 1)
+		ch <- update.SeqNum
+		close(ch)
+		return &responses.Expunge{SeqNums: ch}
+	}
+	return nil
+}
+
+// vanished reports an expunge with a VANISHED response with the messages that were expunged since the last one,
+// since a client that enabled QRESYNC keeps track of the messages by their uids (RFC 7162 section 3.2.10).
+// It returns nil when there is nothing to report.
+func (c *conn) vanished() imap.WriterTo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mailbox == nil {
+		return nil
+	}
+	uids, modSeq, err := c.mailbox.ExpungedSince(c.expungedSince)
+	if err != nil || len(uids) == 0 {
+		return nil
+	}
+	c.expungedSince = modSeq
+
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+	return &Vanished{UIDs: set}
+}
@@ -0,0 +1,103 @@
+// Package imapserver serves IMAP, like imap.Serve, but accepts the connections on its own listener,
+// so it can be put behind a load balancer.
+package imapserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/mistralmail/imap"
+	"github.com/mistralmail/mistralmail/imapserver/condstore"
+	"github.com/mistralmail/mistralmail/proxyprotocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server is an IMAP server.
+type Server struct {
+	Server  *server.Server
+	address string
+
+	// TrustedProxies are the load balancers that may send the address of the client with the PROXY protocol.
+	TrustedProxies []*net.IPNet
+	// ImplicitTLS makes the connections encrypted from the start with the TLS config of the server,
+	// like on the IMAPS port 993 (RFC 8314), instead of after STARTTLS.
+	ImplicitTLS bool
+}
+
+// New creates a new IMAP server.
+func New(config *imap.Config, b backend.Backend) *Server {
+	extension := condstore.NewExtension()
+	if updater, ok := b.(backend.BackendUpdater); ok {
+		b = &extendedBackend{Backend: b, updater: updater, extension: extension}
+	}
+
+	s := server.New(b)
+	s.Addr = config.IMAPAddress
+	// Plain text authentication is allowed over unencrypted connections
+	s.AllowInsecureAuth = true
+
+	// Log with logrus
+	logger := log.New()
+	if config.Debug {
+		s.Debug = logger.Writer()
+	}
+	s.ErrorLog = logger
+
+	s.TLSConfig = config.TLSConfig
+
+	s.Enable(extension)
+
+	return &Server{
+		Server:  s,
+		address: config.IMAPAddress,
+	}
+}
+
+// extendedBackend passes the updates of the backend through the CONDSTORE extension,
+// which translates them for every connection.
+type extendedBackend struct {
+	backend.Backend
+	updater   backend.BackendUpdater
+	extension *condstore.Extension
+}
+
+// Updates implements backend.BackendUpdater.
+func (b *extendedBackend) Updates() <-chan backend.Update {
+	return b.extension.Updates(b.updater.Updates())
+}
+
+// ListenAndServe listens on the address of the config and serves IMAP until the server is closed.
+func (s *Server) ListenAndServe() error {
+	if s.ImplicitTLS {
+		log.Printf("Starting IMAP server with implicit TLS at %s", s.address)
+	} else {
+		log.Printf("Starting IMAP server at %s", s.address)
+	}
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("couldn't listen: %w", err)
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves IMAP on the listener until the server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	ln = proxyprotocol.NewListener(ln, s.TrustedProxies)
+	if s.ImplicitTLS {
+		if s.Server.TLSConfig == nil {
+			ln.Close()
+			return errors.New("implicit TLS needs a TLS config")
+		}
+		ln = tls.NewListener(ln, s.Server.TLSConfig)
+	}
+	return s.Server.Serve(ln)
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	return s.Server.Close()
+}
@@ -0,0 +1,120 @@
+package imapserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/mistralmail/imap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loginBackend records the remote address of every login.
+type loginBackend struct {
+	addresses chan string
+}
+
+func (b *loginBackend) Login(connInfo *goimap.ConnInfo, username string, password string) (backend.User, error) {
+	b.addresses <- connInfo.RemoteAddr.String()
+	return nil, errors.New("bad username or password")
+}
+
+func TestServerBehindProxy(t *testing.T) {
+
+	b := &loginBackend{addresses: make(chan string, 1)}
+	s := New(&imap.Config{IMAPAddress: "127.0.0.1:0"}, b)
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	s.TrustedProxies = []*net.IPNet{trusted}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(ln)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 143\r\n"))
+	require.NoError(t, err)
+
+	c, err := client.New(conn)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Error(t, c.Login("alice@example.com", "password"))
+	assert.Equal(t, "203.0.113.7:56324", <-b.addresses)
+}
+
+// testCertificate creates a self-signed certificate for localhost.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestImplicitTLS(t *testing.T) {
+
+	b := &loginBackend{addresses: make(chan string, 1)}
+	s := New(&imap.Config{
+		IMAPAddress: "127.0.0.1:0",
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+	}, b)
+	s.ImplicitTLS = true
+	s.Server.AllowInsecureAuth = false
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := client.DialTLS(ln.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer c.Close()
+	assert.True(t, c.IsTLS())
+
+	// The login reaches the backend, the connection is encrypted
+	assert.Error(t, c.Login("alice@example.com", "password"))
+	assert.Contains(t, <-b.addresses, "127.0.0.1:")
+}
+
+func TestRefuseInsecureAuth(t *testing.T) {
+
+	b := &loginBackend{addresses: make(chan string, 1)}
+	s := New(&imap.Config{IMAPAddress: "127.0.0.1:0"}, b)
+	s.Server.AllowInsecureAuth = false
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := client.Dial(ln.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	ok, err := c.Support("LOGINDISABLED")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Error(t, c.Login("alice@example.com", "password"))
+	assert.Empty(t, b.addresses)
+}
@@ -0,0 +1,451 @@
+// Package lmtpserver implements an LMTP (RFC 2033) server, so MistralMail can be used as mailbox store
+// behind another MTA like Postfix or Exim.
+//
+// LMTP is SMTP without mail queue: after DATA the server replies once for every accepted recipient,
+// so the MTA knows exactly which recipients the message was delivered to.
+package lmtpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxMessageSize is the maximum size of a message in bytes.
+	MaxMessageSize = 64 * 1024 * 1024
+	// Timeout is how long the server waits for the next command or line of data.
+	Timeout = 5 * time.Minute
+	// maxLineLength is the maximum length of a command line.
+	maxLineLength = 4096
+)
+
+var (
+	errTooLarge    = errors.New("message is too large")
+	errLineTooLong = errors.New("line is too long")
+)
+
+// sessionCounter numbers the sessions, like the session ids of the SMTP server.
+var sessionCounter uint32
+
+// Handler delivers the messages received over LMTP.
+type Handler interface {
+	// CheckRecipient returns an error when mail can't be delivered to the address, it is called for every RCPT command.
+	CheckRecipient(address string) error
+	// Deliver delivers the message and returns the result for every recipient of the state, nil when it was delivered.
+	// Errors that implement SMTPError() are sent as reply, other errors are replied to with a local error.
+	Deliver(state *smtp.State) []error
+}
+
+// Server is an LMTP server.
+type Server struct {
+	hostname string
+	address  string
+	handler  Handler
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// New creates a new LMTP server that listens on a TCP address like 127.0.0.1:24,
+// or on a Unix socket with an address like unix:/run/mistralmail/lmtp.sock.
+func New(hostname string, address string, handler Handler) *Server {
+	return &Server{
+		hostname: hostname,
+		address:  address,
+		handler:  handler,
+	}
+}
+
+// ListenAndServe listens on the address and serves LMTP until the server is closed.
+func (s *Server) ListenAndServe() error {
+	log.Printf("Starting LMTP server at %s", s.address)
+
+	network, address := "tcp", s.address
+	if path, ok := strings.CutPrefix(s.address, "unix:"); ok {
+		network, address = "unix", path
+		// Remove the socket of an earlier run
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("couldn't remove old socket: %w", err)
+			}
+		}
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("couldn't listen: %w", err)
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves LMTP on the listener until the server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	defer s.wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.newSession(conn).serve()
+		}()
+	}
+}
+
+// Close stops accepting new connections, the sessions that are running are finished.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// session is a single LMTP connection.
+type session struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	state  *smtp.State
+	lhlo   bool
+}
+
+func (s *Server) newSession(conn net.Conn) *session {
+	state := &smtp.State{
+		SessionId: smtp.Id{Timestamp: time.Now().Unix(), Counter: atomic.AddUint32(&sessionCounter, 1)},
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		state.Ip = addr.IP
+	}
+	state.Reset()
+
+	return &session{
+		server: s,
+		conn:   conn,
+		r:      bufio.NewReaderSize(conn, maxLineLength),
+		w:      bufio.NewWriter(conn),
+		state:  state,
+	}
+}
+
+// reply sends a reply, the last line of the text gets the code followed by a space, the other lines by a dash.
+func (c *session) reply(code int, lines ...string) {
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(c.w, "%d%s%s\r\n", code, separator, line)
+	}
+}
+
+// replyError sends the reply for an error of the handler.
+func (c *session) replyError(err error) {
+	var smtpError interface{ SMTPError() smtp.SMTPError }
+	if errors.As(err, &smtpError) {
+		reply := smtpError.SMTPError()
+		c.reply(int(reply.Status), reply.Message)
+		return
+	}
+	var reply smtp.SMTPError
+	if errors.As(err, &reply) {
+		c.reply(int(reply.Status), reply.Message)
+		return
+	}
+	c.reply(451, "4.3.0 Requested action aborted: local error in processing")
+}
+
+// readLine reads a command line without the line ending.
+func (c *session) readLine() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(Timeout))
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// Skip the rest of the line
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = c.r.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errLineTooLong
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readData reads the message after DATA until the line with a single dot, and removes the dot stuffing.
+func (c *session) readData() ([]byte, error) {
+	data := []byte{}
+	tooLarge := false
+	startOfLine := true
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(Timeout))
+		line, err := c.r.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if startOfLine {
+			if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
+				break
+			}
+			line = bytes.TrimPrefix(line, []byte("."))
+		}
+		startOfLine = err == nil
+
+		if len(data)+len(line) > MaxMessageSize {
+			tooLarge = true
+		}
+		if !tooLarge {
+			data = append(data, line...)
+		}
+	}
+	if tooLarge {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+// serve handles the commands of the session until the client quits.
+func (c *session) serve() {
+	defer c.conn.Close()
+
+	c.reply(220, c.server.hostname+" LMTP ready")
+	c.w.Flush()
+
+	for {
+		line, err := c.readLine()
+		if errors.Is(err, errLineTooLong) {
+			c.reply(500, "5.5.2 Line too long")
+			c.w.Flush()
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		verb, args, _ := strings.Cut(line, " ")
+		quit := c.handle(strings.ToUpper(verb), strings.TrimSpace(args))
+
+		// With pipelining the replies are sent when the client waits for them
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle handles a single command, it returns true when the session ends.
+func (c *session) handle(verb string, args string) bool {
+	switch verb {
+	case "LHLO":
+		if args == "" {
+			c.reply(501, "5.5.4 Syntax: LHLO hostname")
+			return false
+		}
+		c.state.Hostname = args
+		c.state.Reset()
+		c.lhlo = true
+		c.reply(250, c.server.hostname, "PIPELINING", "ENHANCEDSTATUSCODES", "8BITMIME", fmt.Sprintf("SIZE %d", MaxMessageSize))
+
+	case "HELO", "EHLO":
+		c.reply(500, "5.5.1 This is an LMTP server, use LHLO")
+
+	case "MAIL":
+		c.mail(args)
+
+	case "RCPT":
+		c.rcpt(args)
+
+	case "DATA":
+		c.data()
+
+	case "RSET":
+		c.state.Reset()
+		c.reply(250, "2.0.0 OK")
+
+	case "NOOP":
+		c.reply(250, "2.0.0 OK")
+
+	case "VRFY":
+		c.reply(252, "2.5.0 Cannot VRFY user")
+
+	case "QUIT":
+		c.reply(221, "2.0.0 Bye")
+		return true
+
+	default:
+		c.reply(500, "5.5.2 Command not recognized")
+	}
+	return false
+}
+
+// parsePath parses the address of a MAIL or RCPT command, e.g. FROM:<alice@example.com> BODY=8BITMIME,
+// and returns the address and the parameters.
+func parsePath(args string, prefix string) (string, []string, bool) {
+	if len(args) < len(prefix) || !strings.EqualFold(args[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	args = strings.TrimSpace(args[len(prefix):])
+	if !strings.HasPrefix(args, "<") {
+		return "", nil, false
+	}
+	end := strings.Index(args, ">")
+	if end < 0 {
+		return "", nil, false
+	}
+	return args[1:end], strings.Fields(args[end+1:]), true
+}
+
+func (c *session) mail(args string) {
+	if !c.lhlo {
+		c.reply(503, "5.5.1 Send LHLO first")
+		return
+	}
+	if c.state.From != nil {
+		c.reply(503, "5.5.1 Sender already specified")
+		return
+	}
+
+	address, parameters, ok := parsePath(args, "FROM:")
+	if !ok {
+		c.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, parameter := range parameters {
+		key, value, _ := strings.Cut(parameter, "=")
+		switch strings.ToUpper(key) {
+		case "BODY":
+			c.state.EightBitMIME = strings.EqualFold(value, "8BITMIME")
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if err == nil && size > MaxMessageSize {
+				c.reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+				return
+			}
+		}
+	}
+
+	c.state.From = &smtp.MailAddress{Address: address}
+	c.reply(250, "2.1.0 OK")
+}
+
+func (c *session) rcpt(args string) {
+	if c.state.From == nil {
+		c.reply(503, "5.5.1 Need MAIL command first")
+		return
+	}
+
+	address, _, ok := parsePath(args, "TO:")
+	if !ok || address == "" {
+		c.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	err := c.server.handler.CheckRecipient(address)
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+
+	c.state.To = append(c.state.To, &smtp.MailAddress{Address: address})
+	c.reply(250, "2.1.5 OK")
+}
+
+func (c *session) data() {
+	if len(c.state.To) == 0 {
+		c.reply(503, "5.5.1 No valid recipients")
+		return
+	}
+
+	c.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+
+	data, err := c.readData()
+	if errors.Is(err, errTooLarge) {
+		for range c.state.To {
+			c.reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+		}
+		c.state.Reset()
+		return
+	}
+	if err != nil {
+		return
+	}
+	c.state.Data = append(c.receivedHeader(), data...)
+
+	// One reply for every recipient, in the order of the RCPT commands.
+	// The handler gets a copy, so the transaction can be reset without changing the state it received.
+	state := *c.state
+	errs := c.server.handler.Deliver(&state)
+	for i := range c.state.To {
+		var err error
+		if i < len(errs) {
+			err = errs[i]
+		}
+		if err != nil {
+			c.replyError(err)
+			continue
+		}
+		c.reply(250, "2.0.0 OK")
+	}
+
+	c.state.Reset()
+}
+
+// receivedHeader creates the Received trace header of the delivery.
+func (c *session) receivedHeader() []byte {
+	from := c.state.Hostname
+	if c.state.Ip != nil {
+		from += fmt.Sprintf(" ([%s])", c.state.Ip)
+	}
+	header := fmt.Sprintf("Received: from %s\r\n\tby %s with LMTP id %s", from, c.server.hostname, c.state.SessionId.String())
+	if len(c.state.To) == 1 {
+		header += fmt.Sprintf("\r\n\tfor <%s>", c.state.To[0].Address)
+	}
+	header += fmt.Sprintf("; %s\r\n", time.Now().Format(time.RFC1123Z))
+	return []byte(header)
+}
@@ -0,0 +1,174 @@
+package lmtpserver
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHandler knows alice, bob and carol, and can't deliver to carol.
+type testHandler struct {
+	states chan *smtp.State
+}
+
+func (h *testHandler) CheckRecipient(address string) error {
+	switch address {
+	case "alice@example.com", "bob@example.com", "carol@example.com":
+		return nil
+	case "broken@example.com":
+		return errors.New("database down")
+	}
+	return smtp.SMTPError{Status: 550, Message: "5.1.1 Requested action not taken: mailbox unavailable"}
+}
+
+func (h *testHandler) Deliver(state *smtp.State) []error {
+	h.states <- state
+	errs := make([]error, len(state.To))
+	for i, to := range state.To {
+		if to.Address == "carol@example.com" {
+			errs[i] = smtp.SMTPError{Status: 452, Message: "4.2.2 Mailbox full"}
+		}
+	}
+	return errs
+}
+
+// dial connects to the server and reads the greeting.
+func dial(t *testing.T, network string, address string) *textproto.Conn {
+	conn, err := textproto.Dial(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, _, err = conn.ReadResponse(220)
+	require.NoError(t, err)
+	return conn
+}
+
+// cmd sends a command and checks the code of the reply.
+func cmd(t *testing.T, conn *textproto.Conn, expectedCode int, format string, args ...interface{}) string {
+	require.NoError(t, conn.PrintfLine(format, args...))
+	code, message, err := conn.ReadResponse(expectedCode)
+	require.NoError(t, err, "reply %d %s", code, message)
+	return message
+}
+
+func TestServer(t *testing.T) {
+
+	handler := &testHandler{states: make(chan *smtp.State, 1)}
+	s := New("mail.example.com", "", handler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+
+	t.Run("TestReplyPerRecipient", func(t *testing.T) {
+		conn := dial(t, "tcp", ln.Addr().String())
+
+		cmd(t, conn, 500, "EHLO client.example.net")
+		cmd(t, conn, 503, "MAIL FROM:<sender@example.net>")
+		message := cmd(t, conn, 250, "LHLO client.example.net")
+		assert.Contains(t, message, "PIPELINING")
+		assert.Contains(t, message, "ENHANCEDSTATUSCODES")
+
+		cmd(t, conn, 250, "MAIL FROM:<sender@example.net> BODY=8BITMIME")
+		cmd(t, conn, 250, "RCPT TO:<alice@example.com>")
+		cmd(t, conn, 550, "RCPT TO:<unknown@example.com>")
+		cmd(t, conn, 451, "RCPT TO:<broken@example.com>")
+		cmd(t, conn, 250, "RCPT TO:<carol@example.com>")
+		cmd(t, conn, 250, "RCPT TO:<bob@example.com>")
+		cmd(t, conn, 354, "DATA")
+
+		w := conn.DotWriter()
+		_, err := w.Write([]byte("Subject: Hello\n\n.Hello world!\n"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		// A reply for every accepted recipient
+		_, message, err = conn.ReadResponse(250)
+		require.NoError(t, err)
+		assert.Equal(t, "2.0.0 OK", message)
+		_, message, err = conn.ReadResponse(452)
+		require.NoError(t, err)
+		assert.Equal(t, "4.2.2 Mailbox full", message)
+		_, _, err = conn.ReadResponse(250)
+		require.NoError(t, err)
+
+		state := <-handler.states
+		assert.Equal(t, "sender@example.net", state.From.Address)
+		require.Len(t, state.To, 3)
+		assert.Equal(t, "client.example.net", state.Hostname)
+		assert.True(t, state.EightBitMIME)
+		assert.Equal(t, "127.0.0.1", state.Ip.String())
+		assert.True(t, strings.HasPrefix(string(state.Data), "Received: from client.example.net ([127.0.0.1])\r\n\tby mail.example.com with LMTP id "))
+		assert.True(t, strings.HasSuffix(string(state.Data), "\r\nSubject: Hello\r\n\r\n.Hello world!\r\n"))
+
+		// The transaction is reset after DATA
+		cmd(t, conn, 503, "RCPT TO:<alice@example.com>")
+		cmd(t, conn, 221, "QUIT")
+	})
+
+	t.Run("TestPipelining", func(t *testing.T) {
+		conn := dial(t, "tcp", ln.Addr().String())
+
+		cmd(t, conn, 250, "LHLO client.example.net")
+		require.NoError(t, conn.PrintfLine("MAIL FROM:<>\r\nRCPT TO:<alice@example.com>\r\nRCPT TO:<unknown@example.com>\r\nDATA"))
+		for _, code := range []int{250, 250, 550, 354} {
+			_, _, err := conn.ReadResponse(code)
+			require.NoError(t, err)
+		}
+		require.NoError(t, conn.PrintfLine("Subject: Hello\r\n\r\nHello world!\r\n."))
+		_, _, err := conn.ReadResponse(250)
+		require.NoError(t, err)
+
+		state := <-handler.states
+		assert.Equal(t, "", state.From.Address)
+		require.Len(t, state.To, 1)
+		assert.Contains(t, string(state.Data), "\tfor <alice@example.com>;")
+	})
+
+	require.NoError(t, s.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestUnixSocket(t *testing.T) {
+
+	handler := &testHandler{states: make(chan *smtp.State, 1)}
+	path := filepath.Join(t.TempDir(), "lmtp.sock")
+	s := New("mail.example.com", "unix:"+path, handler)
+
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe() }()
+
+	var conn *textproto.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		conn, err = textproto.Dial("unix", path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	defer conn.Close()
+	_, _, err := conn.ReadResponse(220)
+	require.NoError(t, err)
+
+	cmd(t, conn, 250, "LHLO client.example.net")
+	cmd(t, conn, 250, "MAIL FROM:<sender@example.net>")
+	cmd(t, conn, 250, "RCPT TO:<alice@example.com>")
+	cmd(t, conn, 354, "DATA")
+	require.NoError(t, conn.PrintfLine("Subject: Hello\r\n\r\nHello world!\r\n."))
+	_, _, err = conn.ReadResponse(250)
+	require.NoError(t, err)
+
+	state := <-handler.states
+	assert.Nil(t, state.Ip)
+	assert.True(t, strings.HasPrefix(string(state.Data), "Received: from client.example.net\r\n"))
+	cmd(t, conn, 221, "QUIT")
+
+	require.NoError(t, s.Close())
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,175 @@
+package mistralmail
+
+import (
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/mistralmail/handlers"
+	authenticationresults "github.com/mistralmail/mistralmail/handlers/authentication_results"
+	"github.com/mistralmail/mistralmail/handlers/forward"
+	imaphandler "github.com/mistralmail/mistralmail/handlers/imap"
+	messageid "github.com/mistralmail/mistralmail/handlers/message-id"
+	"github.com/mistralmail/mistralmail/handlers/milter"
+	"github.com/mistralmail/mistralmail/handlers/pipe"
+	"github.com/mistralmail/mistralmail/handlers/received"
+	"github.com/mistralmail/mistralmail/handlers/relay"
+	"github.com/mistralmail/mistralmail/handlers/route"
+	"github.com/mistralmail/mistralmail/handlers/script"
+	"github.com/mistralmail/mistralmail/handlers/spamcheck"
+)
+
+// Pipelines contains the ordered handler pipeline of every SMTP listener.
+type Pipelines struct {
+	MTA handlers.Pipeline `json:"mta"`
+	MSA handlers.Pipeline `json:"msa"`
+}
+
+// defaultMTAPipeline returns the MTA pipeline that is used when none is configured.
+func defaultMTAPipeline(enableSpamCheck bool) handlers.Pipeline {
+	pipeline := handlers.Pipeline{
+		{Handler: "authentication-results"},
+		{Handler: "received"},
+	}
+	if enableSpamCheck {
+		pipeline = append(pipeline, handlers.PipelineEntry{Handler: "spamcheck"})
+	}
+	pipeline = append(pipeline,
+		handlers.PipelineEntry{Handler: "forward"},
+		handlers.PipelineEntry{Handler: "route"},
+		handlers.PipelineEntry{Handler: "imap"},
+	)
+	return pipeline
+}
+
+// defaultMSAPipeline returns the MSA pipeline that is used when none is configured.
+func defaultMSAPipeline() handlers.Pipeline {
+	return handlers.Pipeline{
+		{Handler: "received"},
+		{Handler: "message-id"},
+		{Handler: "relay"},
+	}
+}
+
+// Register the built-in handlers.
+func init() {
+
+	handlers.Register(handlers.Registration{
+		Name: "authentication-results",
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return authenticationresults.New(env.Config), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "received",
+		Options: []handlers.OptionSpec{
+			{Name: "includeAuthenticatedUser", Type: handlers.OptionBool, Default: true, Description: "add the username of authenticated clients to the header"},
+			{Name: "stripInternal", Type: handlers.OptionBool, Default: false, Description: "remove the Received headers that are already in the message, e.g. on the MSA"},
+		},
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return received.New(env.Config, options.Bool("includeAuthenticatedUser"), options.Bool("stripInternal")), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "message-id",
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return messageid.New(env.Config), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "spamcheck",
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return spamcheck.New(env.Config), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "forward",
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return forward.New(env.Config, env.SRS, env.Backend, env.Backend.DeliveryRepo, env.Relay), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "route",
+		Options: []handlers.OptionSpec{
+			{Name: "timeout", Type: handlers.OptionDuration, Default: route.DefaultTimeout, Description: "HTTP timeout for posting a message to a route"},
+		},
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return route.New(env.Config, env.Backend.RouteRepo, env.Backend.DeliveryRepo, options.Duration("timeout")), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "imap",
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return imaphandler.New(env.Config, env.Backend.IMAPBackend, env.Backend.Webhooks), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "milter",
+		Options: []handlers.OptionSpec{
+			{Name: "milters", Type: handlers.OptionStrings, Required: true, Description: "milters in order, e.g. inet:localhost:8891 or unix:/run/opendkim/opendkim.sock"},
+			{Name: "timeout", Type: handlers.OptionDuration, Default: milter.DefaultTimeout, Description: "connect, read and write timeout"},
+			{Name: "defaultAction", Type: handlers.OptionString, Default: string(milter.DefaultActionTempFail), Description: "what to do when a milter is unavailable: tempfail, accept or reject"},
+		},
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return milter.New(env.Config, options.Strings("milters"), options.Duration("timeout"), milter.DefaultAction(options.String("defaultAction")))
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "pipe",
+		Options: []handlers.OptionSpec{
+			{Name: "command", Type: handlers.OptionString, Required: true, Description: "program the message is piped to"},
+			{Name: "args", Type: handlers.OptionStrings, Description: "arguments of the program"},
+			{Name: "timeout", Type: handlers.OptionDuration, Default: pipe.DefaultTimeout, Description: "how long the program is allowed to run"},
+			{Name: "replaceMessage", Type: handlers.OptionBool, Default: false, Description: "replace the message with the output of the program"},
+		},
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			return pipe.New(env.Config, options.String("command"), options.Strings("args"), options.Duration("timeout"), options.Bool("replaceMessage"))
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "script",
+		Options: []handlers.OptionSpec{
+			{Name: "path", Type: handlers.OptionString, Required: true, Description: "Starlark script that defines smtp(mail), reloaded when the file changes"},
+			{Name: "maxSteps", Type: handlers.OptionInt, Default: int(scripting.DefaultMaxSteps), Description: "max number of computation steps of a single run"},
+			{Name: "timeout", Type: handlers.OptionDuration, Default: scripting.DefaultTimeout, Description: "how long a single run is allowed to take"},
+		},
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			s, err := scripting.New(options.String("path"), uint64(options.Int("maxSteps")), options.Duration("timeout"))
+			if err != nil {
+				return nil, err
+			}
+			return script.New(env.Config, s), nil
+		},
+	})
+
+	handlers.Register(handlers.Registration{
+		Name: "relay",
+		Options: []handlers.OptionSpec{
+			{Name: "hostname", Type: handlers.OptionString, Description: "hostname of the relay, the external relay is used when empty"},
+			{Name: "port", Type: handlers.OptionInt, Default: 587, Description: "port of the relay"},
+			{Name: "username", Type: handlers.OptionString, Description: "username for authenticating with the relay"},
+			{Name: "password", Type: handlers.OptionString, Description: "password for authenticating with the relay"},
+			{Name: "insecureSkipVerify", Type: handlers.OptionBool, Default: false, Description: "skip verifying the TLS certificate of the relay"},
+		},
+		New: func(env *handlers.Environment, options handlers.Options) (handlers.Handler, error) {
+			if options.String("hostname") == "" {
+				return env.Relay, nil
+			}
+			return relay.New(
+				options.String("hostname"),
+				options.Int("port"),
+				options.String("username"),
+				options.String("password"),
+				options.Bool("insecureSkipVerify"),
+				env.Backend.Webhooks,
+			), nil
+		},
+	})
+
+}
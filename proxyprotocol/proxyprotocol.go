@@ -0,0 +1,82 @@
+// Package proxyprotocol accepts connections through load balancers like HAProxy that speak the PROXY protocol,
+// so the address of the client is known instead of the address of the load balancer.
+package proxyprotocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// ReadHeaderTimeout is how long a trusted proxy may take to send the PROXY header.
+const ReadHeaderTimeout = 10 * time.Second
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or IP addresses of trusted proxies.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	trusted := []*net.IPNet{}
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range: %w", err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return trusted, nil
+}
+
+// NewListener returns a listener whose connections from the trusted proxies can start with a PROXY header (v1 or v2).
+// The remote address of those connections is the address of the client in the header.
+// Other connections are used as they are, so their PROXY headers aren't trusted.
+// Without trusted proxies the listener is returned as it is.
+func NewListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	if len(trusted) == 0 {
+		return ln
+	}
+
+	return &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if isTrusted(upstream, trusted) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.SKIP, nil
+		},
+		ReadHeaderTimeout: ReadHeaderTimeout,
+	}
+}
+
+// isTrusted returns whether the address is in one of the trusted ranges.
+func isTrusted(addr net.Addr, trusted []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::/32,")
+	require.NoError(t, err)
+	require.Len(t, trusted, 3)
+	assert.Equal(t, "10.0.0.0/8", trusted[0].String())
+	assert.Equal(t, "192.0.2.1/32", trusted[1].String())
+	assert.Equal(t, "2001:db8::/32", trusted[2].String())
+
+	trusted, err = ParseTrustedProxies("")
+	require.NoError(t, err)
+	assert.Empty(t, trusted)
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies("proxy.example.com")
+	assert.Error(t, err)
+}
+
+// accept accepts one connection and returns its remote address and first line.
+func accept(t *testing.T, ln net.Listener) (string, string) {
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return conn.RemoteAddr().String(), line
+}
+
+func TestListener(t *testing.T) {
+
+	listen := func(trusted string) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		cidrs, err := ParseTrustedProxies(trusted)
+		require.NoError(t, err)
+		return NewListener(ln, cidrs)
+	}
+
+	send := func(ln net.Listener, data string) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	t.Run("TestV1", func(t *testing.T) {
+		ln := listen("127.0.0.0/8")
+		send(ln, "PROXY TCP4 203.0.113.7 192.0.2.1 56324 25\r\nEHLO client.example.net\r\n")
+
+		addr, line := accept(t, ln)
+		assert.Equal(t, "203.0.113.7:56324", addr)
+		assert.Equal(t, "EHLO client.example.net\r\n", line)
+	})
+
+	t.Run("TestV2", func(t *testing.T) {
+		ln := listen("127.0.0.1")
+		header := proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 143})
+		data, err := header.Format()
+		require.NoError(t, err)
+		send(ln, string(data)+"a LOGIN\r\n")
+
+		addr, line := accept(t, ln)
+		assert.Equal(t, "[2001:db8::7]:56324", addr)
+		assert.Equal(t, "a LOGIN\r\n", line)
+	})
+
+	t.Run("TestWithoutHeader", func(t *testing.T) {
+		ln := listen("127.0.0.0/8")
+		send(ln, "EHLO client.example.net\r\n")
+
+		addr, line := accept(t, ln)
+		assert.Contains(t, addr, "127.0.0.1:")
+		assert.Equal(t, "EHLO client.example.net\r\n", line)
+	})
+
+	t.Run("TestUntrusted", func(t *testing.T) {
+		// The header of a client that isn't a trusted proxy is passed on as it is
+		ln := listen("10.0.0.0/8")
+		send(ln, "PROXY TCP4 203.0.113.7 192.0.2.1 56324 25\r\n")
+
+		addr, line := accept(t, ln)
+		assert.Contains(t, addr, "127.0.0.1:")
+		assert.Equal(t, "PROXY TCP4 203.0.113.7 192.0.2.1 56324 25\r\n", line)
+	})
+
+}
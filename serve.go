@@ -8,18 +8,18 @@ import (
 	"syscall"
 
 	"github.com/evalphobia/logrus_sentry"
-	"github.com/mistralmail/imap"
 	"github.com/mistralmail/mistralmail/api"
 	"github.com/mistralmail/mistralmail/backend"
 	"github.com/mistralmail/mistralmail/backend/services/certificates"
+	"github.com/mistralmail/mistralmail/backend/services/scripting"
+	"github.com/mistralmail/mistralmail/backend/services/srs"
+	"github.com/mistralmail/mistralmail/backend/services/webhooks"
 	"github.com/mistralmail/mistralmail/handlers"
-	authenticationresults "github.com/mistralmail/mistralmail/handlers/authentication_results"
 	imaphandler "github.com/mistralmail/mistralmail/handlers/imap"
-	messageid "github.com/mistralmail/mistralmail/handlers/message-id"
-	"github.com/mistralmail/mistralmail/handlers/received"
 	"github.com/mistralmail/mistralmail/handlers/relay"
-	"github.com/mistralmail/mistralmail/handlers/spamcheck"
-	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/mistralmail/imapserver"
+	"github.com/mistralmail/mistralmail/lmtpserver"
+	"github.com/mistralmail/mistralmail/smtpserver"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
@@ -61,8 +61,69 @@ func Serve(config *Config) {
 		}
 	}()
 
+	// Stores for the message content
+	err = backend.SetBlobStores(config.BlobStore, config.OldBlobStores)
+	if err != nil {
+		log.Fatalf("Couldn't set blob stores: %v", err)
+	}
+	err = backend.MessageRepo.CollectBlobs()
+	if err != nil {
+		log.Warnf("Couldn't delete unreferenced blobs: %v", err)
+	}
+	err = backend.MessageRepo.SetCompressionLevel(config.CompressionLevel)
+	if err != nil {
+		log.Fatalf("Couldn't set compression level: %v", err)
+	}
+	if !backend.MessageRepo.HasTextIndex() {
+		log.Warnf("The database doesn't have a full-text index, searching for text reads every message (SQLite needs to be built with -tags sqlite_fts5)")
+	}
+
+	// Compress the content that was stored before compression was enabled
+	go func() {
+		compressed, err := backend.MessageRepo.CompressBlobs()
+		if err != nil {
+			log.Warnf("Couldn't compress stored messages: %v", err)
+		}
+		if compressed > 0 {
+			log.Printf("Compressed %d stored messages", compressed)
+		}
+	}()
+
+	// Extract the metadata of the messages that were stored before it was extracted on insert
+	go func() {
+		updated, err := backend.MessageRepo.BackfillMetadata()
+		if err != nil {
+			log.Warnf("Couldn't extract the metadata of stored messages: %v", err)
+		}
+		if updated > 0 {
+			log.Printf("Extracted the metadata of %d stored messages", updated)
+		}
+	}()
+
+	// Outgoing relay, used by the MSA, forwarding and the mail sent by the backend itself
+	outgoingRelay := relay.New(config.ExternalRelayHostname, config.ExternalRelayPort, config.ExternalRelayUsername, config.ExternalRelayPassword, config.ExternalRelayInsecureSkipVerify, backend.Webhooks)
+	backend.MailSender = outgoingRelay
+
+	// Sender Rewriting Scheme for forwarded mail
+	srsRewriter, err := srs.New(config.Secret, config.SRSDomain, srs.DefaultMaxAge)
+	if err != nil {
+		log.Fatalf("Couldn't create SRS rewriter: %v", err)
+	}
+
+	// Script that decides in which mailbox incoming mail is delivered
+	if config.DeliveryScriptFile != "" {
+		deliveryScript, err := scripting.New(config.DeliveryScriptFile, scripting.DefaultMaxSteps, scripting.DefaultTimeout)
+		if err != nil {
+			log.Fatalf("Couldn't load delivery script: %v", err)
+		}
+		backend.IMAPBackend.SetDeliveryScript(deliveryScript)
+	}
+
+	// Deliver queued webhook events
+	backend.Webhooks.Start(webhooks.DefaultPollInterval)
+
 	// Run admin api
-	api, err := api.New(api.Config{HTTPAddress: config.HTTPAddress, Secret: []byte(config.Secret)}, backend)
+	api, err := api.New(api.Config{HTTPAddress: config.HTTPAddress, Secret: []byte(config.Secret), PublicURL: config.PublicURL, TrustedProxies: config.TrustedProxies}, backend)
 	if err != nil {
 		log.Fatalf("Couldn't create API: %v", err)
 	}
@@ -112,19 +173,42 @@ func Serve(config *Config) {
 			msaConfig.TLSConfig = msaTlsConfig
 		}
 
-		msaHandlerChain := &handlers.HandlerMachanism{}
-		msaHandlerChain.AddHandler(
-			received.New(msaConfig),
-			messageid.New(msaConfig),
-			relay.New(config.ExternalRelayHostname, config.ExternalRelayPort, config.ExternalRelayUsername, config.ExternalRelayPassword, config.ExternalRelayInsecureSkipVerify),
-		)
+		msaHandlerChain, err := config.Pipelines.MSA.Build(&handlers.Environment{
+			Listener: "msa",
+			Config:   msaConfig,
+			Backend:  backend,
+			Relay:    outgoingRelay,
+			SRS:      srsRewriter,
+		})
+		if err != nil {
+			log.Fatalf("Couldn't build MSA pipeline: %v", err)
+		}
 
-		msa := server.NewDefault(*msaConfig, msaHandlerChain)
+		msa := smtpserver.New(*msaConfig, msaHandlerChain)
 		msa.Server.AuthBackend = backend.SMTPBackend
+		msa.TrustedProxies = config.TrustedProxies
+
+		// Submission with implicit TLS, e.g. on port 465
+		var submission *smtpserver.Server
+		if config.SMTPAddressOutgoingTLS != "" {
+			submission = smtpserver.New(*config.GenerateMSAImplicitTLSConfig(msaConfig), msaHandlerChain)
+			submission.Server.AuthBackend = backend.SMTPBackend
+			submission.TrustedProxies = config.TrustedProxies
+			submission.ImplicitTLS = true
+			go func() {
+				err := submission.ListenAndServe()
+				if err != nil {
+					log.Errorln(err)
+				}
+			}()
+		}
 
 		go func() {
 			<-sigc
 			msa.Stop()
+			if submission != nil {
+				submission.Stop()
+			}
 		}()
 		err = msa.ListenAndServe()
 		if err != nil {
@@ -139,7 +223,29 @@ func Serve(config *Config) {
 			imapConfig.TLSConfig = imapTlsConfig
 		}
 
-		imap.Serve(imapConfig, backend.IMAPBackend)
+		// IMAPS with implicit TLS, e.g. on port 993
+		if config.IMAPAddressTLS != "" {
+			imapsConfig := *imapConfig
+			imapsConfig.IMAPAddress = config.IMAPAddressTLS
+			imapsServer := imapserver.New(&imapsConfig, backend.IMAPBackend)
+			imapsServer.TrustedProxies = config.TrustedProxies
+			imapsServer.ImplicitTLS = true
+			go func() {
+				err := imapsServer.ListenAndServe()
+				if err != nil {
+					log.Fatalf("Couldn't serve IMAP with implicit TLS: %v", err)
+				}
+			}()
+		}
+
+		imapServer := imapserver.New(imapConfig, backend.IMAPBackend)
+		imapServer.TrustedProxies = config.TrustedProxies
+		// Plain text authentication is only allowed after STARTTLS
+		imapServer.Server.AllowInsecureAuth = !config.TLSRequiredForAuth
+		err := imapServer.ListenAndServe()
+		if err != nil {
+			log.Fatalf("Couldn't serve IMAP: %v", err)
+		}
 	}()
 
 	// Run SMTP MTA
@@ -148,15 +254,30 @@ func Serve(config *Config) {
 		mtaConfig.TLSConfig = mtaTlsConfig
 	}
 
-	mtaHandlerChain := &handlers.HandlerMachanism{}
-	mtaHandlerChain.AddHandler(authenticationresults.New(mtaConfig))
-	mtaHandlerChain.AddHandler(received.New(mtaConfig))
-	if config.EnableSpamCheck {
-		mtaHandlerChain.AddHandler(spamcheck.New(mtaConfig))
+	mtaHandlerChain, err := config.Pipelines.MTA.Build(&handlers.Environment{
+		Listener: "mta",
+		Config:   mtaConfig,
+		Backend:  backend,
+		Relay:    outgoingRelay,
+		SRS:      srsRewriter,
+	})
+	if err != nil {
+		log.Fatalf("Couldn't build MTA pipeline: %v", err)
+	}
+
+	// Run LMTP for delivery by another MTA
+	if config.LMTPAddress != "" {
+		go func() {
+			lmtp := lmtpserver.New(config.Hostname, config.LMTPAddress, imaphandler.New(mtaConfig, backend.IMAPBackend, backend.Webhooks))
+			err := lmtp.ListenAndServe()
+			if err != nil {
+				log.Fatalf("Couldn't serve LMTP: %v", err)
+			}
+		}()
 	}
-	mtaHandlerChain.AddHandler(imaphandler.New(mtaConfig, backend.IMAPBackend))
 
-	mta := server.NewDefault(*mtaConfig, mtaHandlerChain)
+	mta := smtpserver.New(*mtaConfig, mtaHandlerChain)
+	mta.TrustedProxies = config.TrustedProxies
 	go func() {
 		<-sigc
 		mta.Stop()
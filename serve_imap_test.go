@@ -3,6 +3,7 @@ package mistralmail
 import (
 	"fmt"
 	"io"
+	"net/textproto"
 	"os"
 	"strings"
 	"testing"
@@ -10,8 +11,8 @@ import (
 
 	goimap "github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/mistralmail/imap"
 	"github.com/mistralmail/mistralmail/backend"
+	"github.com/mistralmail/mistralmail/imapserver"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -65,7 +66,7 @@ func TestIMAPServer(t *testing.T) {
 	// Run IMAP server
 	go func() {
 		imapConfig := config.GenerateIMAPBackendConfig()
-		imap.Serve(imapConfig, backend.IMAPBackend)
+		err := imapserver.New(imapConfig, backend.IMAPBackend).ListenAndServe()
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -409,6 +410,289 @@ func TestIMAPServer(t *testing.T) {
 
 			})
 
+			Convey("IDLE", func() {
+
+				Convey("When a message is appended while another session is idling", func() {
+
+					mailbox := "IdleMailbox"
+					err := imapClient.Create(mailbox)
+					So(err, ShouldBeNil)
+
+					// A second session waits for changes in the mailbox
+					idleClient, err := client.Dial(address)
+					So(err, ShouldBeNil)
+					defer idleClient.Logout()
+					err = idleClient.Login(testUser.Email, testUser.Password)
+					So(err, ShouldBeNil)
+					_, err = idleClient.Select(mailbox, false)
+					So(err, ShouldBeNil)
+
+					updates := make(chan client.Update, 10)
+					idleClient.Updates = updates
+					stop := make(chan struct{})
+					idleDone := make(chan error, 1)
+					go func() {
+						idleDone <- idleClient.Idle(stop, nil)
+					}()
+
+					err = imapClient.Append(mailbox, nil, date, convertToLiteral(message))
+					So(err, ShouldBeNil)
+
+					var messages uint32
+					timeout := time.After(5 * time.Second)
+					for messages == 0 {
+						select {
+						case update := <-updates:
+							if update, ok := update.(*client.MailboxUpdate); ok {
+								messages = update.Mailbox.Messages
+							}
+						case <-timeout:
+							t.Fatal("no mailbox update received")
+						}
+					}
+
+					close(stop)
+					So(<-idleDone, ShouldBeNil)
+
+					Convey("The idling session should be notified of the new message", func() {
+						So(messages, ShouldEqual, 1)
+					})
+				})
+
+			})
+
+			Convey("CONDSTORE and QRESYNC", func() {
+
+				Convey("When a session synchronizes a mailbox with mod-sequences", func() {
+
+					mailbox := "SyncMailbox"
+					err := imapClient.Create(mailbox)
+					So(err, ShouldBeNil)
+					for i := 0; i < 3; i++ {
+						err = imapClient.Append(mailbox, nil, date, convertToLiteral(message))
+						So(err, ShouldBeNil)
+					}
+
+					conn, err := textproto.Dial("tcp", address)
+					So(err, ShouldBeNil)
+					defer conn.Close()
+					_, err = conn.ReadLine()
+					So(err, ShouldBeNil)
+
+					// command sends a command and returns the untagged responses and the tagged response
+					tag := 0
+					command := func(format string, args ...interface{}) ([]string, string) {
+						tag++
+						err := conn.PrintfLine(fmt.Sprintf("t%d ", tag)+format, args...)
+						So(err, ShouldBeNil)
+						lines := []string{}
+						for {
+							line, err := conn.ReadLine()
+							So(err, ShouldBeNil)
+							if strings.HasPrefix(line, fmt.Sprintf("t%d ", tag)) {
+								return lines, line
+							}
+							lines = append(lines, line)
+						}
+					}
+
+					_, status := command("LOGIN %s %s", testUser.Email, testUser.Password)
+					So(status, ShouldContainSubstring, "OK")
+					lines, _ := command("ENABLE QRESYNC")
+					So(lines, ShouldContain, "* ENABLED QRESYNC")
+
+					lines, status = command("SELECT %s", mailbox)
+					So(status, ShouldContainSubstring, "OK [READ-WRITE]")
+					So(lines, ShouldContain, "* OK [HIGHESTMODSEQ 4] Highest")
+					var uidValidity uint32
+					for _, line := range lines {
+						fmt.Sscanf(line, "* OK [UIDVALIDITY %d]", &uidValidity)
+					}
+					So(uidValidity, ShouldNotEqual, 0)
+
+					// The first message didn't change since the first append, the second store comes too late
+					lines, status = command(`UID STORE 1 (UNCHANGEDSINCE 2) +FLAGS (\Seen)`)
+					So(status, ShouldEqual, fmt.Sprintf("t%d OK UID STORE completed", tag))
+					So(strings.Join(lines, "\n"), ShouldContainSubstring, "MODSEQ (5)")
+					_, status = command(`UID STORE 1 (UNCHANGEDSINCE 2) +FLAGS (\Flagged)`)
+					So(status, ShouldStartWith, fmt.Sprintf("t%d OK [MODIFIED 1]", tag))
+
+					lines, _ = command("UID FETCH 1:* (FLAGS) (CHANGEDSINCE 4)")
+					So(lines, ShouldHaveLength, 1)
+					So(lines[0], ShouldContainSubstring, "UID 1")
+					So(lines[0], ShouldContainSubstring, "MODSEQ (5)")
+
+					// Another session expunges the second message
+					_, err = imapClient.Select(mailbox, false)
+					So(err, ShouldBeNil)
+					uids := &goimap.SeqSet{}
+					uids.AddNum(2)
+					err = imapClient.UidStore(uids, goimap.FormatFlagsOp(goimap.AddFlags, true), []interface{}{goimap.DeletedFlag}, nil)
+					So(err, ShouldBeNil)
+					err = imapClient.Expunge(nil)
+					So(err, ShouldBeNil)
+
+					vanished := false
+					for i := 0; i < 10 && !vanished; i++ {
+						lines, _ = command("NOOP")
+						So(lines, ShouldNotContain, "* 2 EXPUNGE")
+						for _, line := range lines {
+							vanished = vanished || line == "* VANISHED 2"
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+
+					Convey("The session should be told which message vanished and only get the changes when it selects the mailbox again", func() {
+						So(vanished, ShouldBeTrue)
+
+						lines, status = command("SELECT %s (QRESYNC (%d 4 1:3))", mailbox, uidValidity)
+						So(status, ShouldContainSubstring, "OK [READ-WRITE]")
+						So(lines, ShouldContain, "* OK [HIGHESTMODSEQ 7] Highest")
+						So(lines, ShouldContain, "* VANISHED (EARLIER) 2")
+
+						fetched := []string{}
+						for _, line := range lines {
+							if strings.Contains(line, " FETCH ") {
+								fetched = append(fetched, line)
+							}
+						}
+						So(fetched, ShouldHaveLength, 1)
+						So(fetched[0], ShouldContainSubstring, "UID 1")
+
+						lines, _ = command("STATUS %s (HIGHESTMODSEQ)", mailbox)
+						So(lines, ShouldContain, fmt.Sprintf("* STATUS %q (HIGHESTMODSEQ 7)", mailbox))
+					})
+				})
+
+			})
+
+			Convey("Sequence numbers", func() {
+
+				Convey("When another session expunges messages while two sessions have the mailbox selected", func() {
+
+					mailbox := "ExpungeMailbox"
+					err := imapClient.Create(mailbox)
+					So(err, ShouldBeNil)
+					for i := 0; i < 5; i++ {
+						err = imapClient.Append(mailbox, nil, date, convertToLiteral(message))
+						So(err, ShouldBeNil)
+					}
+
+					// session logs in and selects the mailbox, it returns a function that sends a command
+					// and returns the untagged responses and the tagged response
+					session := func() func(format string, args ...interface{}) ([]string, string) {
+						conn, err := textproto.Dial("tcp", address)
+						So(err, ShouldBeNil)
+						Reset(func() { conn.Close() })
+						_, err = conn.ReadLine()
+						So(err, ShouldBeNil)
+
+						tag := 0
+						command := func(format string, args ...interface{}) ([]string, string) {
+							tag++
+							err := conn.PrintfLine(fmt.Sprintf("t%d ", tag)+format, args...)
+							So(err, ShouldBeNil)
+							lines := []string{}
+							for {
+								line, err := conn.ReadLine()
+								So(err, ShouldBeNil)
+								if strings.HasPrefix(line, fmt.Sprintf("t%d ", tag)) {
+									return lines, line
+								}
+								lines = append(lines, line)
+							}
+						}
+
+						_, status := command("LOGIN %s %s", testUser.Email, testUser.Password)
+						So(status, ShouldContainSubstring, "OK")
+						lines, _ := command("SELECT %s", mailbox)
+						So(lines, ShouldContain, "* 5 EXISTS")
+						return command
+					}
+					sessions := [](func(format string, args ...interface{}) ([]string, string)){session(), session()}
+
+					_, err = imapClient.Select(mailbox, false)
+					So(err, ShouldBeNil)
+					seqSet := &goimap.SeqSet{}
+					seqSet.AddNum(2, 4)
+					err = imapClient.Store(seqSet, goimap.FormatFlagsOp(goimap.AddFlags, true), []interface{}{goimap.DeletedFlag}, nil)
+					So(err, ShouldBeNil)
+					err = imapClient.Expunge(nil)
+					So(err, ShouldBeNil)
+
+					// Both sessions are told, although the server shares the response of an update between them
+					expunged := [][]string{}
+					for _, command := range sessions {
+						lines := []string{}
+						for i := 0; i < 10 && len(lines) < 2; i++ {
+							untagged, _ := command("NOOP")
+							for _, line := range untagged {
+								if strings.HasSuffix(line, "EXPUNGE") {
+									lines = append(lines, line)
+								}
+							}
+							time.Sleep(10 * time.Millisecond)
+						}
+						expunged = append(expunged, lines)
+					}
+
+					Convey("Every session should be told about the expunges from the last to the first and renumber the messages", func() {
+						for _, lines := range expunged {
+							So(lines, ShouldResemble, []string{"* 4 EXPUNGE", "* 2 EXPUNGE"})
+						}
+						for _, command := range sessions {
+							lines, status := command("FETCH 3 (UID)")
+							So(status, ShouldContainSubstring, "OK")
+							So(lines, ShouldResemble, []string{"* 3 FETCH (UID 5)"})
+						}
+					})
+				})
+
+				Convey("When a session expunges messages itself", func() {
+
+					mailbox := "SelfExpungeMailbox"
+					err := imapClient.Create(mailbox)
+					So(err, ShouldBeNil)
+					for i := 0; i < 3; i++ {
+						err = imapClient.Append(mailbox, nil, date, convertToLiteral(message))
+						So(err, ShouldBeNil)
+					}
+
+					conn, err := textproto.Dial("tcp", address)
+					So(err, ShouldBeNil)
+					defer conn.Close()
+					_, err = conn.ReadLine()
+					So(err, ShouldBeNil)
+
+					// command sends a command and returns the lines the server writes until the tagged response
+					tag := 0
+					command := func(format string, args ...interface{}) []string {
+						tag++
+						err := conn.PrintfLine(fmt.Sprintf("t%d ", tag)+format, args...)
+						So(err, ShouldBeNil)
+						lines := []string{}
+						for {
+							line, err := conn.ReadLine()
+							So(err, ShouldBeNil)
+							lines = append(lines, line)
+							if strings.HasPrefix(line, fmt.Sprintf("t%d ", tag)) {
+								return lines
+							}
+						}
+					}
+
+					command("LOGIN %s %s", testUser.Email, testUser.Password)
+					command("SELECT %s", mailbox)
+					command(`STORE 1,3 +FLAGS.SILENT (\Deleted)`)
+					lines := command("EXPUNGE")
+
+					Convey("The expunges should be written before the tagged response of the command", func() {
+						So(lines, ShouldResemble, []string{"* 3 EXPUNGE", "* 1 EXPUNGE", fmt.Sprintf("t%d OK EXPUNGE completed", tag)})
+					})
+				})
+
+			})
+
 			Convey("Sequence Sets", func() {
 
 				Convey("When working with sequence sets in a new mailbox", func() {
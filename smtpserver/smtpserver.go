@@ -0,0 +1,174 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mistralmail/mistralmail/proxyprotocol"
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandshakeTimeout is how long a client of an implicit TLS listener gets for the TLS handshake.
+const HandshakeTimeout = 30 * time.Second
+
+// sessions contains the TLS connection state of every encrypted session, by SMTP state.
+var sessions sync.Map
+
+// TLSConnectionState returns the TLS connection state of the session the SMTP state belongs to,
+// or nil when the session isn't encrypted.
+func TLSConnectionState(state *smtp.State) *tls.ConnectionState {
+	cs, ok := sessions.Load(state)
+	if !ok {
+		return nil
+	}
+	return cs.(*tls.ConnectionState)
+}
+
+// Server is an SMTP server that accepts the connections itself instead of server.DefaultMta,
+// so the details of the connection of every session are known to the handlers.
+type Server struct {
+	Server  *server.Server
+	address string
+
+	// TrustedProxies are the load balancers that may send the address of the client with the PROXY protocol.
+	TrustedProxies []*net.IPNet
+	// ImplicitTLS makes the connections encrypted from the start with the TLS config of the server,
+	// like on the submission port 465 (RFC 8314), instead of after STARTTLS.
+	ImplicitTLS bool
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// New creates a new SMTP server.
+func New(c server.Config, h server.Handler) *Server {
+	return &Server{
+		Server:  server.New(c, h),
+		address: net.JoinHostPort(c.Ip, fmt.Sprint(c.Port)),
+	}
+}
+
+// ListenAndServe listens on the address of the config and serves SMTP until the server is stopped.
+func (s *Server) ListenAndServe() error {
+	if s.ImplicitTLS {
+		log.Printf("Starting SMTP server with implicit TLS at %s", s.address)
+	} else {
+		log.Printf("Starting SMTP server at %s", s.address)
+	}
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("couldn't listen: %w", err)
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves SMTP on the listener until the server is stopped.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.ImplicitTLS && s.Server.TlsConfig == nil {
+		ln.Close()
+		return errors.New("implicit TLS needs a TLS config")
+	}
+	ln = proxyprotocol.NewListener(ln, s.TrustedProxies)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	defer s.wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				log.Printf("Listener is closed, waiting for connections to close...")
+				return nil
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve handles a single connection.
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+
+	var cs *tls.ConnectionState
+	if s.ImplicitTLS {
+		tlsConn := tls.Server(conn, s.Server.TlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(HandshakeTimeout))
+		err := tlsConn.Handshake()
+		if err != nil {
+			log.WithField("Ip", conn.RemoteAddr().String()).Debugf("TLS handshake failed: %v", err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		cs = &state
+		conn = tlsConn
+	}
+
+	proto := &protocol{MtaProtocol: smtp.NewMtaProtocol(conn)}
+	defer sessions.Delete(proto.GetState())
+	if cs != nil {
+		proto.GetState().Secure = true
+		sessions.Store(proto.GetState(), cs)
+	}
+
+	s.Server.HandleClient(proto)
+}
+
+// Stop stops accepting new connections and stops the existing ones after a grace period.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	s.Server.Stop()
+}
+
+// protocol records the TLS connection state after STARTTLS.
+type protocol struct {
+	*smtp.MtaProtocol
+}
+
+// StartTls implements the smtp.Protocol interface.
+func (p *protocol) StartTls(c *tls.Config) error {
+	state := p.GetState()
+
+	config := c.Clone()
+	verify := c.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		sessions.Store(state, &cs)
+		return nil
+	}
+
+	return p.MtaProtocol.StartTls(config)
+}
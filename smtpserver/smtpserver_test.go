@@ -0,0 +1,197 @@
+package smtpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	netsmtp "net/smtp"
+	"testing"
+	"time"
+
+	"github.com/mistralmail/smtp/server"
+	"github.com/mistralmail/smtp/smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate creates a self-signed certificate for localhost.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServer(t *testing.T) {
+
+	type result struct {
+		secure bool
+		tls    *tls.ConnectionState
+	}
+	results := make(chan result, 1)
+
+	handler := server.HandlerFunc(func(state *smtp.State) error {
+		results <- result{secure: state.Secure, tls: TLSConnectionState(state)}
+		return nil
+	})
+
+	s := New(server.Config{
+		Hostname:    "localhost",
+		DisableAuth: true,
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+	}, handler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+
+	send := func(startTLS bool) {
+		c, err := netsmtp.Dial(ln.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		require.NoError(t, c.Hello("client.example.net"))
+		if startTLS {
+			require.NoError(t, c.StartTLS(&tls.Config{ServerName: "localhost", InsecureSkipVerify: true}))
+		}
+		require.NoError(t, c.Mail("from@example.net"))
+		require.NoError(t, c.Rcpt("to@example.com"))
+		w, err := c.Data()
+		require.NoError(t, err)
+		_, err = w.Write([]byte("Subject: Hello\r\n\r\nHello world!\r\n"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.NoError(t, c.Quit())
+	}
+
+	t.Run("TestTLSConnectionState", func(t *testing.T) {
+		send(true)
+		r := <-results
+		assert.True(t, r.secure)
+		require.NotNil(t, r.tls)
+		assert.Equal(t, uint16(tls.VersionTLS13), r.tls.Version)
+		assert.NotZero(t, r.tls.CipherSuite)
+	})
+
+	t.Run("TestPlainSession", func(t *testing.T) {
+		send(false)
+		r := <-results
+		assert.False(t, r.secure)
+		assert.Nil(t, r.tls)
+	})
+
+	// Stop waits for a grace period, so close the listener only
+	s.mu.Lock()
+	s.closed = true
+	s.listener.Close()
+	s.mu.Unlock()
+	assert.NoError(t, <-done)
+}
+
+func TestImplicitTLS(t *testing.T) {
+
+	results := make(chan *tls.ConnectionState, 1)
+	handler := server.HandlerFunc(func(state *smtp.State) error {
+		assert.True(t, state.Secure)
+		results <- TLSConnectionState(state)
+		return nil
+	})
+
+	s := New(server.Config{
+		Hostname:    "localhost",
+		DisableAuth: true,
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+	}, handler)
+	s.ImplicitTLS = true
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	c, err := netsmtp.NewClient(conn, "localhost")
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.example.net"))
+
+	// STARTTLS isn't offered on a connection that is already encrypted
+	ok, _ := c.Extension("STARTTLS")
+	assert.False(t, ok)
+
+	require.NoError(t, c.Mail("from@example.net"))
+	require.NoError(t, c.Rcpt("to@example.com"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Hello\r\n\r\nHello world!\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+
+	cs := <-results
+	require.NotNil(t, cs)
+	assert.Equal(t, uint16(tls.VersionTLS13), cs.Version)
+
+	s.mu.Lock()
+	s.closed = true
+	s.listener.Close()
+	s.mu.Unlock()
+	assert.NoError(t, <-done)
+}
+
+func TestServerBehindProxy(t *testing.T) {
+
+	ips := make(chan net.IP, 1)
+	handler := server.HandlerFunc(func(state *smtp.State) error {
+		ips <- state.Ip
+		return nil
+	})
+
+	s := New(server.Config{Hostname: "localhost", DisableAuth: true}, handler)
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	s.TrustedProxies = []*net.IPNet{trusted}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 25\r\n"))
+	require.NoError(t, err)
+
+	c, err := netsmtp.NewClient(conn, "localhost")
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.example.net"))
+	require.NoError(t, c.Mail("from@example.net"))
+	require.NoError(t, c.Rcpt("to@example.com"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Hello\r\n\r\nHello world!\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+
+	assert.Equal(t, "203.0.113.7", (<-ips).String())
+
+	s.mu.Lock()
+	s.closed = true
+	s.listener.Close()
+	s.mu.Unlock()
+	assert.NoError(t, <-done)
+}